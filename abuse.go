@@ -0,0 +1,257 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// The actions taken on suspect uploads.
+const (
+	abuseTag  = "tag"
+	abuseDrop = "drop"
+)
+
+// The reasons an upload is suspect.
+const (
+	abuseTimestamp     = "timestamp"      // a launch time or duration that can't be real
+	abuseSharedSession = "shared_session" // a session ID uploaded from too many addresses
+	abuseSessionCount  = "session_count"  // too many sessions in one upload
+)
+
+const (
+	suspectTag                = "suspect"
+	defaultAbuseMaxSessions   = 200
+	defaultAbuseMaxSessionIPs = 5
+	defaultAbuseMaxClockSkew  = 24 * time.Hour
+	defaultAbuseWindow        = 24 * time.Hour
+)
+
+// earliestLaunch is a launch time before which no session can be
+// real, since NGL didn't exist yet.
+var earliestLaunch = time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// AbuseConfig configures the detection of uploads whose logs look
+// fabricated, such as those sent by a scraper or a misbehaving
+// client to poison the usage data.
+type AbuseConfig struct {
+	// Action is what is done with suspect uploads: tag (the
+	// default) tags their sessions suspect=true, and drop drops
+	// them.
+	Action string `json:"action,omitempty"`
+	// MaxUploadSessions is the number of sessions beyond which an
+	// upload is suspect.  Defaults to 200.
+	MaxUploadSessions int `json:"max_upload_sessions,omitempty"`
+	// MaxSessionIPs is the number of client addresses a session ID
+	// can be uploaded from, within a window, before uploads of it
+	// are suspect.  Defaults to 5.
+	MaxSessionIPs int `json:"max_session_ips,omitempty"`
+	// Window is how long the addresses a session ID was uploaded
+	// from are remembered.  Defaults to 24h.
+	Window caddy.Duration `json:"window,omitempty"`
+	// MaxClockSkew is how far past the time of its upload a
+	// session's launch time can be.  Defaults to 24h.
+	MaxClockSkew caddy.Duration `json:"max_clock_skew,omitempty"`
+}
+
+// The abuse registry holds the session sightings shared by all the
+// trackers with the same name that detect abuse.  Like the usage
+// registry, it outlives any single configuration, so a config reload
+// doesn't forget which addresses have uploaded which sessions.  The
+// sightings are discarded when the last tracker using them is
+// cleaned up.
+var abuseRegistry = struct {
+	sync.Mutex
+	sightings map[string]*sessionSightings
+}{sightings: make(map[string]*sessionSightings)}
+
+// A sessionSightings remembers the client addresses each session
+// ID has been uploaded from.  Sightings are kept in two generations,
+// each covering a window, so each is remembered for at least one
+// window and at most two.
+type sessionSightings struct {
+	name string
+	refs int
+
+	mu       sync.Mutex
+	window   time.Duration
+	start    time.Time
+	current  map[string]map[string]bool
+	previous map[string]map[string]bool
+}
+
+// acquireSightings returns the named tracker's session sightings,
+// creating them if necessary.  The window of existing sightings is
+// replaced by the given one, so the newest configuration wins.
+func acquireSightings(name string, window time.Duration) *sessionSightings {
+	abuseRegistry.Lock()
+	defer abuseRegistry.Unlock()
+	s, ok := abuseRegistry.sightings[name]
+	if !ok {
+		s = &sessionSightings{name: name, current: make(map[string]map[string]bool)}
+		abuseRegistry.sightings[name] = s
+	}
+	s.refs++
+	s.mu.Lock()
+	s.window = window
+	s.mu.Unlock()
+	return s
+}
+
+// release gives up one tracker's use of the sightings.
+func (s *sessionSightings) release() {
+	abuseRegistry.Lock()
+	defer abuseRegistry.Unlock()
+	s.refs--
+	if s.refs == 0 && abuseRegistry.sightings[s.name] == s {
+		delete(abuseRegistry.sightings, s.name)
+	}
+}
+
+// see records that the given sessions were uploaded from addr at
+// now, and returns the largest number of addresses any of them has
+// been uploaded from.
+func (s *sessionSightings) see(sessions []core.Session, addr string, now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.start.IsZero() {
+		s.start = now
+	}
+	if !now.Before(s.start.Add(s.window)) {
+		s.previous, s.current = s.current, make(map[string]map[string]bool)
+		if !now.Before(s.start.Add(2 * s.window)) {
+			s.previous = nil
+		}
+		s.start = now
+	}
+	most := 0
+	for _, session := range sessions {
+		addrs := s.current[session.SessionId]
+		if addrs == nil {
+			addrs = make(map[string]bool)
+			for a := range s.previous[session.SessionId] {
+				addrs[a] = true
+			}
+			s.current[session.SessionId] = addrs
+		}
+		addrs[addr] = true
+		most = max(most, len(addrs))
+	}
+	return most
+}
+
+// An abuseDetector flags uploads that look fabricated.
+type abuseDetector struct {
+	name          string // of the tracker, for its metrics
+	drop          bool
+	maxSessions   int
+	maxSessionIPs int
+	maxClockSkew  time.Duration
+	sightings     *sessionSightings
+}
+
+// newAbuseDetector checks the configuration and acquires the
+// named tracker's session sightings.
+func newAbuseDetector(cfg AbuseConfig, name string) (*abuseDetector, error) {
+	a := &abuseDetector{
+		name:          name,
+		maxSessions:   cfg.MaxUploadSessions,
+		maxSessionIPs: cfg.MaxSessionIPs,
+		maxClockSkew:  time.Duration(cfg.MaxClockSkew),
+	}
+	switch cfg.Action {
+	case "", abuseTag:
+	case abuseDrop:
+		a.drop = true
+	default:
+		return nil, fmt.Errorf("abuse action must be %s or %s, not %q", abuseTag, abuseDrop, cfg.Action)
+	}
+	if a.maxSessions == 0 {
+		a.maxSessions = defaultAbuseMaxSessions
+	}
+	if a.maxSessionIPs == 0 {
+		a.maxSessionIPs = defaultAbuseMaxSessionIPs
+	}
+	if a.maxClockSkew == 0 {
+		a.maxClockSkew = defaultAbuseMaxClockSkew
+	}
+	window := time.Duration(cfg.Window)
+	if window == 0 {
+		window = defaultAbuseWindow
+	}
+	if a.maxSessions < 0 || a.maxSessionIPs < 0 || a.maxClockSkew < 0 || window < 0 {
+		return nil, fmt.Errorf("abuse detection limits must not be negative")
+	}
+	a.sightings = acquireSightings(name, window)
+	return a, nil
+}
+
+// release gives up the detector's use of the shared sightings.
+func (a *abuseDetector) release() {
+	a.sightings.release()
+}
+
+// inspect returns the reasons, if any, that the sessions parsed
+// from an upload received at now are suspect.  Every upload is
+// inspected, suspect or not, so that the sessions it contains are
+// counted against the addresses that upload them.
+func (a *abuseDetector) inspect(sessions []core.Session, remoteAddr string, now time.Time) []string {
+	if a == nil || len(sessions) == 0 {
+		return nil
+	}
+	var reasons []string
+	latest := now.Add(a.maxClockSkew)
+	for _, s := range sessions {
+		if s.LaunchTime.Before(earliestLaunch) || s.LaunchTime.After(latest) || s.LaunchDuration < 0 {
+			reasons = append(reasons, abuseTimestamp)
+			break
+		}
+	}
+	if a.sightings.see(sessions, core.AddressHost(remoteAddr), now) > a.maxSessionIPs {
+		reasons = append(reasons, abuseSharedSession)
+	}
+	if len(sessions) > a.maxSessions {
+		reasons = append(reasons, abuseSessionCount)
+	}
+	return reasons
+}
+
+// report logs and counts a suspect upload.
+func (a *abuseDetector) report(reasons []string, up upload, logger *zap.Logger) {
+	action := abuseTag
+	if a.drop {
+		action = abuseDrop
+	}
+	logger.Warn("AdobeUsageTracker: suspect upload",
+		zap.String("remote-address", up.remoteAddr),
+		zap.String("user-agent", up.userAgent),
+		zap.Int("session-count", len(up.sessions)),
+		zap.Strings("reasons", reasons),
+		zap.String("action", action),
+	)
+	trackerMetrics.init.Do(initTrackerMetrics)
+	for _, reason := range reasons {
+		trackerMetrics.suspects.WithLabelValues(a.name, reason, action).Inc()
+	}
+}
+
+// tagSuspect returns copies of the sessions tagged as suspect,
+// with the tag policy deciding any conflict with another source
+// of a suspect tag.
+func tagSuspect(sessions []core.Session, tags *tagPolicy, logger *zap.Logger) []core.Session {
+	tagged := make([]core.Session, len(sessions))
+	for i, s := range sessions {
+		tagged[i] = tags.merge(s, map[string]string{suspectTag: "true"}, tagSourceAbuse, logger)
+	}
+	return tagged
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAbuseDetectorReasons(t *testing.T) {
+	a, err := newAbuseDetector(AbuseConfig{MaxUploadSessions: 2, MaxSessionIPs: 2, Window: caddy.Duration(time.Hour)}, "")
+	if err != nil {
+		t.Fatalf("Failed to create abuse detector: %v", err)
+	}
+	defer a.release()
+	buffer, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	real := core.ParseLog(string(buffer), "127.0.0.1:53450")
+	received := real[len(real)-1].LaunchTime.Add(time.Hour)
+	if reasons := a.inspect(real[:2], "127.0.0.1:53450", received); len(reasons) != 0 {
+		t.Errorf("Expected a real upload not to be suspect, got %v", reasons)
+	}
+	future := core.Session{SessionId: "f", LaunchTime: received.Add(48 * time.Hour)}
+	if reasons := a.inspect([]core.Session{future}, "127.0.0.2:1", received); !reflect.DeepEqual(reasons, []string{abuseTimestamp}) {
+		t.Errorf("Expected a launch in the future to be suspect, got %v", reasons)
+	}
+	// the same sessions from a second address are fine, but not from a third
+	if reasons := a.inspect(real[:1], "127.0.0.3:1", received); len(reasons) != 0 {
+		t.Errorf("Expected a second address not to be suspect, got %v", reasons)
+	}
+	if reasons := a.inspect(real[:1], "127.0.0.4:1", received); !reflect.DeepEqual(reasons, []string{abuseSharedSession}) {
+		t.Errorf("Expected a third address to be suspect, got %v", reasons)
+	}
+	// sightings are forgotten after two windows
+	if reasons := a.inspect(real[:1], "127.0.0.5:1", received.Add(3*time.Hour)); len(reasons) != 0 {
+		t.Errorf("Expected old sightings to be forgotten, got %v", reasons)
+	}
+	many := []core.Session{{SessionId: "a"}, {SessionId: "b"}, {SessionId: "c"}}
+	for i := range many {
+		many[i].LaunchTime = received
+	}
+	if reasons := a.inspect(many, "127.0.0.6:1", received); !reflect.DeepEqual(reasons, []string{abuseSessionCount}) {
+		t.Errorf("Expected too many sessions to be suspect, got %v", reasons)
+	}
+}
+
+func TestProcessUploadSuspect(t *testing.T) {
+	session := core.Session{SessionId: "s1", AppId: "Photoshop1", LaunchTime: time.UnixMilli(1)}
+	for _, action := range []string{abuseTag, abuseDrop} {
+		abuse, err := newAbuseDetector(AbuseConfig{Action: action}, "")
+		if err != nil {
+			t.Fatalf("Failed to create abuse detector: %v", err)
+		}
+		obsCore, logs := observer.New(zap.InfoLevel)
+		m := AdobeUsageTracker{sessionLog: zap.New(obsCore), abuse: abuse}
+		m.processUpload(upload{received: time.Now(), remoteAddr: "127.0.0.1:1", sessions: []core.Session{session}})
+		abuse.release()
+		entries := logs.All()
+		if action == abuseDrop && len(entries) != 0 {
+			t.Errorf("Expected a suspect upload to be dropped, got %d sessions", len(entries))
+		}
+		if action == abuseTag && (len(entries) != 1 || entries[0].ContextMap()[suspectTag] != "true") {
+			t.Errorf("Expected a suspect session to be tagged, got %v", entries)
+		}
+	}
+	if _, err := newAbuseDetector(AbuseConfig{Action: "block"}, ""); err == nil {
+		t.Errorf("Expected an error for an unknown action")
+	}
+}
+
+func TestTagSuspectPrecedence(t *testing.T) {
+	session := core.Session{SessionId: "s1", Tags: map[string]string{suspectTag: "reviewed"}}
+	for _, c := range []struct {
+		precedence []string
+		expected   string
+	}{
+		{nil, "true"},
+		{[]string{tagSourceDirectory}, "reviewed"},
+	} {
+		p, err := newTagPolicy(c.precedence)
+		if err != nil {
+			t.Fatalf("Failed to create tag policy: %v", err)
+		}
+		p.own(tagSourceDirectory, suspectTag)
+		p.own(tagSourceAbuse, suspectTag)
+		tagged := tagSuspect([]core.Session{session}, p, zap.NewNop())
+		if got := tagged[0].Tags[suspectTag]; got != c.expected {
+			t.Errorf("With precedence %v, expected suspect tag %q, got %q", c.precedence, c.expected, got)
+		}
+	}
+	if session.Tags[suspectTag] != "reviewed" {
+		t.Errorf("Expected the original session to be unchanged")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+)
+
+// Parsers for uploads.  The NGL parser (the default) handles the
+// licensing logs uploaded by Adobe apps.  The AGS parser handles
+// the logs uploaded by the Adobe Genuine Service.
+const (
+	parserNGL = "ngl"
+	parserAGS = "ags"
+)
+
+// validParser checks that a parser is one we know.
+func validParser(parser string) error {
+	switch parser {
+	case "", parserNGL, parserAGS:
+		return nil
+	}
+	return fmt.Errorf("parser must be %s or %s, not %q", parserNGL, parserAGS, parser)
+}
+
+// processAGSUpload sends the events parsed from an AGS upload
+// to the database, and records the outcome.  As with processUpload,
+// it returns the error, if any, with which sending them failed.
+func (m AdobeUsageTracker) processAGSUpload(up upload) error {
+	logger := caddy.Log()
+	logger.Info("AdobeUsageTracker: incoming AGS request summary",
+		zap.String("remote-address", up.remoteAddr),
+		zap.String("user-agent", up.userAgent),
+		zap.Int("content-length", len(up.body)),
+		zap.Int("event-count", len(up.events)),
+	)
+	if m.sessionLog != nil {
+		for _, event := range up.events {
+			m.sessionLog.Info("ags-event", zap.Inline(event))
+		}
+	}
+	rec := auditRecord{
+		Timestamp:     up.received,
+		ClientAddress: up.remoteAddr,
+		Bytes:         len(up.body),
+		SessionsFound: len(up.events),
+		Outcome:       auditNoSessions,
+	}
+	var failure error
+	if len(up.events) == 0 {
+		logger.Info("AdobeUsageTracker: no AGS events to upload")
+		if len(up.body) > 0 {
+			m.reportError(parseFailureReport(up.body, up.userAgent), logger)
+		}
+	} else if m.ep == "" {
+		rec.Outcome = auditLogged
+	} else {
+		lines := make([]string, 0, len(up.events))
+		for _, event := range up.events {
+			lines = append(lines, core.AGSEventLine(event))
+		}
+		err := m.sendWithToken(func(tok string) error {
+			return core.UploadLines(m.ep, m.db, m.policyFor(classAGS), tok, lines, logger)
+		}, logger)
+		err = m.findRejected(err, classAGS, logger)
+		m.recordSend(err, up, nil, len(up.events), &rec, logger)
+		if rec.Outcome == auditFailed {
+			failure = err
+		}
+	}
+	m.writeAudit(rec, logger)
+	return failure
+}
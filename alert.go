@@ -0,0 +1,152 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// defaultAlertAfter is how long writes must fail continuously
+// before an alert is raised, if not otherwise configured.
+const defaultAlertAfter = 5 * time.Minute
+
+// An alerter notifies operators, via a Slack-compatible webhook,
+// when writes to the database have been failing continuously
+// for longer than a configured duration.  It sends one alert when
+// the failure threshold is crossed, and one notice when writes
+// start succeeding again.  Every write counts: sessions, the
+// aggregate points, and the version events.
+//
+// If it has a spool limit, it likewise sends one alert when the
+// spool holds more than that many uploads, and one notice when
+// it has drained back to the limit.
+type alerter struct {
+	webhook    string
+	after      time.Duration
+	now        func() time.Time
+	spoolLimit int // set before the first upload is spooled
+
+	mu           sync.Mutex
+	failingSince time.Time
+	alerted      bool
+	spoolAlerted bool
+}
+
+// newAlerter returns an alerter that posts to the given webhook.
+func newAlerter(webhook string, after time.Duration) *alerter {
+	if after <= 0 {
+		after = defaultAlertAfter
+	}
+	return &alerter{webhook: webhook, after: after, now: time.Now}
+}
+
+// writeSucceeded records a successful write, sending a recovery
+// notice if an alert had previously been sent.
+func (a *alerter) writeSucceeded(logger *zap.Logger) {
+	if text := a.recordSuccess(); text != "" {
+		go a.notify(text, logger)
+	}
+}
+
+// writeFailed records a failed write, sending an alert if writes
+// have now been failing for longer than the threshold.
+func (a *alerter) writeFailed(err error, logger *zap.Logger) {
+	if text := a.recordFailure(err); text != "" {
+		go a.notify(text, logger)
+	}
+}
+
+// recordSuccess updates the failure state after a successful
+// write, and returns the text of any notice that should be sent.
+func (a *alerter) recordSuccess() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	since, alerted := a.failingSince, a.alerted
+	a.failingSince, a.alerted = time.Time{}, false
+	if !alerted {
+		return ""
+	}
+	return fmt.Sprintf("Adobe usage tracker: writes to the database are succeeding again after failing for %s.",
+		a.now().Sub(since).Round(time.Second))
+}
+
+// recordFailure updates the failure state after a failed write,
+// and returns the text of any alert that should be sent.
+func (a *alerter) recordFailure(err error) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	if a.failingSince.IsZero() {
+		a.failingSince = now
+	}
+	if a.alerted || now.Sub(a.failingSince) < a.after {
+		return ""
+	}
+	a.alerted = true
+	return fmt.Sprintf("Adobe usage tracker: writes to the database have been failing for %s (latest error: %v).",
+		now.Sub(a.failingSince).Round(time.Second), err)
+}
+
+// writeDone records the outcome of a write, as writeSucceeded
+// or writeFailed.  A partial write counts as a success, since the
+// database is reachable and accepting points.
+func (a *alerter) writeDone(err error, logger *zap.Logger) {
+	var pw core.PartialWriteError
+	if err != nil && !errors.As(err, &pw) {
+		a.writeFailed(err, logger)
+	} else {
+		a.writeSucceeded(logger)
+	}
+}
+
+// spoolChanged records the number of uploads in the spool, sending
+// an alert if it has grown past the limit, or a notice if it has
+// drained back to the limit after an alert.
+func (a *alerter) spoolChanged(files int, logger *zap.Logger) {
+	if text := a.recordSpool(files); text != "" {
+		go a.notify(text, logger)
+	}
+}
+
+// recordSpool updates the spool state, and returns the text of any
+// alert or notice that should be sent.
+func (a *alerter) recordSpool(files int) string {
+	if a.spoolLimit <= 0 {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if files > a.spoolLimit && !a.spoolAlerted {
+		a.spoolAlerted = true
+		return fmt.Sprintf("Adobe usage tracker: the spool holds %d uploads waiting to be sent, more than the limit of %d.",
+			files, a.spoolLimit)
+	}
+	if files <= a.spoolLimit && a.spoolAlerted {
+		a.spoolAlerted = false
+		return fmt.Sprintf("Adobe usage tracker: the spool has drained to %d uploads, within the limit of %d.",
+			files, a.spoolLimit)
+	}
+	return ""
+}
+
+// notify posts a Slack-compatible message to the webhook.
+func (a *alerter) notify(text string, logger *zap.Logger) {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err == nil {
+		err = postReport(a.webhook, body, nil)
+	}
+	if err != nil {
+		logger.Error("AdobeUsageTracker: failed to send alert", zap.String("alert", text), zap.Error(err))
+	}
+}
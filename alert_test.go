@@ -0,0 +1,161 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/clickonetwo/tracker/internal/influxtest"
+	"go.uber.org/zap/zaptest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAlerterThreshold(t *testing.T) {
+	clock := time.UnixMilli(1716994039000)
+	a := newAlerter("http://localhost/unused", 5*time.Minute)
+	a.now = func() time.Time { return clock }
+	failure := fmt.Errorf("upload status code: 500")
+	if text := a.recordFailure(failure); text != "" {
+		t.Errorf("Expected no alert on first failure, got %q", text)
+	}
+	clock = clock.Add(4 * time.Minute)
+	if text := a.recordFailure(failure); text != "" {
+		t.Errorf("Expected no alert before threshold, got %q", text)
+	}
+	clock = clock.Add(time.Minute)
+	if text := a.recordFailure(failure); !strings.Contains(text, "failing for 5m0s") {
+		t.Errorf("Expected alert at threshold, got %q", text)
+	}
+	clock = clock.Add(time.Minute)
+	if text := a.recordFailure(failure); text != "" {
+		t.Errorf("Expected only one alert while failing, got %q", text)
+	}
+	if text := a.recordSuccess(); !strings.Contains(text, "succeeding again") {
+		t.Errorf("Expected recovery notice, got %q", text)
+	}
+	if text := a.recordSuccess(); text != "" {
+		t.Errorf("Expected no notice for continued success, got %q", text)
+	}
+	if text := a.recordFailure(failure); text != "" {
+		t.Errorf("Expected failure clock to restart after success, got %q", text)
+	}
+}
+
+func TestAlerterNotify(t *testing.T) {
+	var message map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Errorf("Alert body is not valid JSON: %s", err)
+		}
+	}))
+	defer server.Close()
+	a := newAlerter(server.URL, 0)
+	if a.after != defaultAlertAfter {
+		t.Errorf("Expected default threshold %v, got %v", defaultAlertAfter, a.after)
+	}
+	a.notify("test alert", zaptest.NewLogger(t))
+	if message["text"] != "test alert" {
+		t.Errorf("Expected Slack-compatible text %q, got %v", "test alert", message)
+	}
+}
+
+func TestAlerterSpoolLimit(t *testing.T) {
+	a := newAlerter("http://localhost/unused", 0)
+	if text := a.recordSpool(1000); text != "" {
+		t.Errorf("Expected no spool alert without a limit, got %q", text)
+	}
+	a.spoolLimit = 10
+	if text := a.recordSpool(10); text != "" {
+		t.Errorf("Expected no spool alert at the limit, got %q", text)
+	}
+	if text := a.recordSpool(11); !strings.Contains(text, "holds 11 uploads") {
+		t.Errorf("Expected a spool alert past the limit, got %q", text)
+	}
+	if text := a.recordSpool(20); text != "" {
+		t.Errorf("Expected only one spool alert while over the limit, got %q", text)
+	}
+	if text := a.recordSpool(10); !strings.Contains(text, "drained to 10 uploads") {
+		t.Errorf("Expected a notice once the spool drained, got %q", text)
+	}
+	if text := a.recordSpool(3); text != "" {
+		t.Errorf("Expected no notice while within the limit, got %q", text)
+	}
+}
+
+func TestAlerterCountsAllWrites(t *testing.T) {
+	server := influxtest.NewServer(2, "secret")
+	defer server.Close()
+	m := newIntegrationTracker(t, server, "alert_webhook http://localhost/unused")
+	logger := zaptest.NewLogger(t)
+	server.FailNext(http.StatusInternalServerError, "down")
+	if err := m.sendRollup([]string{"user-machines,user=u1 machines=1i 1716994039000"}); err == nil {
+		t.Fatalf("Expected the rollup write to fail")
+	}
+	if m.alerts.failingSince.IsZero() {
+		t.Errorf("Expected a failed rollup write to count as a failure")
+	}
+	m.sendEvents("NGL upgrades", []string{"ngl-upgrade,app=Photoshop1 version=\"1.35\" 1716994039000"}, logger)
+	if !m.alerts.failingSince.IsZero() {
+		t.Errorf("Expected a successful event write to count as a success")
+	}
+	m.alerts.writeDone(fmt.Errorf("down"), logger)
+	m.alerts.writeDone(core.PartialWriteError{Status: http.StatusBadRequest}, logger)
+	if !m.alerts.failingSince.IsZero() {
+		t.Errorf("Expected a partial write to count as a success")
+	}
+}
+
+func TestAlertSpoolFilesConfig(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		alert_spool_files 500
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil || m.AlertSpoolFiles != 500 {
+		t.Fatalf("Expected alert_spool_files 500, got %d (%v)", m.AlertSpoolFiles, err)
+	}
+	for _, value := range []string{"0", "-1", "many"} {
+		var m AdobeUsageTracker
+		d := caddyfile.NewTestDispenser("adobe_usage_tracker {\nalert_spool_files " + value + "\n}")
+		if err := m.UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("Expected an error for alert_spool_files %q", value)
+		}
+	}
+	server := influxtest.NewServer(2, "secret")
+	defer server.Close()
+	for _, options := range []string{
+		"alert_spool_files 10\nmode background\nspool_dir " + t.TempDir(),
+		"alert_spool_files 10\nalert_webhook http://localhost/unused",
+	} {
+		d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+			endpoint ` + server.URL + `
+			database tracker
+			policy autogen
+			token secret
+			` + options + `
+		}`)
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("Failed to unmarshal %q: %v", options, err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		if err := m.Provision(ctx); err == nil {
+			t.Errorf("Expected an error provisioning %q", options)
+			_ = m.Cleanup()
+		}
+		cancel()
+	}
+}
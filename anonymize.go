@@ -0,0 +1,210 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// The hashing algorithms for anonymized identifiers.
+const (
+	hashHMACSHA256 = "hmac-sha256"
+	hashHMACSHA512 = "hmac-sha512"
+	hashSHA256     = "sha256"
+	defaultTenant  = "default"
+	minSaltLength  = 16
+)
+
+// The fields in which the identifiers hashed with a previous salt
+// are written while a salt is being rotated.
+const (
+	previousUserIdField   = "previousUserId"
+	previousClientIpField = "previousClientIp"
+)
+
+// AnonymizeConfig configures the hashing of the user ID and
+// client IP of each session before it is logged or sent.
+type AnonymizeConfig struct {
+	// Algorithm is the hashing algorithm: hmac-sha256 (the
+	// default), hmac-sha512, or sha256 (of the salt followed by
+	// the identifier).
+	Algorithm string `json:"algorithm,omitempty"`
+	// SaltDir is the directory of salt files, one per tenant,
+	// each named for its tenant with a .salt extension.
+	SaltDir string `json:"salt_dir,omitempty"`
+	// Tenant is the tenant whose salt is used.  Defaults to
+	// "default".
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// An anonymizer hashes the identifiers in sessions with the
+// salts of a single tenant.
+type anonymizer struct {
+	newHash  func() hash.Hash
+	keyed    bool
+	current  []byte
+	previous []saltEntry
+}
+
+// A saltEntry is a previous salt, which is used alongside the
+// current one until the given time.
+type saltEntry struct {
+	salt  []byte
+	until time.Time
+}
+
+// newAnonymizer loads the tenant's salts from the salt directory.
+func newAnonymizer(cfg AnonymizeConfig) (*anonymizer, error) {
+	a := &anonymizer{}
+	switch cfg.Algorithm {
+	case "", hashHMACSHA256:
+		a.newHash, a.keyed = sha256.New, true
+	case hashHMACSHA512:
+		a.newHash, a.keyed = sha512.New, true
+	case hashSHA256:
+		a.newHash = sha256.New
+	default:
+		return nil, fmt.Errorf("hashing algorithm must be %s, %s, or %s, not %q",
+			hashHMACSHA256, hashHMACSHA512, hashSHA256, cfg.Algorithm)
+	}
+	if cfg.SaltDir == "" {
+		return nil, fmt.Errorf("anonymizing identifiers needs a salt directory")
+	}
+	tenant := cfg.Tenant
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	if strings.ContainsAny(tenant, `/\`) || tenant == "." || tenant == ".." {
+		return nil, fmt.Errorf("invalid tenant name %q", tenant)
+	}
+	if err := a.loadSalts(filepath.Join(cfg.SaltDir, tenant+".salt")); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadSalts reads a salt file.  Each line of the file that isn't
+// blank or a comment gives a base64-encoded salt.  The first is
+// the current salt.  Each later one is a previous salt, followed
+// by the time (in RFC 3339 format) until which identifiers are
+// also hashed with it, so that the old and new hashes can be
+// matched up while downstream systems move to the new salt.
+func (a *anonymizer) loadSalts(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot open salt file: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Fields(line)
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil || len(salt) < minSaltLength {
+			return fmt.Errorf("%s:%d: a salt must be at least %d bytes, base64-encoded", path, n, minSaltLength)
+		}
+		if a.current == nil {
+			if len(parts) != 1 {
+				return fmt.Errorf("%s:%d: the current salt cannot have an end time", path, n)
+			}
+			a.current = salt
+			continue
+		}
+		if len(parts) != 2 {
+			return fmt.Errorf("%s:%d: a previous salt must be followed by the time it is used until", path, n)
+		}
+		until, err := time.Parse(time.RFC3339, parts[1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid end time: %v", path, n, err)
+		}
+		a.previous = append(a.previous, saltEntry{salt: salt, until: until})
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("cannot read salt file: %v", err)
+	}
+	if a.current == nil {
+		return fmt.Errorf("salt file %s has no salt", path)
+	}
+	return nil
+}
+
+// hash returns the hex-encoded hash of an identifier with a salt.
+func (a *anonymizer) hash(salt []byte, id string) string {
+	var h hash.Hash
+	if a.keyed {
+		h = hmac.New(a.newHash, salt)
+	} else {
+		h = a.newHash()
+		h.Write(salt)
+	}
+	h.Write([]byte(id))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// previousSalt returns the newest previous salt still in use at
+// now, if any.
+func (a *anonymizer) previousSalt(now time.Time) []byte {
+	for _, entry := range a.previous {
+		if now.Before(entry.until) {
+			return entry.salt
+		}
+	}
+	return nil
+}
+
+// apply returns copies of the sessions with their user IDs and
+// client IPs hashed.  Only the host part of a client IP is hashed,
+// so all the uploads from a machine get the same hash.  While a
+// previous salt is in use, the hashes with that salt are added as
+// extra fields.
+func (a *anonymizer) apply(sessions []core.Session, now time.Time) []core.Session {
+	if a == nil {
+		return sessions
+	}
+	previous := a.previousSalt(now)
+	hashed := make([]core.Session, len(sessions))
+	for i, s := range sessions {
+		host := core.AddressHost(s.ClientIp)
+		if previous != nil {
+			fields := make(map[string]string, len(s.Fields)+2)
+			for name, value := range s.Fields {
+				fields[name] = value
+			}
+			if s.UserId != "" {
+				fields[previousUserIdField] = a.hash(previous, s.UserId)
+			}
+			if host != "" {
+				fields[previousClientIpField] = a.hash(previous, host)
+			}
+			s.Fields = fields
+		}
+		if s.UserId != "" {
+			s.UserId = a.hash(a.current, s.UserId)
+		}
+		if host != "" {
+			s.ClientIp = a.hash(a.current, host)
+		}
+		hashed[i] = s
+	}
+	return hashed
+}
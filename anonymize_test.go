@@ -0,0 +1,132 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSalt     = "MDEyMzQ1Njc4OWFiY2RlZg==" // "0123456789abcdef"
+	testOldSalt  = "ZmVkY2JhOTg3NjU0MzIxMA==" // "fedcba9876543210"
+	testOldUntil = "2024-06-01T00:00:00Z"
+)
+
+func writeSaltFile(t *testing.T, tenant string, content string) string {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, tenant+".salt"), []byte(content), 0o600); err != nil {
+		t.Fatalf("Failed to write salt file: %v", err)
+	}
+	return dir
+}
+
+func TestAnonymizerRotation(t *testing.T) {
+	dir := writeSaltFile(t, "acme", "# current salt\n"+testSalt+"\n\n"+testOldSalt+" "+testOldUntil+"\n")
+	a, err := newAnonymizer(AnonymizeConfig{SaltDir: dir, Tenant: "acme"})
+	if err != nil {
+		t.Fatalf("Failed to create anonymizer: %v", err)
+	}
+	sessions := []core.Session{{SessionId: "a", UserId: "user@example.com", ClientIp: "10.0.0.1:54321"}}
+	before := a.apply(sessions, time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC))
+	after := a.apply(sessions, time.Date(2024, 6, 2, 0, 0, 0, 0, time.UTC))
+	if sessions[0].UserId != "user@example.com" {
+		t.Errorf("Expected the original sessions to be unchanged, got %v", sessions[0])
+	}
+	if before[0].UserId != after[0].UserId || before[0].UserId == sessions[0].UserId {
+		t.Errorf("Expected the user ID to be hashed with the current salt, got %q and %q",
+			before[0].UserId, after[0].UserId)
+	}
+	other := a.apply([]core.Session{{ClientIp: "10.0.0.1:12345"}}, time.Now())
+	if other[0].ClientIp != before[0].ClientIp {
+		t.Errorf("Expected the client port to be ignored, got %q and %q", other[0].ClientIp, before[0].ClientIp)
+	}
+	if before[0].Fields[previousUserIdField] == "" || before[0].Fields[previousClientIpField] == "" {
+		t.Errorf("Expected previous hashes before the end time, got %v", before[0].Fields)
+	}
+	if before[0].Fields[previousUserIdField] == before[0].UserId {
+		t.Errorf("Expected the previous salt to give a different hash")
+	}
+	if len(after[0].Fields) != 0 {
+		t.Errorf("Expected no previous hashes after the end time, got %v", after[0].Fields)
+	}
+	line := core.SessionLine(before[0], &core.LineFormat{}, zap.NewNop())
+	if !strings.Contains(line, `previousUserId="`+before[0].Fields[previousUserIdField]+`"`) {
+		t.Errorf("Expected the line to include the previous user ID: %s", line)
+	}
+}
+
+func TestAnonymizerAlgorithms(t *testing.T) {
+	dir := writeSaltFile(t, defaultTenant, testSalt+"\n")
+	hashes := make(map[string]bool)
+	for _, algorithm := range []string{hashHMACSHA256, hashHMACSHA512, hashSHA256} {
+		a, err := newAnonymizer(AnonymizeConfig{Algorithm: algorithm, SaltDir: dir})
+		if err != nil {
+			t.Fatalf("Failed to create %s anonymizer: %v", algorithm, err)
+		}
+		hashed := a.apply([]core.Session{{UserId: "user@example.com"}}, time.Now())
+		hashes[hashed[0].UserId] = true
+	}
+	if len(hashes) != 3 {
+		t.Errorf("Expected each algorithm to give a different hash, got %v", hashes)
+	}
+	var a *anonymizer
+	if s := a.apply([]core.Session{{UserId: "user"}}, time.Now()); s[0].UserId != "user" {
+		t.Errorf("Expected a nil anonymizer to leave sessions alone, got %v", s)
+	}
+}
+
+func TestAnonymizerAddresses(t *testing.T) {
+	a, err := newAnonymizer(AnonymizeConfig{SaltDir: writeSaltFile(t, defaultTenant, testSalt+"\n")})
+	if err != nil {
+		t.Fatalf("Failed to create anonymizer: %v", err)
+	}
+	hashed := a.apply([]core.Session{
+		{ClientIp: "[2001:DB8::1]:53450", AddressFamily: core.FamilyIPv6},
+		{ClientIp: "[2001:db8:0::1]:53451"},
+		{ClientIp: "[::ffff:10.0.0.1]:53450"},
+		{ClientIp: "10.0.0.1:53451"},
+	}, time.Now())
+	if hashed[0].ClientIp != hashed[1].ClientIp || hashed[2].ClientIp != hashed[3].ClientIp ||
+		hashed[0].ClientIp == hashed[2].ClientIp {
+		t.Errorf("Expected each machine to have one hash, got %v", hashed)
+	}
+	if hashed[0].AddressFamily != core.FamilyIPv6 {
+		t.Errorf("Expected the address family to survive anonymization, got %q", hashed[0].AddressFamily)
+	}
+}
+
+func TestAnonymizerErrors(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"c2hvcnQ=\n",
+		testSalt + " " + testOldUntil + "\n",
+		testSalt + "\n" + testOldSalt + "\n",
+		testSalt + "\n" + testOldSalt + " yesterday\n",
+	} {
+		dir := writeSaltFile(t, defaultTenant, content)
+		if _, err := newAnonymizer(AnonymizeConfig{SaltDir: dir}); err == nil {
+			t.Errorf("Expected an error for salt file %q", content)
+		}
+	}
+	dir := writeSaltFile(t, defaultTenant, testSalt+"\n")
+	for _, cfg := range []AnonymizeConfig{
+		{},
+		{SaltDir: dir, Algorithm: "md5"},
+		{SaltDir: dir, Tenant: "../default"},
+		{SaltDir: dir, Tenant: "missing"},
+	} {
+		if _, err := newAnonymizer(cfg); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,420 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// archiveDayLayout names the directory of each day's archived
+// uploads, and is the format of the dates in re-parse requests.
+const archiveDayLayout = "2006-01-02"
+
+// maxReparseDays is the most days a single re-parse can cover.
+const maxReparseDays = 366
+
+// An uploadArchive keeps a copy of every upload a tracker receives,
+// in a directory for each day (UTC) on which they were received, so
+// that the uploads of a range of days can be parsed again later:
+// for example, to backfill sessions after the parser has been
+// enhanced.  Archive files have the same format as spool files, and
+// are encrypted with the spool key if there is one, but unlike
+// spool files they aren't removed once they are read: each day's
+// directory is kept until it is older than the retention, if
+// there is one.
+type uploadArchive struct {
+	dir  string
+	key  []byte
+	days int // how many days are kept, or 0 to keep them all
+
+	mu     sync.Mutex
+	day    string
+	spool  *uploadSpool // the spool for the current day's directory
+	cutoff string       // the first day kept by the last prune
+}
+
+// openUploadArchive opens (or creates) the archive directory.  The
+// key, if given, is an AES key as for the spool.
+func openUploadArchive(dir string, key []byte, days int) (*uploadArchive, error) {
+	if _, err := openUploadSpool(dir, key); err != nil {
+		return nil, fmt.Errorf("cannot open upload archive: %v", err)
+	}
+	return &uploadArchive{dir: dir, key: key, days: days}, nil
+}
+
+// write adds an upload to the directory for the day it was received.
+func (a *uploadArchive) write(up upload) error {
+	day := up.received.UTC().Format(archiveDayLayout)
+	a.mu.Lock()
+	if day != a.day {
+		spool, err := openUploadSpool(filepath.Join(a.dir, day), a.key)
+		if err != nil {
+			a.mu.Unlock()
+			return err
+		}
+		a.day, a.spool = day, spool
+	}
+	spool := a.spool
+	a.mu.Unlock()
+	return spool.write(up)
+}
+
+// prune removes the directories of the days before the last one
+// kept, as of now, by the archive's retention.  It looks for them
+// at most once a day.  Entries that aren't day directories, such as
+// the archives of named trackers, are left alone.
+func (a *uploadArchive) prune(now time.Time) error {
+	if a.days <= 0 {
+		return nil
+	}
+	cutoff := now.UTC().AddDate(0, 0, 1-a.days).Format(archiveDayLayout)
+	a.mu.Lock()
+	if cutoff == a.cutoff {
+		a.mu.Unlock()
+		return nil
+	}
+	a.cutoff = cutoff
+	a.mu.Unlock()
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		return fmt.Errorf("cannot list upload archive: %v", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, err := time.Parse(archiveDayLayout, name); err != nil || !entry.IsDir() || name >= cutoff {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(a.dir, name)); err != nil {
+			return fmt.Errorf("cannot remove archived uploads of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// each calls visit on each upload archived on the days from through
+// to, in the order they were received.  Files that can't be read
+// are passed to bad instead.
+func (a *uploadArchive) each(from, to time.Time, visit func(up upload), bad func(err error)) error {
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		dir := filepath.Join(a.dir, day.Format(archiveDayLayout))
+		if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		spool, err := openUploadSpool(dir, a.key)
+		if err != nil {
+			return err
+		}
+		names, err := spool.list()
+		if err != nil {
+			return fmt.Errorf("cannot list archive directory %q: %v", dir, err)
+		}
+		for _, name := range names {
+			up, err := spool.read(name)
+			if err != nil {
+				bad(err)
+				continue
+			}
+			visit(up)
+		}
+	}
+	return nil
+}
+
+// archiveUpload adds an upload to the archive, if there is one,
+// and removes the days that are past the archive's retention.
+func (m AdobeUsageTracker) archiveUpload(up upload) {
+	if m.archive == nil {
+		return
+	}
+	if err := m.archive.write(up); err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to archive upload",
+			zap.String("remote-address", up.remoteAddr), zap.Error(err))
+	}
+	if err := m.archive.prune(up.received); err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to prune upload archive", zap.Error(err))
+	}
+}
+
+// The archive registry holds, for each tracker name, the trackers
+// with that name that archive their uploads, so a re-parse request
+// can find the current one.  Like the other registries, the newest
+// configuration wins: a re-parse uses the parser and pipeline of
+// the most recently provisioned tracker.  It also holds the status
+// of the latest re-parse of each name, so its progress can be
+// followed.  A name can only have one re-parse running at a time.
+var archiveRegistry = struct {
+	sync.Mutex
+	trackers map[string][]*AdobeUsageTracker
+	reparses map[string]*reparseStatus
+}{trackers: make(map[string][]*AdobeUsageTracker), reparses: make(map[string]*reparseStatus)}
+
+// registerArchive adds a tracker that archives its uploads.
+func registerArchive(m *AdobeUsageTracker) {
+	archiveRegistry.Lock()
+	defer archiveRegistry.Unlock()
+	archiveRegistry.trackers[m.Name] = append(archiveRegistry.trackers[m.Name], m)
+}
+
+// unregisterArchive removes a tracker added by registerArchive.
+func unregisterArchive(m *AdobeUsageTracker) {
+	archiveRegistry.Lock()
+	defer archiveRegistry.Unlock()
+	trackers := archiveRegistry.trackers[m.Name]
+	for i, t := range trackers {
+		if t == m {
+			trackers = append(trackers[:i:i], trackers[i+1:]...)
+			break
+		}
+	}
+	if len(trackers) == 0 {
+		delete(archiveRegistry.trackers, m.Name)
+	} else {
+		archiveRegistry.trackers[m.Name] = trackers
+	}
+}
+
+// The states of a re-parse.
+const (
+	reparseRunning = "running"
+	reparseDone    = "done"
+	reparseFailed  = "failed"
+)
+
+// A reparseStatus is the progress of a re-parse: the request, the
+// counts so far, and, once it has finished, how it ended.
+type reparseStatus struct {
+	reparseRequest
+	reparseResult
+	State    string     `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"` // why a failed re-parse stopped
+}
+
+// startReparse returns the current tracker with the name in the
+// request that archives its uploads, after checking that it can
+// re-parse them as requested, and records that the re-parse is
+// running.  The caller must call finishReparse when it's done.
+func startReparse(req reparseRequest) (*AdobeUsageTracker, error) {
+	archiveRegistry.Lock()
+	defer archiveRegistry.Unlock()
+	trackers := archiveRegistry.trackers[req.Name]
+	if len(trackers) == 0 {
+		if req.Name != "" {
+			return nil, caddy.APIError{HTTPStatus: http.StatusNotFound,
+				Err: fmt.Errorf("no tracker named %q archives its uploads", req.Name)}
+		}
+		return nil, caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no tracker archives its uploads")}
+	}
+	if status := archiveRegistry.reparses[req.Name]; status != nil && status.State == reparseRunning {
+		return nil, caddy.APIError{HTTPStatus: http.StatusConflict, Err: fmt.Errorf("a re-parse is already running")}
+	}
+	m := trackers[len(trackers)-1]
+	if live := m.Measurement; req.Measurement == live || (live == "" && req.Measurement == core.DefaultMeasurement) {
+		return nil, caddy.APIError{HTTPStatus: http.StatusBadRequest,
+			Err: fmt.Errorf("the target measurement cannot be the one the tracker writes to")}
+	}
+	if m.ep == "" {
+		return nil, caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("the tracker has no endpoint to write to")}
+	}
+	archiveRegistry.reparses[req.Name] = &reparseStatus{reparseRequest: req, State: reparseRunning, Started: time.Now()}
+	return m, nil
+}
+
+// updateReparse records the counts so far of the named re-parse.
+func updateReparse(name string, result reparseResult) {
+	archiveRegistry.Lock()
+	defer archiveRegistry.Unlock()
+	archiveRegistry.reparses[name].reparseResult = result
+}
+
+// finishReparse records the end of a re-parse started by startReparse.
+func finishReparse(name string, result reparseResult, err error) {
+	archiveRegistry.Lock()
+	defer archiveRegistry.Unlock()
+	status := archiveRegistry.reparses[name]
+	finished := time.Now()
+	status.reparseResult, status.State, status.Finished = result, reparseDone, &finished
+	if err != nil {
+		status.State, status.Error = reparseFailed, err.Error()
+	}
+}
+
+// reparseStatusOf returns a copy of the status of the latest
+// re-parse of the given name, if there has been one.
+func reparseStatusOf(name string) (reparseStatus, bool) {
+	archiveRegistry.Lock()
+	defer archiveRegistry.Unlock()
+	status := archiveRegistry.reparses[name]
+	if status == nil {
+		return reparseStatus{}, false
+	}
+	return *status, true
+}
+
+// A reparseRequest is the body of a re-parse request.  From and To
+// are the first and last days (UTC) whose uploads are re-parsed,
+// and Measurement is the measurement template the sessions are
+// written with.
+type reparseRequest struct {
+	Name        string `json:"name,omitempty"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	Measurement string `json:"measurement"`
+}
+
+// A reparseResult counts the progress of a re-parse.
+type reparseResult struct {
+	Uploads    int    `json:"uploads"`              // archived uploads read
+	Unreadable int    `json:"unreadable"`           // archive files that couldn't be read
+	Crashed    int    `json:"crashed"`              // uploads that made the parser panic
+	Sessions   int    `json:"sessions"`             // sessions left by the pipeline
+	Written    int    `json:"written"`              // sessions written
+	Failed     int    `json:"failed"`               // uploads whose sessions weren't all written
+	LastError  string `json:"last_error,omitempty"` // the last write error, if any
+}
+
+// handleReparse starts a re-parse of the uploads archived by the
+// named tracker over a range of days, which writes the sessions to
+// a measurement other than the one the tracker writes to, so that
+// sessions parsed by an enhanced parser can be backfilled without
+// disturbing (or duplicating) the live data.  Since a re-parse can
+// take a long time, it runs in the background: a POST starts it and
+// responds with its status, and a GET responds with the status of
+// the latest re-parse, running or not.
+func (a trackerAdmin) handleReparse(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == http.MethodGet {
+		name := r.URL.Query().Get("name")
+		status, ok := reparseStatusOf(name)
+		if !ok {
+			if name != "" {
+				return caddy.APIError{HTTPStatus: http.StatusNotFound,
+					Err: fmt.Errorf("no re-parse of the tracker named %q has been started", name)}
+			}
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no re-parse has been started")}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(status)
+	}
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	var req reparseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid re-parse request: %v", err)}
+	}
+	from, err := time.Parse(archiveDayLayout, req.From)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid from date %q", req.From)}
+	}
+	to, err := time.Parse(archiveDayLayout, req.To)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid to date %q", req.To)}
+	}
+	if to.Before(from) || to.Sub(from) >= maxReparseDays*24*time.Hour {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest,
+			Err: fmt.Errorf("dates must span from 1 to %d days", maxReparseDays)}
+	}
+	if req.Measurement == "" {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("a target measurement must be specified")}
+	}
+	measure, err := core.ParseMeasurementTemplate(req.Measurement)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+	m, err := startReparse(req)
+	if err != nil {
+		return err
+	}
+	logger := caddy.Log()
+	logger.Info("AdobeUsageTracker: re-parsing archived uploads",
+		zap.String("name", req.Name), zap.String("from", req.From), zap.String("to", req.To),
+		zap.String("measurement", req.Measurement))
+	go func() {
+		result, err := m.reparse(from, to, measure, func(result reparseResult) {
+			updateReparse(req.Name, result)
+		})
+		finishReparse(req.Name, result, err)
+		if err != nil {
+			logger.Error("AdobeUsageTracker: re-parse failed", zap.String("name", req.Name), zap.Error(err))
+			return
+		}
+		logger.Info("AdobeUsageTracker: re-parse complete", zap.String("name", req.Name),
+			zap.Int("uploads", result.Uploads), zap.Int("sessions", result.Sessions), zap.Int("written", result.Written))
+	}()
+	status, _ := reparseStatusOf(req.Name)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	return json.NewEncoder(w).Encode(status)
+}
+
+// reparse parses the archived uploads of the given days with the
+// current parser, passes their sessions through the enrichment,
+// filter, transform, and anonymization stages of the pipeline, and
+// writes them with the given measurement template.  Abuse detection,
+// dedup, and the aggregates are skipped, since the sessions were
+// already counted by them when their uploads first arrived.  The
+// counts so far are passed to progress after each upload.
+func (m AdobeUsageTracker) reparse(from, to time.Time, measure *core.MeasurementTemplate,
+	progress func(reparseResult)) (reparseResult, error) {
+	logger := caddy.Log()
+	format := *m.format
+	format.Measure = measure
+	var result reparseResult
+	err := m.archive.each(from, to, func(up upload) {
+		defer func() { progress(result) }()
+		result.Uploads++
+		limits := core.NewLimits(m.MaxLineLength, m.MaxLines, m.MaxSessions)
+		_ = m.parseUpload(bytes.NewReader(up.body), &up, limits)
+		if up.panic != "" {
+			result.Crashed++
+			return
+		}
+		if m.TargetTags {
+			tagTarget(up.sessions, up.targetHost, up.targetPath, m.tags, logger)
+		}
+		m.directory.enrich(up.sessions, up.identity, logger)
+		enriched := m.enrich(up.sessions, logger)
+		kept := m.transform.apply(m.filter.apply(enriched, logger), logger)
+		sessions := m.anonymizer.apply(kept, time.Now())
+		if len(sessions) == 0 {
+			return
+		}
+		result.Sessions += len(sessions)
+		err := m.sendWithToken(func(tok string) error {
+			return core.SendSessions(m.ep, m.db, m.policyFor(classSessions), tok, &format, sessions, logger)
+		}, logger)
+		var pw core.PartialWriteError
+		if errors.As(err, &pw) {
+			result.Written += max(len(sessions)-pw.Count(), 0)
+		} else if err == nil {
+			result.Written += len(sessions)
+		}
+		if err != nil {
+			result.Failed++
+			result.LastError = err.Error()
+		}
+	}, func(err error) {
+		logger.Warn("AdobeUsageTracker: skipping unreadable archived upload", zap.Error(err))
+		result.Unreadable++
+		progress(result)
+	})
+	return result, err
+}
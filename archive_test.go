@@ -0,0 +1,235 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/internal/influxtest"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadArchive(t *testing.T) {
+	dir := t.TempDir()
+	a, err := openUploadArchive(dir, make([]byte, 32), 0)
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	day1 := time.Date(2024, 5, 29, 23, 59, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Minute)
+	for i, received := range []time.Time{day1, day2, day2.Add(time.Second)} {
+		up := upload{received: received, remoteAddr: "10.0.0.1", body: []byte{byte('a' + i)}}
+		if err := a.write(up); err != nil {
+			t.Fatalf("Failed to archive upload: %v", err)
+		}
+	}
+	for day, count := range map[string]int{"2024-05-29": 1, "2024-05-30": 2} {
+		entries, _ := os.ReadDir(filepath.Join(dir, day))
+		if len(entries) != count {
+			t.Errorf("Expected %d uploads archived on %s, got %d", count, day, len(entries))
+		}
+	}
+	_ = os.WriteFile(filepath.Join(dir, "2024-05-30", "0-bad"+spoolSuffix), []byte("garbage"), 0o640)
+	var bodies []string
+	bad := 0
+	from, to := time.Date(2024, 5, 28, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 30, 0, 0, 0, 0, time.UTC)
+	err = a.each(from, to, func(up upload) { bodies = append(bodies, string(up.body)) }, func(error) { bad++ })
+	if err != nil {
+		t.Fatalf("Failed to read archive: %v", err)
+	}
+	if strings.Join(bodies, "") != "abc" || bad != 1 {
+		t.Errorf("Expected uploads a, b, c in order and 1 bad file, got %v and %d", bodies, bad)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2024-05-30", "0-bad"+spoolSuffix)); err != nil {
+		t.Errorf("Expected a bad archive file to be left in place: %v", err)
+	}
+}
+
+func TestUploadArchiveRetention(t *testing.T) {
+	dir := t.TempDir()
+	a, err := openUploadArchive(dir, nil, 2)
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	for _, name := range []string{"2024-05-28", "2024-05-29", "2024-05-30", "staging"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0o750); err != nil {
+			t.Fatalf("Failed to make directory: %v", err)
+		}
+	}
+	now := time.Date(2024, 5, 30, 12, 0, 0, 0, time.UTC)
+	if err := a.prune(now); err != nil {
+		t.Fatalf("Failed to prune archive: %v", err)
+	}
+	for name, kept := range map[string]bool{"2024-05-28": false, "2024-05-29": true, "2024-05-30": true, "staging": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("Expected %s to be kept: %v, but got %v", name, kept, err)
+		}
+	}
+	// pruning is only done once a day
+	_ = os.Mkdir(filepath.Join(dir, "2024-05-28"), 0o750)
+	if err := a.prune(now.Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to prune archive: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2024-05-28")); err != nil {
+		t.Errorf("Expected no second prune on the same day: %v", err)
+	}
+	if err := a.prune(now.AddDate(0, 0, 1)); err != nil {
+		t.Fatalf("Failed to prune archive: %v", err)
+	}
+	for name, kept := range map[string]bool{"2024-05-28": false, "2024-05-29": false, "2024-05-30": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("Expected %s to be kept the next day: %v, but got %v", name, kept, err)
+		}
+	}
+}
+
+func TestArchiveDaysConfig(t *testing.T) {
+	for _, value := range []string{"0", "-1", "week"} {
+		var m AdobeUsageTracker
+		d := caddyfile.NewTestDispenser("adobe_usage_tracker {\narchive_days " + value + "\n}")
+		if err := m.UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("Expected an error for archive_days %q", value)
+		}
+	}
+	server := influxtest.NewServer(2, "secret")
+	defer server.Close()
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		endpoint ` + server.URL + `
+		database tracker
+		policy autogen
+		token secret
+		archive_days 30
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil || m.ArchiveDays != 30 {
+		t.Fatalf("Expected archive_days 30, got %d (%v)", m.ArchiveDays, err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := m.Provision(ctx); err == nil {
+		t.Errorf("Expected an error for archive_days without an upload archive")
+		_ = m.Cleanup()
+	}
+}
+
+// reparseRequestFor starts a re-parse with the given body, waits
+// for it to finish, and returns its final status.
+func reparseRequestFor(t *testing.T, body string) (reparseStatus, error) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, "/adobe_usage_tracker/reparse", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	var status reparseStatus
+	if err := (trackerAdmin{}).handleReparse(w, r); err != nil {
+		return status, err
+	}
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected a re-parse to be accepted, got status %d", w.Code)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Cannot decode status %q: %v", w.Body.String(), err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for status.State == reparseRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status = reparseStatusFor(t, status.Name)
+	}
+	return status, nil
+}
+
+// reparseStatusFor gets the status of the latest re-parse of a name.
+func reparseStatusFor(t *testing.T, name string) reparseStatus {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/adobe_usage_tracker/reparse?name="+name, nil)
+	w := httptest.NewRecorder()
+	var status reparseStatus
+	if err := (trackerAdmin{}).handleReparse(w, r); err != nil {
+		t.Fatalf("Cannot get re-parse status: %v", err)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("Cannot decode status %q: %v", w.Body.String(), err)
+	}
+	return status
+}
+
+func TestReparseArchivedUploads(t *testing.T) {
+	server := influxtest.NewServer(2, "secret")
+	defer server.Close()
+	dir := t.TempDir()
+	key := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	m := newIntegrationTracker(t, server, "name backfill\nupload_archive "+dir+"\nspool_key "+key)
+	uploadFile(t, m, "testdata/indesign-multi-session-1-2.txt")
+	live := len(server.Lines())
+	if live != 2 {
+		t.Fatalf("Expected 2 sessions written live, got %d", live)
+	}
+	today := time.Now().UTC().Format(archiveDayLayout)
+	if entries, _ := os.ReadDir(filepath.Join(dir, "backfill", today)); len(entries) != 1 {
+		t.Fatalf("Expected the upload to be archived, got %v", entries)
+	}
+
+	body := `{"name": "backfill", "from": "` + today + `", "to": "` + today + `", "measurement": "backfill-session"}`
+	status, err := reparseRequestFor(t, body)
+	if err != nil {
+		t.Fatalf("Re-parse failed: %v", err)
+	}
+	if status.State != reparseDone || status.Finished == nil || status.Measurement != "backfill-session" {
+		t.Errorf("Expected a finished re-parse, got %+v", status)
+	}
+	if status.Uploads != 1 || status.Sessions != 2 || status.Written != 2 || status.Failed != 0 {
+		t.Errorf("Unexpected re-parse result: %+v", status.reparseResult)
+	}
+	lines := server.Lines()[live:]
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 re-parsed sessions, got %v", lines)
+	}
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "backfill-session,") {
+			t.Errorf("Expected re-parsed sessions in the target measurement, got %q", line)
+		}
+	}
+
+	for _, body := range []string{
+		`{"name": "backfill", "from": "2024-05-30", "to": "2024-05-29", "measurement": "backfill"}`,
+		`{"name": "backfill", "from": "2023-01-01", "to": "2024-12-31", "measurement": "backfill"}`,
+		`{"name": "backfill", "from": "yesterday", "to": "2024-05-29", "measurement": "backfill"}`,
+		`{"name": "backfill", "from": "2024-05-29", "to": "2024-05-29"}`,
+		`{"name": "backfill", "from": "2024-05-29", "to": "2024-05-29", "measurement": "{nope}"}`,
+		`{"name": "backfill", "from": "2024-05-29", "to": "2024-05-29", "measurement": "log-session"}`,
+		`{"name": "staging", "from": "2024-05-29", "to": "2024-05-29", "measurement": "backfill"}`,
+	} {
+		if _, err := reparseRequestFor(t, body); err == nil {
+			t.Errorf("Expected an error for %s", body)
+		}
+	}
+	if _, err := startReparse(reparseRequest{Name: "backfill", Measurement: "backfill-session"}); err != nil {
+		t.Fatalf("Failed to start a re-parse: %v", err)
+	}
+	if status := reparseStatusFor(t, "backfill"); status.State != reparseRunning {
+		t.Errorf("Expected a running re-parse, got %+v", status)
+	}
+	if _, err := reparseRequestFor(t, body); err == nil {
+		t.Errorf("Expected an error for a second re-parse of the same name")
+	}
+	finishReparse("backfill", reparseResult{}, fmt.Errorf("cannot list archive directory"))
+	if status := reparseStatusFor(t, "backfill"); status.State != reparseFailed || status.Error == "" {
+		t.Errorf("Expected a failed re-parse, got %+v", status)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/adobe_usage_tracker/reparse?name=staging", nil)
+	if err := (trackerAdmin{}).handleReparse(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error for the status of a name never re-parsed")
+	}
+}
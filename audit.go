@@ -0,0 +1,82 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Outcomes recorded in the audit log for each upload.
+const (
+	auditNoSessions = "no-sessions"
+	auditWritten    = "written"
+	auditFailed     = "failed"
+	auditPartial    = "partial"
+	auditDropped    = "dropped"
+	auditLogged     = "logged"
+	auditFiltered   = "filtered"
+	auditDuplicate  = "duplicate"
+	auditSuspect    = "suspect"
+	auditCrashed    = "crashed"
+	auditRejected   = "rejected"
+)
+
+// An auditRecord is the audit trail entry for a single upload.
+// Exactly one of these is written for every request handled by
+// the tracker, whether or not it contained any sessions.
+type auditRecord struct {
+	Timestamp       time.Time `json:"timestamp"`
+	ClientAddress   string    `json:"client_address"`
+	Bytes           int       `json:"bytes"`
+	SessionsFound   int       `json:"sessions_found"`
+	SessionsWritten int       `json:"sessions_written"`
+	Outcome         string    `json:"outcome"`
+	Error           string    `json:"error,omitempty"`
+}
+
+// An auditLog appends auditRecords, one JSON object per line,
+// to a file.  It is kept separate from the caddy logs so that
+// it can be retained and shipped independently of them.
+type auditLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openAuditLog opens (or creates) the audit log file at path
+// for appending.
+func openAuditLog(path string) (*auditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open audit log %q: %v", path, err)
+	}
+	return &auditLog{file: f}, nil
+}
+
+// write appends a single record to the audit log.
+func (a *auditLog) write(rec auditRecord) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.file.Write(line)
+	return err
+}
+
+// Close closes the underlying audit log file.
+func (a *auditLog) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.file.Close()
+}
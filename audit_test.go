@@ -0,0 +1,65 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLogAppendsRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %s", err)
+	}
+	records := []auditRecord{
+		{Timestamp: time.UnixMilli(1716994039000), ClientAddress: "127.0.0.1:53450", Bytes: 1024, Outcome: auditNoSessions},
+		{Timestamp: time.UnixMilli(1716994040000), ClientAddress: "127.0.0.1:53451", Bytes: 2048,
+			SessionsFound: 2, Outcome: auditFailed, Error: "upload status code: 500"},
+		{Timestamp: time.UnixMilli(1716994041000), ClientAddress: "127.0.0.1:53452", Bytes: 4096,
+			SessionsFound: 1, SessionsWritten: 1, Outcome: auditWritten},
+	}
+	for _, rec := range records {
+		if err := audit.write(rec); err != nil {
+			t.Fatalf("Failed to write audit record: %s", err)
+		}
+	}
+	if err := audit.Close(); err != nil {
+		t.Fatalf("Failed to close audit log: %s", err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen audit log: %s", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("Line %d is not a valid audit record: %s", i, err)
+		}
+		if i >= len(records) {
+			continue
+		}
+		expected := records[i]
+		if !rec.Timestamp.Equal(expected.Timestamp) || rec.ClientAddress != expected.ClientAddress ||
+			rec.Bytes != expected.Bytes || rec.SessionsFound != expected.SessionsFound ||
+			rec.SessionsWritten != expected.SessionsWritten || rec.Outcome != expected.Outcome ||
+			rec.Error != expected.Error {
+			t.Errorf("Line %d: expected %+v, got %+v", i, expected, rec)
+		}
+	}
+	if i != len(records) {
+		t.Errorf("Expected %d audit records, got %d", len(records), i)
+	}
+}
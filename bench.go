@@ -0,0 +1,243 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBenchMeasurement is the measurement benchmark sessions are
+// written to, so they are kept apart from real usage data.
+const defaultBenchMeasurement = "tracker-bench"
+
+// benchCommand returns the bench subcommand.
+func benchCommand() *cobra.Command {
+	bench := &cobra.Command{
+		Use: "bench [--config <path>] [--adapter <name>] [--handler <n>] [--mock] " +
+			"[--batches <n>] [--sessions <n>] [--workers <n>] [--measurement <name>]",
+		Short: "Measures write throughput to an adobe_usage_tracker handler's endpoint",
+		Long: `
+Sends batches of synthetic sessions, as a handler sends the sessions
+parsed from uploads, and reports the write throughput in points per
+second and the latency of each batch.  The sessions are written to
+the endpoint, database, and sessions policy of the nth
+adobe_usage_tracker handler in the config (the first by default),
+with its token, but in their own measurement (tracker-bench by
+default), so they can be told apart from (and dropped without
+touching) real usage data.
+
+With --mock, the sessions are instead written to a mock endpoint
+in this process that accepts every write, which measures the
+tracker's own overhead.  A config isn't needed with --mock.
+
+--config and --adapter load the config as the run command does.
+`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdBench),
+	}
+	bench.Flags().StringP("config", "c", "", "Configuration file")
+	bench.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+	bench.Flags().Int("handler", 1, "Which adobe_usage_tracker handler to use")
+	bench.Flags().Bool("mock", false, "Write to a mock endpoint instead")
+	bench.Flags().Int("batches", 100, "Number of batches to send")
+	bench.Flags().Int("sessions", 50, "Number of sessions in each batch")
+	bench.Flags().Int("workers", 4, "Number of batches sent at once")
+	bench.Flags().String("measurement", defaultBenchMeasurement, "Measurement to write to")
+	return bench
+}
+
+// cmdBench implements the bench command.
+func cmdBench(fs caddycmd.Flags) (int, error) {
+	cfg := benchConfig{batches: fs.Int("batches"), sessions: fs.Int("sessions"), workers: fs.Int("workers")}
+	if cfg.batches <= 0 || cfg.sessions <= 0 || cfg.workers <= 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("batches, sessions, and workers must be positive")
+	}
+	measure, err := core.ParseMeasurementTemplate(fs.String("measurement"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	m := &AdobeUsageTracker{db: "bench", rp: "autogen", format: &core.LineFormat{}}
+	if fs.String("config") != "" || !fs.Bool("mock") {
+		config, _, err := caddycmd.LoadConfig(fs.String("config"), fs.String("adapter"))
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		var tree any
+		if err := json.Unmarshal(config, &tree); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("cannot decode config: %v", err)
+		}
+		handlers := findTrackerHandlers(tree, nil)
+		n := fs.Int("handler")
+		if n < 1 || n > len(handlers) {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("config has %d adobe_usage_tracker handlers, not %d", len(handlers), n)
+		}
+		var cleanup func()
+		if m, cleanup, err = loadTracker(handlers[n-1]); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer cleanup()
+	}
+	if fs.Bool("mock") {
+		server := newBenchServer()
+		defer server.Close()
+		m.ep, m.oauth, m.token = server.URL, nil, &tokenHolder{}
+	} else if m.ep == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("handler has no endpoint (use --mock to measure without one)")
+	}
+	format := *m.format
+	format.Measure = measure
+	m.format = &format
+	fmt.Printf("Sending %d batches of %d sessions to %s (database %q, policy %q), %d at a time\n",
+		cfg.batches, cfg.sessions, m.ep, m.db, m.policyFor(classSessions), cfg.workers)
+	result := m.runBench(cfg)
+	fmt.Println(result)
+	if result.failed > 0 {
+		return 1, fmt.Errorf("%d of %d batches failed", result.failed, cfg.batches)
+	}
+	return 0, nil
+}
+
+// A benchConfig gives the shape of a benchmark run.
+type benchConfig struct {
+	batches  int // number of batches sent
+	sessions int // number of sessions in each batch
+	workers  int // number of batches sent at once
+}
+
+// A benchResult summarizes a benchmark run.
+type benchResult struct {
+	points    int             // points written successfully
+	failed    int             // batches that failed
+	elapsed   time.Duration   // wall time of the run
+	latencies []time.Duration // latency of each batch, sorted
+	lastErr   error           // the last error, if any batches failed
+}
+
+func (r benchResult) String() string {
+	var b strings.Builder
+	rate := 0.0
+	if r.elapsed > 0 {
+		rate = float64(r.points) / r.elapsed.Seconds()
+	}
+	_, _ = fmt.Fprintf(&b, "  %d points written in %s: %.0f points/sec\n", r.points, r.elapsed.Round(time.Millisecond), rate)
+	_, _ = fmt.Fprintf(&b, "  batch latency: p50 %s, p95 %s, p99 %s, max %s",
+		r.percentile(50), r.percentile(95), r.percentile(99), r.percentile(100))
+	if r.failed > 0 {
+		_, _ = fmt.Fprintf(&b, "\n  %d batches failed; the last with: %v", r.failed, r.lastErr)
+	}
+	return b.String()
+}
+
+// percentile returns the given percentile of the batch latencies.
+func (r benchResult) percentile(p int) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	i := (len(r.latencies)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return r.latencies[i].Round(time.Microsecond)
+}
+
+// runBench sends the configured batches of synthetic sessions and
+// measures how long they take.
+func (m AdobeUsageTracker) runBench(cfg benchConfig) benchResult {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	batches := make(chan []core.Session, cfg.batches)
+	for i := 0; i < cfg.batches; i++ {
+		batches <- syntheticSessions(rng, cfg.sessions, time.Now())
+	}
+	close(batches)
+	var mu sync.Mutex
+	var result benchResult
+	var wg sync.WaitGroup
+	logger := zap.NewNop()
+	start := time.Now()
+	for i := 0; i < cfg.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sessions := range batches {
+				sent := time.Now()
+				err := m.sendWithToken(func(tok string) error {
+					return core.SendSessions(m.ep, m.db, m.policyFor(classSessions), tok, m.format, sessions, logger)
+				}, logger)
+				latency := time.Since(sent)
+				mu.Lock()
+				result.latencies = append(result.latencies, latency)
+				if err != nil {
+					result.failed++
+					result.lastErr = err
+				} else {
+					result.points += len(sessions)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	result.elapsed = time.Since(start)
+	sort.Slice(result.latencies, func(i, j int) bool { return result.latencies[i] < result.latencies[j] })
+	return result
+}
+
+// benchApps are the apps whose launches are synthesized.
+var benchApps = []struct{ id, version string }{
+	{"Photoshop1", "25.9.0"},
+	{"Illustrator1", "28.5.0"},
+	{"InDesign1", "19.4"},
+	{"PremierePro1", "24.4.1"},
+	{"AcrobatDC1", "24.2.20759.7"},
+}
+
+// syntheticSessions returns n sessions that look like real launches
+// in the hour before now, each with its own session ID.
+func syntheticSessions(rng *rand.Rand, n int, now time.Time) []core.Session {
+	sessions := make([]core.Session, n)
+	for i := range sessions {
+		app := benchApps[rng.Intn(len(benchApps))]
+		launch := now.Add(-time.Duration(rng.Int63n(int64(time.Hour))))
+		sessions[i] = core.Session{
+			SessionId:      fmt.Sprintf("%08x-bench.%d", rng.Uint32(), launch.UnixMilli()),
+			LaunchTime:     launch,
+			LaunchDuration: time.Duration(rng.Int63n(int64(now.Sub(launch)) + 1)),
+			ClientIp:       fmt.Sprintf("10.%d.%d.%d:%d", rng.Intn(256), rng.Intn(256), rng.Intn(256), 49152+rng.Intn(16384)),
+			AppId:          app.id,
+			AppVersion:     app.version,
+			AppLocale:      "en_US",
+			NglVersion:     "1.35.0.19",
+			OsName:         "MAC",
+			OsVersion:      "14.5.0",
+			UserId:         fmt.Sprintf("%040x", rng.Uint64()),
+			LaunchKind:     core.LaunchWarm,
+		}
+	}
+	return sessions
+}
+
+// newBenchServer starts a mock influx endpoint that accepts every write.
+func newBenchServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+}
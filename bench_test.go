@@ -0,0 +1,74 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bufio"
+	"github.com/clickonetwo/tracker/core"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunBench(t *testing.T) {
+	var points, requests atomic.Int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fail every fifth batch
+		if requests.Add(1)%5 == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), "tracker-bench,") {
+				t.Errorf("Unexpected point: %s", scanner.Text())
+			}
+			points.Add(1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	measure, err := core.ParseMeasurementTemplate(defaultBenchMeasurement)
+	if err != nil {
+		t.Fatalf("Failed to parse measurement: %v", err)
+	}
+	m := AdobeUsageTracker{ep: server.URL, db: "db", rp: "rp", format: &core.LineFormat{Measure: measure}}
+	m.token = &tokenHolder{}
+	result := m.runBench(benchConfig{batches: 10, sessions: 7, workers: 3})
+	if result.failed != 2 || result.points != 56 || int64(result.points) != points.Load() {
+		t.Errorf("Expected 56 points written and 2 batches failed, got %+v (server saw %d points)", result, points.Load())
+	}
+	if len(result.latencies) != 10 || result.percentile(100) < result.percentile(50) {
+		t.Errorf("Expected 10 sorted latencies, got %v", result.latencies)
+	}
+	if report := result.String(); !strings.Contains(report, "56 points written") || !strings.Contains(report, "2 batches failed") {
+		t.Errorf("Unexpected report: %s", report)
+	}
+}
+
+func TestSyntheticSessions(t *testing.T) {
+	now := time.Now()
+	sessions := syntheticSessions(rand.New(rand.NewSource(1)), 100, now)
+	seen := make(map[string]bool)
+	for _, s := range sessions {
+		if seen[s.SessionId] {
+			t.Errorf("Duplicate session ID %s", s.SessionId)
+		}
+		seen[s.SessionId] = true
+		if s.LaunchTime.After(now) || s.LaunchTime.Add(s.LaunchDuration).After(now) || s.AppId == "" {
+			t.Errorf("Unrealistic session: %+v", s)
+		}
+	}
+	latencies := benchResult{latencies: []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond}}
+	if latencies.percentile(50) != 2*time.Millisecond || latencies.percentile(99) != 4*time.Millisecond {
+		t.Errorf("Unexpected percentiles %v and %v", latencies.percentile(50), latencies.percentile(99))
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultConcurrencyWindow      = time.Hour
+	defaultConcurrencyMeasurement = "app-concurrency"
+	concurrencyInterval           = time.Minute
+)
+
+// ConcurrencyConfig configures the gauge of the sessions of each
+// app that were active at the same time.  Every minute, the peak
+// number of simultaneous sessions of each app in the last Window
+// is written to Measurement.
+type ConcurrencyConfig struct {
+	Window      caddy.Duration `json:"window,omitempty"`
+	Measurement string         `json:"measurement,omitempty"`
+	// Epsilon, if positive, adds Laplace noise to each peak and
+	// session count, so the points are differentially private for
+	// each session.  Since each session can change both counts, each
+	// is given half of Epsilon, for noise with scale 2/Epsilon.
+	Epsilon float64 `json:"epsilon,omitempty"`
+}
+
+// The concurrency registry holds the concurrency gauge for each
+// endpoint, database, and measurement.  Like the rollup registry,
+// it outlives any single configuration, so that a config reload
+// doesn't lose the sessions seen in the current window.  A gauge is
+// stopped when the last tracker using it is cleaned up.
+var concurrencyRegistry = struct {
+	sync.Mutex
+	gauges map[string]*concurrencyGauge
+}{gauges: make(map[string]*concurrencyGauge)}
+
+// A concurrencyGauge keeps the interval each recent session was
+// active, from its launch to its last log line, and periodically
+// writes the peak number of overlapping intervals for each app.
+// Since logs are uploaded some time after they are written, the
+// gauge is an estimate that firms up as late uploads arrive.
+type concurrencyGauge struct {
+	key         string
+	measurement string
+	refs        int
+	stop        chan struct{}
+	done        sync.WaitGroup
+
+	mu       sync.Mutex
+	window   time.Duration
+	epsilon  float64
+	send     func(lines []string) error
+	sessions map[string]activeSession
+}
+
+// An activeSession is the interval during which a session was active.
+type activeSession struct {
+	appId string
+	start time.Time
+	end   time.Time
+}
+
+// acquireConcurrency returns the named tracker's concurrency gauge
+// for the given endpoint and database and the configured
+// measurement, starting it if necessary.  The window, epsilon, and
+// send function of an existing gauge are replaced by the given ones,
+// so the newest configuration wins.
+func acquireConcurrency(cfg ConcurrencyConfig, name string, ep string, db string, send func(lines []string) error) (*concurrencyGauge, error) {
+	window := time.Duration(cfg.Window)
+	if window == 0 {
+		window = defaultConcurrencyWindow
+	}
+	if window < concurrencyInterval {
+		return nil, fmt.Errorf("concurrency window must be at least %s", concurrencyInterval)
+	}
+	if err := validEpsilon(cfg.Epsilon); err != nil {
+		return nil, fmt.Errorf("concurrency %v", err)
+	}
+	measurement := cfg.Measurement
+	if measurement == "" {
+		measurement = defaultConcurrencyMeasurement
+	}
+	concurrencyRegistry.Lock()
+	defer concurrencyRegistry.Unlock()
+	key := name + "|" + ep + "|" + db + "|" + measurement
+	g, ok := concurrencyRegistry.gauges[key]
+	if !ok {
+		g = &concurrencyGauge{key: key, measurement: measurement, stop: make(chan struct{})}
+		g.sessions = make(map[string]activeSession)
+		concurrencyRegistry.gauges[key] = g
+		g.run()
+	}
+	g.refs++
+	g.mu.Lock()
+	g.window, g.epsilon, g.send = window, cfg.Epsilon, send
+	g.mu.Unlock()
+	return g, nil
+}
+
+// release gives up one tracker's use of the gauge.  When the last
+// use is given up, the gauge is stopped.
+func (g *concurrencyGauge) release() {
+	concurrencyRegistry.Lock()
+	g.refs--
+	last := g.refs == 0
+	if last {
+		delete(concurrencyRegistry.gauges, g.key)
+	}
+	concurrencyRegistry.Unlock()
+	if last {
+		close(g.stop)
+		g.done.Wait()
+	}
+}
+
+// add records the intervals during which the given sessions were
+// active.  A session whose logs are split across several uploads
+// is counted once, with the longest interval uploaded.
+func (g *concurrencyGauge) add(sessions []core.Session) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, s := range sessions {
+		if s.AppId == "" || s.LaunchDuration < 0 {
+			continue
+		}
+		end := s.LaunchTime.Add(s.LaunchDuration)
+		if prev, ok := g.sessions[s.SessionId]; ok && !end.After(prev.end) {
+			continue
+		}
+		g.sessions[s.SessionId] = activeSession{appId: s.AppId, start: s.LaunchTime, end: end}
+	}
+}
+
+// tick forgets the sessions that ended before the window ending at
+// now, and returns the lines for the window, and the function to
+// send them.
+func (g *concurrencyGauge) tick(now time.Time) ([]string, func(lines []string) error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	from := now.Add(-g.window)
+	for id, s := range g.sessions {
+		if s.end.Before(from) {
+			delete(g.sessions, id)
+		}
+	}
+	return g.lines(from, now), g.send
+}
+
+// lines returns one line protocol point for each app with a
+// session active between from and to, giving the peak number of
+// its sessions active at the same time, and the number of them
+// active at all, timestamped with to.  If the gauge has an
+// epsilon, the counts are noisy, with half of it spent on each.
+func (g *concurrencyGauge) lines(from time.Time, to time.Time) []string {
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	events := make(map[string][]event)
+	for _, s := range g.sessions {
+		if s.end.Before(from) || s.start.After(to) {
+			continue
+		}
+		start := s.start
+		if start.Before(from) {
+			start = from
+		}
+		events[s.appId] = append(events[s.appId], event{start, 1}, event{s.end, -1})
+	}
+	apps := make([]string, 0, len(events))
+	for app := range events {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	lines := make([]string, 0, len(apps))
+	for _, app := range apps {
+		appEvents := events[app]
+		// at equal times, starts come before ends, so sessions
+		// that touch are counted as overlapping.
+		sort.Slice(appEvents, func(i, j int) bool {
+			if appEvents[i].at.Equal(appEvents[j].at) {
+				return appEvents[i].delta > appEvents[j].delta
+			}
+			return appEvents[i].at.Before(appEvents[j].at)
+		})
+		active, peak := 0, 0
+		for _, e := range appEvents {
+			active += e.delta
+			peak = max(peak, active)
+		}
+		peak, count := noisyCount(peak, g.epsilon/2), noisyCount(len(appEvents)/2, g.epsilon/2)
+		lines = append(lines, fmt.Sprintf("%s,appId=%s peak=%di,sessions=%di %d",
+			g.measurement, core.TagEscaper.Replace(app), peak, count, to.UnixMilli()))
+	}
+	return lines
+}
+
+// flush writes the gauge for the window ending at now.
+func (g *concurrencyGauge) flush(now time.Time) {
+	lines, send := g.tick(now)
+	if len(lines) == 0 {
+		return
+	}
+	if err := send(lines); err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to write concurrency gauge",
+			zap.String("measurement", g.measurement), zap.Error(err))
+	}
+}
+
+// run starts the gauge's periodic writes.
+func (g *concurrencyGauge) run() {
+	g.done.Add(1)
+	go func() {
+		defer g.done.Done()
+		ticker := time.NewTicker(concurrencyInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case now := <-ticker.C:
+				g.flush(now)
+			}
+		}
+	}()
+}
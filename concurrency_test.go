@@ -0,0 +1,76 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyGauge(t *testing.T) {
+	var sent [][]string
+	var mu sync.Mutex
+	send := func(lines []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, lines)
+		return nil
+	}
+	g, err := acquireConcurrency(ConcurrencyConfig{Window: caddy.Duration(time.Hour)}, "", "test-gauge", "db", send)
+	if err != nil {
+		t.Fatalf("Failed to acquire concurrency gauge: %v", err)
+	}
+	defer g.release()
+	start := time.UnixMilli(1716994039000)
+	session := func(id string, app string, from int, minutes int) core.Session {
+		return core.Session{SessionId: id, AppId: app,
+			LaunchTime: start.Add(time.Duration(from) * time.Minute), LaunchDuration: time.Duration(minutes) * time.Minute}
+	}
+	g.add([]core.Session{
+		session("a", "Photoshop1", 0, 30),
+		session("b", "Photoshop1", 10, 10),
+		session("c", "Photoshop1", 40, 10),
+		session("d", "InDesign1", 20, 5),
+		session("e", "Illustrator1", -120, 5),
+	})
+	// a later upload of a session extends its interval
+	g.add([]core.Session{session("c", "Photoshop1", 40, 15), session("b", "Photoshop1", 10, 5)})
+	g.flush(start.Add(time.Hour))
+	expected := []string{
+		"app-concurrency,appId=InDesign1 peak=1i,sessions=1i 1716997639000",
+		"app-concurrency,appId=Photoshop1 peak=2i,sessions=3i 1716997639000",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sent) != 1 || !reflect.DeepEqual(sent[0], expected) {
+		t.Fatalf("Expected points %v, got %v", expected, sent)
+	}
+	if _, ok := g.sessions["e"]; ok {
+		t.Errorf("Expected sessions that ended before the window to be forgotten")
+	}
+}
+
+func TestConcurrencyGaugeConfig(t *testing.T) {
+	noSend := func(lines []string) error { return nil }
+	g1, err := acquireConcurrency(ConcurrencyConfig{}, "", "test-shared", "db", noSend)
+	if err != nil {
+		t.Fatalf("Failed to acquire concurrency gauge: %v", err)
+	}
+	g2, _ := acquireConcurrency(ConcurrencyConfig{Window: caddy.Duration(2 * time.Hour)}, "", "test-shared", "db", noSend)
+	if g1 != g2 || g1.window != 2*time.Hour {
+		t.Errorf("Expected trackers to share a gauge, with the newest window")
+	}
+	g2.release()
+	g1.release()
+	if _, err := acquireConcurrency(ConcurrencyConfig{Window: caddy.Duration(time.Second)}, "", "test-shared", "db", noSend); err == nil {
+		t.Errorf("Expected a window shorter than a minute to be rejected")
+	}
+}
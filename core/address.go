@@ -0,0 +1,72 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// Address families of client addresses.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
+// NormalizeAddress returns the canonical form of a client address,
+// which is an IP address with or without a port (IPv6 addresses
+// with a port are bracketed, as in "[2001:db8::1]:53450").  IPv6
+// addresses are compressed and lower-cased, IPv4 addresses mapped
+// into IPv6 (as dual-stack listeners report them) are unmapped, and
+// zones are dropped, so each machine has just one form.  Addresses
+// that aren't IP addresses are returned unchanged.
+func NormalizeAddress(addr string) string {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return netip.AddrPortFrom(normalizeIP(ap.Addr()), ap.Port()).String()
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")); err == nil {
+		return normalizeIP(ip).String()
+	}
+	return addr
+}
+
+// AddressHost returns the IP address of a client address, without
+// its port, in canonical form.  If the address isn't an IP address,
+// its host part is returned.
+func AddressHost(addr string) string {
+	if ap, err := netip.ParseAddrPort(addr); err == nil {
+		return normalizeIP(ap.Addr()).String()
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")); err == nil {
+		return normalizeIP(ip).String()
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// AddressFamily returns the family of a client address, FamilyIPv4
+// or FamilyIPv6, or the empty string if it isn't an IP address.
+func AddressFamily(addr string) string {
+	ip, err := netip.ParseAddr(AddressHost(addr))
+	switch {
+	case err != nil:
+		return ""
+	case ip.Is4():
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// normalizeIP unmaps IPv4-mapped addresses and drops zones.
+func normalizeIP(ip netip.Addr) netip.Addr {
+	return ip.Unmap().WithZone("")
+}
@@ -0,0 +1,53 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+)
+
+func TestClientAddresses(t *testing.T) {
+	cases := []struct{ addr, normal, host, family string }{
+		{"10.0.0.1:53450", "10.0.0.1:53450", "10.0.0.1", FamilyIPv4},
+		{"10.0.0.1", "10.0.0.1", "10.0.0.1", FamilyIPv4},
+		{"[2001:DB8:0:0::1]:53450", "[2001:db8::1]:53450", "2001:db8::1", FamilyIPv6},
+		{"2001:db8::1", "2001:db8::1", "2001:db8::1", FamilyIPv6},
+		{"[2001:db8::1]", "2001:db8::1", "2001:db8::1", FamilyIPv6},
+		{"[::ffff:10.0.0.1]:53450", "10.0.0.1:53450", "10.0.0.1", FamilyIPv4},
+		{"[fe80::1%en0]:53450", "[fe80::1]:53450", "fe80::1", FamilyIPv6},
+		{"client.example.com:53450", "client.example.com:53450", "client.example.com", ""},
+		{"", "", "", ""},
+	}
+	for _, c := range cases {
+		if normal := NormalizeAddress(c.addr); normal != c.normal {
+			t.Errorf("NormalizeAddress(%q): expected %q, got %q", c.addr, c.normal, normal)
+		}
+		if host := AddressHost(c.addr); host != c.host {
+			t.Errorf("AddressHost(%q): expected %q, got %q", c.addr, c.host, host)
+		}
+		if family := AddressFamily(c.addr); family != c.family {
+			t.Errorf("AddressFamily(%q): expected %q, got %q", c.addr, c.family, family)
+		}
+	}
+}
+
+func TestAddressFamilyTag(t *testing.T) {
+	log := `SessionID=a.1710291735643 Timestamp=2024-03-12T18:02:15:807-0700 Description="SetConfig: OS Name=MAC, OS Version=14.3.1"`
+	sessions := ParseLog(log, "[2001:db8::1]:53450")
+	if len(sessions) != 1 || sessions[0].AddressFamily != FamilyIPv6 {
+		t.Fatalf("Expected one IPv6 session, got %v", sessions)
+	}
+	line := SessionLine(sessions[0], &LineFormat{AddressFamily: true}, zap.NewNop())
+	if !strings.Contains(line, ",addressFamily=ipv6,") || !strings.Contains(line, `clientIp="[2001:db8::1]:53450"`) {
+		t.Errorf("Expected an addressFamily tag and IPv6 client address, got %s", line)
+	}
+	if line := SessionLine(sessions[0], nil, zap.NewNop()); strings.Contains(line, "addressFamily") {
+		t.Errorf("Expected no addressFamily tag by default, got %s", line)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"fmt"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"regexp"
+	"time"
+)
+
+// agsMeasurement is the measurement that AGS events are written to.
+const agsMeasurement = "ags-validation"
+
+var agsRegexMap = map[string]*regexp.Regexp{
+	"version":  regexp.MustCompile(`AGSVersion=([^\s,]+)`),
+	"validate": regexp.MustCompile(`AppID=([^,]+),\s*AppVersion=([^\s,]+),\s*ValidationResult=([^\s,]+)`),
+}
+
+// An AGSEvent captures a single genuine-software validation
+// performed by the Adobe Genuine Service.  AGS logs use the same
+// line format as NGL logs, and each validation of an installed
+// product is logged as a single line.
+type AGSEvent struct {
+	SessionId  string
+	EventTime  time.Time
+	ClientIp   string
+	AgsVersion string
+	AppId      string
+	AppVersion string
+	Result     string
+}
+
+func (e AGSEvent) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("sessionId", e.SessionId)
+	enc.AddString("eventTime", e.EventTime.Format(time.RFC3339))
+	enc.AddString("clientIp", e.ClientIp)
+	enc.AddString("agsVersion", e.AgsVersion)
+	enc.AddString("appId", e.AppId)
+	enc.AddString("appVersion", e.AppVersion)
+	enc.AddString("result", e.Result)
+	return nil
+}
+
+// ParseAGSReader reads an AGS log from r a line at a time, and
+// returns the validation events found and the content that was
+// read, as ParseLogReader does for NGL logs.  Events beyond the
+// session limit are dropped.
+func ParseAGSReader(r io.Reader, ip string, limits *Limits) ([]AGSEvent, []byte, error) {
+	var events []AGSEvent
+	var sessionId, agsVersion string
+	content, err := scanLog(r, limits, func(line string) {
+		for _, match := range regexMap["line"].FindAllStringSubmatch(line, -1) {
+			if match[1] != sessionId {
+				sessionId, agsVersion = match[1], ""
+			}
+			description := match[4]
+			if m := agsRegexMap["version"].FindStringSubmatch(description); m != nil {
+				agsVersion = m[1]
+			}
+			m := agsRegexMap["validate"].FindStringSubmatch(description)
+			if m != nil && limits.allowSession(len(events)) {
+				events = append(events, AGSEvent{
+					SessionId:  sessionId,
+					EventTime:  parseLogTimestamp(match[3]),
+					ClientIp:   ip,
+					AgsVersion: agsVersion,
+					AppId:      m[1],
+					AppVersion: m[2],
+					Result:     m[3],
+				})
+			}
+		}
+	})
+	return events, content, err
+}
+
+// AGSEventLine constructs a line protocol line for the given AGSEvent.
+func AGSEventLine(e AGSEvent) string {
+	return fmt.Sprintf("%s,sessionId=%s,appId=%s result=%q,appVersion=%q,agsVersion=%q,clientIp=%q %d",
+		agsMeasurement,
+		e.SessionId,
+		TagEscaper.Replace(e.AppId),
+		e.Result,
+		e.AppVersion,
+		e.AgsVersion,
+		e.ClientIp,
+		e.EventTime.UnixMilli(),
+	)
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseAGSReader(t *testing.T) {
+	f, err := os.Open("../testdata/ags-validation-1.txt")
+	if err != nil {
+		t.Fatalf("Cannot open test log: %s", err)
+	}
+	defer f.Close()
+	events, content, err := ParseAGSReader(f, "127.0.0.1:53450", nil)
+	if err != nil {
+		t.Fatalf("Failed to read test log: %s", err)
+	}
+	if len(content) == 0 {
+		t.Errorf("Expected the log content to be returned")
+	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events, got %d", len(events))
+	}
+	expected := []struct{ AppId, AppVersion, Result string }{
+		{"Photoshop1", "25.9.0", "GENUINE"},
+		{"Illustrator1", "28.5.0", "NON_GENUINE"},
+		{"InDesign1", "19.4", "UNKNOWN"},
+	}
+	for i, e := range expected {
+		event := events[i]
+		if event.AppId != e.AppId || event.AppVersion != e.AppVersion || event.Result != e.Result {
+			t.Errorf("Event %d: expected %v, got %v", i, e, event)
+		}
+		if event.AgsVersion != "6.1.0.55" || event.ClientIp != "127.0.0.1:53450" {
+			t.Errorf("Event %d: unexpected version or client: %v", i, event)
+		}
+	}
+	if events[0].EventTime.UnixMilli() != 1715350322311 {
+		t.Errorf("Unexpected event time: %v", events[0].EventTime)
+	}
+}
+
+func TestParseAGSReaderIgnoresNGLLogs(t *testing.T) {
+	f, err := os.Open("../testdata/indesign-single-session-1.txt")
+	if err != nil {
+		t.Fatalf("Cannot open test log: %s", err)
+	}
+	defer f.Close()
+	if events, _, _ := ParseAGSReader(f, "127.0.0.1", nil); len(events) != 0 {
+		t.Errorf("Expected no AGS events in an NGL log, got %d", len(events))
+	}
+}
+
+func TestAGSEventLine(t *testing.T) {
+	f, err := os.Open("../testdata/ags-validation-1.txt")
+	if err != nil {
+		t.Fatalf("Cannot open test log: %s", err)
+	}
+	defer f.Close()
+	events, _, _ := ParseAGSReader(f, "127.0.0.1", nil)
+	line := AGSEventLine(events[1])
+	expected := "ags-validation,sessionId=6c1b2f0e-93d4-4a8e-b7a1-2f5d0c9e4b11.1715350321000,appId=Illustrator1 " +
+		`result="NON_GENUINE",appVersion="28.5.0",agsVersion="6.1.0.55",clientIp="127.0.0.1" 1715350322877`
+	if line != expected {
+		t.Errorf("Expected line:\n%s\ngot:\n%s", expected, line)
+	}
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// An Extraction is a site-supplied pattern that is matched against
+// the description of each line of a session's log, so that markers
+// injected into the logs (say, by managed install scripts) become
+// extra tags or fields of the session.  The value extracted is the
+// pattern's capture group, if it has one, and otherwise the whole
+// match.  If more than one line of a session matches, the last
+// match wins, as it does for the attributes NGL logs.
+type Extraction struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Field   bool // whether the value is a field rather than a tag
+}
+
+// NewExtraction compiles an extraction.  The pattern can have at
+// most one capture group, and the name can't be that of a tag or
+// field that every session is written with.
+func NewExtraction(name string, pattern string, field bool) (Extraction, error) {
+	if name == "" {
+		return Extraction{}, fmt.Errorf("extraction names cannot be empty")
+	}
+	if IsReservedKey(name) {
+		return Extraction{}, fmt.Errorf("extraction name %q is reserved", name)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return Extraction{}, fmt.Errorf("invalid pattern for extraction %q: %v", name, err)
+	}
+	if re.NumSubexp() > 1 {
+		return Extraction{}, fmt.Errorf("pattern for extraction %q has more than one capture group", name)
+	}
+	return Extraction{Name: name, Pattern: re, Field: field}, nil
+}
+
+// ExtractAttributes matches the extractions against the lines of
+// the NGL log in content, and returns the sessions parsed from it
+// with the extracted values added to their tags and fields.  The
+// original sessions' tags and fields are left unchanged.
+func ExtractAttributes(content []byte, sessions []Session, extractions []Extraction) []Session {
+	if len(extractions) == 0 || len(sessions) == 0 {
+		return sessions
+	}
+	found := make(map[string]map[int]string) // session ID to extraction index to value
+	_, _ = scanLog(bytes.NewReader(content), nil, func(line string) {
+		for _, match := range regexMap["line"].FindAllStringSubmatch(line, -1) {
+			for i, e := range extractions {
+				m := e.Pattern.FindStringSubmatch(match[4])
+				if m == nil {
+					continue
+				}
+				if found[match[1]] == nil {
+					found[match[1]] = make(map[int]string)
+				}
+				found[match[1]][i] = m[len(m)-1]
+			}
+		}
+	})
+	result := make([]Session, len(sessions))
+	for i, s := range sessions {
+		values := found[s.SessionId]
+		if len(values) > 0 {
+			tags, fields := copyMap(s.Tags), copyMap(s.Fields)
+			for j, value := range values {
+				if extractions[j].Field {
+					fields[extractions[j].Name] = value
+				} else {
+					tags[extractions[j].Name] = value
+				}
+			}
+			if len(tags) > 0 {
+				s.Tags = tags
+			}
+			if len(fields) > 0 {
+				s.Fields = fields
+			}
+		}
+		result[i] = s
+	}
+	return result
+}
+
+// copyMap returns a copy of m that can be added to.
+func copyMap(m map[string]string) map[string]string {
+	result := make(map[string]string, len(m))
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
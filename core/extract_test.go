@@ -0,0 +1,59 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestExtractAttributes(t *testing.T) {
+	buffer, err := os.ReadFile("../testdata/indesign-single-session-1.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	var extractions []Extraction
+	for _, e := range []struct {
+		name, pattern string
+		field         bool
+	}{
+		{"runtimeMode", `Runtimemode=([A-Z_]+)`, false},
+		{"initialized", `Initializing session logs`, true},
+		{"missing", `InstallMarker=(\S+)`, false},
+	} {
+		extraction, err := NewExtraction(e.name, e.pattern, e.field)
+		if err != nil {
+			t.Fatalf("Failed to compile extraction %q: %v", e.name, err)
+		}
+		extractions = append(extractions, extraction)
+	}
+	sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+	sessions[0].Tags = map[string]string{"site": "hq"}
+	extracted := ExtractAttributes(buffer, sessions, extractions)
+	expectedTags := map[string]string{"site": "hq", "runtimeMode": "NAMED_USER_ONLINE"}
+	if !reflect.DeepEqual(extracted[0].Tags, expectedTags) {
+		t.Errorf("Expected tags %v, got %v", expectedTags, extracted[0].Tags)
+	}
+	expectedFields := map[string]string{"initialized": "Initializing session logs"}
+	if !reflect.DeepEqual(extracted[0].Fields, expectedFields) {
+		t.Errorf("Expected fields %v, got %v", expectedFields, extracted[0].Fields)
+	}
+	if len(sessions[0].Tags) != 1 || sessions[0].Fields != nil {
+		t.Errorf("Expected the original session to be unchanged, got %v", sessions[0])
+	}
+	for _, e := range []struct{ name, pattern string }{
+		{"", `x`},
+		{"appId", `x`},
+		{"bad", `(`},
+		{"groups", `(a)(b)`},
+	} {
+		if _, err := NewExtraction(e.name, e.pattern, false); err == nil {
+			t.Errorf("Expected an error compiling extraction %q with pattern %q", e.name, e.pattern)
+		}
+	}
+}
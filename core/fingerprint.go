@@ -0,0 +1,42 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// Fingerprint returns a stable hash of the content of a
+// session.  Sessions parsed from the same log content always have
+// the same fingerprint, no matter when or how often the log is
+// uploaded, so downstream consumers can use it to deduplicate
+// retries and replays.  The content is normalized by listing
+// every attribute in a fixed order, with times in milliseconds.
+// Only the host of the client address is included, since its port
+// changes every time the log is uploaded.
+func Fingerprint(s Session) string {
+	fields := []string{
+		s.SessionId,
+		strconv.FormatInt(s.LaunchTime.UnixMilli(), 10),
+		strconv.FormatInt(s.LaunchDuration.Milliseconds(), 10),
+		AddressHost(s.ClientIp),
+		s.AppId,
+		s.AppVersion,
+		s.AppLocale,
+		s.NglVersion,
+		s.OsName,
+		s.OsVersion,
+		s.UserId,
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,69 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"go.uber.org/zap/zaptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSessionFingerprintStable(t *testing.T) {
+	buffer, err := os.ReadFile("../testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	first := ParseLog(string(buffer), "127.0.0.1:53450")
+	second := ParseLog(string(buffer), "127.0.0.1:53450")
+	if len(first) != 2 || len(second) != 2 {
+		t.Fatalf("Expected 2 sessions from each parse, got %d and %d", len(first), len(second))
+	}
+	for i := range first {
+		if Fingerprint(first[i]) != Fingerprint(second[i]) {
+			t.Errorf("Session %d: fingerprint differs across parses of the same content", i)
+		}
+	}
+	if Fingerprint(first[0]) == Fingerprint(first[1]) {
+		t.Errorf("Different sessions have the same fingerprint")
+	}
+	changed := first[0]
+	changed.ClientIp = "127.0.0.2:53450"
+	if Fingerprint(changed) == Fingerprint(first[0]) {
+		t.Errorf("Sessions with different content have the same fingerprint")
+	}
+}
+
+func TestSessionFingerprintIgnoresPort(t *testing.T) {
+	buffer, err := os.ReadFile("../testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	first := ParseLog(string(buffer), "127.0.0.1:53450")
+	retry := ParseLog(string(buffer), "127.0.0.1:61022")
+	if len(first) != 2 || len(retry) != 2 {
+		t.Fatalf("Expected 2 sessions from each parse, got %d and %d", len(first), len(retry))
+	}
+	for i := range first {
+		if Fingerprint(first[i]) != Fingerprint(retry[i]) {
+			t.Errorf("Session %d: fingerprint differs across uploads from different ports", i)
+		}
+	}
+}
+
+func TestSessionLineFingerprintTag(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	s := Session{SessionId: sessionId, ClientIp: "127.0.0.1:53450"}
+	line := SessionLine(s, &LineFormat{Fingerprint: true}, logger)
+	expected := "log-session,fingerprint=" + Fingerprint(s) + ",sessionId=testSession1 "
+	if !strings.HasPrefix(line, expected) {
+		t.Errorf("Expected line to start with %q, got %q", expected, line)
+	}
+	if line := SessionLine(s, &LineFormat{}, logger); strings.Contains(line, "fingerprint=") {
+		t.Errorf("Expected no fingerprint tag, got %q", line)
+	}
+}
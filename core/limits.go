@@ -0,0 +1,141 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"bufio"
+	"io"
+	"math"
+)
+
+// Default limits on the content parsed from a single upload.
+// These are far beyond anything a real log contains, so they
+// only ever apply to corrupted or adversarial uploads.
+const (
+	defaultMaxLineLength = 64 * 1024
+	defaultMaxLines      = 1_000_000
+	defaultMaxSessions   = 10_000
+)
+
+// Names of the limits, as used in metrics and logs.
+const (
+	LimitLineLength = "line_length"
+	LimitLines      = "lines"
+	LimitSessions   = "sessions"
+)
+
+// Limits bound the work done parsing a single upload.  Content
+// beyond a limit is still read, so the upload is passed through
+// intact, but it isn't parsed: the rest of an overlong line is
+// ignored, as are lines beyond the maximum number, and sessions
+// beyond the maximum number are dropped.
+//
+// A nil *Limits imposes no limits.  Otherwise, a Limits
+// is used for a single upload, and records which limits were hit.
+type Limits struct {
+	lineLength int
+	lines      int
+	sessions   int
+	truncated  map[string]int
+}
+
+// NewLimits returns limits for a single upload, using the
+// default for any limit that isn't positive.
+func NewLimits(lineLength int, lines int, sessions int) *Limits {
+	l := &Limits{
+		lineLength: defaultMaxLineLength,
+		lines:      defaultMaxLines,
+		sessions:   defaultMaxSessions,
+		truncated:  make(map[string]int),
+	}
+	if lineLength > 0 {
+		l.lineLength = lineLength
+	}
+	if lines > 0 {
+		l.lines = lines
+	}
+	if sessions > 0 {
+		l.sessions = sessions
+	}
+	return l
+}
+
+// readLine reads the next line from reader, through the
+// trailing newline, ignoring any of it beyond the line length.
+func (l *Limits) readLine(reader *bufio.Reader) (string, error) {
+	if l == nil {
+		return reader.ReadString('\n')
+	}
+	var line []byte
+	truncated := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if room := l.lineLength - len(line); len(chunk) > room {
+			chunk = chunk[:room]
+			truncated = true
+		}
+		line = append(line, chunk...)
+		if err != bufio.ErrBufferFull {
+			if truncated {
+				l.truncated[LimitLineLength]++
+			}
+			return string(line), err
+		}
+	}
+}
+
+// allowLine reports whether the count'th line is to be parsed.
+func (l *Limits) allowLine(count int) bool {
+	if l == nil || count <= l.lines {
+		return true
+	}
+	if count == l.lines+1 {
+		l.truncated[LimitLines]++
+	}
+	return false
+}
+
+// allowLength reports whether content of the given length, such as
+// one event of a LogTransport2 payload, is short enough to be parsed.
+func (l *Limits) allowLength(length int) bool {
+	if l == nil || length <= l.lineLength {
+		return true
+	}
+	l.truncated[LimitLineLength]++
+	return false
+}
+
+// limitReader returns a reader of at most as much of r as the
+// lines of a log can hold, which bounds the parsing of content
+// (such as a LogTransport2 payload) that isn't read line by line.
+func (l *Limits) limitReader(r io.Reader) *io.LimitedReader {
+	if l == nil {
+		return &io.LimitedReader{R: r, N: math.MaxInt64}
+	}
+	return &io.LimitedReader{R: r, N: int64(l.lineLength) * int64(l.lines)}
+}
+
+// allowSession reports whether a session can be added to the
+// count sessions already found.
+func (l *Limits) allowSession(count int) bool {
+	if l == nil || count < l.sessions {
+		return true
+	}
+	l.truncated[LimitSessions]++
+	return false
+}
+
+// Truncated returns the number of times each limit (by name) was
+// hit while parsing the upload.
+func (l *Limits) Truncated() map[string]int {
+	if l == nil {
+		return nil
+	}
+	return l.truncated
+}
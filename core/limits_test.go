@@ -0,0 +1,63 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLimitLineLength(t *testing.T) {
+	long := strings.Repeat("x", 10000)
+	input := "short\n" + long + "\nlast"
+	limits := NewLimits(100, 0, 0)
+	var lines []string
+	content, err := scanLog(strings.NewReader(input), limits, func(line string) {
+		lines = append(lines, line)
+	})
+	if err != nil {
+		t.Fatalf("Failed to scan: %v", err)
+	}
+	if string(content) != input {
+		t.Errorf("Expected all the content to be read")
+	}
+	if len(lines) != 3 || lines[0] != "short\n" || len(lines[1]) != 100 || lines[2] != "last" {
+		t.Errorf("Unexpected lines: %d, %q, %d", len(lines), lines[0], len(lines[1]))
+	}
+	if limits.truncated[LimitLineLength] != 1 {
+		t.Errorf("Expected one line length truncation, got %v", limits.truncated)
+	}
+}
+
+func TestLimitLinesAndSessions(t *testing.T) {
+	buffer, err := os.ReadFile("../testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	all, _, _ := ParseLogReader(bytes.NewReader(buffer), "127.0.0.1", nil)
+	if len(all) < 2 {
+		t.Fatalf("Expected at least 2 sessions in test log, got %d", len(all))
+	}
+	limits := NewLimits(0, 0, 1)
+	sessions, content, _ := ParseLogReader(bytes.NewReader(buffer), "127.0.0.1", limits)
+	if len(sessions) != 1 || sessions[0].SessionId != all[0].SessionId || len(content) != len(buffer) {
+		t.Errorf("Expected only the first session, got %d", len(sessions))
+	}
+	if limits.truncated[LimitSessions] != len(all)-1 {
+		t.Errorf("Expected %d session truncations, got %v", len(all)-1, limits.truncated)
+	}
+	limits = NewLimits(0, 1, 0)
+	sessions, content, _ = ParseLogReader(bytes.NewReader(buffer), "127.0.0.1", limits)
+	if len(sessions) != 1 || len(content) != len(buffer) {
+		t.Errorf("Expected one session from one line, got %d", len(sessions))
+	}
+	if limits.truncated[LimitLines] != 1 {
+		t.Errorf("Expected one lines truncation, got %v", limits.truncated)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A logTransportEvent is one of the events in the body of a
+// LogTransport2 upload.  LogTransport2 is the mechanism that
+// Creative Cloud apps use to send analytics pings, and each upload
+// is a JSON object whose "events" field holds a batch of events.
+// Each event's data is a flat map whose keys are dotted names such
+// as "source.name".
+type logTransportEvent struct {
+	Data map[string]any `json:"data"`
+}
+
+// logTransportFields maps LogTransport2 event data keys to
+// the session attributes they supply.
+var logTransportFields = map[string]func(s *Session, v string){
+	"source.name":       func(s *Session, v string) { s.AppId = v },
+	"source.version":    func(s *Session, v string) { s.AppVersion = v },
+	"event.language":    func(s *Session, v string) { s.AppLocale = v },
+	"source.platform":   func(s *Session, v string) { s.OsName = v },
+	"source.os_version": func(s *Session, v string) { s.OsVersion = v },
+	"event.user_guid":   func(s *Session, v string) { s.UserId = v },
+}
+
+// ParseUploadReader parses an upload from r.  If logTransport is
+// true, uploads that are JSON are parsed as LogTransport2 payloads,
+// and all other uploads are parsed as NGL logs.  It returns what
+// ParseLogReader returns.
+func ParseUploadReader(
+	r io.Reader, ip string, logTransport bool, limits *Limits,
+) ([]Session, []byte, error) {
+	if !logTransport {
+		return ParseLogReader(r, ip, limits)
+	}
+	br := bufio.NewReader(r)
+	if isJSONUpload(br) {
+		return parseLogTransportReader(br, ip, limits)
+	}
+	return ParseLogReader(br, ip, limits)
+}
+
+// isJSONUpload peeks at the start of an upload to see whether
+// it's a JSON object, ignoring any leading whitespace.
+func isJSONUpload(br *bufio.Reader) bool {
+	// Peek returns what it can even if there's an error
+	start, _ := br.Peek(512)
+	start = bytes.TrimLeft(start, " \t\r\n")
+	return len(start) > 0 && start[0] == '{'
+}
+
+// parseLogTransportReader reads a LogTransport2 payload from r, and
+// returns a Session for each app session mentioned in its events.
+// As with ParseLogReader, it returns the content that was read and
+// any read error, and it reads r until it fails or hits EOF.  A
+// payload that isn't valid JSON yields no sessions but no error.
+//
+// The payload is parsed subject to the same limits as a log: each
+// event counts as a line, so events beyond the line limit, and
+// events longer than the line length, are skipped, and no more of
+// the payload is parsed than the lines of a log could hold.  If the
+// payload is cut off by that limit, the events before the cut are
+// kept.  Sessions beyond the session limit are dropped.
+func parseLogTransportReader(r io.Reader, ip string, limits *Limits) ([]Session, []byte, error) {
+	var content bytes.Buffer
+	tee := io.TeeReader(r, &content)
+	limited := limits.limitReader(tee)
+	events, decodeErr := decodeLogTransportEvents(json.NewDecoder(limited), limits)
+	rest, err := io.Copy(io.Discard, tee)
+	// Only non-nil limits can cut the payload off.
+	cut := limited.N == 0 && rest > 0
+	if cut {
+		limits.truncated[LimitLines]++
+	}
+	if decodeErr != nil && !cut {
+		return nil, content.Bytes(), err
+	}
+	return logTransportSessions(events, ip, limits), content.Bytes(), err
+}
+
+// decodeLogTransportEvents decodes the events of a LogTransport2
+// payload one at a time, so that events beyond the limits are never
+// decoded.  It returns the events decoded before any error.
+func decodeLogTransportEvents(dec *json.Decoder, limits *Limits) ([]logTransportEvent, error) {
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+	var events []logTransportEvent
+	count := 0
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return events, err
+		}
+		if key != "events" {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return events, err
+			}
+			continue
+		}
+		if err := expectDelim(dec, '['); err != nil {
+			return events, err
+		}
+		for dec.More() {
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				return events, err
+			}
+			count++
+			if !limits.allowLine(count) || !limits.allowLength(len(raw)) {
+				continue
+			}
+			var event logTransportEvent
+			if err := json.Unmarshal(raw, &event); err != nil {
+				return events, err
+			}
+			events = append(events, event)
+		}
+		if err := expectDelim(dec, ']'); err != nil {
+			return events, err
+		}
+	}
+	return events, expectDelim(dec, '}')
+}
+
+// expectDelim reads the next token from dec, which must be delim.
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("expected %v in LogTransport2 payload, got %v", delim, token)
+	}
+	return nil
+}
+
+// logTransportSessions groups the events in a LogTransport2 payload
+// by session, in order of first appearance.  A session's launch time
+// is the start time of its first event, and its launch duration runs
+// to the start time of its last event.
+func logTransportSessions(events []logTransportEvent, ip string, limits *Limits) []Session {
+	var sessions []Session
+	index := make(map[string]int)
+	lastTimes := make(map[string]time.Time)
+	for _, event := range events {
+		sessionId := logTransportString(event.Data, "event.session_guid")
+		if sessionId == "" {
+			continue
+		}
+		start, err := time.Parse(time.RFC3339Nano, logTransportString(event.Data, "event.dts_start"))
+		if err != nil {
+			continue
+		}
+		i, ok := index[sessionId]
+		if !ok {
+			if !limits.allowSession(len(sessions)) {
+				continue
+			}
+			i = len(sessions)
+			index[sessionId] = i
+			sessions = append(sessions, Session{SessionId: sessionId, LaunchTime: start, ClientIp: ip,
+				AddressFamily: AddressFamily(ip)})
+			lastTimes[sessionId] = start
+		}
+		s := &sessions[i]
+		if start.Before(s.LaunchTime) {
+			s.LaunchTime = start
+		}
+		if start.After(lastTimes[sessionId]) {
+			lastTimes[sessionId] = start
+		}
+		for key, set := range logTransportFields {
+			if value := logTransportString(event.Data, key); value != "" {
+				set(s, value)
+			}
+		}
+	}
+	for i := range sessions {
+		sessions[i].LaunchDuration = lastTimes[sessions[i].SessionId].Sub(sessions[i].LaunchTime)
+	}
+	return sessions
+}
+
+// logTransportString returns the value of the given key in
+// event data, if it's a string, and the empty string otherwise.
+func logTransportString(data map[string]any, key string) string {
+	if value, ok := data[key].(string); ok {
+		return value
+	}
+	return ""
+}
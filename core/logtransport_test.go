@@ -0,0 +1,120 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogTransportUpload(t *testing.T) {
+	f, err := os.Open("../testdata/logtransport-1.json")
+	if err != nil {
+		t.Fatalf("Cannot open test payload: %s", err)
+	}
+	defer f.Close()
+	sessions, content, err := ParseUploadReader(f, "127.0.0.1", true, nil)
+	if err != nil {
+		t.Fatalf("Failed to read test payload: %s", err)
+	}
+	if len(content) == 0 {
+		t.Errorf("Expected the payload content to be returned")
+	}
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	ps := sessions[0]
+	if ps.AppId != "Photoshop" || ps.AppVersion != "25.9.0" || ps.OsName != "MAC" || ps.AppLocale != "en_US" {
+		t.Errorf("Unexpected Photoshop session: %v", ps)
+	}
+	if ps.LaunchTime.UnixMilli() != 1715350321250 {
+		t.Errorf("Unexpected launch time: %v", ps.LaunchTime)
+	}
+	if expected := 8*time.Minute + 43754*time.Millisecond; ps.LaunchDuration != expected {
+		t.Errorf("Expected launch duration %v, got %v", expected, ps.LaunchDuration)
+	}
+	if ai := sessions[1]; ai.AppId != "Illustrator" || ai.LaunchDuration != 0 {
+		t.Errorf("Unexpected Illustrator session: %v", ai)
+	}
+}
+
+func TestParseUploadReaderFallsBackToNGL(t *testing.T) {
+	buffer, err := os.ReadFile("../testdata/indesign-single-session-1.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	sessions, _, err := ParseUploadReader(strings.NewReader(string(buffer)), "127.0.0.1", true, nil)
+	if err != nil {
+		t.Fatalf("Failed to read test log: %s", err)
+	}
+	if expected := ParseLog(string(buffer), "127.0.0.1"); len(sessions) != len(expected) {
+		t.Errorf("Expected %d sessions, got %d", len(expected), len(sessions))
+	}
+}
+
+func TestParseLogTransportDisabledOrInvalid(t *testing.T) {
+	buffer, err := os.ReadFile("../testdata/logtransport-1.json")
+	if err != nil {
+		t.Fatalf("Cannot read test payload: %s", err)
+	}
+	if sessions, _, _ := ParseUploadReader(strings.NewReader(string(buffer)), "127.0.0.1", false, nil); len(sessions) != 0 {
+		t.Errorf("Expected no sessions when LogTransport2 parsing is off, got %d", len(sessions))
+	}
+	truncated := string(buffer[:len(buffer)/2])
+	sessions, content, err := ParseUploadReader(strings.NewReader(truncated), "127.0.0.1", true, nil)
+	if err != nil || len(sessions) != 0 || string(content) != truncated {
+		t.Errorf("Expected a truncated payload to be read with no sessions, got %d sessions, error %v",
+			len(sessions), err)
+	}
+}
+
+func TestParseLogTransportLimits(t *testing.T) {
+	buffer, err := os.ReadFile("../testdata/logtransport-1.json")
+	if err != nil {
+		t.Fatalf("Cannot read test payload: %s", err)
+	}
+	tests := []struct {
+		name       string
+		lineLength int
+		lines      int
+		sessions   int
+		truncated  map[string]int
+	}{
+		{"events", 0, 3, 2, map[string]int{LimitLines: 1}},
+		{"event length", 100, 0, 0, map[string]int{LimitLineLength: 4}},
+		{"payload size", 800, 2, 1, map[string]int{LimitLines: 1}},
+	}
+	for _, test := range tests {
+		limits := NewLimits(test.lineLength, test.lines, 0)
+		sessions, content, err := ParseUploadReader(strings.NewReader(string(buffer)), "127.0.0.1", true, limits)
+		if err != nil {
+			t.Fatalf("%s: failed to read test payload: %s", test.name, err)
+		}
+		if string(content) != string(buffer) {
+			t.Errorf("%s: expected the whole payload to be returned, got %d bytes", test.name, len(content))
+		}
+		if len(sessions) != test.sessions {
+			t.Errorf("%s: expected %d sessions, got %d", test.name, test.sessions, len(sessions))
+		}
+		for _, session := range sessions {
+			if session.LaunchDuration >= 8*time.Minute {
+				t.Errorf("%s: expected the quit event to be skipped, got %v", test.name, session)
+			}
+		}
+		truncated := limits.Truncated()
+		if len(truncated) != len(test.truncated) {
+			t.Errorf("%s: expected truncations %v, got %v", test.name, test.truncated, truncated)
+		}
+		for name, count := range test.truncated {
+			if truncated[name] != count {
+				t.Errorf("%s: expected truncations %v, got %v", test.name, test.truncated, truncated)
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// DefaultMeasurement is the measurement that sessions are
+// written to if no measurement template is configured.
+const DefaultMeasurement = "log-session"
+
+var (
+	placeholderRegex = regexp.MustCompile(`\{([^{}]*)}`)
+
+	// measurementEscaper escapes the characters that are special
+	// in line protocol measurement names.
+	measurementEscaper = strings.NewReplacer(`,`, `\,`, ` `, `\ `)
+
+	// SessionAttributes gives the session attributes that can be
+	// used as placeholders in a measurement template.
+	SessionAttributes = map[string]func(s Session) string{
+		"sessionId":     func(s Session) string { return s.SessionId },
+		"clientIp":      func(s Session) string { return s.ClientIp },
+		"appId":         func(s Session) string { return s.AppId },
+		"appVersion":    func(s Session) string { return s.AppVersion },
+		"appLocale":     func(s Session) string { return s.AppLocale },
+		"nglVersion":    func(s Session) string { return s.NglVersion },
+		"osName":        func(s Session) string { return s.OsName },
+		"osVersion":     func(s Session) string { return s.OsVersion },
+		"userId":        func(s Session) string { return s.UserId },
+		"launchKind":    func(s Session) string { return s.LaunchKind },
+		"addressFamily": func(s Session) string { return s.AddressFamily },
+		"profileId":     func(s Session) string { return s.ProfileId },
+	}
+)
+
+// A MeasurementTemplate computes the measurement name for a
+// session from a template that may contain placeholders, such as
+// `launches_{appId}`, which are replaced by session attributes.
+// Attributes that are empty in a session expand to "unknown".
+type MeasurementTemplate struct {
+	literals []string // literals[i] precedes attributes[i]
+	attrs    []func(s Session) string
+}
+
+// ParseMeasurementTemplate parses a measurement template,
+// checking that every placeholder names a session attribute.
+func ParseMeasurementTemplate(template string) (*MeasurementTemplate, error) {
+	if template == "" {
+		return nil, fmt.Errorf("measurement template cannot be empty")
+	}
+	t := &MeasurementTemplate{}
+	rest := template
+	for _, loc := range placeholderRegex.FindAllStringSubmatchIndex(template, -1) {
+		name := template[loc[2]:loc[3]]
+		attr, ok := SessionAttributes[name]
+		if !ok {
+			return nil, fmt.Errorf("measurement template %q: unknown placeholder {%s}", template, name)
+		}
+		t.literals = append(t.literals, template[len(template)-len(rest):loc[0]])
+		t.attrs = append(t.attrs, attr)
+		rest = template[loc[1]:]
+	}
+	if strings.ContainsAny(rest, "{}") || strings.ContainsAny(strings.Join(t.literals, ""), "{}") {
+		return nil, fmt.Errorf("measurement template %q has unbalanced braces", template)
+	}
+	t.literals = append(t.literals, rest)
+	return t, nil
+}
+
+// Expand returns the line-protocol-escaped measurement name
+// for the given session.
+func (t *MeasurementTemplate) Expand(s Session) string {
+	if t == nil {
+		return DefaultMeasurement
+	}
+	var b strings.Builder
+	for i, attr := range t.attrs {
+		b.WriteString(t.literals[i])
+		value := attr(s)
+		if value == "" {
+			value = "unknown"
+		}
+		b.WriteString(value)
+	}
+	b.WriteString(t.literals[len(t.attrs)])
+	return measurementEscaper.Replace(b.String())
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"testing"
+)
+
+func TestMeasurementTemplateExpand(t *testing.T) {
+	s := Session{AppId: "InDesign1", AppVersion: "19.2", OsName: "MAC"}
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{"log-session", "log-session"},
+		{"launches_{appId}", "launches_InDesign1"},
+		{"{osName}_{appId}_{appVersion}", "MAC_InDesign1_19.2"},
+		{"{appLocale}-sessions", "unknown-sessions"},
+		{"app launches, {appId}", `app\ launches\,\ InDesign1`},
+	}
+	for _, c := range cases {
+		m, err := ParseMeasurementTemplate(c.template)
+		if err != nil {
+			t.Errorf("Failed to parse template %q: %s", c.template, err)
+			continue
+		}
+		if got := m.Expand(s); got != c.expected {
+			t.Errorf("Template %q: expected %q, got %q", c.template, c.expected, got)
+		}
+	}
+	var none *MeasurementTemplate
+	if got := none.Expand(s); got != DefaultMeasurement {
+		t.Errorf("Nil template: expected %q, got %q", DefaultMeasurement, got)
+	}
+}
+
+func TestMeasurementTemplateErrors(t *testing.T) {
+	for _, template := range []string{"", "{tenant}_sessions", "launches_{appId", "launches_appId}", "{}"} {
+		if _, err := ParseMeasurementTemplate(template); err == nil {
+			t.Errorf("Expected error for template %q", template)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"go.uber.org/zap/zapcore"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// The description patterns key on the NGL function names and
+	// field names in each line, which are the same in every locale,
+	// and not on any of the surrounding text, which isn't.  The
+	// refresh interval has no field name, so it is the first number
+	// after the name of a function that sets it, and it must have at
+	// least five digits (it is in milliseconds), which tells it apart
+	// from the request numbers and statuses those functions also log.
+	regexMap = map[string]*regexp.Regexp{
+		"line":   regexp.MustCompile(`SessionID=([^.]+\.([0-9]+)) Timestamp=([^ ]+) [^\r\n]*Description="([^\r\n]+)"`),
+		"os":     regexp.MustCompile(`SetConfig\s*:.+OS Name=([^\s,]+),\s*OS Version=([^\s,]+)`),
+		"app":    regexp.MustCompile(`SetConfig\s*:.+AppID=([^,]+),\s*AppVersion=([^\s,]+)`),
+		"ngl":    regexp.MustCompile(`SetConfig\s*:.+NGLLibVersion=([^\s,]+)`),
+		"locale": regexp.MustCompile(`SetAppRuntimeConfig\s*:.+AppLocale=([^\s,]+)`),
+		"user":   regexp.MustCompile(`LogCurrentUser\s*:.+UserID=([^\s,]+)`),
+		"expiry": regexp.MustCompile(`(?:GetCachedProfile|ProcessV2Profile)\s*:\D*([0-9]{5,})`),
+		"asnp":   regexp.MustCompile(`ASNP ID\s*:\s*([0-9A-Za-z-]+)`),
+		"config": regexp.MustCompile(`SetConfig\s*:`),
+		"cache":  regexp.MustCompile(`GetCachedNglProfile\s+(Status|ASNP ID)\s*:`),
+	}
+
+	// logNormalizer maps the whitespace and punctuation variants
+	// that appear in logs written under non-English locales to
+	// their ASCII equivalents.
+	logNormalizer = strings.NewReplacer(
+		"\u00a0", " ", // no-break space (e.g., before colons in French)
+		"\u202f", " ", // narrow no-break space
+		"\u3000", " ", // ideographic space
+		"\uff1d", "=", // fullwidth equals sign
+		"\uff0c", ",", // fullwidth comma
+		"\u3001", ",", // ideographic comma
+		"\uff1a", ":", // fullwidth colon
+	)
+)
+
+// Launch kinds, as classified from the markers in a session's log.
+const (
+	LaunchCold   = "cold"   // the app found no cached license profile
+	LaunchWarm   = "warm"   // the app started from its cached profile
+	LaunchResume = "resume" // the log continues an earlier launch
+)
+
+// newLogDecoder returns a transformer that decodes log content to
+// UTF-8. Logs written under some locales (notably on Windows) are
+// UTF-16 with a byte order mark, and others are UTF-8 with one.
+func newLogDecoder() transform.Transformer {
+	return unicode.BOMOverride(unicode.UTF8.NewDecoder())
+}
+
+// A Session captures the information from a single log about
+// a single launch of a single application.
+//
+// The sessionId is generated by the app and is unique to the launch.
+// Although a single launch of a single application may generate more
+// than one log, the session_id will be the same for all of them.
+//
+// The launchTime is taken from the last component of the
+// sessionId, which by Adobe convention is the launch time of the
+// app. This ensures that the launchTime is the same for all logs
+// generated from the same launch.
+//
+// The launchDuration field measures the time between the last
+// log line of the session and the launch time of the session.
+// If a session's log gets split among multiple log files, this
+// means that later files will create sessions with bigger
+// launchDuration times.
+//
+// The profileExpiry field is when the app's cached license profile
+// will expire if it isn't refreshed.  NGL logs the profile's refresh
+// interval (in milliseconds) each time it loads or refreshes the
+// profile, so the expiry is the time of the last such line plus the
+// interval.  It is zero if the log has no such line.
+//
+// The launchKind field classifies the launch, from the markers
+// NGL writes when the app starts.  A log that has none of the
+// app's startup configuration lines continues a launch that was
+// logged earlier (say, after the machine woke from sleep), so it
+// is a resume.  Otherwise, the launch is warm if NGL found a cached
+// license profile, and cold if it had to get one from the server.
+// It is empty if the log doesn't show where the profile came from.
+//
+// The profileId field is the ID of the license profile (the ASNP)
+// that the app was launched with, which identifies the product
+// profile that admins assigned the user in the Admin Console.  NGL
+// logs it when it loads the profile from its cache, so it is empty
+// for launches that fetched their profile from the server.
+//
+// The addressFamily field is the family (ipv4 or ipv6) of the
+// client address.  It is kept separately so that it survives the
+// client address being anonymized.
+type Session struct {
+	SessionId      string
+	LaunchTime     time.Time
+	LaunchDuration time.Duration
+	ClientIp       string
+	AddressFamily  string // FamilyIPv4, FamilyIPv6, or empty
+	AppId          string // NGL app ID
+	AppVersion     string
+	AppLocale      string
+	NglVersion     string // version of the app's NGL library
+	OsName         string
+	OsVersion      string
+	UserId         string            // a SHA1 of the logged-in Adobe user ID
+	ProfileExpiry  time.Time         // when the cached license profile expires
+	ProfileId      string            // ID of the license profile
+	LaunchKind     string            // LaunchCold, LaunchWarm, LaunchResume, or empty
+	Tags           map[string]string // extra tags added by a transform
+	Fields         map[string]string // extra string fields
+}
+
+func (l Session) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("sessionId", l.SessionId)
+	enc.AddString("launchTime", l.LaunchTime.Format(time.RFC3339))
+	enc.AddString("launchDuration", l.LaunchDuration.String())
+	enc.AddString("clientIp", l.ClientIp)
+	if l.AddressFamily != "" {
+		enc.AddString("addressFamily", l.AddressFamily)
+	}
+	enc.AddString("appId", l.AppId)
+	enc.AddString("appVersion", l.AppVersion)
+	enc.AddString("appLocale", l.AppLocale)
+	enc.AddString("nglVersion", l.NglVersion)
+	enc.AddString("osName", l.OsName)
+	enc.AddString("osVersion", l.OsVersion)
+	enc.AddString("userId", l.UserId)
+	if !l.ProfileExpiry.IsZero() {
+		enc.AddString("profileExpiry", l.ProfileExpiry.Format(time.RFC3339))
+	}
+	if l.LaunchKind != "" {
+		enc.AddString("launchKind", l.LaunchKind)
+	}
+	if l.ProfileId != "" {
+		enc.AddString("profileId", l.ProfileId)
+	}
+	for name, value := range l.Tags {
+		enc.AddString(name, value)
+	}
+	for name, value := range l.Fields {
+		enc.AddString(name, value)
+	}
+	return nil
+}
+
+// ParseLog reads every line of a log's contents, and returns
+// a slice of the Sessions found in the log.  It never fails,
+// but it will return an empty slice on malformed input.
+func ParseLog(log string, ip string) []Session {
+	p := logParser{ip: ip}
+	if decoded, _, err := transform.String(newLogDecoder(), log); err == nil {
+		log = decoded
+	}
+	log = logNormalizer.Replace(log)
+	for _, line := range regexMap["line"].FindAllStringSubmatch(log, -1) {
+		p.addLine(line)
+	}
+	return p.finish()
+}
+
+// CountLogLines returns the number of lines in log that have
+// the form of NGL log lines, whether or not they are useful.
+func CountLogLines(log string) int {
+	return len(regexMap["line"].FindAllStringIndex(log, -1))
+}
+
+// ParseLogReader reads a log from r a line at a time, parsing
+// each line as it arrives, so that parsing can proceed while the
+// log is still being uploaded.  It returns the Sessions found
+// and the content that was read.  If reading fails, it returns the
+// read error along with the sessions found in the content read
+// before the failure.  Either way, it reads r until it fails or
+// hits EOF, so that writers to r are never blocked.  Parsing is
+// bounded by the given limits.
+func ParseLogReader(r io.Reader, ip string, limits *Limits) ([]Session, []byte, error) {
+	p := logParser{ip: ip, limits: limits}
+	content, err := scanLog(r, limits, func(line string) {
+		for _, match := range regexMap["line"].FindAllStringSubmatch(line, -1) {
+			p.addLine(match)
+		}
+	})
+	return p.finish(), content, err
+}
+
+// scanLog reads a log from r a line at a time, decoding and
+// normalizing each line and passing it to handle, subject to the
+// line limits.  It returns the content that was read, and the read
+// error, if any.
+func scanLog(r io.Reader, limits *Limits, handle func(line string)) ([]byte, error) {
+	var content bytes.Buffer
+	reader := bufio.NewReader(transform.NewReader(io.TeeReader(r, &content), newLogDecoder()))
+	for count := 1; ; count++ {
+		line, err := limits.readLine(reader)
+		if limits.allowLine(count) {
+			handle(logNormalizer.Replace(line))
+		}
+		if err == io.EOF {
+			return content.Bytes(), nil
+		}
+		if err != nil {
+			return content.Bytes(), err
+		}
+	}
+}
+
+// A logParser accumulates the Sessions found in a sequence of
+// matched log lines.
+type logParser struct {
+	ip       string
+	limits   *Limits
+	session  Session
+	lastTime time.Time
+	launch   launchMarkers
+	sessions []Session
+}
+
+// launchMarkers records which of the markers used to classify
+// a launch have been seen in a session's log.
+type launchMarkers struct {
+	startup       bool // an app startup configuration line
+	profileLookup bool // a lookup of the cached license profile
+	profileCached bool // the ID of the cached license profile
+}
+
+// note records the markers found in the description of a log line.
+func (l *launchMarkers) note(description string) {
+	if regexMap["config"].MatchString(description) {
+		l.startup = true
+	} else if match := regexMap["cache"].FindStringSubmatch(description); match != nil {
+		l.profileLookup = true
+		l.profileCached = l.profileCached || match[1] == "ASNP ID"
+	}
+}
+
+// kind classifies the launch from the markers seen.
+func (l launchMarkers) kind() string {
+	switch {
+	case !l.startup:
+		return LaunchResume
+	case l.profileCached:
+		return LaunchWarm
+	case l.profileLookup:
+		return LaunchCold
+	}
+	return ""
+}
+
+// addLine adds the content of a matched log line to the session
+// it belongs to, finishing the prior session if this line starts
+// a new one.
+func (p *logParser) addLine(line []string) {
+	if sessionId := line[1]; sessionId != p.session.SessionId {
+		p.endSession()
+		p.session = Session{SessionId: sessionId, LaunchTime: parseTimeMillis(line[2]), ClientIp: p.ip,
+			AddressFamily: AddressFamily(p.ip)}
+	}
+	p.lastTime = parseLogTimestamp(line[3])
+	parseLogDescription(line[4], p.lastTime, &p.session)
+	p.launch.note(line[4])
+}
+
+// endSession adds the session in progress, if any, to the
+// list of completed sessions.
+func (p *logParser) endSession() {
+	if p.session.SessionId != "" && p.limits.allowSession(len(p.sessions)) {
+		if p.lastTime.Compare(p.session.LaunchTime) > 0 {
+			p.session.LaunchDuration = p.lastTime.Sub(p.session.LaunchTime)
+		}
+		p.session.LaunchKind = p.launch.kind()
+		p.sessions = append(p.sessions, p.session)
+	}
+	p.session = Session{}
+	p.launch = launchMarkers{}
+}
+
+// finish completes the session in progress, if any, and returns
+// all the sessions found.
+func (p *logParser) finish() []Session {
+	p.endSession()
+	return p.sessions
+}
+
+// parseLogDescription takes the description field of a log line and
+// fills session parameters from values found in the description.
+// The timestamp of the line is used to compute the profile expiry.
+func parseLogDescription(description string, timestamp time.Time, session *Session) {
+	var match []string
+	if match = regexMap["os"].FindStringSubmatch(description); match != nil {
+		session.OsName = match[1]
+		session.OsVersion = match[2]
+	} else if match = regexMap["app"].FindStringSubmatch(description); match != nil {
+		session.AppId = match[1]
+		session.AppVersion = match[2]
+	} else if match = regexMap["ngl"].FindStringSubmatch(description); match != nil {
+		session.NglVersion = match[1]
+	} else if match = regexMap["locale"].FindStringSubmatch(description); match != nil {
+		session.AppLocale = match[1]
+	} else if match = regexMap["user"].FindStringSubmatch(description); match != nil {
+		session.UserId = match[1]
+	} else if match = regexMap["expiry"].FindStringSubmatch(description); match != nil {
+		if msec, err := strconv.ParseInt(match[1], 10, 64); err == nil && timestamp.UnixMilli() > 0 {
+			session.ProfileExpiry = timestamp.Add(time.Duration(msec) * time.Millisecond)
+		}
+	} else if match = regexMap["asnp"].FindStringSubmatch(description); match != nil {
+		session.ProfileId = match[1]
+	}
+}
+
+// parseTimeMillis is given a string representing a number of
+// milliseconds since the Unix Epoch and returns a time.Time
+// containing that value. If it's given malformed input, it
+// returns the epoch.
+func parseTimeMillis(s string) time.Time {
+	msec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.UnixMilli(0)
+	}
+	return time.UnixMilli(msec)
+}
+
+// parseLogTiimestamp is given a date string in the unique format
+// written by Adobe apps in their log, and returns a time.Time
+// containing that value. If it's given malformed input, it
+// returns the epoch.
+func parseLogTimestamp(s string) time.Time {
+	// incoming format is "2024-02-15T10:54:21:732-0800"
+	// but we have to replace that last : with a . to get it to parse.
+	// Luckily, it's at a fixed offset in the timestring
+	if len(s) < 20 || s[19] != ':' {
+		return time.UnixMilli(0)
+	}
+	valid := s[0:19] + "." + s[20:]
+	t, err := time.Parse("2006-01-02T15:04:05.999-0700", valid)
+	if err != nil {
+		return time.UnixMilli(0)
+	}
+	return t
+}
@@ -0,0 +1,357 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSingleSessionLogs(t *testing.T) {
+	for i := 1; i <= 2; i++ {
+		path := fmt.Sprintf("../testdata/indesign-single-session-%d.txt", i)
+		buffer, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Failed to read file %s: %s", path, err)
+		}
+		sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+		if len(sessions) != 1 {
+			t.Fatalf("Expected 1 session, got %d", len(sessions))
+		}
+		session := sessions[0]
+		if session.AppId != "InDesign1" {
+			t.Errorf("%d: Expected appId %q, got %q", i, "InDesign1", sessions[0].AppId)
+		}
+		if session.AppVersion != "19.2" {
+			t.Errorf("%d: Expected appVersion %q, got %q", i, "19.2", session.AppVersion)
+		}
+		if session.OsName != "MAC" {
+			t.Errorf("%d: Expected osName %q, got %q", i, "MAC", session.OsName)
+		}
+		if session.OsVersion != "14.3.1" {
+			t.Errorf("%d: Expected osVersion %q, got %q", i, "14.3.1", session.OsVersion)
+		}
+		if session.NglVersion != "1.35.0.19" {
+			t.Errorf("%d: Expected nglVersion %q, got %q", i, "1.35.0.19", session.NglVersion)
+		}
+		if session.AppLocale != "en_US" {
+			t.Errorf("%d: Expected appLocale %q, got %q", i, "en_US", session.AppLocale)
+		}
+		if session.UserId != "9f22a90139cbb9f1676b0113e1fb574976dc550a" {
+			t.Errorf("%d: Expected userId %q, got %q", i, "9f22a90139cbb9f1676b0113e1fb574976dc550a", session.UserId)
+		}
+	}
+}
+
+func TestParseSplitSessionLogs(t *testing.T) {
+	var buffer []byte
+	var err error
+	var sessions []Session
+	path1 := fmt.Sprintf("../testdata/indesign-split-session-1-1.txt")
+	path2 := fmt.Sprintf("../testdata/indesign-split-session-1-2.txt")
+	buffer, err = os.ReadFile(path1)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", path1, err)
+	}
+	sessions = ParseLog(string(buffer), "127.0.0.1:53450")
+	if len(sessions) != 1 {
+		t.Fatalf("%s: Expected 1 session, got %d", path1, len(sessions))
+	}
+	session1 := sessions[0]
+	buffer, err = os.ReadFile(path2)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", path2, err)
+	}
+	sessions = ParseLog(string(buffer), "127.0.0.1:53450")
+	if len(sessions) != 1 {
+		t.Fatalf("%s: Expected 1 session, got %d", path2, len(sessions))
+	}
+	session2 := sessions[0]
+	if session1.SessionId != session2.SessionId {
+		t.Errorf("Session ids differ in split-session logs")
+	}
+	if session1.LaunchDuration >= session2.LaunchDuration {
+		t.Errorf(
+			"Session 2 launch duration (%v) < Session 1 launch duration (%v)",
+			session2.LaunchDuration, session1.LaunchDuration,
+		)
+	}
+}
+
+func TestParseMultiSessionLogs(t *testing.T) {
+	var buffer []byte
+	var err error
+	var sessions []Session
+	path1 := fmt.Sprintf("../testdata/indesign-multi-session-1-1.txt")
+	path2 := fmt.Sprintf("../testdata/indesign-multi-session-1-2.txt")
+	buffer, err = os.ReadFile(path1)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", path1, err)
+	}
+	sessions = ParseLog(string(buffer), "127.0.0.1:53450")
+	if len(sessions) != 1 {
+		t.Fatalf("%s: Expected 1 session, got %d", path1, len(sessions))
+	}
+	session1 := sessions[0]
+	buffer, err = os.ReadFile(path2)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", path2, err)
+	}
+	sessions = ParseLog(string(buffer), "127.0.0.1:53450")
+	if len(sessions) != 2 {
+		t.Fatalf("%s: Expected 2 sessions, got %d", path2, len(sessions))
+	}
+	session2 := sessions[0]
+	session3 := sessions[1]
+	if session1.SessionId != session2.SessionId {
+		t.Errorf("Session ids differ in split-multi-session logs")
+	}
+	if session2.SessionId == session3.SessionId {
+		t.Errorf("Session ids don't differ in multi-session logs")
+	}
+	if session1.LaunchTime.Compare(session3.LaunchTime) != -1 {
+		t.Errorf(
+			"Session 1 launch time (%v) < Session 3 launch time (%v)",
+			session1.LaunchTime, session3.LaunchTime,
+		)
+	}
+}
+
+func TestParseLatestLogs(t *testing.T) {
+	files, err := filepath.Glob("../testdata/*.log")
+	if err != nil {
+		t.Fatalf("Cannot glob testdata/*.log: %s", err)
+	}
+	for _, file := range files {
+		buffer, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Cannot read file %s: %s", file, err)
+		}
+		sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+		if len(sessions) == 0 {
+			t.Errorf("No sessions found in file %s", file)
+			continue
+		}
+		session := sessions[0]
+		if session.AppId == "" || session.AppVersion == "" || session.AppLocale == "" {
+			t.Errorf("In file %s: Expected appId and appVersion and appLocale to be non-empty", file)
+		}
+		if session.NglVersion == "" || session.OsName == "" || session.OsVersion == "" {
+			t.Errorf("In file %s: Expected nglVersion and osName and osVersion to be non-empty", file)
+		}
+		if session.UserId == "" {
+			t.Errorf("In file %s: Expected userId to be non-empty", file)
+		}
+		if session.LaunchDuration == 0 {
+			t.Errorf("In file %s: Expected launchDuration to be non-zero", file)
+		}
+	}
+}
+
+func TestParseLogReaderMatchesParseLog(t *testing.T) {
+	files, err := filepath.Glob("../testdata/*")
+	if err != nil {
+		t.Fatalf("Cannot glob testdata/*: %s", err)
+	}
+	for _, file := range files {
+		buffer, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Cannot read file %s: %s", file, err)
+		}
+		expected := ParseLog(string(buffer), "127.0.0.1:53450")
+		sessions, content, err := ParseLogReader(bytes.NewReader(buffer), "127.0.0.1:53450", nil)
+		if err != nil {
+			t.Errorf("In file %s: unexpected read error: %s", file, err)
+		}
+		if !bytes.Equal(content, buffer) {
+			t.Errorf("In file %s: content read differs from content supplied", file)
+		}
+		if !reflect.DeepEqual(sessions, expected) {
+			t.Errorf("In file %s: streamed sessions differ from parsed sessions", file)
+		}
+	}
+}
+
+func TestParseLocalizedLogs(t *testing.T) {
+	locales := []struct {
+		file      string
+		appLocale string
+	}{
+		{"../testdata/localized-ja_JP.txt", "ja_JP"},
+		{"../testdata/localized-de_DE.txt", "de_DE"},
+		{"../testdata/localized-fr_FR.txt", "fr_FR"},
+	}
+	for _, locale := range locales {
+		buffer, err := os.ReadFile(locale.file)
+		if err != nil {
+			t.Fatalf("Failed to read file %s: %s", locale.file, err)
+		}
+		sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+		if len(sessions) != 1 {
+			t.Fatalf("%s: Expected 1 session, got %d", locale.file, len(sessions))
+		}
+		session := sessions[0]
+		if session.AppId != "InDesign1" || session.AppVersion != "19.2" {
+			t.Errorf("%s: Expected app InDesign1 19.2, got %q %q", locale.file, session.AppId, session.AppVersion)
+		}
+		if session.OsName != "MAC" || session.OsVersion != "14.3.1" {
+			t.Errorf("%s: Expected os MAC 14.3.1, got %q %q", locale.file, session.OsName, session.OsVersion)
+		}
+		if session.NglVersion != "1.35.0.19" {
+			t.Errorf("%s: Expected nglVersion %q, got %q", locale.file, "1.35.0.19", session.NglVersion)
+		}
+		// the refresh interval is found whatever the language of its line
+		expiry := time.Date(2024, 3, 13, 1, 2, 16, 351_000_000, time.UTC).Add(87840000 * time.Millisecond)
+		if !session.ProfileExpiry.Equal(expiry) {
+			t.Errorf("%s: Expected profile expiry %v, got %v", locale.file, expiry, session.ProfileExpiry)
+		}
+		if session.AppLocale != locale.appLocale {
+			t.Errorf("%s: Expected appLocale %q, got %q", locale.file, locale.appLocale, session.AppLocale)
+		}
+		if session.UserId != "9f22a90139cbb9f1676b0113e1fb574976dc550a" {
+			t.Errorf("%s: Expected userId %q, got %q", locale.file, "9f22a90139cbb9f1676b0113e1fb574976dc550a", session.UserId)
+		}
+		if session.LaunchDuration == 0 {
+			t.Errorf("%s: Expected launchDuration to be non-zero", locale.file)
+		}
+	}
+}
+
+func TestParseProfileExpiry(t *testing.T) {
+	path := "../testdata/indesign-single-session-1.txt"
+	buffer, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read file %s: %s", path, err)
+	}
+	sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+	if len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %d", len(sessions))
+	}
+	// the last refresh interval line in the log wins
+	expected := parseLogTimestamp("2024-03-12T18:02:16:351-0700").Add(87840000 * time.Millisecond)
+	if !sessions[0].ProfileExpiry.Equal(expected) {
+		t.Errorf("Expected profile expiry %v, got %v", expected, sessions[0].ProfileExpiry)
+	}
+	sessions = ParseLog(`SessionID=a.1710291735643 Timestamp=2024-03-12T18:02:15:807-0700 Description="SetConfig: OS Name=MAC, OS Version=14.3.1"`, "")
+	if len(sessions) != 1 || !sessions[0].ProfileExpiry.IsZero() {
+		t.Errorf("Expected one session with no profile expiry, got %v", sessions)
+	}
+	// the other lines of the functions that log the interval have
+	// numbers too, but none of them is an interval
+	for _, description := range []string{
+		"ProcessV2Profile: request id: 2 api: 0 call-status: 110 profile-status: 110 sequence: initial",
+		"ProcessV2Profile: handler succeeded (latest profile status 0)",
+		"GetImsProfile: request 14 returned status 0",
+		"GetProfile: request 2 refresh interval to 87840000",
+	} {
+		line := `SessionID=a.1710291735643 Timestamp=2024-03-12T18:02:15:807-0700 Description="` + description + `"`
+		if sessions := ParseLog(line, ""); len(sessions) != 1 || !sessions[0].ProfileExpiry.IsZero() {
+			t.Errorf("Expected no profile expiry from %q, got %v", description, sessions)
+		}
+	}
+}
+
+func TestParseLaunchKind(t *testing.T) {
+	cases := []struct{ path, kind string }{
+		{"../testdata/NGLClient_Photoshop125.9.0.log", LaunchWarm},
+		{"../testdata/NGLClient_Photoshop123.5.5.log", LaunchCold},
+		{"../testdata/indesign-split-session-1-1.txt", LaunchWarm},
+		{"../testdata/indesign-split-session-1-2.txt", LaunchResume},
+		{"../testdata/localized-de_DE.txt", ""},
+	}
+	for _, c := range cases {
+		buffer, err := os.ReadFile(c.path)
+		if err != nil {
+			t.Fatalf("Failed to read file %s: %s", c.path, err)
+		}
+		sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+		if len(sessions) == 0 {
+			t.Fatalf("%s: Expected sessions, got none", c.path)
+		}
+		if kind := sessions[0].LaunchKind; kind != c.kind {
+			t.Errorf("%s: Expected launch kind %q, got %q", c.path, c.kind, kind)
+		}
+	}
+}
+
+func TestParseShortTimestamp(t *testing.T) {
+	for _, stamp := range []string{"", "2024", "2024-03-12T18:02:15"} {
+		if ts := parseLogTimestamp(stamp); !ts.Equal(time.UnixMilli(0)) {
+			t.Errorf("Expected the epoch for timestamp %q, got %v", stamp, ts)
+		}
+	}
+	sessions := ParseLog(`SessionID=a.1710291735643 Timestamp=2024 Description="SetConfig: OS Name=MAC, OS Version=14.3.1"`, "")
+	if len(sessions) != 1 || sessions[0].OsName != "MAC" {
+		t.Errorf("Expected one session on MAC, got %v", sessions)
+	}
+}
+
+// FuzzParseLog checks that no log, however malformed, makes the
+// parsers panic, and that the streaming parser reads all of it.
+func FuzzParseLog(f *testing.F) {
+	for _, path := range []string{
+		"../testdata/indesign-single-session-1.txt",
+		"../testdata/indesign-split-session-1-2.txt",
+		"../testdata/localized-ja_JP.txt",
+		"../testdata/logtransport-1.json",
+	} {
+		buffer, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatalf("Cannot read file %s: %s", path, err)
+		}
+		f.Add(buffer)
+	}
+	f.Add([]byte(`SessionID=a.1 Timestamp=2024 Description="GetCachedProfile: Update refresh interval to 9999999999999"`))
+	f.Add([]byte("\xff\xfeS\x00e\x00s\x00"))
+	f.Fuzz(func(t *testing.T, log []byte) {
+		for _, session := range ParseLog(string(log), "127.0.0.1:53450") {
+			if session.SessionId == "" {
+				t.Errorf("Parsed a session with no ID from %q", log)
+			}
+		}
+		limits := NewLimits(256, 100, 10)
+		_, content, err := ParseUploadReader(bytes.NewReader(log), "127.0.0.1:53450", true, limits)
+		if err != nil {
+			t.Errorf("Unexpected read error: %s", err)
+		}
+		if !bytes.Equal(content, log) {
+			t.Errorf("Content read differs from content supplied")
+		}
+	})
+}
+
+func TestParseProfileId(t *testing.T) {
+	cases := []struct{ path, profileId string }{
+		{"../testdata/NGLClient_Photoshop125.9.0.log", "9588d6ba-4041-4b7d-a16c-81907bb9b520"},
+		{"../testdata/indesign-split-session-1-1.txt", "e6f2fec4-32f0-47dc-a85e-ea3db716cc1c"},
+		{"../testdata/NGLClient_Photoshop123.5.5.log", ""},
+	}
+	for _, c := range cases {
+		buffer, err := os.ReadFile(c.path)
+		if err != nil {
+			t.Fatalf("Failed to read file %s: %s", c.path, err)
+		}
+		sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+		if len(sessions) == 0 {
+			t.Fatalf("%s: Expected sessions, got none", c.path)
+		}
+		if id := sessions[0].ProfileId; id != c.profileId {
+			t.Errorf("%s: Expected profile ID %q, got %q", c.path, c.profileId, id)
+		}
+		line := SessionLine(sessions[0], nil, zap.NewNop())
+		if written := strings.Contains(line, `,profileId="`+c.profileId+`"`); written != (c.profileId != "") {
+			t.Errorf("%s: Unexpected profileId field in line %s", c.path, line)
+		}
+	}
+}
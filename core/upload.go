@@ -0,0 +1,366 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package core parses Adobe usage logs and uploads them to Influx,
+// independent of Caddy.
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TagEscaper escapes the characters that are special in line
+// protocol tag keys and values.
+var TagEscaper = strings.NewReplacer(`,`, `\,`, `=`, `\=`, ` `, `\ `)
+
+// reservedKeys are the tag and field keys written by SessionLine,
+// which a session's extra tags must not duplicate.
+var reservedKeys = map[string]bool{
+	"sessionId": true, "fingerprint": true, "expiryRisk": true, "launchKind": true, "addressFamily": true,
+	"launchDuration": true, "clientIp": true, "appId": true, "appVersion": true, "appLocale": true,
+	"nglVersion": true, "osName": true, "osVersion": true, "userId": true, "days_to_expiry": true,
+	"profileId": true,
+}
+
+// IsReservedKey reports whether a tag or field key is written by
+// SessionLine, so can't be used as the name of an extra tag.
+func IsReservedKey(name string) bool {
+	return reservedKeys[name]
+}
+
+// A LineFormat controls how Sessions are encoded as line protocol.
+// A nil LineFormat encodes sessions in the default measurement with
+// no optional tags.
+type LineFormat struct {
+	Measure       *MeasurementTemplate // nil means the default measurement
+	Fingerprint   bool                 // whether to add a fingerprint tag
+	ExpiryRisk    time.Duration        // tag sessions whose profile expires sooner than this
+	LaunchKind    bool                 // whether to add a launchKind tag
+	AddressFamily bool                 // whether to add an addressFamily tag
+}
+
+// SendSessions takes an InfluxDB upload URL and a sequence of Sessions
+// and uploads the Session data to InfluxDB in the given format.
+func SendSessions(
+	ep string, db string, pol string, tok string,
+	format *LineFormat, sessions []Session, logger *zap.Logger,
+) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	var lines = make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		lines = append(lines, SessionLine(session, format, logger))
+	}
+	err := UploadLines(ep, db, pol, tok, lines, logger)
+	var pw PartialWriteError
+	if errors.As(err, &pw) {
+		for i, reason := range pw.Rejected {
+			if i < len(sessions) {
+				logger.Warn("AdobeUsageTracker: session rejected by database",
+					zap.String("sessionId", sessions[i].SessionId), zap.String("reason", reason))
+			}
+		}
+	}
+	return err
+}
+
+// SessionLine constructs a line protocol line for the given Session
+// in the given format.
+func SessionLine(s Session, format *LineFormat, logger *zap.Logger) string {
+	var measurement, tags string
+	if format == nil {
+		measurement = DefaultMeasurement
+	} else {
+		measurement = format.Measure.Expand(s)
+		if format.Fingerprint {
+			tags = ",fingerprint=" + Fingerprint(s)
+		}
+		if format.ExpiryRisk > 0 && !s.ProfileExpiry.IsZero() && TimeToExpiry(s) < format.ExpiryRisk {
+			tags = tags + ",expiryRisk=true"
+		}
+		if format.LaunchKind && s.LaunchKind != "" {
+			tags = tags + ",launchKind=" + s.LaunchKind
+		}
+		if format.AddressFamily && s.AddressFamily != "" {
+			tags = tags + ",addressFamily=" + s.AddressFamily
+		}
+	}
+	if len(s.Tags) > 0 {
+		names := make([]string, 0, len(s.Tags))
+		for name := range s.Tags {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			tags = tags + "," + TagEscaper.Replace(name) + "=" + TagEscaper.Replace(s.Tags[name])
+		}
+	}
+	line := fmt.Sprintf("%s%s,sessionId=%s launchDuration=%d,clientIp=%q",
+		measurement,
+		tags,
+		s.SessionId,
+		s.LaunchDuration.Milliseconds(),
+		s.ClientIp,
+	)
+	if s.AppId != "" {
+		line = line + fmt.Sprintf(",appId=%q,appVersion=%q", s.AppId, s.AppVersion)
+	}
+	if s.AppLocale != "" {
+		line = line + fmt.Sprintf(",appLocale=%q", s.AppLocale)
+	}
+	if s.NglVersion != "" {
+		line = line + fmt.Sprintf(",nglVersion=%q", s.NglVersion)
+	}
+	if s.OsName != "" {
+		line = line + fmt.Sprintf(",osName=%q,osVersion=%q", s.OsName, s.OsVersion)
+	}
+	if s.UserId != "" {
+		line = line + fmt.Sprintf(",userId=%q", s.UserId)
+	}
+	if !s.ProfileExpiry.IsZero() {
+		line = line + fmt.Sprintf(",days_to_expiry=%.2f", TimeToExpiry(s).Hours()/24)
+	}
+	if s.ProfileId != "" {
+		line = line + fmt.Sprintf(",profileId=%q", s.ProfileId)
+	}
+	if len(s.Fields) > 0 {
+		names := make([]string, 0, len(s.Fields))
+		for name := range s.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line = line + fmt.Sprintf(",%s=%q", TagEscaper.Replace(name), s.Fields[name])
+		}
+	}
+	line = line + fmt.Sprintf(" %d", s.LaunchTime.UnixMilli())
+	logger.Debug("session-line-protocol", zap.Object("session", s), zap.String("line", line))
+	return line
+}
+
+// TimeToExpiry returns how long the session's license profile had
+// left before expiring, as of the session's last log line.
+func TimeToExpiry(s Session) time.Duration {
+	return s.ProfileExpiry.Sub(s.LaunchTime.Add(s.LaunchDuration))
+}
+
+func UploadLines(ep string, db string, pol string, tok string, lines []string, logger *zap.Logger) error {
+	content := strings.Join(lines, "\n") + "\n"
+	logger.Debug("AdobeUsageTracker uploading line protocol",
+		zap.Strings("incoming", lines), zap.String("outgoing", content))
+	target := fmt.Sprintf("%s/write?db=%s&rp=%s&precision=ms", ep, url.QueryEscape(db), url.QueryEscape(pol))
+	body := strings.NewReader(content)
+	req, err := http.NewRequest("POST", target, body)
+	if err != nil {
+		logger.Error("AdobeUsageTracker upload create request error", zap.String("error", err.Error()))
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", Authorization(tok))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Error("AdobeUsageTracker upload POST request error", zap.String("error", err.Error()))
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			logger.Error("AdobeUsageTracker POST response close error", zap.String("error", err.Error()))
+		}
+	}(res.Body)
+	if res.StatusCode != http.StatusNoContent {
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			logger.Error("AdobeUsageTracker upload error response invalid",
+				zap.Int("status", res.StatusCode),
+				zap.String("error", err.Error()),
+			)
+		} else {
+			logger.Error("AdobeUsageTracker upload data issues",
+				zap.Int("status", res.StatusCode),
+				zap.String("error", string(body)),
+			)
+			if pw, ok := ParsePartialWrite(res.StatusCode, body); ok {
+				pw.Lines = lines
+				return pw
+			}
+		}
+		return UploadError{Status: res.StatusCode}
+	}
+	return nil
+}
+
+// Authorization returns the Authorization header value for a
+// token.  Static tokens use the influx Token scheme, while tokens
+// acquired via OAuth2 already carry their Bearer scheme.
+func Authorization(tok string) string {
+	if strings.HasPrefix(tok, "Bearer ") {
+		return tok
+	}
+	return "Token " + tok
+}
+
+// An UploadError reports an unsuccessful status from the write endpoint.
+type UploadError struct {
+	Status int
+}
+
+func (e UploadError) Error() string {
+	return fmt.Sprintf("upload status code: %d", e.Status)
+}
+
+var (
+	partialWriteRegex = regexp.MustCompile(`(?i)partial write`)
+	rejectedLineRegex = regexp.MustCompile(`line (\d+):`)
+	droppedRegex      = regexp.MustCompile(`dropped=(\d+)`)
+)
+
+// A PartialWriteError reports that the database accepted some of
+// the points in a write, but rejected others (for example, because
+// of a field type conflict or a timestamp beyond the retention
+// policy).  Newer databases identify the rejected lines; v1
+// databases only give a count of the points dropped.
+type PartialWriteError struct {
+	Status   int
+	Lines    []string       // the lines that were written
+	Rejected map[int]string // reasons, by 0-based index of rejected line
+	Dropped  int
+	Message  string
+}
+
+func (e PartialWriteError) Error() string {
+	return fmt.Sprintf("partial write: %d points rejected: %s", e.Count(), e.Message)
+}
+
+// Count returns the number of points rejected.
+func (e PartialWriteError) Count() int {
+	if len(e.Rejected) > 0 {
+		return len(e.Rejected)
+	}
+	return e.Dropped
+}
+
+// ParsePartialWrite checks whether an error response from the
+// write endpoint reports a partial write, and if so, what was
+// rejected.
+func ParsePartialWrite(status int, body []byte) (PartialWriteError, bool) {
+	message := string(body)
+	var response struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &response) == nil {
+		message = response.Error + response.Message
+	}
+	if !partialWriteRegex.MatchString(message) {
+		return PartialWriteError{}, false
+	}
+	e := PartialWriteError{Status: status, Rejected: make(map[int]string), Message: message}
+	locs := rejectedLineRegex.FindAllStringSubmatchIndex(message, -1)
+	for i, loc := range locs {
+		line, err := strconv.Atoi(message[loc[2]:loc[3]])
+		if err != nil || line < 1 {
+			continue
+		}
+		end := len(message)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		e.Rejected[line-1] = strings.Trim(message[loc[1]:end], " ;,\n")
+	}
+	if match := droppedRegex.FindStringSubmatch(message); match != nil {
+		e.Dropped, _ = strconv.Atoi(match[1])
+	}
+	return e, true
+}
+
+// FindRejected identifies the lines rejected in a partial write
+// whose response only gave the number of points dropped, as v1
+// databases do.  It writes the lines again, in halves, using the
+// number dropped from each half to narrow the search, until it has
+// found each rejected line.  This is safe, since rewriting an
+// accepted point only overwrites it with the same values.  The write
+// function writes some lines, as UploadLines does.  If a rewrite
+// fails for any reason other than the rejection of its points, the
+// error is returned.
+func FindRejected(pw PartialWriteError, write func(lines []string) error) (PartialWriteError, error) {
+	if len(pw.Rejected) > 0 || pw.Dropped == 0 {
+		return pw, nil
+	}
+	rejected := make(map[int]string, pw.Dropped)
+	// search finds the rejected lines among lines, of which dropped
+	// are known to be rejected for the given reason.
+	var search func(offset int, lines []string, dropped int, reason string) error
+	search = func(offset int, lines []string, dropped int, reason string) error {
+		if dropped <= 0 {
+			return nil
+		}
+		if dropped >= len(lines) {
+			for i := range lines {
+				rejected[offset+i] = reason
+			}
+			return nil
+		}
+		half := len(lines) / 2
+		count, halfReason, err := rewrite(lines[:half], write)
+		if err != nil {
+			return err
+		}
+		if err := search(offset, lines[:half], count, halfReason); err != nil {
+			return err
+		}
+		return search(offset+half, lines[half:], dropped-count, reason)
+	}
+	if err := search(0, pw.Lines, pw.Dropped, droppedReason(pw.Message)); err != nil {
+		return pw, err
+	}
+	pw.Rejected = rejected
+	return pw, nil
+}
+
+// rewrite writes lines again for FindRejected, and returns how
+// many of them were rejected, and why.
+func rewrite(lines []string, write func(lines []string) error) (int, string, error) {
+	err := write(lines)
+	var pw PartialWriteError
+	var ue UploadError
+	switch {
+	case err == nil:
+		return 0, "", nil
+	case errors.As(err, &pw):
+		return max(pw.Count(), 1), droppedReason(pw.Message), nil
+	case errors.As(err, &ue) && ue.Status == http.StatusBadRequest:
+		return len(lines), ue.Error(), nil
+	}
+	return 0, "", err
+}
+
+// droppedReason returns the reason given in a v1 partial write
+// message, without its count of the points dropped.
+func droppedReason(message string) string {
+	return strings.TrimSpace(droppedRegex.ReplaceAllString(message, ""))
+}
+
+// IsAuthError reports whether err is a rejection of the token.
+func IsAuthError(err error) bool {
+	var ue UploadError
+	if errors.As(err, &ue) {
+		return ue.Status == http.StatusUnauthorized || ue.Status == http.StatusForbidden
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/clickonetwo/tracker/internal/influxtest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	ep             = os.Getenv("TRACKER_URL")
+	db             = os.Getenv("TRACKER_DB")
+	pol            = os.Getenv("TRACKER_RP")
+	tok            = os.Getenv("TRACKER_TOKEN")
+	sessionId      = "testSession1"
+	launchTime     = 1716994039000
+	launchDuration = 320010
+	appId          = "InDesign1"
+	appVersion     = "19.2"
+	appLocale      = "en_US"
+	nglVersion     = "1.35.0.19"
+	osName         = "MAC"
+	osVersion      = "14.3.1"
+	userId         = "9e5fa"
+)
+
+func TestSessionLineDurationOnly(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	expected := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450" 1716994039000`
+
+	s := Session{
+		SessionId:      sessionId,
+		LaunchTime:     time.UnixMilli(int64(launchTime)),
+		LaunchDuration: time.Duration(launchDuration * 1000000),
+		ClientIp:       "127.0.0.1:53450",
+	}
+	l := SessionLine(s, nil, logger)
+	if l != expected {
+		t.Errorf("SessionLine(%v): expected %q,\ngot %q", sessionId, expected, l)
+	}
+}
+
+func TestSessionLineAllFields(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	expected := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450"` +
+		`,appId="InDesign1",appVersion="19.2"` +
+		`,appLocale="en_US"` +
+		`,nglVersion="1.35.0.19"` +
+		`,osName="MAC",osVersion="14.3.1"` +
+		`,userId="9e5fa"` +
+		` 1716994039000`
+
+	s := Session{
+		SessionId:      sessionId,
+		LaunchTime:     time.UnixMilli(int64(launchTime)),
+		LaunchDuration: time.Duration(launchDuration * 1000000),
+		ClientIp:       "127.0.0.1:53450",
+		AppId:          appId,
+		AppVersion:     appVersion,
+		AppLocale:      appLocale,
+		NglVersion:     nglVersion,
+		OsName:         osName,
+		OsVersion:      osVersion,
+		UserId:         userId,
+	}
+	l := SessionLine(s, nil, logger)
+	if l != expected {
+		t.Errorf("SessionLine(%v): expected %q,\ngot %q", sessionId, expected, l)
+	}
+}
+
+func TestSessionLineLatestLogs(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	files, err := filepath.Glob("../testdata/*.log")
+	if err != nil {
+		t.Fatalf("Cannot glob testdata/*.log: %s", err)
+	}
+	for _, file := range files {
+		buffer, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Cannot read file %s: %s", file, err)
+		}
+		sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+		for _, session := range sessions {
+			l := SessionLine(session, nil, logger)
+			if !strings.Contains(l, ",appId=") || !strings.Contains(l, ",osName") {
+				_ = fmt.Errorf("missing fields in line protocol %q for file %s", l, file)
+			}
+		}
+	}
+}
+
+func TestUploadSessionLine1(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	line1 := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450"` +
+		`,appId="InDesign1",appVersion="19.2"` +
+		`,appLocale="en_US"` +
+		`,nglVersion="1.35.0.19"` +
+		`,osName="MAC",osVersion="14.3.1"` +
+		`,userId="9e5fa"` +
+		` 1716994039000`
+	lines := []string{line1}
+	if err := UploadLines(ep, db, pol, tok, lines, logger); err != nil {
+		t.Errorf("uploadLines failed: %s", err.Error())
+	}
+}
+
+func TestUploadSessionLine2(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	line2 := `log-session,sessionId=testSession1 launchDuration=640020,clientIp="127.0.0.1:53450" 1716994039000`
+	lines := []string{line2}
+	if err := UploadLines(ep, db, pol, tok, lines, logger); err != nil {
+		t.Errorf("uploadLines failed: %s", err.Error())
+	}
+}
+
+func TestUploadSessionBothLines(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	line1 := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450"` +
+		`,appId="InDesign1",appVersion="19.2"` +
+		`,appLocale="en_US"` +
+		`,nglVersion="1.35.0.19"` +
+		`,osName="MAC",osVersion="14.3.1"` +
+		`,userId="9e5fa"` +
+		` 1716994039000`
+	line2 := `log-session,sessionId=testSession1 launchDuration=640020,clientIp="127.0.0.1:53450" 1716994039000`
+	lines := []string{line1, line2}
+	if err := UploadLines(ep, db, pol, tok, lines, logger); err != nil {
+		t.Errorf("uploadLines failed: %s", err.Error())
+	}
+}
+
+func TestUploadLatestLogs(t *testing.T) {
+	files, err := filepath.Glob("../testdata/*.log")
+	if err != nil {
+		t.Fatalf("Cannot glob testdata/*.log: %s", err)
+	}
+	for _, file := range files {
+		buffer, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Cannot read file %s: %s", file, err)
+		}
+		sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+		logger := zaptest.NewLogger(t)
+		if err = SendSessions(ep, db, pol, tok, nil, sessions, logger); err != nil {
+			t.Errorf("Failed to send sessions from: %s", file)
+		}
+	}
+}
+
+func TestSendSessionsMock(t *testing.T) {
+	files, err := filepath.Glob("../testdata/*.log")
+	if err != nil {
+		t.Fatalf("Cannot glob testdata/*.log: %s", err)
+	}
+	for _, version := range []int{1, 2} {
+		server := influxtest.NewServer(version, "secret")
+		restore := server.TrustInDefaultClient()
+		expected := 0
+		for _, file := range files {
+			buffer, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Cannot read file %s: %s", file, err)
+			}
+			sessions := ParseLog(string(buffer), "127.0.0.1:53450")
+			expected += len(sessions)
+			if err = SendSessions(server.URL, "tracker", "autogen", "secret", nil, sessions, zap.NewNop()); err != nil {
+				t.Errorf("v%d: Failed to send sessions from %s: %v", version, file, err)
+			}
+		}
+		for _, w := range server.Writes() {
+			if w.Database != "tracker" || w.RetentionPolicy != "autogen" || w.Precision != "ms" || w.Authorization != "Token secret" {
+				t.Errorf("v%d: Unexpected write parameters: %+v", version, w)
+			}
+		}
+		if got := len(server.Lines()); got != expected {
+			t.Errorf("v%d: Expected %d points written, got %d", version, expected, got)
+		}
+		restore()
+		server.Close()
+	}
+}
+
+func TestUploadLinesMockErrors(t *testing.T) {
+	server := influxtest.NewServer(2, "secret")
+	defer server.Close()
+	defer server.TrustInDefaultClient()()
+	line := `log-session,sessionId=testSession1 launchDuration=640020,clientIp="127.0.0.1:53450" 1716994039000`
+	if err := UploadLines(server.URL, "tracker", "autogen", "Bearer secret", []string{line}, zap.NewNop()); err != nil {
+		t.Errorf("Expected a bearer token to be accepted: %v", err)
+	}
+	if err := UploadLines(server.URL, "tracker", "autogen", "wrong", []string{line}, zap.NewNop()); !IsAuthError(err) {
+		t.Errorf("Expected an auth error for the wrong token, got %v", err)
+	}
+	bad := `log-session,sessionId=testSession1 launchDuration=640020,clientIp="127.0.0.1:53450" 1716994039`
+	var ue UploadError
+	if err := UploadLines(server.URL, "tracker", "autogen", "secret", []string{bad}, zap.NewNop()); !errors.As(err, &ue) || ue.Status != 400 {
+		t.Errorf("Expected a 400 for a timestamp in seconds, got %v", err)
+	}
+	server.FailNext(400, `{"code":"invalid","message":"partial write has occurred, errors encountered on line(s): line 1: field type conflict"}`)
+	var pw PartialWriteError
+	if err := UploadLines(server.URL, "tracker", "autogen", "secret", []string{line}, zap.NewNop()); !errors.As(err, &pw) || pw.Count() != 1 {
+		t.Errorf("Expected a partial write, got %v", err)
+	}
+	if server.Requests() != 4 || len(server.Writes()) != 1 {
+		t.Errorf("Expected 4 requests and 1 write, got %d and %d", server.Requests(), len(server.Writes()))
+	}
+}
+
+func TestParsePartialWrite(t *testing.T) {
+	v1 := `{"error":"partial write: field type conflict: input field \"launchDuration\" on measurement ` +
+		`\"log-session\" is type float, already exists as type integer dropped=2"}`
+	pw, ok := ParsePartialWrite(400, []byte(v1))
+	if !ok || pw.Dropped != 2 || len(pw.Rejected) != 0 || pw.Count() != 2 {
+		t.Errorf("Unexpected v1 partial write: %v, %v", ok, pw)
+	}
+	v3 := `{"code":"invalid","message":"partial write has occurred, errors encountered on line(s): ` +
+		`line 2: timestamp is outside the retention period; line 4: field type conflict"}`
+	pw, ok = ParsePartialWrite(400, []byte(v3))
+	if !ok || pw.Count() != 2 {
+		t.Fatalf("Unexpected v3 partial write: %v, %v", ok, pw)
+	}
+	if pw.Rejected[1] != "timestamp is outside the retention period" || pw.Rejected[3] != "field type conflict" {
+		t.Errorf("Unexpected rejections: %q", pw.Rejected)
+	}
+	if _, ok = ParsePartialWrite(400, []byte(`{"error":"unable to parse 'foo': missing fields"}`)); ok {
+		t.Errorf("Expected a parse error not to be a partial write")
+	}
+}
+
+func TestSessionLineProfileExpiry(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	s := Session{
+		SessionId:      sessionId,
+		LaunchTime:     time.UnixMilli(int64(launchTime)),
+		LaunchDuration: time.Duration(launchDuration * 1000000),
+		ClientIp:       "127.0.0.1:53450",
+	}
+	s.ProfileExpiry = s.LaunchTime.Add(s.LaunchDuration).Add(36 * time.Hour)
+	expected := `log-session,sessionId=testSession1 launchDuration=320010,clientIp="127.0.0.1:53450"` +
+		`,days_to_expiry=1.50 1716994039000`
+	if l := SessionLine(s, nil, logger); l != expected {
+		t.Errorf("SessionLine(%v): expected %q,\ngot %q", sessionId, expected, l)
+	}
+	format := &LineFormat{ExpiryRisk: 48 * time.Hour}
+	if l := SessionLine(s, format, logger); !strings.Contains(l, ",expiryRisk=true,sessionId=") {
+		t.Errorf("Expected an expiryRisk tag, got %q", l)
+	}
+	format.ExpiryRisk = 24 * time.Hour
+	if l := SessionLine(s, format, logger); strings.Contains(l, "expiryRisk") {
+		t.Errorf("Expected no expiryRisk tag, got %q", l)
+	}
+}
+
+func TestSessionLineLaunchKind(t *testing.T) {
+	logger := zaptest.NewLogger(t)
+	s := Session{SessionId: sessionId, LaunchKind: LaunchCold}
+	if l := SessionLine(s, &LineFormat{}, logger); strings.Contains(l, "launchKind") {
+		t.Errorf("Expected no launchKind tag, got %q", l)
+	}
+	format := &LineFormat{LaunchKind: true}
+	if l := SessionLine(s, format, logger); !strings.Contains(l, ",launchKind=cold,sessionId=") {
+		t.Errorf("Expected a launchKind tag, got %q", l)
+	}
+	s.LaunchKind = ""
+	if l := SessionLine(s, format, logger); strings.Contains(l, "launchKind") {
+		t.Errorf("Expected no launchKind tag on an unclassified session, got %q", l)
+	}
+}
+
+func TestFindRejected(t *testing.T) {
+	lines := []string{"a", "b", "bad1", "c", "d", "e", "bad2", "f"}
+	writes := 0
+	write := func(lines []string) error {
+		writes++
+		dropped := 0
+		for _, line := range lines {
+			if strings.HasPrefix(line, "bad") {
+				dropped++
+			}
+		}
+		if dropped == 0 {
+			return nil
+		}
+		return PartialWriteError{Status: 400, Lines: lines, Dropped: dropped,
+			Message: fmt.Sprintf("partial write: field type conflict dropped=%d", dropped)}
+	}
+	pw := PartialWriteError{Status: 400, Lines: lines, Dropped: 2, Message: "partial write: field type conflict dropped=2"}
+	found, err := FindRejected(pw, write)
+	if err != nil {
+		t.Fatalf("Failed to find rejected lines: %v", err)
+	}
+	if len(found.Rejected) != 2 || found.Rejected[2] != "partial write: field type conflict" || found.Rejected[6] == "" {
+		t.Errorf("Expected lines 2 and 6 to be rejected, got %q", found.Rejected)
+	}
+	if writes >= len(lines) {
+		t.Errorf("Expected fewer rewrites than lines, got %d", writes)
+	}
+	// a rewrite that fails for another reason is an error
+	_, err = FindRejected(pw, func([]string) error { return UploadError{Status: 503} })
+	if ue := (UploadError{}); !errors.As(err, &ue) || ue.Status != 503 {
+		t.Errorf("Expected the rewrite's error, got %v", err)
+	}
+	// rejections that are already identified aren't looked for
+	pw.Rejected = map[int]string{2: "field type conflict"}
+	if _, err := FindRejected(pw, func([]string) error { t.Errorf("Expected no rewrites"); return nil }); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
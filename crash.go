@@ -0,0 +1,41 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// processCrashed records an upload that made the parser panic.
+// Nothing parsed from it can be trusted, so nothing is sent.
+// Instead, the upload is counted, quarantined (if there is a
+// quarantine file) so the panic can be reproduced, reported, and
+// audited.
+func (m AdobeUsageTracker) processCrashed(up upload) {
+	logger := caddy.Log()
+	parser := m.Parser
+	if parser == "" {
+		parser = parserNGL
+	}
+	trackerMetrics.init.Do(initTrackerMetrics)
+	trackerMetrics.panics.WithLabelValues(m.Name, parser).Inc()
+	if m.quarantine != nil {
+		if err := m.quarantine.writeUpload(up, "parser panic: "+up.panic); err != nil {
+			logger.Error("AdobeUsageTracker: failed to quarantine upload", zap.Error(err))
+		}
+	}
+	m.reportError(parserPanicReport(up.body, up.panic, up.userAgent), logger)
+	m.writeAudit(auditRecord{
+		Timestamp:     up.received,
+		ClientAddress: up.remoteAddr,
+		Bytes:         len(up.body),
+		Outcome:       auditCrashed,
+		Error:         up.panic,
+	}, logger)
+}
@@ -0,0 +1,66 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"github.com/clickonetwo/tracker/core"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A panicReader panics the first time it is read, as a parser bug
+// would, and reads normally after that.
+type panicReader struct {
+	*strings.Reader
+	panicked bool
+}
+
+func (r *panicReader) Read(p []byte) (int, error) {
+	if !r.panicked {
+		r.panicked = true
+		panic("parser bug")
+	}
+	return r.Reader.Read(p)
+}
+
+func TestParserPanic(t *testing.T) {
+	dir := t.TempDir()
+	quarantine, err := openQuarantineLog(filepath.Join(dir, "quarantine.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open quarantine: %v", err)
+	}
+	audit, err := openAuditLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	m := AdobeUsageTracker{quarantine: quarantine, audit: audit}
+	up := upload{received: time.Now(), remoteAddr: "127.0.0.1:53450"}
+	r := &panicReader{Reader: strings.NewReader("a pathological log")}
+	if err := m.parseUpload(r, &up, core.NewLimits(0, 0, 0)); err != nil {
+		t.Errorf("Expected no read error after a panic, got %v", err)
+	}
+	if up.panic != "parser bug" || string(up.body) != "a pathological log" || up.sessions != nil {
+		t.Fatalf("Expected a panicked upload with its content, got %+v", up)
+	}
+	m.processUpload(up)
+	_ = quarantine.Close()
+	_ = audit.Close()
+
+	var q quarantineRecord
+	readOneRecord(t, filepath.Join(dir, "quarantine.jsonl"), &q)
+	if !bytes.Equal(q.Upload, up.body) || q.Reason != "parser panic: parser bug" || q.Line != "" {
+		t.Errorf("Unexpected quarantine record: %+v", q)
+	}
+	var a auditRecord
+	readOneRecord(t, filepath.Join(dir, "audit.jsonl"), &a)
+	if a.Outcome != auditCrashed || a.Bytes != len(up.body) || a.Error != "parser bug" {
+		t.Errorf("Unexpected audit record: %+v", a)
+	}
+}
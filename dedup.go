@@ -0,0 +1,347 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupHorizon  = 28 * 24 * time.Hour
+	defaultDedupCapacity = 1_000_000
+	defaultDedupFPRate   = 0.001
+	dedupGenerations     = 4
+	dedupSaveInterval    = time.Minute
+	dedupFileVersion     = 1
+)
+
+// DedupConfig configures the persistent store of the sessions
+// already written, which is used to drop sessions that clients
+// upload again, even weeks later.
+type DedupConfig struct {
+	// Path is the file the store is kept in.
+	Path string `json:"path"`
+	// Horizon is how long a session is remembered.  Defaults to
+	// 28 days.
+	Horizon caddy.Duration `json:"horizon,omitempty"`
+	// Capacity is the number of sessions expected in a horizon.
+	// Defaults to 1,000,000.
+	Capacity int `json:"capacity,omitempty"`
+	// FalsePositiveRate bounds the chance that a session not seen
+	// before is taken for one that was, while no more than Capacity
+	// sessions are seen in a horizon.  Defaults to 0.001.
+	FalsePositiveRate float64 `json:"false_positive_rate,omitempty"`
+}
+
+// The dedup registry holds the open dedup store for each path.
+// Like the rollup registry, it outlives any single configuration,
+// so that the store isn't reread from disk on every config reload.
+// A store is saved and closed when the last tracker using it is
+// cleaned up.
+var dedupRegistry = struct {
+	sync.Mutex
+	stores map[string]*dedupStore
+}{stores: make(map[string]*dedupStore)}
+
+// A dedupStore remembers the fingerprints of the sessions written
+// in the last horizon, in a sequence of Bloom filters that each
+// cover a part of the horizon.  Fingerprints are added to the newest
+// filter, and a filter is discarded once the horizon has passed
+// since it was replaced, so every fingerprint is remembered for at
+// least the horizon.  The store is saved to disk periodically, and
+// when it is closed.
+type dedupStore struct {
+	path string
+	refs int
+	stop chan struct{}
+	done sync.WaitGroup
+
+	mu         sync.Mutex
+	horizon    time.Duration
+	generation time.Duration
+	bits       int // the size of each new filter
+	hashes     int // the hash count of each new filter
+	filters    []dedupFilter
+	dirty      bool
+}
+
+// A dedupFilter is a Bloom filter holding the fingerprints added
+// between its start and its end.  The newest filter has no end.
+type dedupFilter struct {
+	Start  time.Time
+	End    time.Time
+	Hashes int
+	Bits   []uint64
+}
+
+// A dedupFile is the saved form of a dedupStore.
+type dedupFile struct {
+	Version int
+	Filters []dedupFilter
+}
+
+// acquireDedup returns the dedup store kept at the configured
+// path, opening it if necessary.  The horizon and filter sizes of
+// an open store are replaced by the given ones, so the newest
+// configuration wins; filters already made keep their own sizes
+// until they are discarded.
+func acquireDedup(cfg DedupConfig) (*dedupStore, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("a dedup store needs a path")
+	}
+	horizon := time.Duration(cfg.Horizon)
+	if horizon == 0 {
+		horizon = defaultDedupHorizon
+	}
+	capacity := cfg.Capacity
+	if capacity == 0 {
+		capacity = defaultDedupCapacity
+	}
+	rate := cfg.FalsePositiveRate
+	if rate == 0 {
+		rate = defaultDedupFPRate
+	}
+	if horizon < dedupGenerations*time.Minute {
+		return nil, fmt.Errorf("dedup horizon must be at least %s", dedupGenerations*time.Minute)
+	}
+	if capacity < 0 {
+		return nil, fmt.Errorf("dedup capacity must not be negative")
+	}
+	if rate <= 0 || rate >= 1 {
+		return nil, fmt.Errorf("dedup false positive rate must be between 0 and 1, not %v", rate)
+	}
+	// a fingerprint is checked against every filter, so each filter
+	// gets its share of the false positive rate.
+	bits, hashes := bloomSize(float64(capacity)/dedupGenerations, rate/(dedupGenerations+1))
+	dedupRegistry.Lock()
+	defer dedupRegistry.Unlock()
+	s, ok := dedupRegistry.stores[cfg.Path]
+	if !ok {
+		s = &dedupStore{path: cfg.Path, stop: make(chan struct{})}
+		filters, err := loadDedupFilters(cfg.Path)
+		if err != nil {
+			return nil, err
+		}
+		s.filters = filters
+		dedupRegistry.stores[cfg.Path] = s
+		s.run()
+	}
+	s.refs++
+	s.mu.Lock()
+	s.horizon, s.generation, s.bits, s.hashes = horizon, horizon/dedupGenerations, bits, hashes
+	s.mu.Unlock()
+	return s, nil
+}
+
+// bloomSize returns the number of bits (rounded up to a whole
+// number of words) and hash functions for a Bloom filter holding
+// n keys with the given false positive rate.
+func bloomSize(n float64, rate float64) (int, int) {
+	n = math.Max(n, 1)
+	bits := int(math.Ceil(-n * math.Log(rate) / (math.Ln2 * math.Ln2)))
+	bits = (bits + 63) / 64 * 64
+	hashes := int(math.Max(1, math.Round(float64(bits)/n*math.Ln2)))
+	return bits, hashes
+}
+
+// loadDedupFilters reads the filters saved at path, if any.
+func loadDedupFilters(path string) ([]dedupFilter, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open dedup store %q: %v", path, err)
+	}
+	defer func() { _ = f.Close() }()
+	var saved dedupFile
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return nil, fmt.Errorf("cannot read dedup store %q: %v", path, err)
+	}
+	if saved.Version != dedupFileVersion {
+		return nil, fmt.Errorf("dedup store %q has unknown version %d", path, saved.Version)
+	}
+	return saved.Filters, nil
+}
+
+// release gives up one tracker's use of the store.  When the last
+// use is given up, the store is saved and closed.
+func (s *dedupStore) release() {
+	dedupRegistry.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		delete(dedupRegistry.stores, s.path)
+	}
+	dedupRegistry.Unlock()
+	if last {
+		close(s.stop)
+		s.done.Wait()
+	}
+}
+
+// unseen returns the sessions whose fingerprints are not in the
+// store, and the number of sessions that were.
+func (s *dedupStore) unseen(sessions []core.Session, now time.Time) ([]core.Session, int) {
+	if s == nil {
+		return sessions, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(now)
+	kept := make([]core.Session, 0, len(sessions))
+	for _, session := range sessions {
+		h1, h2 := dedupHashes(core.Fingerprint(session))
+		seen := false
+		for _, f := range s.filters {
+			if f.has(h1, h2) {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			kept = append(kept, session)
+		}
+	}
+	return kept, len(sessions) - len(kept)
+}
+
+// remember adds the fingerprints of the given sessions to the store.
+func (s *dedupStore) remember(sessions []core.Session, now time.Time) {
+	if s == nil || len(sessions) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rotate(now)
+	newest := &s.filters[len(s.filters)-1]
+	for _, session := range sessions {
+		newest.add(dedupHashes(core.Fingerprint(session)))
+	}
+	s.dirty = true
+}
+
+// rotate starts a new filter if the newest one has covered a
+// generation, and discards the filters whose fingerprints have
+// been remembered for the horizon.
+func (s *dedupStore) rotate(now time.Time) {
+	n := len(s.filters)
+	if n == 0 || !now.Before(s.filters[n-1].Start.Add(s.generation)) {
+		if n > 0 {
+			s.filters[n-1].End = now
+		}
+		s.filters = append(s.filters, dedupFilter{Start: now, Hashes: s.hashes, Bits: make([]uint64, s.bits/64)})
+		s.dirty = true
+	}
+	for len(s.filters) > 1 && !now.Before(s.filters[0].End.Add(s.horizon)) {
+		s.filters = s.filters[1:]
+	}
+}
+
+// dedupHashes returns the two hashes of a fingerprint from which
+// the Bloom filter positions are derived.
+func dedupHashes(fingerprint string) (uint64, uint64) {
+	sum := sha256.Sum256([]byte(fingerprint))
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+// positions calls visit with each bit position of a key's hashes.
+func (f *dedupFilter) positions(h1 uint64, h2 uint64, visit func(word int, mask uint64) bool) {
+	size := uint64(len(f.Bits)) * 64
+	for i := 0; i < f.Hashes; i++ {
+		bit := (h1 + uint64(i)*h2) % size
+		if !visit(int(bit/64), uint64(1)<<(bit%64)) {
+			return
+		}
+	}
+}
+
+// add adds a key to the filter.
+func (f *dedupFilter) add(h1 uint64, h2 uint64) {
+	f.positions(h1, h2, func(word int, mask uint64) bool {
+		f.Bits[word] |= mask
+		return true
+	})
+}
+
+// has reports whether the filter may hold a key.
+func (f *dedupFilter) has(h1 uint64, h2 uint64) bool {
+	found := len(f.Bits) > 0
+	f.positions(h1, h2, func(word int, mask uint64) bool {
+		found = f.Bits[word]&mask != 0
+		return found
+	})
+	return found
+}
+
+// save writes the store to disk, if it has changed since it was
+// last saved.  The store is written to a temporary file that
+// replaces the old one, so a crash never leaves a partial store.
+func (s *dedupStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(dedupFile{Version: dedupFileVersion, Filters: s.filters})
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// run starts the store's background saves.
+func (s *dedupStore) run() {
+	s.done.Add(1)
+	go func() {
+		defer s.done.Done()
+		ticker := time.NewTicker(dedupSaveInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				s.logSave()
+				return
+			case <-ticker.C:
+				s.logSave()
+			}
+		}
+	}()
+}
+
+// logSave saves the store, logging any failure.
+func (s *dedupStore) logSave() {
+	if err := s.save(); err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to save dedup store",
+			zap.String("path", s.path), zap.Error(err))
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/clickonetwo/tracker/internal/influxtest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDedupStoreHorizon(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	horizon := 28 * 24 * time.Hour
+	s, err := acquireDedup(DedupConfig{Path: path, Horizon: caddy.Duration(horizon), Capacity: 1000})
+	if err != nil {
+		t.Fatalf("Failed to open dedup store: %v", err)
+	}
+	start := time.UnixMilli(1716994039000)
+	first := []core.Session{{SessionId: "a"}, {SessionId: "b"}}
+	s.remember(first, start)
+	kept, duplicates := s.unseen(append(first, core.Session{SessionId: "c"}), start.Add(time.Hour))
+	if len(kept) != 1 || kept[0].SessionId != "c" || duplicates != 2 {
+		t.Errorf("Expected only session c to be unseen, got %v", kept)
+	}
+	// a session is remembered for the whole horizon, even as
+	// later sessions are added to newer filters.
+	for day := 1; day < 28; day++ {
+		s.remember([]core.Session{{SessionId: fmt.Sprintf("day%d", day)}}, start.Add(time.Duration(day)*24*time.Hour))
+	}
+	if _, duplicates := s.unseen(first, start.Add(horizon-time.Hour)); duplicates != 2 {
+		t.Errorf("Expected sessions to be remembered within the horizon")
+	}
+	s.release()
+
+	// the store survives a restart
+	s, err = acquireDedup(DedupConfig{Path: path, Horizon: caddy.Duration(horizon), Capacity: 1000})
+	if err != nil {
+		t.Fatalf("Failed to reopen dedup store: %v", err)
+	}
+	defer s.release()
+	if _, duplicates := s.unseen(first, start.Add(horizon-time.Hour)); duplicates != 2 {
+		t.Errorf("Expected sessions to be remembered after a restart")
+	}
+	if _, duplicates := s.unseen(first, start.Add(2*horizon)); duplicates != 0 {
+		t.Errorf("Expected sessions to be forgotten after the horizon")
+	}
+}
+
+func TestDedupReplayFromNewConnection(t *testing.T) {
+	server := influxtest.NewServer(1, "secret")
+	defer server.Close()
+	path := filepath.Join(t.TempDir(), "dedup.db")
+	m := newIntegrationTracker(t, server, "dedup_store "+path)
+	uploadFileFrom(t, m, "testdata/indesign-multi-session-1-2.txt", "10.0.0.1:5000")
+	if written := len(server.Lines()); written != 2 {
+		t.Fatalf("Expected 2 sessions written, got %d", written)
+	}
+	// a relay's retry arrives on a new connection, from a new port
+	uploadFileFrom(t, m, "testdata/indesign-multi-session-1-2.txt", "10.0.0.1:5001")
+	if lines := server.Lines(); len(lines) != 2 {
+		t.Errorf("Expected the replayed sessions to be dropped, got %v", lines)
+	}
+}
+
+func TestDedupStoreFalsePositives(t *testing.T) {
+	const capacity, rate = 20000, 0.01
+	s, err := acquireDedup(DedupConfig{Path: filepath.Join(t.TempDir(), "dedup.db"), Capacity: capacity, FalsePositiveRate: rate})
+	if err != nil {
+		t.Fatalf("Failed to open dedup store: %v", err)
+	}
+	defer s.release()
+	now := time.Now()
+	sessions := make([]core.Session, capacity/dedupGenerations)
+	for i := range sessions {
+		sessions[i] = core.Session{SessionId: fmt.Sprintf("seen%d", i)}
+	}
+	s.remember(sessions, now)
+	for i := range sessions {
+		sessions[i] = core.Session{SessionId: fmt.Sprintf("unseen%d", i)}
+	}
+	_, duplicates := s.unseen(sessions, now)
+	if observed := float64(duplicates) / float64(len(sessions)); observed > rate {
+		t.Errorf("Expected a false positive rate below %v, got %v", rate, observed)
+	}
+}
+
+func TestDedupStoreErrors(t *testing.T) {
+	for _, cfg := range []DedupConfig{
+		{},
+		{Path: "dedup.db", Horizon: caddy.Duration(time.Minute)},
+		{Path: "dedup.db", FalsePositiveRate: 1.5},
+	} {
+		if _, err := acquireDedup(cfg); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
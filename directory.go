@@ -0,0 +1,221 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for directory lookups.
+const (
+	defaultDirectoryMatch    = "externalId"
+	defaultDirectoryCacheTTL = time.Hour
+	directoryErrorTTL        = time.Minute
+)
+
+// DirectoryConfig configures the enrichment of sessions with
+// attributes of their users, such as department or cost center,
+// looked up in a SCIM 2.0 directory.  Users are looked up by the
+// user ID in the session (a hash of their Adobe ID), unless an
+// Identity is given, in which case they are looked up by the value
+// of that placeholder (e.g., `{http.auth.user.email}`) on the request.
+type DirectoryConfig struct {
+	// URL is the base URL of the SCIM service, such as
+	// https://directory.mydomain.com/scim/v2.
+	URL string `json:"url"`
+	// Token is a bearer token for the SCIM service.
+	Token string `json:"token,omitempty"`
+	// Match is the SCIM user attribute that is matched against
+	// the identity.  Defaults to externalId.
+	Match string `json:"match,omitempty"`
+	// Identity is a placeholder for the identity to look up.
+	Identity string `json:"identity,omitempty"`
+	// Tags maps the names of tags to add to sessions to the SCIM
+	// attributes that supply their values, such as `title`,
+	// `name.familyName`, or (for an extension attribute)
+	// `urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department`.
+	Tags map[string]string `json:"tags"`
+	// CacheTTL is how long lookup results are cached.  Defaults to 1 hour.
+	CacheTTL caddy.Duration `json:"cache_ttl,omitempty"`
+}
+
+// A directory looks up user attributes in a SCIM directory,
+// caching the results.  Expired results are swept from the cache
+// as new ones are added, so it holds only the users seen within
+// the last cache TTL, however many users pass through.
+type directory struct {
+	config DirectoryConfig
+	ttl    time.Duration
+	now    func() time.Time
+	tags   *tagPolicy // decides conflicts with tags from other sources
+
+	mu    sync.Mutex
+	cache map[string]directoryEntry
+	sweep time.Time // when expired results are next swept
+}
+
+// A directoryEntry is a cached lookup result.
+type directoryEntry struct {
+	tags    map[string]string
+	expires time.Time
+}
+
+// newDirectory checks a directory configuration and returns
+// a directory for it.
+func newDirectory(config DirectoryConfig) (*directory, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a valid directory URL", config.URL)
+	}
+	if len(config.Tags) == 0 {
+		return nil, fmt.Errorf("at least one directory tag must be specified")
+	}
+	if config.Match == "" {
+		config.Match = defaultDirectoryMatch
+	}
+	d := &directory{config: config, ttl: time.Duration(config.CacheTTL), now: time.Now}
+	if d.ttl <= 0 {
+		d.ttl = defaultDirectoryCacheTTL
+	}
+	d.cache = make(map[string]directoryEntry)
+	return d, nil
+}
+
+// enrich adds the directory tags of each session's user.  The
+// identity, if not empty, is used in place of each session's user ID.
+func (d *directory) enrich(sessions []core.Session, identity string, logger *zap.Logger) {
+	if d == nil {
+		return
+	}
+	for i := range sessions {
+		key := identity
+		if key == "" {
+			key = sessions[i].UserId
+		}
+		if key == "" {
+			continue
+		}
+		tags, err := d.lookup(key)
+		if err != nil {
+			logger.Error("AdobeUsageTracker: directory lookup failed", zap.Error(err))
+		}
+		sessions[i] = d.tags.merge(sessions[i], tags, tagSourceDirectory, logger)
+	}
+}
+
+// lookup returns the tags for the user with the given identity,
+// from the cache if possible.  Failed lookups are cached briefly,
+// so a directory outage doesn't slow every upload.
+func (d *directory) lookup(identity string) (map[string]string, error) {
+	d.mu.Lock()
+	entry, ok := d.cache[identity]
+	d.mu.Unlock()
+	if ok && d.now().Before(entry.expires) {
+		return entry.tags, nil
+	}
+	tags, err := d.query(identity)
+	ttl := d.ttl
+	if err != nil {
+		ttl = directoryErrorTTL
+	}
+	d.mu.Lock()
+	d.store(identity, directoryEntry{tags: tags, expires: d.now().Add(ttl)})
+	d.mu.Unlock()
+	return tags, err
+}
+
+// store caches a lookup result, first sweeping out the expired
+// ones if it's time to.  Sweeps are at most a minute apart, so
+// their cost is spread over all the lookups in between.
+// The caller must hold the directory's lock.
+func (d *directory) store(identity string, entry directoryEntry) {
+	now := d.now()
+	if !now.Before(d.sweep) {
+		for key, cached := range d.cache {
+			if !now.Before(cached.expires) {
+				delete(d.cache, key)
+			}
+		}
+		d.sweep = now.Add(directoryErrorTTL)
+	}
+	d.cache[identity] = entry
+}
+
+// query fetches the tags for the user with the given identity
+// from the directory.  A user who isn't found has no tags.
+func (d *directory) query(identity string) (map[string]string, error) {
+	filter := fmt.Sprintf("%s eq %q", d.config.Match, identity)
+	target := strings.TrimSuffix(d.config.URL, "/") + "/Users?filter=" + url.QueryEscape(filter)
+	req, err := http.NewRequest("GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/scim+json")
+	if d.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.config.Token)
+	}
+	res, err := reportClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("directory status code: %d", res.StatusCode)
+	}
+	var result struct {
+		Resources []map[string]any `json:"Resources"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("directory response invalid: %v", err)
+	}
+	if len(result.Resources) == 0 {
+		return nil, nil
+	}
+	tags := make(map[string]string)
+	for tag, attr := range d.config.Tags {
+		if value := scimAttribute(result.Resources[0], attr); value != "" {
+			tags[tag] = value
+		}
+	}
+	return tags, nil
+}
+
+// scimAttribute returns the string value of an attribute of a
+// SCIM resource.  Extension attributes are given by their schema
+// URN followed by a colon and the attribute name, and sub-attributes
+// follow their attribute after a dot.
+func scimAttribute(resource map[string]any, attr string) string {
+	var current any = resource
+	if strings.HasPrefix(attr, "urn:") {
+		i := strings.LastIndex(attr, ":")
+		current, attr = resource[attr[:i]], attr[i+1:]
+	}
+	for _, name := range strings.Split(attr, ".") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return ""
+		}
+		current = m[name]
+	}
+	switch value := current.(type) {
+	case string:
+		return value
+	case float64, bool:
+		return fmt.Sprint(value)
+	}
+	return ""
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const scimUser = `{
+	"schemas": ["urn:ietf:params:scim:api:messages:2.0:ListResponse"],
+	"totalResults": 1,
+	"Resources": [{
+		"id": "2819c223",
+		"externalId": "9e5fa",
+		"title": "Designer",
+		"name": {"familyName": "Jensen"},
+		"urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {
+			"department": "Marketing",
+			"costCenter": "4130"
+		}
+	}]
+}`
+
+func TestDirectoryEnrichment(t *testing.T) {
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query().Get("filter"))
+		if r.Header.Get("Authorization") != "Bearer scim-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/scim+json")
+		if r.URL.Query().Get("filter") == `externalId eq "9e5fa"` {
+			_, _ = w.Write([]byte(scimUser))
+		} else {
+			_, _ = w.Write([]byte(`{"totalResults": 0, "Resources": []}`))
+		}
+	}))
+	defer server.Close()
+	dir, err := newDirectory(DirectoryConfig{
+		URL:   server.URL + "/scim/v2/",
+		Token: "scim-token",
+		Tags: map[string]string{
+			"department": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department",
+			"costCenter": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:costCenter",
+			"title":      "title",
+			"surname":    "name.familyName",
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	sessions := []core.Session{{SessionId: "a", UserId: "9e5fa"}, {SessionId: "b", UserId: "9e5fa"}, {SessionId: "c", UserId: "other"}}
+	dir.enrich(sessions, "", zap.NewNop())
+	tags := sessions[0].Tags
+	if tags["department"] != "Marketing" || tags["costCenter"] != "4130" || tags["title"] != "Designer" || tags["surname"] != "Jensen" {
+		t.Errorf("Unexpected Tags: %v", tags)
+	}
+	if sessions[1].Tags["department"] != "Marketing" || sessions[2].Tags != nil {
+		t.Errorf("Unexpected tags for other sessions: %v, %v", sessions[1].Tags, sessions[2].Tags)
+	}
+	if len(queries) != 2 {
+		t.Errorf("Expected lookups to be cached, got queries %v", queries)
+	}
+	now := time.Now().Add(2 * time.Hour)
+	dir.now = func() time.Time { return now }
+	dir.enrich([]core.Session{{UserId: "9e5fa"}}, "", zap.NewNop())
+	if len(queries) != 3 {
+		t.Errorf("Expected an expired lookup to be repeated, got queries %v", queries)
+	}
+	if _, ok := dir.cache["other"]; ok || len(dir.cache) != 1 {
+		t.Errorf("Expected expired lookups to be swept, got cache %v", dir.cache)
+	}
+}
+
+func TestDirectoryIdentity(t *testing.T) {
+	var filter string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filter = r.URL.Query().Get("filter")
+		_, _ = w.Write([]byte(scimUser))
+	}))
+	defer server.Close()
+	dir, err := newDirectory(DirectoryConfig{URL: server.URL, Match: "emails.value", Tags: map[string]string{"title": "title"}})
+	if err != nil {
+		t.Fatalf("Failed to create directory: %v", err)
+	}
+	sessions := []core.Session{{UserId: "9e5fa"}}
+	dir.enrich(sessions, "bjensen@example.com", zap.NewNop())
+	if filter != `emails.value eq "bjensen@example.com"` || sessions[0].Tags["title"] != "Designer" {
+		t.Errorf("Unexpected lookup %q with tags %v", filter, sessions[0].Tags)
+	}
+}
@@ -0,0 +1,845 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	caddy.RegisterModule(StaticEnricher{})
+	caddy.RegisterModule(SubnetEnricher{})
+	caddy.RegisterModule(GeoEnricher{})
+	caddy.RegisterModule(HashEnricher{})
+	caddy.RegisterModule(RenameEnricher{})
+	caddy.RegisterModule(TenantEnricher{})
+}
+
+// enricherNamespace is the Caddy module namespace of enrichers.
+const enricherNamespace = "tracker.enrichers"
+
+// An Enricher is a step in a tracker's enrichment pipeline.  The
+// pipeline runs on the sessions parsed from each upload, after the
+// target tags and directory enrichment and before any filters, with
+// each enricher given the sessions returned by the one before.
+// Enrichers are Caddy modules in the tracker.enrichers namespace, so
+// third parties can add their own by registering a module there.
+//
+// Enrich returns the enriched sessions.  It must not change the
+// given sessions' Tags or Fields maps, which may be shared, so an
+// enricher that adds tags should replace the map rather than add to
+// it.  Enrich may be called concurrently.
+type Enricher interface {
+	Enrich(sessions []core.Session, logger *zap.Logger) []core.Session
+}
+
+// enrich runs the sessions through the enrichment pipeline.
+func (m AdobeUsageTracker) enrich(sessions []core.Session, logger *zap.Logger) []core.Session {
+	for _, e := range m.enrichers {
+		sessions = e.Enrich(sessions, logger)
+	}
+	return sessions
+}
+
+// loadEnrichers loads and provisions the enrichment pipeline.  The
+// tags added by the built-in enrichers are merged with those from
+// other sources by the tracker's tag policy.
+//
+// Each enricher is loaded by its module ID, rather than by
+// ctx.LoadModule, because LoadModule recognizes a json.RawMessage
+// field by the package path and name of its type.  When Go is built
+// with the jsonv2 experiment (as Go 1.27 is by default), that type
+// is jsontext.Value, of which json.RawMessage is an alias, so
+// LoadModule doesn't recognize the EnrichersRaw field at all.
+func (m *AdobeUsageTracker) loadEnrichers(ctx caddy.Context) error {
+	m.enrichers = nil
+	for i, raw := range m.EnrichersRaw {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return fmt.Errorf("enricher %d: %v", i, err)
+		}
+		var name string
+		if err := json.Unmarshal(fields["enricher"], &name); err != nil || name == "" {
+			return fmt.Errorf("enricher %d has no enricher name", i)
+		}
+		delete(fields, "enricher")
+		config, err := json.Marshal(fields)
+		if err != nil {
+			return fmt.Errorf("enricher %d: %v", i, err)
+		}
+		mod, err := ctx.LoadModuleByID(enricherNamespace+"."+name, config)
+		if err != nil {
+			return fmt.Errorf("loading enricher %s: %v", name, err)
+		}
+		enricher, ok := mod.(Enricher)
+		if !ok {
+			return fmt.Errorf("module %s is not an enricher", name)
+		}
+		if tagger, ok := enricher.(taggingEnricher); ok {
+			tagger.useTagPolicy(m.tags)
+			for _, name := range m.tags.own(tagSourceEnrichers, tagger.tagNames()...) {
+				caddy.Log().Warn("AdobeUsageTracker: tag is added by more than one source",
+					zap.String("tag", name), zap.String("winner", m.tags.holder(name, "")))
+			}
+		}
+		m.enrichers = append(m.enrichers, enricher)
+	}
+	return nil
+}
+
+// A taggingEnricher is a built-in enricher that adds tags.  Its
+// tags are added through the tracker's tag policy, which needs to
+// know their names.
+type taggingEnricher interface {
+	useTagPolicy(p *tagPolicy)
+	tagNames() []string
+}
+
+// enricherTags is embedded in the built-in enrichers that add tags.
+type enricherTags struct {
+	tags *tagPolicy
+}
+
+func (e *enricherTags) useTagPolicy(p *tagPolicy) {
+	e.tags = p
+}
+
+// addTags returns a session with the given tags merged into its tags.
+func (e *enricherTags) addTags(s core.Session, extra map[string]string, logger *zap.Logger) core.Session {
+	return e.tags.merge(s, extra, tagSourceEnrichers, logger)
+}
+
+// unmarshalEnrichers parses an enrichers block of the form:
+//
+//	enrichers {
+//	    <name> [<args>...] [{
+//	        ...
+//	    }]
+//	}
+//
+// where each line names a module in the tracker.enrichers namespace,
+// which parses its own arguments and block.  The enrichers are added
+// after any already configured.
+func (m *AdobeUsageTracker) unmarshalEnrichers(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		unm, err := caddyfile.UnmarshalModule(d, enricherNamespace+"."+name)
+		if err != nil {
+			return err
+		}
+		var warnings []caddyconfig.Warning
+		raw := caddyconfig.JSONModuleObject(unm, "enricher", name, &warnings)
+		if len(warnings) > 0 {
+			return d.Errf("cannot encode enricher %s: %s", name, warnings[0].Message)
+		}
+		m.EnrichersRaw = append(m.EnrichersRaw, raw)
+	}
+	return nil
+}
+
+// checkTagNames checks that none of the given tag names are
+// written as part of every session.
+func checkTagNames(names ...string) error {
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("tag names cannot be empty")
+		}
+		if core.IsReservedKey(name) {
+			return fmt.Errorf("tag name %q is reserved", name)
+		}
+	}
+	return nil
+}
+
+// StaticEnricher tags every session with the same tags.
+type StaticEnricher struct {
+	// Tags are the tag names and values.
+	Tags map[string]string `json:"tags,omitempty"`
+
+	enricherTags
+}
+
+// CaddyModule returns the Caddy module information.
+func (StaticEnricher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  enricherNamespace + ".static",
+		New: func() caddy.Module { return new(StaticEnricher) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (e *StaticEnricher) Provision(caddy.Context) error {
+	for name, value := range e.Tags {
+		if err := checkTagNames(name); err != nil {
+			return err
+		}
+		if value == "" {
+			return fmt.Errorf("tag %q has no value", name)
+		}
+	}
+	return nil
+}
+
+func (e *StaticEnricher) tagNames() []string {
+	names := make([]string, 0, len(e.Tags))
+	for name := range e.Tags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Enrich implements Enricher.
+func (e *StaticEnricher) Enrich(sessions []core.Session, logger *zap.Logger) []core.Session {
+	enriched := make([]core.Session, len(sessions))
+	for i, s := range sessions {
+		enriched[i] = e.addTags(s, e.Tags, logger)
+	}
+	return enriched
+}
+
+// UnmarshalCaddyfile parses a static enricher of the form:
+//
+//	static {
+//	    <name> <value>
+//	}
+func (e *StaticEnricher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the enricher name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	e.Tags = make(map[string]string)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		name := d.Val()
+		var value string
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		e.Tags[name] = value
+	}
+	return nil
+}
+
+// A prefixTable maps IP address prefixes to values, and looks up
+// the value of the longest prefix containing an address.
+type prefixTable struct {
+	lengths  []int // in decreasing order
+	prefixes map[netip.Prefix][]string
+}
+
+// add maps a prefix, given in CIDR notation, to values.
+func (t *prefixTable) add(cidr string, values ...string) error {
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return fmt.Errorf("invalid network %q: %v", cidr, err)
+	}
+	prefix = prefix.Masked()
+	if t.prefixes == nil {
+		t.prefixes = make(map[netip.Prefix][]string)
+	}
+	if _, ok := t.prefixes[prefix]; !ok {
+		bits := prefix.Bits()
+		if prefix.Addr().Is4() {
+			bits += 96 // lookups use IPv4-mapped IPv6 addresses
+		}
+		i := sort.Search(len(t.lengths), func(i int) bool { return t.lengths[i] <= bits })
+		if i == len(t.lengths) || t.lengths[i] != bits {
+			t.lengths = append(t.lengths[:i], append([]int{bits}, t.lengths[i:]...)...)
+		}
+	}
+	t.prefixes[prefix] = values
+	return nil
+}
+
+// lookup returns the values of the longest prefix containing the
+// host part of a client address, or nil if there is none.
+func (t *prefixTable) lookup(clientIp string) []string {
+	addr, err := netip.ParseAddr(sessionMachine(core.Session{ClientIp: clientIp}))
+	if err != nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	mapped := netip.AddrFrom16(addr.As16())
+	for _, bits := range t.lengths {
+		var prefix netip.Prefix
+		if addr.Is4() && bits >= 96 {
+			prefix, _ = addr.Prefix(bits - 96)
+		} else {
+			prefix, _ = mapped.Prefix(bits)
+		}
+		if values, ok := t.prefixes[prefix]; ok {
+			return values
+		}
+	}
+	return nil
+}
+
+// SubnetEnricher tags each session with a value chosen by the
+// network its client address is in, such as a site or department.
+type SubnetEnricher struct {
+	// Tag is the name of the tag.
+	Tag string `json:"tag"`
+	// Subnets maps networks, in CIDR notation, to tag values.  A
+	// session is tagged with the value of the most specific network
+	// containing its client address, and not tagged if there is none.
+	Subnets map[string]string `json:"subnets,omitempty"`
+	// File is a YAML or JSON mapping file of more networks, which
+	// is reloaded whenever it changes.  Its networks take precedence
+	// over the same networks in Subnets.
+	File string `json:"file,omitempty"`
+
+	table *atomic.Pointer[prefixTable]
+	file  *mappingFile
+	enricherTags
+}
+
+// CaddyModule returns the Caddy module information.
+func (SubnetEnricher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  enricherNamespace + ".subnet",
+		New: func() caddy.Module { return new(SubnetEnricher) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (e *SubnetEnricher) Provision(caddy.Context) error {
+	if err := checkTagNames(e.Tag); err != nil {
+		return err
+	}
+	e.table = new(atomic.Pointer[prefixTable])
+	if e.File == "" {
+		return e.load(nil)
+	}
+	file, err := watchMappingFile(e.File, e.load)
+	if err != nil {
+		return err
+	}
+	e.file = file
+	return nil
+}
+
+// load builds the enricher's table from its subnets and those
+// in its mapping file, and swaps it in.  Every network must have a
+// value, since Influx rejects points with empty tag values.
+func (e *SubnetEnricher) load(mappings map[string]string) error {
+	table := &prefixTable{}
+	for _, subnets := range []map[string]string{e.Subnets, mappings} {
+		for cidr, value := range subnets {
+			if value == "" {
+				return fmt.Errorf("network %q has no %s value", cidr, e.Tag)
+			}
+			if err := table.add(cidr, value); err != nil {
+				return err
+			}
+		}
+	}
+	e.table.Store(table)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (e *SubnetEnricher) Cleanup() error {
+	e.file.close()
+	return nil
+}
+
+func (e *SubnetEnricher) tagNames() []string {
+	return []string{e.Tag}
+}
+
+// Enrich implements Enricher.
+func (e *SubnetEnricher) Enrich(sessions []core.Session, logger *zap.Logger) []core.Session {
+	table := e.table.Load()
+	enriched := make([]core.Session, len(sessions))
+	for i, s := range sessions {
+		if values := table.lookup(s.ClientIp); values != nil {
+			s = e.addTags(s, map[string]string{e.Tag: values[0]}, logger)
+		}
+		enriched[i] = s
+	}
+	return enriched
+}
+
+// UnmarshalCaddyfile parses a subnet enricher of the form:
+//
+//	subnet <tag> {
+//	    file <path>
+//	    <network> <value>
+//	}
+func (e *SubnetEnricher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the enricher name
+	if !d.Args(&e.Tag) || d.NextArg() {
+		return d.ArgErr()
+	}
+	e.Subnets = make(map[string]string)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		network := d.Val()
+		var value string
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		if network == "file" {
+			e.File = value
+			continue
+		}
+		e.Subnets[network] = value
+	}
+	return nil
+}
+
+// The tags added by the geo enricher.
+const (
+	geoCountryTag = "country"
+	geoRegionTag  = "region"
+)
+
+// GeoEnricher tags each session with the country (and, if known,
+// region) of its client address, as given by a CSV file of networks.
+type GeoEnricher struct {
+	// File is the CSV file of networks.  Each record gives a
+	// network in CIDR notation, a country code, and optionally a
+	// region.  A header record starting with "network" is skipped.
+	File string `json:"file"`
+
+	table prefixTable
+	enricherTags
+}
+
+// CaddyModule returns the Caddy module information.
+func (GeoEnricher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  enricherNamespace + ".geo",
+		New: func() caddy.Module { return new(GeoEnricher) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (e *GeoEnricher) Provision(caddy.Context) error {
+	if e.File == "" {
+		return fmt.Errorf("the geo enricher needs a file of networks")
+	}
+	f, err := os.Open(e.File)
+	if err != nil {
+		return fmt.Errorf("cannot open geo file: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	e.table = prefixTable{}
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	for {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read geo file: %v", err)
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) < 2 || len(record) > 3 {
+			return fmt.Errorf("%s:%d: expected a network, a country, and an optional region", e.File, line)
+		}
+		if strings.EqualFold(record[0], "network") {
+			continue
+		}
+		if err := e.table.add(record[0], record[1:]...); err != nil {
+			return fmt.Errorf("%s:%d: %v", e.File, line, err)
+		}
+	}
+	return nil
+}
+
+func (e *GeoEnricher) tagNames() []string {
+	return []string{geoCountryTag, geoRegionTag}
+}
+
+// Enrich implements Enricher.
+func (e *GeoEnricher) Enrich(sessions []core.Session, logger *zap.Logger) []core.Session {
+	enriched := make([]core.Session, len(sessions))
+	for i, s := range sessions {
+		values := e.table.lookup(s.ClientIp)
+		if len(values) > 0 && values[0] != "" {
+			tags := map[string]string{geoCountryTag: values[0]}
+			if len(values) > 1 && values[1] != "" {
+				tags[geoRegionTag] = values[1]
+			}
+			s = e.addTags(s, tags, logger)
+		}
+		enriched[i] = s
+	}
+	return enriched
+}
+
+// UnmarshalCaddyfile parses a geo enricher of the form:
+//
+//	geo <file>
+func (e *GeoEnricher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the enricher name
+	if !d.Args(&e.File) || d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+// HashEnricher hashes the user ID and client IP of each session, as
+// the anonymize option does, but at its place in the pipeline, so
+// that later enrichers, filters, and transforms see only the hashes.
+type HashEnricher struct {
+	AnonymizeConfig
+
+	anonymizer *anonymizer
+}
+
+// CaddyModule returns the Caddy module information.
+func (HashEnricher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  enricherNamespace + ".hash",
+		New: func() caddy.Module { return new(HashEnricher) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (e *HashEnricher) Provision(caddy.Context) error {
+	anonymizer, err := newAnonymizer(e.AnonymizeConfig)
+	if err != nil {
+		return err
+	}
+	e.anonymizer = anonymizer
+	return nil
+}
+
+// Enrich implements Enricher.
+func (e *HashEnricher) Enrich(sessions []core.Session, _ *zap.Logger) []core.Session {
+	return e.anonymizer.apply(sessions, time.Now())
+}
+
+// UnmarshalCaddyfile parses a hash enricher, which takes the same
+// block as the anonymize option.
+func (e *HashEnricher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the enricher name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return unmarshalAnonymizeBlock(d, &e.AnonymizeConfig)
+}
+
+// RenameEnricher renames the tags and fields that sessions were
+// given earlier, such as by a directory, an extraction, or another
+// enricher, so that their names match a site's schema.
+type RenameEnricher struct {
+	// Names maps old tag and field names to new ones.
+	Names map[string]string `json:"names,omitempty"`
+	// File is a YAML or JSON mapping file of more names, which is
+	// reloaded whenever it changes.  Its names take precedence over
+	// the same names in Names.
+	File string `json:"file,omitempty"`
+
+	names *atomic.Pointer[map[string]string]
+	file  *mappingFile
+}
+
+// CaddyModule returns the Caddy module information.
+func (RenameEnricher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  enricherNamespace + ".rename",
+		New: func() caddy.Module { return new(RenameEnricher) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (e *RenameEnricher) Provision(caddy.Context) error {
+	e.names = new(atomic.Pointer[map[string]string])
+	if e.File == "" {
+		return e.load(nil)
+	}
+	file, err := watchMappingFile(e.File, e.load)
+	if err != nil {
+		return err
+	}
+	e.file = file
+	return nil
+}
+
+// load merges the enricher's names with those in its mapping file,
+// checks them, and swaps them in.  No two names can be renamed to
+// the same name, since which value won would be a matter of chance.
+func (e *RenameEnricher) load(mappings map[string]string) error {
+	names := make(map[string]string, len(e.Names)+len(mappings))
+	for _, m := range []map[string]string{e.Names, mappings} {
+		for from, to := range m {
+			names[from] = to
+		}
+	}
+	renamed := make(map[string]string, len(names))
+	for from, to := range names {
+		if err := checkTagNames(from, to); err != nil {
+			return err
+		}
+		if other, ok := renamed[to]; ok {
+			return fmt.Errorf("both %q and %q are renamed to %q", other, from, to)
+		}
+		renamed[to] = from
+	}
+	e.names.Store(&names)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (e *RenameEnricher) Cleanup() error {
+	e.file.close()
+	return nil
+}
+
+// Enrich implements Enricher.  A renamed tag or field replaces
+// any of the same name that the session already has.
+func (e *RenameEnricher) Enrich(sessions []core.Session, _ *zap.Logger) []core.Session {
+	names := *e.names.Load()
+	enriched := make([]core.Session, len(sessions))
+	for i, s := range sessions {
+		s.Tags = renameKeys(s.Tags, names)
+		s.Fields = renameKeys(s.Fields, names)
+		enriched[i] = s
+	}
+	return enriched
+}
+
+// renameKeys returns m with its keys renamed, or m itself
+// if none of them are.
+func renameKeys(m map[string]string, names map[string]string) map[string]string {
+	renamed := false
+	for key := range m {
+		if _, ok := names[key]; ok {
+			renamed = true
+			break
+		}
+	}
+	if !renamed {
+		return m
+	}
+	result := make(map[string]string, len(m))
+	for key, value := range m {
+		if _, ok := names[key]; !ok {
+			result[key] = value
+		}
+	}
+	for key, value := range m {
+		if to, ok := names[key]; ok {
+			result[to] = value
+		}
+	}
+	return result
+}
+
+// UnmarshalCaddyfile parses a rename enricher of the form:
+//
+//	rename {
+//	    file <path>
+//	    <old name> <new name>
+//	}
+func (e *RenameEnricher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the enricher name
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	e.Names = make(map[string]string)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		from := d.Val()
+		var to string
+		if !d.Args(&to) || d.NextArg() {
+			return d.ArgErr()
+		}
+		if from == "file" {
+			e.File = to
+			continue
+		}
+		e.Names[from] = to
+	}
+	return nil
+}
+
+// tenantTag is the tag added by the tenant enricher.
+const tenantTag = "tenant"
+
+// TenantEnricher tags each session with the tenant it belongs to,
+// chosen by a routing table from the value of one of its attributes
+// or tags, such as its targetHost or a department from a directory.
+// Measurement templates, filters, and later enrichers can then use
+// the tenant tag to keep tenants' data apart.
+type TenantEnricher struct {
+	// By is the session attribute (such as appId) or tag (such as
+	// targetHost) whose value routes the session.
+	By string `json:"by"`
+	// Routes maps values of By to tenants.
+	Routes map[string]string `json:"routes,omitempty"`
+	// File is a YAML or JSON mapping file of more routes, which is
+	// reloaded whenever it changes.  Its routes take precedence over
+	// the same routes in Routes.
+	File string `json:"file,omitempty"`
+	// Default is the tenant of sessions with no route.  If it's
+	// empty, those sessions aren't tagged.
+	Default string `json:"default,omitempty"`
+
+	value  func(s core.Session) string
+	routes *atomic.Pointer[map[string]string]
+	file   *mappingFile
+	enricherTags
+}
+
+// CaddyModule returns the Caddy module information.
+func (TenantEnricher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  enricherNamespace + ".tenant",
+		New: func() caddy.Module { return new(TenantEnricher) },
+	}
+}
+
+// Provision implements caddy.Provisioner.
+func (e *TenantEnricher) Provision(caddy.Context) error {
+	if err := checkTagNames(tenantTag); err != nil {
+		return err
+	}
+	if e.By == "" {
+		return fmt.Errorf("the tenant enricher needs an attribute or tag to route by")
+	}
+	if attr, ok := core.SessionAttributes[e.By]; ok {
+		e.value = attr
+	} else {
+		e.value = func(s core.Session) string { return s.Tags[e.By] }
+	}
+	e.routes = new(atomic.Pointer[map[string]string])
+	if e.File == "" {
+		return e.load(nil)
+	}
+	file, err := watchMappingFile(e.File, e.load)
+	if err != nil {
+		return err
+	}
+	e.file = file
+	return nil
+}
+
+// load merges the enricher's routes with those in its mapping
+// file and swaps them in.
+func (e *TenantEnricher) load(mappings map[string]string) error {
+	routes := make(map[string]string, len(e.Routes)+len(mappings))
+	for _, m := range []map[string]string{e.Routes, mappings} {
+		for value, tenant := range m {
+			if tenant == "" {
+				return fmt.Errorf("the route for %q has no tenant", value)
+			}
+			routes[value] = tenant
+		}
+	}
+	e.routes.Store(&routes)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (e *TenantEnricher) Cleanup() error {
+	e.file.close()
+	return nil
+}
+
+func (e *TenantEnricher) tagNames() []string {
+	return []string{tenantTag}
+}
+
+// Enrich implements Enricher.
+func (e *TenantEnricher) Enrich(sessions []core.Session, logger *zap.Logger) []core.Session {
+	routes := *e.routes.Load()
+	enriched := make([]core.Session, len(sessions))
+	for i, s := range sessions {
+		tenant, ok := routes[e.value(s)]
+		if !ok {
+			tenant = e.Default
+		}
+		if tenant != "" {
+			s = e.addTags(s, map[string]string{tenantTag: tenant}, logger)
+		}
+		enriched[i] = s
+	}
+	return enriched
+}
+
+// UnmarshalCaddyfile parses a tenant enricher of the form:
+//
+//	tenant <attribute or tag> {
+//	    file <path>
+//	    default <tenant>
+//	    <value> <tenant>
+//	}
+func (e *TenantEnricher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume the enricher name
+	if !d.Args(&e.By) || d.NextArg() {
+		return d.ArgErr()
+	}
+	e.Routes = make(map[string]string)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		key := d.Val()
+		var value string
+		if !d.Args(&value) || d.NextArg() {
+			return d.ArgErr()
+		}
+		switch key {
+		case "file":
+			e.File = value
+		case "default":
+			e.Default = value
+		default:
+			e.Routes[key] = value
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ Enricher              = (*StaticEnricher)(nil)
+	_ caddy.Provisioner     = (*StaticEnricher)(nil)
+	_ caddyfile.Unmarshaler = (*StaticEnricher)(nil)
+	_ Enricher              = (*SubnetEnricher)(nil)
+	_ caddy.Provisioner     = (*SubnetEnricher)(nil)
+	_ caddyfile.Unmarshaler = (*SubnetEnricher)(nil)
+	_ caddy.CleanerUpper    = (*SubnetEnricher)(nil)
+	_ Enricher              = (*GeoEnricher)(nil)
+	_ caddy.Provisioner     = (*GeoEnricher)(nil)
+	_ caddyfile.Unmarshaler = (*GeoEnricher)(nil)
+	_ Enricher              = (*HashEnricher)(nil)
+	_ caddy.Provisioner     = (*HashEnricher)(nil)
+	_ caddyfile.Unmarshaler = (*HashEnricher)(nil)
+	_ Enricher              = (*RenameEnricher)(nil)
+	_ caddy.Provisioner     = (*RenameEnricher)(nil)
+	_ caddy.CleanerUpper    = (*RenameEnricher)(nil)
+	_ caddyfile.Unmarshaler = (*RenameEnricher)(nil)
+	_ Enricher              = (*TenantEnricher)(nil)
+	_ caddy.Provisioner     = (*TenantEnricher)(nil)
+	_ caddy.CleanerUpper    = (*TenantEnricher)(nil)
+	_ caddyfile.Unmarshaler = (*TenantEnricher)(nil)
+	_ taggingEnricher       = (*StaticEnricher)(nil)
+	_ taggingEnricher       = (*SubnetEnricher)(nil)
+	_ taggingEnricher       = (*GeoEnricher)(nil)
+	_ taggingEnricher       = (*TenantEnricher)(nil)
+)
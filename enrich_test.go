@@ -0,0 +1,223 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestEnrichmentPipeline(t *testing.T) {
+	dir := t.TempDir()
+	geoFile := filepath.Join(dir, "geo.csv")
+	geo := "network,country,region\n10.0.0.0/8,US,CA\n10.1.0.0/16,FR\n2001:db8::/32,DE,BE\n"
+	if err := os.WriteFile(geoFile, []byte(geo), 0o600); err != nil {
+		t.Fatalf("Failed to write geo file: %v", err)
+	}
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		session_logger sessions
+		enrichers {
+			static {
+				fleet studio
+			}
+			subnet site {
+				10.0.0.0/8 hq
+				10.1.2.0/24 lab
+			}
+			geo ` + geoFile + `
+		}
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	if len(m.EnrichersRaw) != 3 {
+		t.Fatalf("Expected 3 enrichers, got %d", len(m.EnrichersRaw))
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	sessions := []core.Session{
+		{SessionId: "a", ClientIp: "10.1.2.3:53450"},
+		{SessionId: "b", ClientIp: "10.2.0.1:53450"},
+		{SessionId: "c", ClientIp: "[2001:db8::1]:53450"},
+		{SessionId: "d", ClientIp: "192.0.2.1:53450", Tags: map[string]string{"fleet": "old"}},
+	}
+	enriched := m.enrich(sessions, zap.NewNop())
+	expected := []map[string]string{
+		{"fleet": "studio", "site": "lab", "country": "FR"},
+		{"fleet": "studio", "site": "hq", "country": "US", "region": "CA"},
+		{"fleet": "studio", "country": "DE", "region": "BE"},
+		{"fleet": "studio"},
+	}
+	for i, s := range enriched {
+		if !reflect.DeepEqual(s.Tags, expected[i]) {
+			t.Errorf("Session %s: expected tags %v, got %v", s.SessionId, expected[i], s.Tags)
+		}
+	}
+	if sessions[3].Tags["fleet"] != "old" {
+		t.Errorf("Expected the original sessions to be unchanged")
+	}
+}
+
+func TestMappingEnrichers(t *testing.T) {
+	dir := t.TempDir()
+	sitesFile := filepath.Join(dir, "sites.yaml")
+	if err := os.WriteFile(sitesFile, []byte("10.1.0.0/16: annex\n\"2001:db8::/32\": remote\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write sites file: %v", err)
+	}
+	tenantsFile := filepath.Join(dir, "tenants.json")
+	if err := os.WriteFile(tenantsFile, []byte(`{"annex": "acme"}`), 0o600); err != nil {
+		t.Fatalf("Failed to write tenants file: %v", err)
+	}
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		session_logger sessions
+		enrichers {
+			static {
+				dept design
+			}
+			subnet site {
+				file ` + sitesFile + `
+				10.0.0.0/8 hq
+				10.1.0.0/16 lab
+			}
+			rename {
+				dept department
+			}
+			tenant site {
+				file ` + tenantsFile + `
+				default shared
+				hq globex
+			}
+		}
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	defer func() { _ = m.Cleanup() }()
+	sessions := []core.Session{
+		{SessionId: "a", ClientIp: "10.1.2.3:53450"},
+		{SessionId: "b", ClientIp: "10.2.0.1:53450", Fields: map[string]string{"dept": "x"}},
+		{SessionId: "c", ClientIp: "[2001:db8::1]:53450"},
+	}
+	enriched := m.enrich(sessions, zap.NewNop())
+	expected := []map[string]string{
+		{"department": "design", "site": "annex", "tenant": "acme"},
+		{"department": "design", "site": "hq", "tenant": "globex"},
+		{"department": "design", "site": "remote", "tenant": "shared"},
+	}
+	for i, s := range enriched {
+		if !reflect.DeepEqual(s.Tags, expected[i]) {
+			t.Errorf("Session %s: expected tags %v, got %v", s.SessionId, expected[i], s.Tags)
+		}
+	}
+	if enriched[1].Fields["department"] != "x" || sessions[1].Fields["dept"] != "x" {
+		t.Errorf("Expected the field renamed in a copy, got %v and %v", enriched[1].Fields, sessions[1].Fields)
+	}
+	// a reloaded table is used by the next upload
+	var subnet *SubnetEnricher
+	for _, e := range m.enrichers {
+		if s, ok := e.(*SubnetEnricher); ok {
+			subnet = s
+		}
+	}
+	if err := subnet.load(map[string]string{"10.2.0.0/16": "annex"}); err != nil {
+		t.Fatalf("Failed to reload subnets: %v", err)
+	}
+	if got := m.enrich(sessions[1:2], zap.NewNop())[0].Tags["tenant"]; got != "acme" {
+		t.Errorf("Expected tenant acme after reload, got %q", got)
+	}
+}
+
+func TestEnricherTagPrecedence(t *testing.T) {
+	for _, c := range []struct {
+		precedence string
+		expected   string
+	}{
+		{"", "mirror"},
+		{"tag_precedence target enrichers", "lcs-cops.adobe.io"},
+	} {
+		d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+			session_logger sessions
+			target_tags
+			` + c.precedence + `
+			enrichers {
+				static {
+					targetHost mirror
+				}
+			}
+		}`)
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(d); err != nil {
+			t.Fatalf("Failed to unmarshal directive: %v", err)
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		if err := m.Provision(ctx); err != nil {
+			cancel()
+			t.Fatalf("Failed to provision: %v", err)
+		}
+		sessions := []core.Session{{SessionId: "a"}}
+		tagTarget(sessions, "lcs-cops.adobe.io", "/ulecs/v1", m.tags, zap.NewNop())
+		if got := m.enrich(sessions, zap.NewNop())[0].Tags[targetHostTag]; got != c.expected {
+			t.Errorf("With %q, expected targetHost %q, got %q", c.precedence, c.expected, got)
+		}
+		_ = m.Cleanup()
+		cancel()
+	}
+}
+
+func TestEnricherErrors(t *testing.T) {
+	emptyValues := filepath.Join(t.TempDir(), "sites.yaml")
+	if err := os.WriteFile(emptyValues, []byte("10.1.0.0/16: annex\n10.2.0.0/16: \"\"\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write sites file: %v", err)
+	}
+	for _, config := range []string{
+		"enrichers {\nunknown\n}",
+		"enrichers {\nstatic extra\n}",
+		"enrichers {\nsubnet\n}",
+		"enrichers {\ngeo\n}",
+	} {
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\n" + config + "\n}")); err == nil {
+			t.Errorf("Expected an error parsing %q", config)
+		}
+	}
+	for _, e := range []caddy.Provisioner{
+		&StaticEnricher{Tags: map[string]string{"appId": "x"}},
+		&StaticEnricher{Tags: map[string]string{"fleet": ""}},
+		&SubnetEnricher{Tag: "site", Subnets: map[string]string{"10.0.0.0": "hq"}},
+		&SubnetEnricher{Tag: "site", Subnets: map[string]string{"10.0.0.0/8": ""}},
+		&SubnetEnricher{Tag: "site", File: emptyValues},
+		&GeoEnricher{File: filepath.Join(t.TempDir(), "missing.csv")},
+		&HashEnricher{},
+		&SubnetEnricher{Tag: "site", File: filepath.Join(t.TempDir(), "missing.yaml")},
+		&RenameEnricher{Names: map[string]string{"dept": "appId"}},
+		&RenameEnricher{Names: map[string]string{"dept": "department", "division": "department"}},
+		&TenantEnricher{},
+		&TenantEnricher{By: "site", Routes: map[string]string{"hq": ""}},
+	} {
+		if err := e.Provision(caddy.Context{}); err == nil {
+			t.Errorf("Expected an error provisioning %#v", e)
+		}
+	}
+}
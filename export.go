@@ -0,0 +1,349 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"go.uber.org/zap"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExportInterval = time.Hour
+	defaultExportMaxRows  = 100_000
+	minExportInterval     = time.Minute
+	// exportDefaultPartition is the partition of sessions without
+	// an app ID, named as Hive and Spark name null partitions.
+	exportDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+)
+
+// The compression codecs that exported files can be written with.
+const (
+	exportSnappy = "snappy"
+	exportGzip   = "gzip"
+	exportZstd   = "zstd"
+	exportNone   = "none"
+)
+
+var exportCodecs = map[string]parquet.CompressionCodec{
+	exportSnappy: parquet.CompressionCodec_SNAPPY,
+	exportGzip:   parquet.CompressionCodec_GZIP,
+	exportZstd:   parquet.CompressionCodec_ZSTD,
+	exportNone:   parquet.CompressionCodec_UNCOMPRESSED,
+}
+
+// ExportConfig configures the export of sessions as Parquet files,
+// partitioned by launch date and app, so they can be queried with
+// tools such as DuckDB and Spark.
+type ExportConfig struct {
+	// Dir is the root directory of the export.  Each file is
+	// written to Dir/date=<yyyy-mm-dd>/app=<appId>.
+	Dir string `json:"dir"`
+	// FlushInterval is how often buffered sessions are written.
+	// Defaults to 1h.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+	// MaxRows is the most sessions buffered for a partition before
+	// they are written.  Defaults to 100,000.
+	MaxRows int `json:"max_rows,omitempty"`
+	// Compression is the codec files are written with: snappy (the
+	// default), gzip, zstd, or none.
+	Compression string `json:"compression,omitempty"`
+}
+
+// The export registry holds the open session export for each
+// directory.  Like the dedup registry, it outlives any single
+// configuration, so that sessions buffered when a config is
+// reloaded are written with those that follow.  An export is
+// flushed and closed when the last tracker using it is cleaned up.
+var exportRegistry = struct {
+	sync.Mutex
+	exports map[string]*sessionExport
+}{exports: make(map[string]*sessionExport)}
+
+// A sessionExport buffers sessions by partition, and writes each
+// partition's buffered sessions to a new Parquet file when the
+// buffer is full or the flush interval passes.  Files are written
+// under a temporary name and renamed when complete, so readers
+// never see a partial file.
+type sessionExport struct {
+	dir  string
+	refs int
+	stop chan struct{}
+	done sync.WaitGroup
+
+	mu       sync.Mutex
+	interval time.Duration
+	maxRows  int
+	codec    parquet.CompressionCodec
+	seq      int
+	parts    map[exportPartition][]exportRow
+}
+
+// An exportPartition is the launch date and app of the sessions in
+// an exported file.
+type exportPartition struct {
+	date string
+	app  string
+}
+
+// An exportRow is the Parquet form of a session.
+type exportRow struct {
+	SessionId      string            `parquet:"name=session_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	LaunchTime     int64             `parquet:"name=launch_time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	LaunchDuration int64             `parquet:"name=launch_duration_ms, type=INT64"`
+	ClientIp       string            `parquet:"name=client_ip, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AddressFamily  string            `parquet:"name=address_family, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AppId          string            `parquet:"name=app_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AppVersion     string            `parquet:"name=app_version, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AppLocale      string            `parquet:"name=app_locale, type=BYTE_ARRAY, convertedtype=UTF8"`
+	NglVersion     string            `parquet:"name=ngl_version, type=BYTE_ARRAY, convertedtype=UTF8"`
+	OsName         string            `parquet:"name=os_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	OsVersion      string            `parquet:"name=os_version, type=BYTE_ARRAY, convertedtype=UTF8"`
+	UserId         string            `parquet:"name=user_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ProfileExpiry  *int64            `parquet:"name=profile_expiry, type=INT64, convertedtype=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL"`
+	ProfileId      string            `parquet:"name=profile_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	LaunchKind     string            `parquet:"name=launch_kind, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Tags           map[string]string `parquet:"name=tags, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Fields         map[string]string `parquet:"name=fields, type=MAP, convertedtype=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+// acquireExport returns the session export to the configured
+// directory, opening it if necessary.  The interval, row limit, and
+// compression of an open export are replaced by the given ones, so
+// the newest configuration wins.
+func acquireExport(cfg ExportConfig) (*sessionExport, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("a parquet export needs a directory")
+	}
+	interval := time.Duration(cfg.FlushInterval)
+	if interval == 0 {
+		interval = defaultExportInterval
+	}
+	if interval < minExportInterval {
+		return nil, fmt.Errorf("parquet export flush interval must be at least %s", minExportInterval)
+	}
+	maxRows := cfg.MaxRows
+	if maxRows == 0 {
+		maxRows = defaultExportMaxRows
+	}
+	if maxRows < 0 {
+		return nil, fmt.Errorf("parquet export max_rows must not be negative")
+	}
+	compression := cfg.Compression
+	if compression == "" {
+		compression = exportSnappy
+	}
+	if err := validExportCompression(compression); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o750); err != nil {
+		return nil, fmt.Errorf("cannot create parquet export directory %q: %v", cfg.Dir, err)
+	}
+	exportRegistry.Lock()
+	defer exportRegistry.Unlock()
+	e, ok := exportRegistry.exports[cfg.Dir]
+	if !ok {
+		e = &sessionExport{dir: cfg.Dir, stop: make(chan struct{}), interval: interval}
+		e.parts = make(map[exportPartition][]exportRow)
+		exportRegistry.exports[cfg.Dir] = e
+		e.run()
+	}
+	e.refs++
+	e.mu.Lock()
+	e.interval, e.maxRows, e.codec = interval, maxRows, exportCodecs[compression]
+	e.mu.Unlock()
+	return e, nil
+}
+
+// validExportCompression checks that a compression codec is one we
+// can write.
+func validExportCompression(compression string) error {
+	if _, ok := exportCodecs[compression]; !ok {
+		return fmt.Errorf("parquet export compression must be %s, %s, %s, or %s, not %q",
+			exportSnappy, exportGzip, exportZstd, exportNone, compression)
+	}
+	return nil
+}
+
+// release gives up one tracker's use of the export.  When the last
+// use is given up, the export is stopped and its buffered sessions
+// written.
+func (e *sessionExport) release() {
+	exportRegistry.Lock()
+	e.refs--
+	last := e.refs == 0
+	if last {
+		delete(exportRegistry.exports, e.dir)
+	}
+	exportRegistry.Unlock()
+	if last {
+		close(e.stop)
+		e.done.Wait()
+	}
+}
+
+// add buffers the given sessions in their partitions, and writes
+// any partition whose buffer is full.
+func (e *sessionExport) add(sessions []core.Session) {
+	if e == nil || len(sessions) == 0 {
+		return
+	}
+	full := make(map[exportPartition][]exportRow)
+	e.mu.Lock()
+	for _, s := range sessions {
+		part := exportPartition{date: s.LaunchTime.UTC().Format(time.DateOnly), app: s.AppId}
+		e.parts[part] = append(e.parts[part], newExportRow(s))
+		if len(e.parts[part]) >= e.maxRows {
+			full[part] = e.parts[part]
+			delete(e.parts, part)
+		}
+	}
+	e.mu.Unlock()
+	e.writeAll(full)
+}
+
+// newExportRow returns the Parquet form of a session.
+func newExportRow(s core.Session) exportRow {
+	row := exportRow{
+		SessionId:      s.SessionId,
+		LaunchTime:     s.LaunchTime.UnixMilli(),
+		LaunchDuration: s.LaunchDuration.Milliseconds(),
+		ClientIp:       s.ClientIp,
+		AddressFamily:  s.AddressFamily,
+		AppId:          s.AppId,
+		AppVersion:     s.AppVersion,
+		AppLocale:      s.AppLocale,
+		NglVersion:     s.NglVersion,
+		OsName:         s.OsName,
+		OsVersion:      s.OsVersion,
+		UserId:         s.UserId,
+		ProfileId:      s.ProfileId,
+		LaunchKind:     s.LaunchKind,
+		Tags:           s.Tags,
+		Fields:         s.Fields,
+	}
+	if !s.ProfileExpiry.IsZero() {
+		expiry := s.ProfileExpiry.UnixMilli()
+		row.ProfileExpiry = &expiry
+	}
+	return row
+}
+
+// flush writes the sessions buffered in every partition.
+func (e *sessionExport) flush() {
+	e.mu.Lock()
+	parts := e.parts
+	e.parts = make(map[exportPartition][]exportRow)
+	e.mu.Unlock()
+	e.writeAll(parts)
+}
+
+// writeAll writes each of the given partitions' sessions to a new
+// file, in partition order, logging any failures.
+func (e *sessionExport) writeAll(parts map[exportPartition][]exportRow) {
+	ordered := make([]exportPartition, 0, len(parts))
+	for part := range parts {
+		ordered = append(ordered, part)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		return a.date < b.date || (a.date == b.date && a.app < b.app)
+	})
+	for _, part := range ordered {
+		path, err := e.write(part, parts[part])
+		if err != nil {
+			caddy.Log().Error("AdobeUsageTracker: failed to export sessions",
+				zap.String("dir", e.dir), zap.String("date", part.date), zap.String("app", part.app),
+				zap.Int("session-count", len(parts[part])), zap.Error(err))
+			continue
+		}
+		caddy.Log().Debug("AdobeUsageTracker: exported sessions",
+			zap.String("path", path), zap.Int("session-count", len(parts[part])))
+	}
+}
+
+// write writes the given sessions of a partition to a new file, and
+// returns its path.
+func (e *sessionExport) write(part exportPartition, rows []exportRow) (string, error) {
+	app := exportDefaultPartition
+	if part.app != "" {
+		app = url.PathEscape(part.app)
+	}
+	dir := filepath.Join(e.dir, "date="+part.date, "app="+app)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return "", err
+	}
+	e.mu.Lock()
+	e.seq++
+	name := fmt.Sprintf("sessions-%d-%d.parquet", time.Now().UnixNano(), e.seq)
+	codec := e.codec
+	e.mu.Unlock()
+	path := filepath.Join(dir, name)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return "", err
+	}
+	err = writeExportRows(f, rows, codec)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return "", err
+	}
+	return path, os.Rename(tmp, path)
+}
+
+// writeExportRows writes the rows as a Parquet file to f.
+func writeExportRows(f *os.File, rows []exportRow, codec parquet.CompressionCodec) error {
+	pw, err := writer.NewParquetWriterFromWriter(f, new(exportRow), 1)
+	if err != nil {
+		return err
+	}
+	pw.CompressionType = codec
+	for _, row := range rows {
+		if err := pw.Write(row); err != nil {
+			return err
+		}
+	}
+	return pw.WriteStop()
+}
+
+// run starts the export's periodic flushes.  The interval is read
+// at each flush, so a reload that changes it takes effect after the
+// next one.
+func (e *sessionExport) run() {
+	e.done.Add(1)
+	go func() {
+		defer e.done.Done()
+		for {
+			e.mu.Lock()
+			interval := e.interval
+			e.mu.Unlock()
+			timer := time.NewTimer(interval)
+			select {
+			case <-e.stop:
+				timer.Stop()
+				e.flush()
+				return
+			case <-timer.C:
+				e.flush()
+			}
+		}
+	}()
+}
@@ -0,0 +1,232 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/source"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A parquetTestFile lets the parquet reader read a local file.
+type parquetTestFile struct {
+	*os.File
+}
+
+func (f parquetTestFile) Open(name string) (source.ParquetFile, error) {
+	if name == "" {
+		name = f.Name()
+	}
+	file, err := os.Open(name)
+	return parquetTestFile{file}, err
+}
+
+func (f parquetTestFile) Create(string) (source.ParquetFile, error) {
+	return nil, fmt.Errorf("test files are read-only")
+}
+
+// readExport returns the rows of the exported files under dir,
+// keyed by their path relative to dir, less the file name.
+func readExport(t *testing.T, dir string) map[string][]exportRow {
+	t.Helper()
+	result := make(map[string][]exportRow)
+	err := filepath.WalkDir(dir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if !strings.HasSuffix(path, ".parquet") {
+			return fmt.Errorf("unexpected file %q in export", path)
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		pr, err := reader.NewParquetReader(parquetTestFile{file}, new(exportRow), 1)
+		if err != nil {
+			return fmt.Errorf("cannot read %q: %v", path, err)
+		}
+		defer pr.ReadStop()
+		rows := make([]exportRow, pr.GetNumRows())
+		if err := pr.Read(&rows); err != nil {
+			return fmt.Errorf("cannot read rows of %q: %v", path, err)
+		}
+		rel, _ := filepath.Rel(dir, filepath.Dir(path))
+		result[filepath.ToSlash(rel)] = append(result[filepath.ToSlash(rel)], rows...)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	return result
+}
+
+func TestExportPartitions(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "export")
+	e, err := acquireExport(ExportConfig{Dir: dir})
+	if err != nil {
+		t.Fatalf("Failed to acquire export: %v", err)
+	}
+	day1 := time.Date(2024, 5, 29, 23, 30, 0, 0, time.UTC)
+	day2 := day1.Add(time.Hour)
+	expiry := day1.Add(30 * 24 * time.Hour)
+	e.add([]core.Session{
+		{SessionId: "a", LaunchTime: day1, LaunchDuration: 1500 * time.Millisecond, AppId: "Photoshop1",
+			UserId: "u1", ProfileExpiry: expiry, Tags: map[string]string{"dept": "design"}},
+		{SessionId: "b", LaunchTime: day2, AppId: "Photoshop1", Fields: map[string]string{"site": "hq"}},
+		{SessionId: "c", LaunchTime: day2, AppId: "Acrobat DC/1"},
+		{SessionId: "d", LaunchTime: day2},
+	})
+	if files := readExport(t, dir); len(files) != 0 {
+		t.Errorf("Expected sessions to be buffered until flushed, got %v", files)
+	}
+	e.release()
+	files := readExport(t, dir)
+	expected := map[string][]string{
+		"date=2024-05-29/app=Photoshop1":                 {"a"},
+		"date=2024-05-30/app=Photoshop1":                 {"b"},
+		"date=2024-05-30/app=Acrobat%20DC%2F1":           {"c"},
+		"date=2024-05-30/app=__HIVE_DEFAULT_PARTITION__": {"d"},
+	}
+	got := make(map[string][]string)
+	for part, rows := range files {
+		for _, row := range rows {
+			got[part] = append(got[part], row.SessionId)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Expected partitions %v, got %v", expected, got)
+	}
+	a := files["date=2024-05-29/app=Photoshop1"][0]
+	if a.LaunchTime != day1.UnixMilli() || a.LaunchDuration != 1500 || a.UserId != "u1" ||
+		a.ProfileExpiry == nil || *a.ProfileExpiry != expiry.UnixMilli() || a.Tags["dept"] != "design" {
+		t.Errorf("Unexpected row for session a: %+v", a)
+	}
+	b := files["date=2024-05-30/app=Photoshop1"][0]
+	if b.ProfileExpiry != nil || b.Fields["site"] != "hq" || len(b.Tags) != 0 {
+		t.Errorf("Unexpected row for session b: %+v", b)
+	}
+}
+
+func TestExportMaxRows(t *testing.T) {
+	dir := t.TempDir()
+	for _, compression := range []string{exportSnappy, exportGzip, exportZstd, exportNone} {
+		dir := filepath.Join(dir, compression)
+		e, err := acquireExport(ExportConfig{Dir: dir, MaxRows: 2, Compression: compression})
+		if err != nil {
+			t.Fatalf("Failed to acquire export: %v", err)
+		}
+		launch := time.UnixMilli(1716994039000)
+		e.add([]core.Session{
+			{SessionId: "a", LaunchTime: launch, AppId: "InDesign1"},
+			{SessionId: "b", LaunchTime: launch, AppId: "InDesign1"},
+			{SessionId: "c", LaunchTime: launch, AppId: "InDesign1"},
+		})
+		entries, _ := filepath.Glob(filepath.Join(dir, "*", "*", "*.parquet"))
+		if len(entries) != 1 {
+			t.Errorf("%s: expected a full partition to be written at once, got %v", compression, entries)
+		}
+		e.release()
+		entries, _ = filepath.Glob(filepath.Join(dir, "*", "*", "*.parquet"))
+		var ids []string
+		for _, rows := range readExport(t, dir) {
+			for _, row := range rows {
+				ids = append(ids, row.SessionId)
+			}
+		}
+		sort.Strings(ids)
+		if len(entries) != 2 || !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+			t.Errorf("%s: expected 2 files with all 3 sessions, got %v with %v", compression, entries, ids)
+		}
+	}
+}
+
+func TestExportConfig(t *testing.T) {
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		parquet_export /var/lib/tracker/export {
+			flush_interval 15m
+			max_rows 5000
+			compression zstd
+		}
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal parquet_export: %v", err)
+	}
+	expected := ExportConfig{Dir: "/var/lib/tracker/export", FlushInterval: caddy.Duration(15 * time.Minute),
+		MaxRows: 5000, Compression: exportZstd}
+	if m.Export == nil || *m.Export != expected {
+		t.Errorf("Expected %+v, got %+v", expected, m.Export)
+	}
+	for _, config := range []string{
+		"parquet_export",
+		"parquet_export /tmp/export {\nflush_interval soon\n}",
+		"parquet_export /tmp/export {\nmax_rows 0\n}",
+		"parquet_export /tmp/export {\ncompression brotli\n}",
+		"parquet_export /tmp/export {\nformat csv\n}",
+	} {
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\n" + config + "\n}")); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+	dir := t.TempDir()
+	for _, cfg := range []ExportConfig{
+		{},
+		{Dir: dir, FlushInterval: caddy.Duration(time.Second)},
+		{Dir: dir, MaxRows: -1},
+		{Dir: dir, Compression: "brotli"},
+	} {
+		if _, err := acquireExport(cfg); err == nil {
+			t.Errorf("Expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestExportOnlyTracker(t *testing.T) {
+	dir := t.TempDir()
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		parquet_export ` + dir + `
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := m.Provision(ctx); err != nil {
+		t.Fatalf("Expected a tracker that only exports to provision, got: %v", err)
+	}
+	if err := m.Validate(); err != nil {
+		t.Fatalf("Expected a tracker that only exports to validate, got: %v", err)
+	}
+	uploadFile(t, &m, "testdata/indesign-multi-session-1-2.txt")
+	if err := m.Cleanup(); err != nil {
+		t.Fatalf("Cleanup failed: %v", err)
+	}
+	count := 0
+	for part, rows := range readExport(t, dir) {
+		if !strings.HasSuffix(part, "/app=InDesign1") && !strings.HasSuffix(part, "/app="+exportDefaultPartition) {
+			t.Errorf("Unexpected partition %q", part)
+		}
+		count += len(rows)
+	}
+	if count != 2 {
+		t.Errorf("Expected 2 exported sessions, got %d", count)
+	}
+}
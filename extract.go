@@ -0,0 +1,41 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+)
+
+// An ExtractionConfig names a pattern to match against the lines
+// of each session's log.  The value it matches becomes a tag (or,
+// if Field is true, a field) of that name on the session.
+type ExtractionConfig struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	Field   bool   `json:"field,omitempty"`
+}
+
+// compileExtractions compiles the configured extractions,
+// checking that no name is used twice.
+func compileExtractions(configs []ExtractionConfig) ([]core.Extraction, error) {
+	seen := make(map[string]bool, len(configs))
+	extractions := make([]core.Extraction, 0, len(configs))
+	for _, cfg := range configs {
+		if seen[cfg.Name] {
+			return nil, fmt.Errorf("extraction name %q is used more than once", cfg.Name)
+		}
+		seen[cfg.Name] = true
+		e, err := core.NewExtraction(cfg.Name, cfg.Pattern, cfg.Field)
+		if err != nil {
+			return nil, err
+		}
+		extractions = append(extractions, e)
+	}
+	return extractions, nil
+}
@@ -0,0 +1,65 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestUnmarshalExtract(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		extract {
+			tag runtimeMode "Runtimemode=([A-Z_]+)"
+			field ngl "NGLLibVersion=([0-9.]+)"
+		}
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	expected := []ExtractionConfig{
+		{Name: "runtimeMode", Pattern: "Runtimemode=([A-Z_]+)"},
+		{Name: "ngl", Pattern: "NGLLibVersion=([0-9.]+)", Field: true},
+	}
+	if !reflect.DeepEqual(m.Extractions, expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, m.Extractions)
+	}
+	extractions, err := compileExtractions(m.Extractions)
+	if err != nil {
+		t.Fatalf("Failed to compile extractions: %v", err)
+	}
+	m.extractions = extractions
+	buffer, err := os.ReadFile("testdata/indesign-single-session-1.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	up := upload{remoteAddr: "127.0.0.1:53450"}
+	if err := m.parseUpload(bytes.NewReader(buffer), &up, core.NewLimits(0, 0, 0)); err != nil {
+		t.Fatalf("Failed to parse upload: %v", err)
+	}
+	if len(up.sessions) != 1 || up.sessions[0].Tags["runtimeMode"] != "NAMED_USER_ONLINE" ||
+		up.sessions[0].Fields["ngl"] != "1.35.0.19" {
+		t.Errorf("Expected extracted attributes, got %+v", up.sessions)
+	}
+	for _, config := range []string{
+		"extract now {\ntag a b\n}",
+		"extract {\nlabel a b\n}",
+		"extract {\ntag a\n}",
+		"extract {\ntag a x\nfield a y\n}",
+		"extract {\ntag sessionId x\n}",
+	} {
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\n" + config + "\n}")); err == nil {
+			t.Errorf("Expected an error parsing %q", config)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"strings"
+	"time"
+)
+
+// Filter rule actions and matching modes.
+const (
+	filterKeep     = "keep"
+	filterDrop     = "drop"
+	filterMatchAll = "all"
+	filterMatchAny = "any"
+)
+
+// A FilterRule keeps or drops the sessions that match its
+// conditions.  A session matches a rule if it meets all of the
+// rule's conditions (or any of them, if Match is "any").
+//
+// Rules are tried in order, and the first rule that a session
+// matches decides whether it is kept or dropped.  A session that
+// matches no rule is dropped if there are any keep rules, and
+// kept otherwise.
+type FilterRule struct {
+	// Action is "keep" or "drop".
+	Action string `json:"action"`
+	// Match is "all" (the default) or "any".
+	Match      string            `json:"match,omitempty"`
+	Conditions []FilterCondition `json:"conditions"`
+}
+
+// A FilterCondition compares a session attribute with a value.
+// The string attributes (appId, osName, appLocale, etc.) can be
+// compared with ==, !=, ^= (has prefix), and $= (has suffix).
+// The launchDuration attribute is compared with a duration such as
+// "2s" using ==, !=, <, <=, >, or >=.
+type FilterCondition struct {
+	Attribute string `json:"attribute"`
+	Op        string `json:"op"`
+	Value     string `json:"value"`
+}
+
+// A filterRule is a compiled FilterRule.
+type filterRule struct {
+	keep  bool
+	any   bool
+	conds []func(s core.Session) bool
+}
+
+// A sessionFilter applies a sequence of compiled rules.
+type sessionFilter struct {
+	rules    []filterRule
+	keepRule bool // whether any rule is a keep rule
+}
+
+// newSessionFilter compiles a sequence of filter rules.
+func newSessionFilter(rules []FilterRule) (*sessionFilter, error) {
+	f := &sessionFilter{}
+	for i, rule := range rules {
+		compiled, err := compileFilterRule(rule)
+		if err != nil {
+			return nil, fmt.Errorf("filter rule %d: %v", i+1, err)
+		}
+		f.rules = append(f.rules, compiled)
+		f.keepRule = f.keepRule || compiled.keep
+	}
+	return f, nil
+}
+
+// compileFilterRule checks and compiles a single filter rule.
+func compileFilterRule(rule FilterRule) (filterRule, error) {
+	var r filterRule
+	switch rule.Action {
+	case filterKeep:
+		r.keep = true
+	case filterDrop:
+	default:
+		return r, fmt.Errorf("action must be %s or %s, not %q", filterKeep, filterDrop, rule.Action)
+	}
+	switch rule.Match {
+	case "", filterMatchAll:
+	case filterMatchAny:
+		r.any = true
+	default:
+		return r, fmt.Errorf("match must be %s or %s, not %q", filterMatchAll, filterMatchAny, rule.Match)
+	}
+	if len(rule.Conditions) == 0 {
+		return r, fmt.Errorf("at least one condition must be given")
+	}
+	for _, c := range rule.Conditions {
+		cond, err := compileFilterCondition(c)
+		if err != nil {
+			return r, err
+		}
+		r.conds = append(r.conds, cond)
+	}
+	return r, nil
+}
+
+// compileFilterCondition checks and compiles a single condition.
+func compileFilterCondition(c FilterCondition) (func(s core.Session) bool, error) {
+	if c.Attribute == "launchDuration" {
+		dur, err := caddy.ParseDuration(c.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid launchDuration %q: %v", c.Value, err)
+		}
+		var compare func(d time.Duration) bool
+		switch c.Op {
+		case "==":
+			compare = func(d time.Duration) bool { return d == dur }
+		case "!=":
+			compare = func(d time.Duration) bool { return d != dur }
+		case "<":
+			compare = func(d time.Duration) bool { return d < dur }
+		case "<=":
+			compare = func(d time.Duration) bool { return d <= dur }
+		case ">":
+			compare = func(d time.Duration) bool { return d > dur }
+		case ">=":
+			compare = func(d time.Duration) bool { return d >= dur }
+		default:
+			return nil, fmt.Errorf("unknown launchDuration comparison %q", c.Op)
+		}
+		return func(s core.Session) bool { return compare(s.LaunchDuration) }, nil
+	}
+	attr, ok := core.SessionAttributes[c.Attribute]
+	if !ok {
+		return nil, fmt.Errorf("unknown session attribute %q", c.Attribute)
+	}
+	value := c.Value
+	switch c.Op {
+	case "==":
+		return func(s core.Session) bool { return attr(s) == value }, nil
+	case "!=":
+		return func(s core.Session) bool { return attr(s) != value }, nil
+	case "^=":
+		return func(s core.Session) bool { return strings.HasPrefix(attr(s), value) }, nil
+	case "$=":
+		return func(s core.Session) bool { return strings.HasSuffix(attr(s), value) }, nil
+	}
+	return nil, fmt.Errorf("unknown %s comparison %q", c.Attribute, c.Op)
+}
+
+// matches reports whether a session matches a rule.
+func (r filterRule) matches(s core.Session) bool {
+	for _, cond := range r.conds {
+		if cond(s) == r.any {
+			return r.any
+		}
+	}
+	return !r.any
+}
+
+// keeps reports whether a session is kept by the filter.
+func (f *sessionFilter) keeps(s core.Session) bool {
+	for _, rule := range f.rules {
+		if rule.matches(s) {
+			return rule.keep
+		}
+	}
+	return !f.keepRule
+}
+
+// apply returns the sessions that are kept by the filter.
+func (f *sessionFilter) apply(sessions []core.Session, logger *zap.Logger) []core.Session {
+	if f == nil {
+		return sessions
+	}
+	kept := make([]core.Session, 0, len(sessions))
+	for _, session := range sessions {
+		if f.keeps(session) {
+			kept = append(kept, session)
+		} else {
+			logger.Debug("AdobeUsageTracker: session dropped by filter", zap.Object("session", session))
+		}
+	}
+	return kept
+}
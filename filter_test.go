@@ -0,0 +1,102 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"testing"
+	"time"
+)
+
+func TestFilterRules(t *testing.T) {
+	filter, err := newSessionFilter([]FilterRule{
+		{Action: "drop", Match: "any", Conditions: []FilterCondition{
+			{Attribute: "osName", Op: "!=", Value: "MAC"},
+			{Attribute: "launchDuration", Op: "<", Value: "1s"},
+		}},
+		{Action: "keep", Match: "any", Conditions: []FilterCondition{
+			{Attribute: "appId", Op: "^=", Value: "InDesign"},
+			{Attribute: "appId", Op: "^=", Value: "Photoshop"},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile filter: %v", err)
+	}
+	sessions := []core.Session{
+		{SessionId: "kept-indesign", AppId: "InDesign1", OsName: "MAC", LaunchDuration: 2 * time.Second},
+		{SessionId: "windows", AppId: "InDesign1", OsName: "WIN", LaunchDuration: 2 * time.Second},
+		{SessionId: "fast", AppId: "Photoshop1", OsName: "MAC", LaunchDuration: 500 * time.Millisecond},
+		{SessionId: "kept-photoshop", AppId: "Photoshop1", OsName: "MAC", LaunchDuration: time.Second},
+		{SessionId: "unmatched", AppId: "Illustrator1", OsName: "MAC", LaunchDuration: 2 * time.Second},
+	}
+	kept := filter.apply(sessions, zap.NewNop())
+	if len(kept) != 2 || kept[0].SessionId != "kept-indesign" || kept[1].SessionId != "kept-photoshop" {
+		t.Errorf("Unexpected sessions kept: %v", kept)
+	}
+}
+
+func TestFilterDropOnly(t *testing.T) {
+	filter, err := newSessionFilter([]FilterRule{
+		{Action: "drop", Conditions: []FilterCondition{
+			{Attribute: "appId", Op: "==", Value: "AcrobatDC1"},
+			{Attribute: "appVersion", Op: "^=", Value: "24."},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to compile filter: %v", err)
+	}
+	sessions := []core.Session{
+		{SessionId: "dropped", AppId: "AcrobatDC1", AppVersion: "24.2"},
+		{SessionId: "old", AppId: "AcrobatDC1", AppVersion: "23.1"},
+		{SessionId: "other", AppId: "InDesign1", AppVersion: "24.2"},
+	}
+	if kept := filter.apply(sessions, zap.NewNop()); len(kept) != 2 {
+		t.Errorf("Expected 2 sessions kept, got %v", kept)
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, rule := range []FilterRule{
+		{Action: "maybe", Conditions: []FilterCondition{{Attribute: "appId", Op: "==", Value: "x"}}},
+		{Action: "keep", Match: "some", Conditions: []FilterCondition{{Attribute: "appId", Op: "==", Value: "x"}}},
+		{Action: "keep"},
+		{Action: "keep", Conditions: []FilterCondition{{Attribute: "tenant", Op: "==", Value: "x"}}},
+		{Action: "keep", Conditions: []FilterCondition{{Attribute: "appId", Op: "<", Value: "x"}}},
+		{Action: "keep", Conditions: []FilterCondition{{Attribute: "launchDuration", Op: "<", Value: "soon"}}},
+	} {
+		if _, err := newSessionFilter([]FilterRule{rule}); err == nil {
+			t.Errorf("Expected an error compiling %v", rule)
+		}
+	}
+}
+
+func TestUnmarshalFilter(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		filter drop any {
+			osName != MAC
+			launchDuration < 1s
+		}
+		filter keep {
+			appId ^= InDesign
+		}
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal: %v", err)
+	}
+	if len(m.Filters) != 2 {
+		t.Fatalf("Expected 2 filter rules, got %d", len(m.Filters))
+	}
+	if r := m.Filters[0]; r.Action != "drop" || r.Match != "any" || len(r.Conditions) != 2 {
+		t.Errorf("Unexpected first rule: %v", r)
+	}
+	if c := m.Filters[1].Conditions[0]; c.Attribute != "appId" || c.Op != "^=" || c.Value != "InDesign" {
+		t.Errorf("Unexpected condition: %v", c)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+// A tracker's name scopes the state it shares with other trackers:
+// its tokens, rollups, gauges, sketches, usage aggregate, NGL
+// versions, and session sightings, as well as its metrics and its
+// spool directory.  Trackers with different names share none of
+// these, so one server can run independent pipelines (say, for
+// production and a pilot) side by side.  Unnamed trackers all
+// share the empty name.
+//
+// Names are used in registry keys, metric labels, and directory
+// names, so they are limited to letters, digits, dots, dashes,
+// and underscores, and can't start with a dot or dash.
+var namePattern = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+// validName checks a tracker name.  The empty name is valid.
+func validName(name string) error {
+	if name != "" && !namePattern.MatchString(name) {
+		return fmt.Errorf("tracker name %q may only contain letters, digits, '.', '-', and '_', "+
+			"and must not start with '.' or '-'", name)
+	}
+	return nil
+}
+
+// spoolDirFor returns the directory a tracker spools to: the spool
+// directory itself for an unnamed tracker, and a subdirectory named
+// for the tracker otherwise, so named trackers that are given the
+// same spool directory never process each other's uploads.
+func spoolDirFor(dir string, name string) string {
+	if name == "" {
+		return dir
+	}
+	return filepath.Join(dir, name)
+}
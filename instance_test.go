@@ -0,0 +1,94 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/internal/influxtest"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	for _, name := range []string{"", "production", "pilot-2", "eu_west.1", "_internal"} {
+		if err := validName(name); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", name, err)
+		}
+	}
+	for _, name := range []string{"..", ".hidden", "-x", "a/b", "a|b", "two words", "café"} {
+		if err := validName(name); err == nil {
+			t.Errorf("Expected %q to be invalid", name)
+		}
+		var m AdobeUsageTracker
+		d := caddyfile.NewTestDispenser("adobe_usage_tracker {\nname \"" + name + "\"\n}")
+		if err := m.UnmarshalCaddyfile(d); err == nil {
+			t.Errorf("Expected the Caddyfile to reject name %q", name)
+		}
+	}
+	if got := spoolDirFor("/var/spool", ""); got != "/var/spool" {
+		t.Errorf("Expected unnamed trackers to spool to the spool directory, got %q", got)
+	}
+	if got := spoolDirFor("/var/spool", "pilot"); got != filepath.Join("/var/spool", "pilot") {
+		t.Errorf("Expected named trackers to spool to a subdirectory, got %q", got)
+	}
+}
+
+func TestNamedTrackersAreIsolated(t *testing.T) {
+	server := influxtest.NewServer(2, "secret")
+	defer server.Close()
+	production := newIntegrationTracker(t, server, "name production\nusage_snapshot")
+	pilot := newIntegrationTracker(t, server, "name pilot\nusage_snapshot")
+	if production.token == pilot.token {
+		t.Fatalf("Expected named trackers to have their own token holders")
+	}
+	if production.usage == pilot.usage {
+		t.Fatalf("Expected named trackers to have their own usage aggregates")
+	}
+
+	// swapping the pilot's token leaves production's alone
+	body := `{"name": "pilot", "token": "rotated"}`
+	r := httptest.NewRequest(http.MethodPost, "/adobe_usage_tracker/token", strings.NewReader(body))
+	if err := (trackerAdmin{}).handleToken(httptest.NewRecorder(), r); err != nil {
+		t.Fatalf("Token swap failed: %v", err)
+	}
+	if tok := pilot.token.current(); tok != "rotated" {
+		t.Errorf("Expected the pilot's token to be swapped, got %q", tok)
+	}
+	if tok := production.token.current(); tok != "secret" {
+		t.Errorf("Expected production's token to be unchanged, got %q", tok)
+	}
+	body = `{"name": "staging", "token": "rotated"}`
+	r = httptest.NewRequest(http.MethodPost, "/adobe_usage_tracker/token", strings.NewReader(body))
+	if err := (trackerAdmin{}).handleToken(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error swapping the token of an unknown name")
+	}
+
+	// each name's usage counts only its own uploads
+	uploadFile(t, production, "testdata/indesign-multi-session-1-2.txt")
+	for name, launches := range map[string]int{"production": 2, "pilot": 0} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/adobe_usage_tracker/usage?name="+name, nil)
+		if err := (trackerAdmin{}).handleUsage(w, r); err != nil {
+			t.Fatalf("Usage snapshot of %s failed: %v", name, err)
+		}
+		var snap usageSnapshot
+		if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+			t.Fatalf("Cannot decode snapshot %q: %v", w.Body.String(), err)
+		}
+		if snap.Launches != launches {
+			t.Errorf("Expected %d launches for %s, got %d", launches, name, snap.Launches)
+		}
+	}
+	r = httptest.NewRequest(http.MethodGet, "/adobe_usage_tracker/usage?name=staging", nil)
+	if err := (trackerAdmin{}).handleUsage(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error for the usage of an unknown name")
+	}
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/clickonetwo/tracker/internal/influxtest"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// integrationClient is the address that test uploads come from.
+const integrationClient = "10.0.0.1:5000"
+
+// newIntegrationTracker provisions a tracker from a Caddyfile
+// directive that writes to the server, with the given options.
+func newIntegrationTracker(t *testing.T, server *influxtest.Server, options string) *AdobeUsageTracker {
+	t.Helper()
+	t.Cleanup(server.TrustInDefaultClient())
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		endpoint ` + server.URL + `
+		database tracker
+		policy autogen
+		token secret
+		` + options + `
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	if err := m.Provision(ctx); err != nil {
+		cancel()
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = m.Cleanup()
+		cancel()
+	})
+	return &m
+}
+
+// uploadFile sends a test log through the tracker, to a next handler
+// that reads it as a proxy would.
+func uploadFile(t *testing.T, m *AdobeUsageTracker, file string) {
+	t.Helper()
+	uploadFileFrom(t, m, file, integrationClient)
+}
+
+// uploadFileFrom is uploadFile for a client at the given address.
+func uploadFileFrom(t *testing.T, m *AdobeUsageTracker, file string, remoteAddr string) {
+	t.Helper()
+	if err := serveFile(t, m, file, remoteAddr); err != nil {
+		t.Fatalf("ServeHTTP failed: %s", err)
+	}
+}
+
+// serveFile sends a test log through the tracker as uploadFileFrom
+// does, and returns the error with which the tracker answered it.
+func serveFile(t *testing.T, m *AdobeUsageTracker, file string, remoteAddr string) error {
+	t.Helper()
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	proxy := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := io.Copy(io.Discard, r.Body)
+		return err
+	})
+	r := httptest.NewRequest("POST", "/ulecs/v1", bytes.NewReader(content))
+	r.RemoteAddr = remoteAddr
+	return m.ServeHTTP(httptest.NewRecorder(), r, proxy)
+}
+
+// TestIntegrationWrites uploads raw logs through a tracker, with each
+// case's options, to mock v1 and v2 databases.  Any {tmp} in the
+// options is replaced by a temporary directory.
+func TestIntegrationWrites(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		options string
+		files   []string
+		check   func(t *testing.T, writes []influxtest.Write)
+	}{
+		{
+			name:  "single session",
+			files: []string{"testdata/indesign-single-session-1.txt"},
+			check: expectLines(
+				`log-session,sessionId=1ffe79ab-258a-4ad0-ad0b-14f7718ea7f5.1710291735643 launchDuration=31133,` +
+					`clientIp="10.0.0.1:5000",appId="InDesign1",appVersion="19.2",appLocale="en_US",` +
+					`nglVersion="1.35.0.19",osName="MAC",osVersion="14.3.1",` +
+					`userId="9f22a90139cbb9f1676b0113e1fb574976dc550a",days_to_expiry=1.02,` +
+					`profileId="e59a641b-0c10-4ca3-a7d9-0e2e92ff2c5a" 1710291735643`,
+			),
+		},
+		{
+			name:  "multiple sessions",
+			files: []string{"testdata/indesign-multi-session-1-2.txt"},
+			check: expectLines(
+				`log-session,sessionId=0717afac-6d37-4c33-b085-34bcf72a5d19.1710292251620 launchDuration=923335,`+
+					`clientIp="10.0.0.1:5000" 1710292251620`,
+				`log-session,sessionId=8c368a66-4995-4d23-8c27-cb9b3f1edc30.1710358298773 launchDuration=69152,`+
+					`clientIp="10.0.0.1:5000",appId="InDesign1",appVersion="19.2",appLocale="en_US",`+
+					`nglVersion="1.35.0.19",osName="MAC",osVersion="14.3.1",`+
+					`userId="9f22a90139cbb9f1676b0113e1fb574976dc550a",days_to_expiry=1.02,`+
+					`profileId="e9a63683-8dc5-4ca0-872d-e6cc7c8d50fc" 1710358298773`,
+			),
+		},
+		{
+			name: "line format options",
+			options: `measurement launches_{appId}
+				fingerprint
+				address_family
+				enrichers {
+					static {
+						fleet "design studio"
+					}
+				}`,
+			files: []string{"testdata/indesign-single-session-1.txt"},
+			check: func(t *testing.T, writes []influxtest.Write) {
+				p := onlyPoint(t, writes)
+				if p.Measurement != "launches_InDesign1" {
+					t.Errorf("Expected measurement launches_InDesign1, got %q", p.Measurement)
+				}
+				if p.Tags["fleet"] != "design studio" || p.Tags["addressFamily"] != "ipv4" || p.Tags["fingerprint"] == "" {
+					t.Errorf("Expected fleet, addressFamily, and fingerprint tags, got %v", p.Tags)
+				}
+			},
+		},
+		{
+			name: "retention policies",
+			options: `policies {
+					sessions four_weeks
+				}`,
+			files: []string{"testdata/indesign-single-session-1.txt"},
+			check: func(t *testing.T, writes []influxtest.Write) {
+				onlyPoint(t, writes)
+				if writes[0].Database != "tracker" || writes[0].RetentionPolicy != "four_weeks" || writes[0].Precision != "ms" {
+					t.Errorf("Expected a write to tracker.four_weeks in ms, got %+v", writes[0])
+				}
+			},
+		},
+		{
+			name: "filtered",
+			options: `filter drop {
+					appId == InDesign1
+				}`,
+			files: []string{"testdata/indesign-single-session-1.txt"},
+			check: expectLines(),
+		},
+		{
+			name:    "duplicates",
+			options: "dedup_store {tmp}/dedup.bin",
+			files:   []string{"testdata/indesign-single-session-1.txt", "testdata/indesign-single-session-1.txt"},
+			check: func(t *testing.T, writes []influxtest.Write) {
+				onlyPoint(t, writes)
+			},
+		},
+		{
+			name:    "ags events",
+			options: "parser ags",
+			files:   []string{"testdata/ags-validation-1.txt"},
+			check: func(t *testing.T, writes []influxtest.Write) {
+				if len(writes) == 0 || len(writes[0].Points) == 0 {
+					t.Fatalf("Expected AGS events to be written")
+				}
+				for _, p := range writes[0].Points {
+					if p.Time.IsZero() {
+						t.Errorf("Expected every AGS event to have a timestamp, got %+v", p)
+					}
+				}
+			},
+		},
+	} {
+		for _, version := range []int{1, 2} {
+			t.Run(fmt.Sprintf("%s v%d", c.name, version), func(t *testing.T) {
+				server := influxtest.NewServer(version, "secret")
+				defer server.Close()
+				m := newIntegrationTracker(t, server, strings.ReplaceAll(c.options, "{tmp}", t.TempDir()))
+				for _, file := range c.files {
+					uploadFile(t, m, file)
+				}
+				c.check(t, server.Writes())
+			})
+		}
+	}
+}
+
+// expectLines checks that exactly the given lines were written.
+func expectLines(lines ...string) func(t *testing.T, writes []influxtest.Write) {
+	return func(t *testing.T, writes []influxtest.Write) {
+		var got []string
+		for _, w := range writes {
+			got = append(got, w.Lines...)
+		}
+		if !reflect.DeepEqual(got, lines) {
+			t.Errorf("Expected lines:\n%s\ngot:\n%s", strings.Join(lines, "\n"), strings.Join(got, "\n"))
+		}
+	}
+}
+
+// onlyPoint checks that a single point was written, and returns it.
+func onlyPoint(t *testing.T, writes []influxtest.Write) influxtest.Point {
+	t.Helper()
+	if len(writes) != 1 || len(writes[0].Points) != 1 {
+		t.Fatalf("Expected a single point written, got %+v", writes)
+	}
+	return writes[0].Points[0]
+}
+
+func TestIntegrationFailures(t *testing.T) {
+	partial := `{"code":"invalid","message":"partial write has occurred, errors encountered on line(s): line 2: field type conflict"}`
+	for _, c := range []struct {
+		name     string
+		status   int
+		body     string
+		requests int
+		written  int
+		outcome  string
+	}{
+		{"server error", http.StatusInternalServerError, "oops", 1, 0, auditFailed},
+		{"rejected token", http.StatusUnauthorized, `{"code":"unauthorized"}`, 1, 0, auditFailed},
+		{"partial write", http.StatusBadRequest, partial, 1, 0, auditPartial},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := influxtest.NewServer(2, "secret")
+			defer server.Close()
+			auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+			m := newIntegrationTracker(t, server, "audit_log "+auditFile)
+			server.FailNext(c.status, c.body)
+			uploadFile(t, m, "testdata/indesign-multi-session-1-2.txt")
+			if server.Requests() != c.requests || len(server.Lines()) != c.written {
+				t.Errorf("Expected %d requests writing %d lines, got %d requests writing %d",
+					c.requests, c.written, server.Requests(), len(server.Lines()))
+			}
+			_ = m.audit.Close()
+			var rec auditRecord
+			readOneRecord(t, auditFile, &rec)
+			if rec.Outcome != c.outcome || rec.SessionsFound != 2 {
+				t.Errorf("Expected outcome %s for 2 sessions, got %+v", c.outcome, rec)
+			}
+		})
+	}
+}
+
+func TestIntegrationTokenRetry(t *testing.T) {
+	server := influxtest.NewServer(2, "rotated")
+	defer server.Close()
+	m := newIntegrationTracker(t, server, "")
+	// the token is swapped (as via the admin API) while
+	// the first write is in flight
+	var once sync.Once
+	server.OnRequest = func(r *http.Request) {
+		once.Do(func() { m.token.set("rotated") })
+	}
+	uploadFile(t, m, "testdata/indesign-single-session-1.txt")
+	writes := server.Writes()
+	if server.Requests() != 2 || len(writes) != 1 || writes[0].Authorization != "Token rotated" {
+		t.Errorf("Expected a rejected write and a retry with the new token, got %d requests and %+v",
+			server.Requests(), writes)
+	}
+}
+
+func TestIntegrationRetryLater(t *testing.T) {
+	partial := `{"code":"invalid","message":"partial write has occurred, errors encountered on line(s): line 2: field type conflict"}`
+	for _, c := range []struct {
+		name    string
+		status  int
+		body    string
+		retried bool // whether the relay is told to retry
+	}{
+		{"server error", http.StatusInternalServerError, "oops", true},
+		{"rejected token", http.StatusUnauthorized, `{"code":"unauthorized"}`, true},
+		{"partial write", http.StatusBadRequest, partial, false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			server := influxtest.NewServer(2, "secret")
+			defer server.Close()
+			m := newIntegrationTracker(t, server, "on_error retry-later")
+			server.FailNext(c.status, c.body)
+			err := serveFile(t, m, "testdata/indesign-multi-session-1-2.txt", integrationClient)
+			var handlerErr caddyhttp.HandlerError
+			if !c.retried {
+				if err != nil {
+					t.Fatalf("Expected the upload passed on, got %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &handlerErr) || handlerErr.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("Expected a 503 answer, got %v", err)
+			}
+			// the relay's retry is written
+			uploadFile(t, m, "testdata/indesign-multi-session-1-2.txt")
+			if lines := server.Lines(); len(lines) != 2 {
+				t.Errorf("Expected the retry to write 2 sessions, got %v", lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package influxtest provides a mock Influx write endpoint, so that
+// the tracker's uploads can be tested end to end without a database.
+package influxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// A Write is a request that the server accepted.
+type Write struct {
+	Path            string // the path written to: /write or /api/v2/write
+	Database        string
+	RetentionPolicy string
+	Precision       string
+	Authorization   string
+	Lines           []string
+	Points          []Point
+}
+
+// A response is a scripted response to a write.
+type response struct {
+	status int
+	body   string
+}
+
+// A Server is a mock Influx server that accepts writes in the style
+// of a v1 database (Version 1) or a v2 database (Version 2), which
+// also takes v1-style writes on /write.  Each write is checked as a
+// real database would check it: the token must match, the database
+// must be given, and every line must be valid line protocol with a
+// plausible timestamp for its precision.  Writes that pass are
+// recorded, and answered with 204 No Content, unless a failure has
+// been scripted for them with FailNext.
+type Server struct {
+	*httptest.Server
+	Version int
+
+	// OnRequest, if set, is called with each request before it's
+	// checked, so tests can change things (such as the token the
+	// tracker holds) between a failed write and its retry.
+	OnRequest func(r *http.Request)
+
+	mu       sync.Mutex
+	token    string
+	requests int
+	writes   []Write
+	script   []response
+}
+
+// NewServer starts a mock server of the given version that accepts
+// writes with the given token (or any token, if it's empty).  Since
+// the tracker only writes to https endpoints, the server uses TLS,
+// with a certificate that only its Client trusts.
+func NewServer(version int, token string) *Server {
+	s := &Server{Version: version, token: token}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// TrustInDefaultClient makes http.DefaultClient, which the uploader
+// uses, trust the server's certificate, until the returned function
+// is called.  Tests that use it can't run in parallel.
+func (s *Server) TrustInDefaultClient() (restore func()) {
+	old := http.DefaultClient.Transport
+	http.DefaultClient.Transport = s.Client().Transport
+	return func() { http.DefaultClient.Transport = old }
+}
+
+// SetToken changes the token the server accepts.
+func (s *Server) SetToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// FailNext scripts a response to the next write that would otherwise
+// succeed.  Scripted responses are used in the order given.
+func (s *Server) FailNext(status int, body string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, response{status, body})
+}
+
+// Requests returns the number of requests made, including failed ones.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// Writes returns the writes accepted so far.
+func (s *Server) Writes() []Write {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Write(nil), s.writes...)
+}
+
+// Lines returns the lines of all the writes accepted so far.
+func (s *Server) Lines() []string {
+	var lines []string
+	for _, w := range s.Writes() {
+		lines = append(lines, w.Lines...)
+	}
+	return lines
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if s.OnRequest != nil {
+		s.OnRequest(r)
+	}
+	s.mu.Lock()
+	s.requests++
+	token := s.token
+	s.mu.Unlock()
+	write, status, err := s.check(r, token)
+	if err != nil {
+		s.fail(w, status, err.Error())
+		return
+	}
+	s.mu.Lock()
+	if len(s.script) > 0 {
+		next := s.script[0]
+		s.script = s.script[1:]
+		s.mu.Unlock()
+		w.WriteHeader(next.status)
+		_, _ = io.WriteString(w, next.body)
+		return
+	}
+	s.writes = append(s.writes, write)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// check checks a write request, returning the write if it's
+// acceptable, and otherwise the status and error to answer with.
+func (s *Server) check(r *http.Request, token string) (Write, int, error) {
+	write := Write{Path: r.URL.Path, Authorization: r.Header.Get("Authorization")}
+	q := r.URL.Query()
+	switch {
+	case r.Method != http.MethodPost:
+		return write, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed")
+	case r.URL.Path == "/write":
+		write.Database, write.RetentionPolicy = q.Get("db"), q.Get("rp")
+		if write.Database == "" {
+			return write, http.StatusBadRequest, fmt.Errorf("database is required")
+		}
+	case r.URL.Path == "/api/v2/write" && s.Version >= 2:
+		if q.Get("org") == "" || q.Get("bucket") == "" {
+			return write, http.StatusBadRequest, fmt.Errorf("org and bucket are required")
+		}
+		write.Database, write.RetentionPolicy, _ = strings.Cut(q.Get("bucket"), "/")
+	default:
+		return write, http.StatusNotFound, fmt.Errorf("not found")
+	}
+	if !s.authorized(r, token) {
+		return write, http.StatusUnauthorized, fmt.Errorf("unauthorized access")
+	}
+	write.Precision = q.Get("precision")
+	if write.Precision == "" {
+		write.Precision = "ns"
+	}
+	if _, ok := precisions[write.Precision]; !ok {
+		return write, http.StatusBadRequest, fmt.Errorf("invalid precision %q", write.Precision)
+	}
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		return write, http.StatusBadRequest, fmt.Errorf("cannot read body: %v", err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := ParseLine(line, write.Precision)
+		if err != nil {
+			return write, http.StatusBadRequest, fmt.Errorf("unable to parse '%s': %v", line, err)
+		}
+		write.Lines = append(write.Lines, line)
+		write.Points = append(write.Points, point)
+	}
+	if len(write.Lines) == 0 {
+		return write, http.StatusBadRequest, fmt.Errorf("no points in write")
+	}
+	return write, 0, nil
+}
+
+// authorized reports whether a request carries the token.  Both
+// versions take it in an Authorization header, with the Token or
+// Bearer scheme; v1 databases also take it as a password.
+func (s *Server) authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "Token "+token || auth == "Bearer "+token {
+		return true
+	}
+	if s.Version < 2 {
+		if _, password, ok := r.BasicAuth(); ok && password == token {
+			return true
+		}
+		return r.URL.Query().Get("p") == token
+	}
+	return false
+}
+
+// fail answers a request with an error in the style of the
+// server's version.
+func (s *Server) fail(w http.ResponseWriter, status int, message string) {
+	var body any
+	if s.Version < 2 {
+		body = map[string]string{"error": message}
+	} else {
+		code := "invalid"
+		if status == http.StatusUnauthorized {
+			code = "unauthorized"
+		} else if status == http.StatusNotFound {
+			code = "not found"
+		}
+		body = map[string]string{"code": code, "message": message}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package influxtest
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	p, err := ParseLine(`log\ session,appId=Photo\,shop,os\=name=MAC count=3i,ok=true,ratio=0.5,note="say \"hi\", ok" 1716994039000`, "ms")
+	if err != nil {
+		t.Fatalf("Failed to parse line: %v", err)
+	}
+	expected := Point{
+		Measurement: "log session",
+		Tags:        map[string]string{"appId": "Photo,shop", "os=name": "MAC"},
+		Fields:      map[string]string{"count": "3i", "ok": "true", "ratio": "0.5", "note": `"say \"hi\", ok"`},
+		Time:        time.UnixMilli(1716994039000).UTC(),
+	}
+	if !reflect.DeepEqual(p, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, p)
+	}
+	if _, err := ParseLine("m f=1", "ns"); err != nil {
+		t.Errorf("Expected a line without a timestamp to parse: %v", err)
+	}
+	for _, bad := range []string{
+		"m",
+		"m 1716994039000",
+		",t=1 f=1",
+		"m,t f=1",
+		"m,t= f=1",
+		"m f= 1716994039000",
+		"m f=1x",
+		"m f=12.5i",
+		"m f=NaN",
+		`m f="open`,
+		`m f="a"b"`,
+		`m f="ends in escape\"`,
+		"m f=1 soon",
+		"m f=1 1716994039000 extra",
+		"m f=1 1716994039000000000", // nanoseconds written as milliseconds
+		"m f=1 1716994039",          // seconds written as milliseconds
+	} {
+		if _, err := ParseLine(bad, "ms"); err == nil {
+			t.Errorf("Expected an error parsing %q", bad)
+		}
+	}
+}
+
+func TestServerChecks(t *testing.T) {
+	line := "m,t=1 f=1i 1716994039000"
+	for _, c := range []struct {
+		version int
+		path    string
+		auth    string
+		body    string
+		status  int
+		errKey  string
+	}{
+		{1, "/write?db=d&rp=r&precision=ms", "Token tok", line, 204, ""},
+		{1, "/write?db=d&precision=ms&p=tok", "", line, 204, ""},
+		{1, "/write?db=d&precision=ms", "Token other", line, 401, "error"},
+		{1, "/write?precision=ms", "Token tok", line, 400, "error"},
+		{1, "/write?db=d&precision=ms", "Token tok", "m f=1 17169940390", 400, "error"},
+		{1, "/api/v2/write?org=o&bucket=d/r&precision=ms", "Token tok", line, 404, "error"},
+		{2, "/api/v2/write?org=o&bucket=d/r&precision=ms", "Bearer tok", line, 204, ""},
+		{2, "/write?db=d&precision=ms&p=tok", "", line, 401, "code"},
+		{2, "/write?db=d&precision=ms", "Token tok", "\n\n", 400, "code"},
+	} {
+		s := NewServer(c.version, "tok")
+		req, _ := http.NewRequest("POST", s.URL+c.path, strings.NewReader(c.body))
+		if c.auth != "" {
+			req.Header.Set("Authorization", c.auth)
+		}
+		res, err := s.Client().Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		content, _ := io.ReadAll(res.Body)
+		_ = res.Body.Close()
+		body := string(content)
+		s.Close()
+		if res.StatusCode != c.status {
+			t.Errorf("v%d %s: expected status %d, got %d (%s)", c.version, c.path, c.status, res.StatusCode, body)
+		}
+		if c.errKey != "" && !strings.Contains(body, `"`+c.errKey+`"`) {
+			t.Errorf("v%d %s: expected a %q in the error, got %s", c.version, c.path, c.errKey, body)
+		}
+		if c.status == 204 && (len(s.Writes()) != 1 || s.Writes()[0].Database != "d" || s.Lines()[0] != line) {
+			t.Errorf("v%d %s: expected the write recorded, got %+v", c.version, c.path, s.Writes())
+		}
+	}
+}
+
+func TestServerScript(t *testing.T) {
+	s := NewServer(2, "")
+	defer s.Close()
+	s.FailNext(http.StatusServiceUnavailable, "busy")
+	post := func() int {
+		res, err := s.Client().Post(s.URL+"/write?db=d&precision=ms", "text/plain", strings.NewReader("m f=1 1716994039000"))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		_ = res.Body.Close()
+		return res.StatusCode
+	}
+	if status := post(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected the scripted failure, got %d", status)
+	}
+	if status := post(); status != http.StatusNoContent {
+		t.Errorf("Expected success after the script ran out, got %d", status)
+	}
+	if s.Requests() != 2 || len(s.Writes()) != 1 {
+		t.Errorf("Expected 2 requests and 1 write, got %d and %d", s.Requests(), len(s.Writes()))
+	}
+}
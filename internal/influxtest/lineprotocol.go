@@ -0,0 +1,190 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package influxtest provides a mock Influx write endpoint, so that
+// the tracker's uploads can be tested end to end without a database.
+package influxtest
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// precisions gives the duration of a timestamp unit in each precision.
+var precisions = map[string]time.Duration{
+	"ns": time.Nanosecond,
+	"n":  time.Nanosecond,
+	"us": time.Microsecond,
+	"u":  time.Microsecond,
+	"ms": time.Millisecond,
+	"s":  time.Second,
+}
+
+// The range of plausible timestamps.  A timestamp outside it
+// almost certainly has the wrong precision.
+var (
+	earliestTimestamp = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	latestTimestamp   = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// A Point is a parsed line of line protocol.  Names and tag values
+// are unescaped; field values are as written (such as `12i` or
+// `"text"`), so their types can be checked.
+type Point struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]string
+	Time        time.Time // zero if the line has no timestamp
+}
+
+// nameUnescaper unescapes measurement names, tag keys and values,
+// and field keys.
+var nameUnescaper = strings.NewReplacer(`\,`, `,`, `\=`, `=`, `\ `, ` `, `\\`, `\`)
+
+// ParseLine parses a line of line protocol, whose timestamp (if it
+// has one) is in the given precision, and checks it as a database
+// would: the measurement and keys must be non-empty, there must be
+// at least one field, every field value must be a valid float,
+// integer, unsigned integer, boolean, or string, and the timestamp
+// must be an integer.  In addition, the timestamp must be between
+// 2000 and 2200, to catch timestamps written in the wrong precision.
+func ParseLine(line string, precision string) (Point, error) {
+	unit, ok := precisions[precision]
+	if !ok {
+		return Point{}, fmt.Errorf("invalid precision %q", precision)
+	}
+	sections, err := split(line, ' ')
+	if err != nil {
+		return Point{}, err
+	}
+	if len(sections) < 2 || len(sections) > 3 {
+		return Point{}, fmt.Errorf("expected a measurement, fields, and an optional timestamp")
+	}
+	keys, err := split(sections[0], ',')
+	if err != nil {
+		return Point{}, err
+	}
+	p := Point{Measurement: nameUnescaper.Replace(keys[0]), Tags: make(map[string]string), Fields: make(map[string]string)}
+	if p.Measurement == "" {
+		return Point{}, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range keys[1:] {
+		key, value, err := splitPair(tag)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid tag %q: %v", tag, err)
+		}
+		if value == "" {
+			return Point{}, fmt.Errorf("missing value for tag %q", key)
+		}
+		p.Tags[key] = nameUnescaper.Replace(value)
+	}
+	fields, err := split(sections[1], ',')
+	if err != nil {
+		return Point{}, err
+	}
+	for _, field := range fields {
+		key, value, err := splitPair(field)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid field %q: %v", field, err)
+		}
+		if err := checkFieldValue(value); err != nil {
+			return Point{}, fmt.Errorf("invalid value for field %q: %v", key, err)
+		}
+		p.Fields[key] = value
+	}
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return Point{}, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		if ts >= 0 && ts <= math.MaxInt64/int64(unit) {
+			p.Time = time.Unix(0, 0).Add(time.Duration(ts) * unit).UTC()
+		}
+		if p.Time.Before(earliestTimestamp) || p.Time.After(latestTimestamp) {
+			return Point{}, fmt.Errorf("timestamp %d is implausible for precision %s", ts, precision)
+		}
+	}
+	return p, nil
+}
+
+// split splits s at each unescaped sep that isn't in a quoted
+// string.  Backslash escapes are kept, to be undone later.
+func split(s string, sep byte) ([]string, error) {
+	var parts []string
+	start, quoted := 0, false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated string")
+	}
+	return append(parts, s[start:]), nil
+}
+
+// splitPair splits a key=value pair at its first unescaped equals
+// sign, and unescapes the key.
+func splitPair(pair string) (string, string, error) {
+	for i := 0; i < len(pair); i++ {
+		switch pair[i] {
+		case '\\':
+			i++
+		case '=':
+			key := nameUnescaper.Replace(pair[:i])
+			if key == "" {
+				return "", "", fmt.Errorf("missing key")
+			}
+			return key, pair[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("missing equals sign")
+}
+
+// checkFieldValue checks that a field value is well formed.
+func checkFieldValue(value string) error {
+	switch {
+	case value == "":
+		return fmt.Errorf("missing value")
+	case value[0] == '"':
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '\\':
+				i++
+			case '"':
+				if i != len(value)-1 {
+					return fmt.Errorf("unescaped quote in string")
+				}
+				return nil
+			}
+		}
+		return fmt.Errorf("unterminated string")
+	case strings.HasSuffix(value, "i"):
+		_, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+		return err
+	case strings.HasSuffix(value, "u"):
+		_, err := strconv.ParseUint(value[:len(value)-1], 10, 64)
+		return err
+	}
+	switch value {
+	case "t", "T", "true", "True", "TRUE", "f", "F", "false", "False", "FALSE":
+		return nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		return fmt.Errorf("%s is not a finite number", value)
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+)
+
+// reportLimits logs and counts the limits that were hit
+// while parsing an upload for the named tracker.
+func reportLimits(l *core.Limits, name string, remoteAddr string, logger *zap.Logger) {
+	for limit, count := range l.Truncated() {
+		trackerMetrics.init.Do(initTrackerMetrics)
+		logger.Warn("AdobeUsageTracker: upload parsing truncated by limit",
+			zap.String("remote-address", remoteAddr),
+			zap.String("limit", limit),
+			zap.Int("count", count),
+		)
+		trackerMetrics.truncations.WithLabelValues(name, limit).Inc()
+	}
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"os"
+	"sync"
+	"time"
+)
+
+// mappingCheckInterval is how often mapping files are checked for changes.
+const mappingCheckInterval = 10 * time.Second
+
+// A mappingFile is a file of mappings from names to values, such as
+// networks to sites, that is kept outside the Caddy config so it can
+// be updated without a reload.  The file is a YAML mapping (or, since
+// YAML includes JSON, a JSON object) whose values are all scalars.
+//
+// The file is checked for changes periodically, and whenever it
+// changes its mappings are passed to apply, which builds whatever
+// it needs from them and swaps that in all at once.  If the file
+// can't be read, or apply rejects its mappings, the error is logged
+// and the mappings already applied stay in use, so a bad edit never
+// leaves a half-loaded table.  Since editors and deploy tools may
+// write the file in place, it's best to write a new file and rename
+// it over the old one.
+type mappingFile struct {
+	path  string
+	apply func(mappings map[string]string) error
+
+	modTime time.Time
+	size    int64
+	lastErr string
+
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+// watchMappingFile loads a mapping file, passing its mappings to
+// apply, and starts watching it for changes.  An error loading it
+// is returned, since it means the config is wrong.
+func watchMappingFile(path string, apply func(mappings map[string]string) error) (*mappingFile, error) {
+	if path == "" {
+		return nil, fmt.Errorf("mapping file path cannot be empty")
+	}
+	f := &mappingFile{path: path, apply: apply, stop: make(chan struct{})}
+	if _, err := f.reload(); err != nil {
+		return nil, err
+	}
+	f.done.Add(1)
+	go f.watch()
+	return f, nil
+}
+
+// reload applies the file's mappings if it has changed since they
+// were last read, and reports whether it had.
+func (f *mappingFile) reload() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, fmt.Errorf("cannot read mapping file: %v", err)
+	}
+	if info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return false, nil
+	}
+	f.modTime, f.size = info.ModTime(), info.Size()
+	content, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, fmt.Errorf("cannot read mapping file: %v", err)
+	}
+	var mappings map[string]string
+	if err := yaml.Unmarshal(content, &mappings); err != nil {
+		return false, fmt.Errorf("cannot parse mapping file %q: %v", f.path, err)
+	}
+	if err := f.apply(mappings); err != nil {
+		return false, fmt.Errorf("mapping file %q: %v", f.path, err)
+	}
+	return true, nil
+}
+
+// watch checks the file for changes until the watcher is closed.
+// Each distinct error is only logged once, so that a missing file
+// doesn't flood the log.
+func (f *mappingFile) watch() {
+	defer f.done.Done()
+	ticker := time.NewTicker(mappingCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-ticker.C:
+		}
+		changed, err := f.reload()
+		switch {
+		case err != nil:
+			if err.Error() != f.lastErr {
+				caddy.Log().Error("AdobeUsageTracker: cannot reload mapping file, keeping its old mappings",
+					zap.String("path", f.path), zap.Error(err))
+			}
+			f.lastErr = err.Error()
+		case changed:
+			caddy.Log().Info("AdobeUsageTracker: reloaded mapping file", zap.String("path", f.path))
+			f.lastErr = ""
+		}
+	}
+}
+
+// close stops watching the file.
+func (f *mappingFile) close() {
+	if f == nil {
+		return
+	}
+	close(f.stop)
+	f.done.Wait()
+}
@@ -0,0 +1,68 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMappingFileReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sites.yaml")
+	write := func(content string, age time.Duration) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("Failed to write mapping file: %v", err)
+		}
+		when := time.Now().Add(-age)
+		if err := os.Chtimes(path, when, when); err != nil {
+			t.Fatalf("Failed to set mapping file time: %v", err)
+		}
+	}
+	write("10.0.0.0/8: hq\n10.1.0.0/16: 42\n", 3*time.Minute)
+	var applied map[string]string
+	f, err := watchMappingFile(path, func(mappings map[string]string) error {
+		if mappings["bad"] != "" {
+			return os.ErrInvalid
+		}
+		applied = mappings
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to load mapping file: %v", err)
+	}
+	defer f.close()
+	if expected := map[string]string{"10.0.0.0/8": "hq", "10.1.0.0/16": "42"}; !reflect.DeepEqual(applied, expected) {
+		t.Errorf("Expected %v, got %v", expected, applied)
+	}
+	if changed, err := f.reload(); changed || err != nil {
+		t.Errorf("Expected an unchanged file not to reload, got %v, %v", changed, err)
+	}
+	// JSON is accepted, too
+	write(`{"10.0.0.0/8": "hq", "10.2.0.0/16": "lab"}`, 2*time.Minute)
+	if changed, err := f.reload(); !changed || err != nil {
+		t.Fatalf("Expected a changed file to reload, got %v, %v", changed, err)
+	}
+	if expected := map[string]string{"10.0.0.0/8": "hq", "10.2.0.0/16": "lab"}; !reflect.DeepEqual(applied, expected) {
+		t.Errorf("Expected %v, got %v", expected, applied)
+	}
+	// bad edits keep the old mappings
+	for i, content := range []string{"bad: mapping\n", "[not, a, mapping]\n", "nested: {a: b}\n"} {
+		write(content, time.Duration(i)*time.Second)
+		if _, err := f.reload(); err == nil {
+			t.Errorf("Expected an error reloading %q", content)
+		}
+		if applied["10.2.0.0/16"] != "lab" {
+			t.Errorf("Expected the old mappings kept after reloading %q, got %v", content, applied)
+		}
+	}
+	if _, err := watchMappingFile(filepath.Join(t.TempDir(), "missing.yaml"), func(map[string]string) error { return nil }); err == nil {
+		t.Errorf("Expected an error watching a missing file")
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"sync"
+)
+
+// The tracker's metrics are registered with the default
+// Prometheus registry, which is the one served by Caddy's
+// metrics handler.  Since they outlive any one configuration,
+// they are registered only once.  Each is labeled with the name
+// of the tracker it counts for, which is empty for unnamed ones.
+var trackerMetrics = struct {
+	init        sync.Once
+	truncations *prometheus.CounterVec
+	suspects    *prometheus.CounterVec
+	panics      *prometheus.CounterVec
+	overflows   *prometheus.CounterVec
+}{
+	init: sync.Once{},
+}
+
+func initTrackerMetrics() {
+	const ns, sub = "caddy", "adobe_usage_tracker"
+
+	trackerMetrics.truncations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "truncations_total",
+		Help:      "Number of uploads whose parsing was truncated by a limit.",
+	}, []string{"tracker", "limit"})
+	trackerMetrics.suspects = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "suspect_uploads_total",
+		Help:      "Number of uploads flagged as suspect, by reason and action.",
+	}, []string{"tracker", "reason", "action"})
+	trackerMetrics.panics = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "parser_panics_total",
+		Help:      "Number of uploads whose parsing panicked, by parser.",
+	}, []string{"tracker", "parser"})
+	trackerMetrics.overflows = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "queue_overflows_total",
+		Help:      "Number of uploads dropped from a full background queue, by policy and by which upload was dropped.",
+	}, []string{"tracker", "policy", "dropped"})
+}
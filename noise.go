@@ -0,0 +1,71 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Aggregate counts (such as the unique users or the sessions of each
+// app) can be published with Laplace noise, so that dashboards built
+// on them can be shared without revealing the exact counts of small
+// groups.  A count that one user or session can change by at most
+// one, published with noise of scale 1/epsilon, is epsilon-
+// differentially private for that user or session.  Smaller
+// epsilons give more privacy and noisier counts.
+
+// validEpsilon checks a privacy budget.  Zero means no noise.
+func validEpsilon(epsilon float64) error {
+	if epsilon < 0 || math.IsNaN(epsilon) || math.IsInf(epsilon, 0) {
+		return fmt.Errorf("epsilon must be a positive number, not %v", epsilon)
+	}
+	return nil
+}
+
+// parseEpsilon parses a privacy budget given in a Caddyfile, where
+// it must be positive, since leaving it out means no noise.
+func parseEpsilon(epsilon string) (float64, error) {
+	e, err := strconv.ParseFloat(epsilon, 64)
+	if err != nil || e <= 0 || validEpsilon(e) != nil {
+		return 0, fmt.Errorf("epsilon must be a positive number, not %q", epsilon)
+	}
+	return e, nil
+}
+
+// noisyCount returns count plus Laplace noise with scale 1/epsilon,
+// rounded to the nearest integer.  Since counts can't be negative,
+// noisy counts below zero are reported as zero.  If epsilon is zero,
+// the count is returned as is.
+func noisyCount(count int, epsilon float64) int {
+	if epsilon == 0 {
+		return count
+	}
+	return max(0, int(math.Round(float64(count)+laplaceNoise(1/epsilon))))
+}
+
+// laplaceNoise returns a sample from the Laplace distribution
+// centered on zero with the given scale.  The randomness comes from
+// crypto/rand, so the noise can't be predicted (and subtracted) by
+// anyone who knows how it was seeded.
+func laplaceNoise(scale float64) float64 {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("cannot read random bytes: %v", err))
+	}
+	// u is uniform on (-0.5, 0.5), excluding the ends, so the
+	// logarithm below is always finite.
+	u := (float64(binary.BigEndian.Uint64(b[:])>>11)+0.5)/(1<<53) - 0.5
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
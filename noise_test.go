@@ -0,0 +1,137 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLaplaceNoise(t *testing.T) {
+	const n, scale = 20000, 2.0
+	var sum, sumAbs float64
+	for i := 0; i < n; i++ {
+		x := laplaceNoise(scale)
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			t.Fatalf("Expected finite noise, got %v", x)
+		}
+		sum += x
+		sumAbs += math.Abs(x)
+	}
+	// the mean is zero, and the mean absolute value is the scale,
+	// each with a standard error of about 0.02 here
+	if mean := sum / n; math.Abs(mean) > 0.1 {
+		t.Errorf("Expected noise centered on 0, got a mean of %v", mean)
+	}
+	if meanAbs := sumAbs / n; math.Abs(meanAbs-scale) > 0.1 {
+		t.Errorf("Expected a mean absolute noise of %v, got %v", scale, meanAbs)
+	}
+}
+
+func TestNoisyCount(t *testing.T) {
+	if got := noisyCount(7, 0); got != 7 {
+		t.Errorf("Expected no noise without an epsilon, got %d", got)
+	}
+	const n = 5000
+	var sum, changed int
+	for i := 0; i < n; i++ {
+		got := noisyCount(1000, 0.5)
+		sum += got
+		if got != 1000 {
+			changed++
+		}
+		if small := noisyCount(0, 0.5); small < 0 {
+			t.Fatalf("Expected noisy counts to be non-negative, got %d", small)
+		}
+	}
+	if mean := float64(sum) / n; math.Abs(mean-1000) > 0.5 {
+		t.Errorf("Expected noisy counts to average 1000, got %v", mean)
+	}
+	if changed < n/2 {
+		t.Errorf("Expected most counts to be changed by noise, but only %d of %d were", changed, n)
+	}
+}
+
+func TestEpsilonConfig(t *testing.T) {
+	for _, value := range []string{"0.1", "1", "8"} {
+		if _, err := parseEpsilon(value); err != nil {
+			t.Errorf("Expected epsilon %q to be valid, got %v", value, err)
+		}
+	}
+	for _, value := range []string{"0", "-1", "NaN", "+Inf", "small"} {
+		if _, err := parseEpsilon(value); err == nil {
+			t.Errorf("Expected epsilon %q to be invalid", value)
+		}
+	}
+	var m AdobeUsageTracker
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		user_sketches {
+			epsilon 0.5
+		}
+		concurrency {
+			epsilon 2
+		}
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal epsilons: %v", err)
+	}
+	if m.Sketches.Epsilon != 0.5 || m.Concurrency.Epsilon != 2 {
+		t.Errorf("Unexpected epsilons: %v and %v", m.Sketches.Epsilon, m.Concurrency.Epsilon)
+	}
+	for _, config := range []string{
+		"user_sketches {\nepsilon 0\n}",
+		"user_sketches {\nepsilon\n}",
+		"user_sketches {\nserialize\nepsilon 1\n}",
+		"concurrency {\nepsilon -2\n}",
+	} {
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\n" + config + "\n}")); err == nil {
+			t.Errorf("Expected an error for %q", config)
+		}
+	}
+	noSend := func(lines []string) error { return nil }
+	if _, err := acquireSketches(SketchConfig{Serialize: true, Epsilon: 1}, "", "test-noise", "db", noSend); err == nil {
+		t.Errorf("Expected an error for serialized sketches with noise")
+	}
+	if _, err := acquireConcurrency(ConcurrencyConfig{Epsilon: math.Inf(1)}, "", "test-noise", "db", noSend); err == nil {
+		t.Errorf("Expected an error for an infinite epsilon")
+	}
+}
+
+func TestNoisyAggregates(t *testing.T) {
+	// with a tiny epsilon, the noise swamps the counts, so
+	// repeated windows all but never give the exact count
+	noSend := func(lines []string) error { return nil }
+	u, err := acquireSketches(SketchConfig{Epsilon: 0.001}, "", "test-noisy-sketches", "db", noSend)
+	if err != nil {
+		t.Fatalf("Failed to acquire sketches: %v", err)
+	}
+	defer u.release()
+	sessions := []core.Session{
+		{SessionId: "a", AppId: "Photoshop1", UserId: "u1"},
+		{SessionId: "b", AppId: "Photoshop1", UserId: "u2"},
+		{SessionId: "c", AppId: "Photoshop1", UserId: "u3"},
+	}
+	exact := 0
+	for i := 0; i < 20; i++ {
+		u.add(sessions)
+		lines, _ := u.tick(time.Now(), true)
+		if len(lines) != 1 {
+			t.Fatalf("Expected one point, got %v", lines)
+		}
+		if strings.Contains(lines[0], " users=3i ") {
+			exact++
+		}
+	}
+	if exact > 2 {
+		t.Errorf("Expected noisy estimates, but %d of 20 were exact", exact)
+	}
+}
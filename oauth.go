@@ -0,0 +1,131 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oauthExpiryMargin is how long before its expiry a bearer
+// token is refreshed, so it never expires while in use.
+const oauthExpiryMargin = time.Minute
+
+// OAuth2Config configures the acquisition of bearer tokens for
+// the write endpoint via the OAuth2 client credentials grant,
+// for endpoints that are behind an OAuth2-protected gateway.
+type OAuth2Config struct {
+	TokenURL     string   `json:"token_url"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+}
+
+// An oauthSource fetches bearer tokens using client credentials,
+// caching each until shortly before it expires.
+type oauthSource struct {
+	config OAuth2Config
+	now    func() time.Time
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// newOAuthSource checks an OAuth2 configuration and returns
+// a token source for it.
+func newOAuthSource(config OAuth2Config) (*oauthSource, error) {
+	u, err := url.Parse(config.TokenURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a valid OAuth2 token URL", config.TokenURL)
+	}
+	if config.ClientID == "" || config.ClientSecret == "" {
+		return nil, fmt.Errorf("an OAuth2 client id and secret must be specified")
+	}
+	return &oauthSource{config: config, now: time.Now}, nil
+}
+
+// current returns a valid bearer token, fetching a new one if
+// there is no cached token or the cached one is about to expire.
+// The token is returned with its scheme, ready for use as the
+// value of an Authorization header.
+func (o *oauthSource) current() (string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token != "" && (o.expiry.IsZero() || o.now().Add(oauthExpiryMargin).Before(o.expiry)) {
+		return o.token, nil
+	}
+	token, expiresIn, err := o.fetch()
+	if err != nil {
+		return "", err
+	}
+	o.token = "Bearer " + token
+	o.expiry = time.Time{}
+	if expiresIn > 0 {
+		o.expiry = o.now().Add(time.Duration(expiresIn) * time.Second)
+	}
+	return o.token, nil
+}
+
+// invalidate discards the cached token, if it's the given one,
+// because the endpoint rejected it.
+func (o *oauthSource) invalidate(token string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.token == token {
+		o.token = ""
+	}
+}
+
+// fetch requests a new token from the token endpoint.
+func (o *oauthSource) fetch() (string, int64, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.config.Scopes, " "))
+	}
+	req, err := http.NewRequest("POST", o.config.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.config.ClientID), url.QueryEscape(o.config.ClientSecret))
+	res, err := reportClient.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("OAuth2 token request failed: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", 0, fmt.Errorf("OAuth2 token response unreadable: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("OAuth2 token request status code: %d", res.StatusCode)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", 0, fmt.Errorf("OAuth2 token response invalid: %v", err)
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("OAuth2 token response has no access token")
+	}
+	if result.TokenType != "" && !strings.EqualFold(result.TokenType, "bearer") {
+		return "", 0, fmt.Errorf("OAuth2 token type must be bearer, not %q", result.TokenType)
+	}
+	return result.AccessToken, result.ExpiresIn, nil
+}
@@ -0,0 +1,106 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTokenServer returns a test OAuth2 token endpoint that issues
+// tokens "token-1", "token-2", ... that expire in an hour.
+func newTokenServer(t *testing.T, issued *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, secret, ok := r.BasicAuth()
+		if !ok || id != "tracker" || secret != "s3cret" || r.FormValue("grant_type") != "client_credentials" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.FormValue("scope") != "write read" {
+			t.Errorf("Unexpected scope: %q", r.FormValue("scope"))
+		}
+		*issued++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"access_token": "token-%d", "token_type": "Bearer", "expires_in": 3600}`, *issued)
+	}))
+}
+
+func TestOAuthSourceCachesAndRefreshes(t *testing.T) {
+	var issued int
+	server := newTokenServer(t, &issued)
+	defer server.Close()
+	source, err := newOAuthSource(OAuth2Config{
+		TokenURL: server.URL, ClientID: "tracker", ClientSecret: "s3cret", Scopes: []string{"write", "read"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create source: %v", err)
+	}
+	now := time.Now()
+	source.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if tok, err := source.current(); err != nil || tok != "Bearer token-1" {
+			t.Errorf("Expected the first token, got %q (%v)", tok, err)
+		}
+	}
+	now = now.Add(time.Hour - oauthExpiryMargin/2)
+	if tok, err := source.current(); err != nil || tok != "Bearer token-2" {
+		t.Errorf("Expected a refreshed token, got %q (%v)", tok, err)
+	}
+	source.invalidate("Bearer token-2")
+	if tok, err := source.current(); err != nil || tok != "Bearer token-3" {
+		t.Errorf("Expected a new token after invalidation, got %q (%v)", tok, err)
+	}
+	source.config.ClientSecret = "wrong"
+	source.invalidate("Bearer token-3")
+	if _, err := source.current(); err == nil {
+		t.Errorf("Expected an error with bad credentials")
+	}
+}
+
+func TestOAuthConfigErrors(t *testing.T) {
+	for _, config := range []OAuth2Config{
+		{TokenURL: "not a url", ClientID: "id", ClientSecret: "secret"},
+		{TokenURL: "https://auth.example.com/token", ClientSecret: "secret"},
+		{TokenURL: "https://auth.example.com/token", ClientID: "id"},
+	} {
+		if _, err := newOAuthSource(config); err == nil {
+			t.Errorf("Expected an error for %v", config)
+		}
+	}
+}
+
+func TestSendWithOAuthRetriesRevokedToken(t *testing.T) {
+	var issued int
+	server := newTokenServer(t, &issued)
+	defer server.Close()
+	source, err := newOAuthSource(OAuth2Config{
+		TokenURL: server.URL, ClientID: "tracker", ClientSecret: "s3cret", Scopes: []string{"write", "read"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create source: %v", err)
+	}
+	m := AdobeUsageTracker{oauth: source}
+	var sent []string
+	err = m.sendWithToken(func(tok string) error {
+		sent = append(sent, core.Authorization(tok))
+		if tok == "Bearer token-1" {
+			return core.UploadError{Status: http.StatusUnauthorized}
+		}
+		return nil
+	}, zap.NewNop())
+	if err != nil || len(sent) != 2 || sent[0] != "Bearer token-1" || sent[1] != "Bearer token-2" {
+		t.Errorf("Expected a retry with a new token, got %v (%v)", sent, err)
+	}
+	if auth := core.Authorization("static"); auth != "Token static" {
+		t.Errorf("Expected the Token scheme for static tokens, got %q", auth)
+	}
+}
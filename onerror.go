@@ -0,0 +1,101 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"strconv"
+)
+
+// Policies for uploads that can't be parsed or processed.
+//
+// With the pass policy (the default), every upload is passed on to
+// the next handler, whatever happens to it.  With the other policies,
+// an upload is completely parsed, and handed off for processing,
+// before it is passed on, and if either fails the client gets an
+// error response instead: the reject policy answers that the upload
+// is bad, and the retry-later policy answers that the service is
+// unavailable, so that a relay retries the upload later.  An upload
+// that fails to parse is not processed at all, and in inline mode a
+// failure to send its sessions is a processing failure.
+const (
+	onErrorPass       = "pass"
+	onErrorReject     = "reject"
+	onErrorRetryLater = "retry-later"
+)
+
+// retryAfter is the delay, in seconds, suggested to clients
+// told to retry an upload later.
+const retryAfter = 60
+
+// validOnError checks that a failure policy is one we know.
+func validOnError(policy string) error {
+	switch policy {
+	case "", onErrorPass, onErrorReject, onErrorRetryLater:
+		return nil
+	}
+	return fmt.Errorf("on_error must be %s, %s, or %s, not %q",
+		onErrorPass, onErrorReject, onErrorRetryLater, policy)
+}
+
+// checksUploads is whether uploads must be parsed and handed off
+// before they are passed on, so that failures can be reported.
+func (m AdobeUsageTracker) checksUploads() bool {
+	return m.OnError == onErrorReject || m.OnError == onErrorRetryLater
+}
+
+// parseFailure returns why a completely read upload failed to
+// parse, or nil if it didn't.  An empty upload is not a failure.
+func parseFailure(up upload, readErr error) error {
+	switch {
+	case readErr != nil:
+		return fmt.Errorf("upload not completely read: %v", readErr)
+	case up.panic != "":
+		return errors.New("upload made the parser panic")
+	case len(up.body) > 0 && len(up.sessions) == 0 && len(up.events) == 0:
+		return errors.New("no sessions found in upload")
+	}
+	return nil
+}
+
+// processFailed records an upload that failed to parse and is
+// being answered with an error.  Nothing parsed from it is sent,
+// but it is reported and audited as it would otherwise have been.
+func (m AdobeUsageTracker) processFailed(up upload, failure error) {
+	if up.panic != "" {
+		m.processCrashed(up)
+		return
+	}
+	logger := caddy.Log()
+	if len(up.body) > 0 {
+		m.reportError(parseFailureReport(up.body, up.userAgent), logger)
+	}
+	m.writeAudit(auditRecord{
+		Timestamp:     up.received,
+		ClientAddress: up.remoteAddr,
+		Bytes:         len(up.body),
+		SessionsFound: len(up.sessions) + len(up.events),
+		Outcome:       auditRejected,
+		Error:         failure.Error(),
+	}, logger)
+}
+
+// failureResponse returns the error with which to answer an upload
+// that failed, according to the failure policy.  Returning it from
+// ServeHTTP lets Caddy's error handling write the response.
+func (m AdobeUsageTracker) failureResponse(w http.ResponseWriter, err error) error {
+	if m.OnError == onErrorRetryLater {
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		return caddyhttp.Error(http.StatusServiceUnavailable, err)
+	}
+	return caddyhttp.Error(http.StatusBadRequest, err)
+}
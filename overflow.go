@@ -0,0 +1,99 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+)
+
+// Policies for uploads that arrive when the background queue is
+// full and they can't be spilled to disk.
+//
+// With the drop-newest policy (the default), the arriving upload is
+// dropped.  With the drop-oldest policy, the oldest queued uploads
+// are dropped to make room for it, so the queue holds the most recent
+// traffic.  With the sample policy, a random fraction of arriving
+// uploads make room as with drop-oldest, and the rest are dropped,
+// so the queue holds a sample of old and new traffic.
+const (
+	overflowDropNewest = "drop-newest"
+	overflowDropOldest = "drop-oldest"
+	overflowSample     = "sample"
+)
+
+// defaultSampleRate is the fraction of arriving uploads
+// kept by the sample policy, if not configured.
+const defaultSampleRate = 0.5
+
+// validQueueOverflow checks that an overflow policy is one we know.
+func validQueueOverflow(policy string) error {
+	switch policy {
+	case "", overflowDropNewest, overflowDropOldest, overflowSample:
+		return nil
+	}
+	return fmt.Errorf("queue_overflow must be %s, %s, or %s, not %q",
+		overflowDropNewest, overflowDropOldest, overflowSample, policy)
+}
+
+// validSampleRate checks that a sample rate is a fraction.
+func validSampleRate(rate string) (float64, error) {
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r <= 0 || r > 1 {
+		return 0, fmt.Errorf("queue_overflow sample rate must be more than 0 and at most 1, not %q", rate)
+	}
+	return r, nil
+}
+
+// overflow applies the queue's overflow policy to an upload that
+// couldn't be queued, for the reason given by err.  If the policy
+// evicts queued uploads to make room, each is passed to the evicted
+// callback.  If the upload is dropped instead, err is returned.
+func (q *uploadQueue) overflow(up upload, err error) error {
+	policy := q.policy
+	if policy == "" {
+		policy = overflowDropNewest
+	}
+	evict := policy == overflowDropOldest || (policy == overflowSample && rand.Float64() < q.rate)
+	// an upload too big for an empty queue would evict everything
+	// and still not fit
+	if q.maxBytes > 0 && int64(len(up.body)) > q.maxBytes {
+		evict = false
+	}
+	for evict {
+		if q.tryQueue(up) {
+			return nil
+		}
+		select {
+		case old, ok := <-q.uploads:
+			if !ok {
+				// the queue was closed
+				evict = false
+				continue
+			}
+			q.bytes.Add(-int64(len(old.body)))
+			countOverflow(q.name, policy, "oldest")
+			if q.evicted != nil {
+				q.evicted(old, fmt.Errorf("%v, and evicted by the %s policy", errQueueFull, policy))
+			}
+		default:
+			// nothing left to evict
+			evict = false
+		}
+	}
+	countOverflow(q.name, policy, "newest")
+	return err
+}
+
+// countOverflow counts an upload dropped by the named tracker's
+// overflow policy.
+func countOverflow(name, policy, dropped string) {
+	trackerMetrics.init.Do(initTrackerMetrics)
+	trackerMetrics.overflows.WithLabelValues(name, policy, dropped).Inc()
+}
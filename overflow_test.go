@@ -0,0 +1,113 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"testing"
+)
+
+// fullQueue returns a length 2 queue whose worker is blocked on
+// the first upload, with two more (client-1 and client-2) queued
+// behind it.  Closing release lets the worker run.
+func fullQueue(t *testing.T, policy string, rate float64, processed *[]string) (*uploadQueue, chan struct{}) {
+	taken, release := make(chan struct{}), make(chan struct{})
+	q := newUploadQueue(2, 0, nil, func(up upload) {
+		if up.remoteAddr == "client-0" {
+			taken <- struct{}{}
+			<-release
+		}
+		*processed = append(*processed, up.remoteAddr)
+	})
+	q.policy, q.rate = policy, rate
+	for i, addr := range []string{"client-0", "client-1", "client-2"} {
+		if err := q.enqueue(upload{remoteAddr: addr}); err != nil {
+			t.Fatalf("Failed to enqueue upload %d: %v", i, err)
+		}
+		if i == 0 {
+			<-taken
+		}
+	}
+	return q, release
+}
+
+func TestQueueOverflowDropNewest(t *testing.T) {
+	var processed []string
+	q, release := fullQueue(t, "", 0, &processed)
+	if err := q.enqueue(upload{remoteAddr: "client-3"}); err == nil {
+		t.Errorf("Expected the newest upload to be dropped")
+	}
+	close(release)
+	q.close()
+	if len(processed) != 3 || processed[2] != "client-2" {
+		t.Errorf("Expected the first 3 uploads processed, got %v", processed)
+	}
+}
+
+func TestQueueOverflowDropOldest(t *testing.T) {
+	for _, c := range []struct {
+		policy string
+		rate   float64
+	}{
+		{overflowDropOldest, 0},
+		{overflowSample, 1},
+	} {
+		var processed, evicted []string
+		q, release := fullQueue(t, c.policy, c.rate, &processed)
+		q.evicted = func(up upload, err error) { evicted = append(evicted, up.remoteAddr) }
+		for _, addr := range []string{"client-3", "client-4"} {
+			if err := q.enqueue(upload{remoteAddr: addr}); err != nil {
+				t.Errorf("%s: Failed to enqueue %s: %v", c.policy, addr, err)
+			}
+		}
+		close(release)
+		q.close()
+		if len(evicted) != 2 || evicted[0] != "client-1" || evicted[1] != "client-2" {
+			t.Errorf("%s: Expected client-1 and client-2 evicted, got %v", c.policy, evicted)
+		}
+		if len(processed) != 3 || processed[1] != "client-3" || processed[2] != "client-4" {
+			t.Errorf("%s: Expected client-0, client-3, and client-4 processed, got %v", c.policy, processed)
+		}
+	}
+}
+
+func TestQueueOverflowTooBig(t *testing.T) {
+	var evicted int
+	q := newUploadQueue(10, 10, nil, func(up upload) {})
+	q.policy, q.evicted = overflowDropOldest, func(up upload, err error) { evicted++ }
+	if err := q.enqueue(upload{body: []byte("more than ten bytes")}); err == nil {
+		t.Errorf("Expected an upload bigger than the queue to be dropped")
+	}
+	q.close()
+	if evicted != 0 {
+		t.Errorf("Expected no uploads evicted for one that can't fit, got %d", evicted)
+	}
+}
+
+func TestUnmarshalQueueOverflow(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		queue_overflow sample 0.25
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	if m.QueueOverflow != overflowSample || m.QueueSampleRate != 0.25 {
+		t.Errorf("Expected sample at 0.25, got %q at %v", m.QueueOverflow, m.QueueSampleRate)
+	}
+	for _, config := range []string{
+		"queue_overflow drop-everything",
+		"queue_overflow drop-oldest 0.5",
+		"queue_overflow sample 0",
+		"queue_overflow sample 2",
+	} {
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\n" + config + "\n}")); err == nil {
+			t.Errorf("Expected %q to be rejected", config)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"strings"
+)
+
+// placeholderPrefix is the prefix of the placeholders that
+// describe what was parsed from an upload.
+const placeholderPrefix = "http.adobe_usage_tracker."
+
+// setPlaceholders sets placeholders on the request describing
+// what was parsed from the upload, for use by other handlers:
+//
+//   - {http.adobe_usage_tracker.bytes}: the size of the upload
+//   - {http.adobe_usage_tracker.session_count}: the number of sessions
+//     (or, with the AGS parser, validation events) parsed
+//   - {http.adobe_usage_tracker.app_ids}: the distinct app IDs of
+//     those sessions or events, comma-separated, in order of appearance
+func setPlaceholders(r *http.Request, up upload) {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	var appIds []string
+	seen := make(map[string]bool)
+	addAppId := func(appId string) {
+		if appId != "" && !seen[appId] {
+			seen[appId] = true
+			appIds = append(appIds, appId)
+		}
+	}
+	for _, session := range up.sessions {
+		addAppId(session.AppId)
+	}
+	for _, event := range up.events {
+		addAppId(event.AppId)
+	}
+	repl.Set(placeholderPrefix+"bytes", len(up.body))
+	repl.Set(placeholderPrefix+"session_count", len(up.sessions)+len(up.events))
+	repl.Set(placeholderPrefix+"app_ids", strings.Join(appIds, ","))
+}
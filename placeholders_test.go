@@ -0,0 +1,63 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/clickonetwo/tracker/core"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPlaceholdersAvailableAfterBodyRead(t *testing.T) {
+	buffer, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	expected := core.ParseLog(string(buffer), "192.0.2.1:1234")
+	repl := caddy.NewReplacer()
+	r := httptest.NewRequest("POST", "/ulecs/v1", bytes.NewReader(buffer))
+	r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+	var m AdobeUsageTracker
+	// the next handler reads the whole body before responding, as a proxy would
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			return err
+		}
+		w.Header().Set("X-Sessions", repl.ReplaceAll("{http.adobe_usage_tracker.session_count}", ""))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	w := httptest.NewRecorder()
+	if err := m.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %s", err)
+	}
+	if got := w.Header().Get("X-Sessions"); got != strconv.Itoa(len(expected)) {
+		t.Errorf("Expected %d sessions in the response header, got %q", len(expected), got)
+	}
+	var appIds []string
+	for _, session := range expected {
+		if session.AppId != "" && !slices.Contains(appIds, session.AppId) {
+			appIds = append(appIds, session.AppId)
+		}
+	}
+	if got := repl.ReplaceAll("{http.adobe_usage_tracker.app_ids}", ""); got != strings.Join(appIds, ",") {
+		t.Errorf("Expected app IDs %q, got %q", strings.Join(appIds, ","), got)
+	}
+	if got := repl.ReplaceAll("{http.adobe_usage_tracker.bytes}", ""); got != strconv.Itoa(len(buffer)) {
+		t.Errorf("Expected %d bytes, got %q", len(buffer), got)
+	}
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The classes of measurement that a tracker writes, each of which
+// can be written with its own retention policy.  Since InfluxDB v2
+// maps each database and retention policy to a bucket, this also
+// allows each class to be written to its own bucket.
+const (
+	classSessions    = "sessions"    // the sessions parsed from NGL logs
+	classRollup      = "rollup"      // the points of the machine rollup
+	classConcurrency = "concurrency" // the points of the concurrency gauge
+	classAGS         = "ags"         // the events parsed from AGS logs
+)
+
+// validPolicyClass checks that a measurement class is one we know.
+func validPolicyClass(class string) error {
+	switch class {
+	case classSessions, classRollup, classConcurrency, classAGS:
+		return nil
+	}
+	return fmt.Errorf("measurement class must be %s, %s, %s, or %s, not %q",
+		classSessions, classRollup, classConcurrency, classAGS, class)
+}
+
+// policyFor returns the retention policy that the given class
+// of measurement is written with.
+func (m AdobeUsageTracker) policyFor(class string) string {
+	if rp, ok := m.rps[class]; ok {
+		return rp
+	}
+	return m.rp
+}
+
+// allPolicies returns the distinct retention policies that
+// the tracker writes with, in order.
+func (m AdobeUsageTracker) allPolicies() []string {
+	seen := map[string]bool{m.rp: true}
+	policies := []string{m.rp}
+	for _, rp := range m.rps {
+		if !seen[rp] {
+			seen[rp] = true
+			policies = append(policies, rp)
+		}
+	}
+	sort.Strings(policies[1:])
+	return policies
+}
@@ -0,0 +1,580 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Processing modes for uploads.
+//
+// In all modes, an upload is parsed as it streams through to the
+// next handler.  The modes differ in how the parsed sessions are
+// sent once the upload is complete.
+//
+// In inline mode (the default), the sessions are sent before the
+// handler returns, so sessions are recorded in the order their
+// uploads arrive.
+//
+// In background mode, the parsed upload is handed to a queue that
+// is processed in arrival order by a background worker. The queue
+// is drained when the tracker is cleaned up (e.g., on config reload),
+// so queued uploads are not lost.  The queue is bounded both by
+// count and by bytes; if a spool directory is configured, uploads
+// that don't fit are spilled to disk, and processed once the
+// in-memory queue has drained.
+//
+// In fire-and-forget mode, each parsed upload is processed on its
+// own goroutine, with no ordering.  Cleanup waits for the uploads
+// still being processed.
+const (
+	modeInline         = "inline"
+	modeBackground     = "background"
+	modeFireAndForget  = "fire-and-forget"
+	defaultQueueLength = 1000
+	defaultQueueMemory = 64 << 20
+)
+
+// validMode checks that a processing mode is one we know.
+func validMode(mode string) error {
+	switch mode {
+	case "", modeInline, modeBackground, modeFireAndForget:
+		return nil
+	}
+	return fmt.Errorf("processing mode must be %s, %s, or %s, not %q",
+		modeInline, modeBackground, modeFireAndForget, mode)
+}
+
+// An upload is the content of a single request, and the
+// sessions parsed from it, to be processed.
+type upload struct {
+	received   time.Time
+	remoteAddr string
+	userAgent  string
+	targetHost string // the normalized host the upload was sent to
+	targetPath string // the normalized path the upload was sent to
+	identity   string // the user identity for directory lookups, if any
+	body       []byte
+	sessions   []core.Session
+	events     []core.AGSEvent // for uploads parsed by the AGS parser
+	spooled    bool            // read back from the spool, so not yet parsed
+	panic      string          // why the parser panicked, if it did
+}
+
+// parseUpload parses the content read from r into the upload,
+// using the configured parser.  If the parser panics, the rest of
+// r is read (so writers to r are never blocked), and the upload is
+// left with its entire content but nothing parsed from it.
+func (m AdobeUsageTracker) parseUpload(r io.Reader, up *upload, limits *core.Limits) (err error) {
+	var content bytes.Buffer
+	defer func() {
+		if p := recover(); p != nil {
+			_, err = io.Copy(&content, r)
+			up.sessions, up.events, up.body = nil, nil, content.Bytes()
+			up.panic = fmt.Sprint(p)
+			caddy.Log().Error("AdobeUsageTracker: recovered from parser panic",
+				zap.String("remote-address", up.remoteAddr), zap.String("panic", up.panic),
+				zap.Stack("stack"))
+		}
+	}()
+	tee := io.TeeReader(r, &content)
+	if m.Parser == parserAGS {
+		up.events, up.body, err = core.ParseAGSReader(tee, up.remoteAddr, limits)
+	} else {
+		up.sessions, up.body, err = core.ParseUploadReader(tee, up.remoteAddr, m.LogTransport, limits)
+		up.sessions = core.ExtractAttributes(up.body, up.sessions, m.extractions)
+	}
+	return err
+}
+
+// processQueued processes an upload taken from the queue,
+// parsing it first if it was read back from the spool.
+func (m AdobeUsageTracker) processQueued(up upload) {
+	if up.spooled {
+		limits := core.NewLimits(m.MaxLineLength, m.MaxLines, m.MaxSessions)
+		_ = m.parseUpload(bytes.NewReader(up.body), &up, limits)
+		reportLimits(limits, m.Name, up.remoteAddr, caddy.Log())
+	}
+	_ = m.processUpload(up)
+}
+
+// processUpload sends the sessions parsed from an upload
+// to the database, and records the outcome.  It returns the
+// error, if any, with which sending the sessions failed.  A
+// partial write is not a failure, since sending the upload
+// again would duplicate the sessions that were written.
+func (m AdobeUsageTracker) processUpload(up upload) error {
+	if up.panic != "" {
+		m.processCrashed(up)
+		return nil
+	}
+	if m.Parser == parserAGS {
+		return m.processAGSUpload(up)
+	}
+	logger := caddy.Log()
+	reasons := m.abuse.inspect(up.sessions, up.remoteAddr, up.received)
+	if len(reasons) > 0 {
+		m.abuse.report(reasons, up, logger)
+	}
+	if m.TargetTags {
+		tagTarget(up.sessions, up.targetHost, up.targetPath, m.tags, logger)
+	}
+	m.directory.enrich(up.sessions, up.identity, logger)
+	enriched := m.enrich(up.sessions, logger)
+	kept := m.transform.apply(m.filter.apply(enriched, logger), logger)
+	if len(reasons) > 0 {
+		if m.abuse.drop {
+			kept = nil
+		} else {
+			kept = tagSuspect(kept, m.tags, logger)
+		}
+	}
+	unique, duplicates := m.dedup.unseen(kept, time.Now())
+	sessions := m.anonymizer.apply(unique, time.Now())
+	logger.Info("AdobeUsageTracker: incoming request summary",
+		zap.String("remote-address", up.remoteAddr),
+		zap.String("user-agent", up.userAgent),
+		zap.Int("content-length", len(up.body)),
+		zap.Int("session-count", len(up.sessions)),
+		zap.Int("duplicate-count", duplicates),
+	)
+	logger.Debug("AdobeUsageTracker: uploading sessions", zap.Objects("sessions", sessions))
+	m.rollup.add(sessions)
+	m.concurrency.add(sessions)
+	m.sketches.add(sessions)
+	m.usage.add(sessions, time.Now())
+	m.export.add(sessions)
+	m.sendEvents("NGL upgrades", m.upgrades.observe(sessions, time.Now()), logger)
+	firstSeen, err := m.versions.observe(m.firstSeenTenant, sessions)
+	if err != nil {
+		logger.Error("AdobeUsageTracker: failed to save first-seen versions", zap.Error(err))
+	}
+	m.sendEvents("first-seen versions", firstSeen, logger)
+	if m.watchdog != nil && len(up.sessions) > 0 {
+		if text := m.watchdog.sessionsParsed(); text != "" {
+			go m.watchdog.notify(text)
+		}
+	}
+	if m.sessionLog != nil {
+		for _, session := range sessions {
+			m.sessionLog.Info("session", zap.Inline(session))
+		}
+	}
+	rec := auditRecord{
+		Timestamp:     up.received,
+		ClientAddress: up.remoteAddr,
+		Bytes:         len(up.body),
+		SessionsFound: len(up.sessions),
+		Outcome:       auditNoSessions,
+	}
+	var failure error
+	if len(up.sessions) == 0 {
+		logger.Info("AdobeUsageTracker: no sessions to upload")
+		if len(up.body) > 0 {
+			m.reportError(parseFailureReport(up.body, up.userAgent), logger)
+		}
+	} else if len(reasons) > 0 && m.abuse.drop {
+		logger.Info("AdobeUsageTracker: all sessions dropped as suspect")
+		rec.Outcome = auditSuspect
+	} else if len(sessions) == 0 && duplicates > 0 {
+		logger.Info("AdobeUsageTracker: all sessions already written")
+		rec.Outcome = auditDuplicate
+	} else if len(sessions) == 0 {
+		logger.Info("AdobeUsageTracker: all sessions dropped by filters or transform")
+		rec.Outcome = auditFiltered
+	} else if m.ep == "" {
+		rec.Outcome = auditLogged
+		m.dedup.remember(unique, time.Now())
+	} else {
+		err := m.sendWithToken(func(tok string) error {
+			return core.SendSessions(m.ep, m.db, m.policyFor(classSessions), tok, m.format, sessions, logger)
+		}, logger)
+		err = m.findRejected(err, classSessions, logger)
+		m.recordSend(err, up, sessions, len(sessions), &rec, logger)
+		if rec.Outcome == auditWritten || rec.Outcome == auditPartial {
+			m.dedup.remember(unique, time.Now())
+		} else {
+			failure = err
+		}
+	}
+	m.writeAudit(rec, logger)
+	return failure
+}
+
+// sendWithToken calls send with the current token.  If the token
+// is rejected, it retries once if the token has been replaced (by a
+// reload or via the admin API) while the send was in flight.
+func (m AdobeUsageTracker) sendWithToken(send func(tok string) error, logger *zap.Logger) error {
+	if m.oauth != nil {
+		return m.sendWithOAuth(send, logger)
+	}
+	tok := m.token.current()
+	err := send(tok)
+	if core.IsAuthError(err) {
+		if newTok := m.token.current(); newTok != tok {
+			logger.Info("AdobeUsageTracker: retrying upload with replacement token")
+			err = send(newTok)
+		}
+	}
+	return err
+}
+
+// sendWithOAuth calls send with a bearer token acquired via OAuth2.
+// If the token is rejected, it retries once with a new token, since
+// the gateway may have revoked the old one before it expired.
+func (m AdobeUsageTracker) sendWithOAuth(send func(tok string) error, logger *zap.Logger) error {
+	tok, err := m.oauth.current()
+	if err != nil {
+		return err
+	}
+	err = send(tok)
+	if core.IsAuthError(err) {
+		m.oauth.invalidate(tok)
+		newTok, tokErr := m.oauth.current()
+		if tokErr != nil {
+			return tokErr
+		}
+		logger.Info("AdobeUsageTracker: retrying upload with new OAuth2 token")
+		err = send(newTok)
+	}
+	return err
+}
+
+// findRejected identifies the points rejected in a partial write
+// of the given class whose response only gave their number, as v1
+// databases do, so that they can be quarantined.  It returns the
+// partial write with the rejected points identified, or err itself
+// if they needn't or can't be.
+func (m AdobeUsageTracker) findRejected(err error, class string, logger *zap.Logger) error {
+	var pw core.PartialWriteError
+	if m.quarantine == nil || !errors.As(err, &pw) || len(pw.Rejected) > 0 {
+		return err
+	}
+	found, findErr := core.FindRejected(pw, func(lines []string) error {
+		return m.sendWithToken(func(tok string) error {
+			return core.UploadLines(m.ep, m.db, m.policyFor(class), tok, lines, logger)
+		}, logger)
+	})
+	if findErr != nil {
+		logger.Error("AdobeUsageTracker: cannot identify rejected points", zap.Error(findErr))
+		return err
+	}
+	return found
+}
+
+// recordSend reports, alerts on, and audits the outcome of
+// sending count points parsed from an upload.  If the database
+// rejected some of the points, those are quarantined.
+func (m AdobeUsageTracker) recordSend(
+	err error, up upload, sessions []core.Session, count int, rec *auditRecord, logger *zap.Logger,
+) {
+	var pw core.PartialWriteError
+	if errors.As(err, &pw) {
+		logger.Warn("AdobeUsageTracker: database rejected some sessions", zap.Error(err))
+		m.reportError(uploadFailureReport(up.body, sessions, err), logger)
+		if m.quarantine != nil {
+			if err := m.quarantine.write(up, sessions, pw); err != nil {
+				logger.Error("AdobeUsageTracker: failed to quarantine rejected sessions", zap.Error(err))
+			}
+		}
+		if m.alerts != nil {
+			m.alerts.writeSucceeded(logger)
+		}
+		rec.Outcome = auditPartial
+		rec.Error = err.Error()
+		rec.SessionsWritten = max(count-pw.Count(), 0)
+	} else if err != nil {
+		logger.Error("AdobeUsageTracker: failed to send sessions", zap.Error(err))
+		m.reportError(uploadFailureReport(up.body, sessions, err), logger)
+		if m.alerts != nil {
+			m.alerts.writeFailed(err, logger)
+		}
+		rec.Outcome = auditFailed
+		rec.Error = err.Error()
+	} else {
+		logger.Info("AdobeUsageTracker: sent sessions successfully")
+		if m.alerts != nil {
+			m.alerts.writeSucceeded(logger)
+		}
+		rec.Outcome = auditWritten
+		rec.SessionsWritten = count
+	}
+}
+
+// sendRollup writes the points of a machine rollup to the database,
+// or logs them if sessions are only being logged.
+func (m *AdobeUsageTracker) sendRollup(lines []string) error {
+	logger := caddy.Log()
+	if m.ep == "" {
+		logger.Info("AdobeUsageTracker: machine rollup", zap.Strings("points", lines))
+		return nil
+	}
+	err := m.sendWithToken(func(tok string) error {
+		return core.UploadLines(m.ep, m.db, m.policyFor(classRollup), tok, lines, logger)
+	}, logger)
+	m.alertOnWrite(err, logger)
+	return err
+}
+
+// sendConcurrency writes the points of a concurrency gauge to the
+// database, or logs them if sessions are only being logged.
+func (m *AdobeUsageTracker) sendConcurrency(lines []string) error {
+	logger := caddy.Log()
+	if m.ep == "" {
+		logger.Info("AdobeUsageTracker: app concurrency", zap.Strings("points", lines))
+		return nil
+	}
+	err := m.sendWithToken(func(tok string) error {
+		return core.UploadLines(m.ep, m.db, m.policyFor(classConcurrency), tok, lines, logger)
+	}, logger)
+	m.alertOnWrite(err, logger)
+	return err
+}
+
+// sendSketches writes the points of the user sketches to the
+// database, or logs them if sessions are only being logged.
+func (m *AdobeUsageTracker) sendSketches(lines []string) error {
+	logger := caddy.Log()
+	if m.ep == "" {
+		logger.Info("AdobeUsageTracker: user sketches", zap.Strings("points", lines))
+		return nil
+	}
+	err := m.sendWithToken(func(tok string) error {
+		return core.UploadLines(m.ep, m.db, m.policyFor(classRollup), tok, lines, logger)
+	}, logger)
+	m.alertOnWrite(err, logger)
+	return err
+}
+
+// alertOnWrite records the outcome of a write with the alerter,
+// if there is one.
+func (m AdobeUsageTracker) alertOnWrite(err error, logger *zap.Logger) {
+	if m.alerts != nil {
+		m.alerts.writeDone(err, logger)
+	}
+}
+
+// writeAudit writes an audit record, if auditing is configured.
+func (m AdobeUsageTracker) writeAudit(rec auditRecord, logger *zap.Logger) {
+	if m.audit != nil {
+		if err := m.audit.write(rec); err != nil {
+			logger.Error("AdobeUsageTracker: failed to write audit record", zap.Error(err))
+		}
+	}
+}
+
+// errQueueFull is returned when an upload can't be queued, and
+// errClosed when an upload arrives after the tracker has been
+// cleaned up (such as a request still in flight when a reload
+// forces its connection closed).
+var (
+	errQueueFull = errors.New("upload queue is full")
+	errClosed    = errors.New("tracker has been cleaned up")
+)
+
+// An uploadQueue hands uploads to a single background worker,
+// which processes them in the order they were queued.  The queue
+// holds at most maxBytes of upload content (if maxBytes is positive).
+// Uploads that don't fit are spilled to the spool, if there is one,
+// and the worker processes those when the in-memory queue is empty.
+type uploadQueue struct {
+	uploads  chan upload
+	maxBytes int64
+	bytes    atomic.Int64
+	spool    *uploadSpool
+	done     sync.WaitGroup
+
+	// closed is set, under mu, when the queue stops accepting
+	// uploads, so that no upload is sent on the closed channel.
+	mu     sync.RWMutex
+	closed bool
+
+	// The tracker's name, the overflow policy, its sample rate, the
+	// callback for evicted uploads, and the callback (if any) given
+	// the number of spooled uploads whenever it changes are set
+	// before the first upload is queued.
+	name         string
+	policy       string
+	rate         float64
+	evicted      func(up upload, err error)
+	spoolChanged func(files int)
+}
+
+// newUploadQueue starts a worker that calls process on each
+// queued upload.
+func newUploadQueue(length int, maxBytes int64, spool *uploadSpool, process func(upload)) *uploadQueue {
+	q := &uploadQueue{uploads: make(chan upload, length), maxBytes: maxBytes, spool: spool}
+	q.done.Add(1)
+	go func() {
+		defer q.done.Done()
+		for {
+			select {
+			case up, ok := <-q.uploads:
+				if !ok {
+					return
+				}
+				q.bytes.Add(-int64(len(up.body)))
+				process(up)
+				continue
+			default:
+			}
+			if q.processSpooled(process) {
+				continue
+			}
+			up, ok := <-q.uploads
+			if !ok {
+				return
+			}
+			q.bytes.Add(-int64(len(up.body)))
+			process(up)
+		}
+	}()
+	return q
+}
+
+// processSpooled processes the oldest spooled upload, if any,
+// and reports whether there was one.
+func (q *uploadQueue) processSpooled(process func(upload)) bool {
+	if q.spool == nil {
+		return false
+	}
+	up, path, err := q.spool.next()
+	if err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to read spooled upload", zap.Error(err))
+		return false
+	}
+	if path == "" {
+		return false
+	}
+	process(up)
+	if err := q.spool.remove(path); err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to remove spooled upload", zap.Error(err))
+	}
+	q.countSpooled()
+	return true
+}
+
+// countSpooled passes the number of spooled uploads to the
+// spoolChanged callback, if there is one.
+func (q *uploadQueue) countSpooled() {
+	if q.spoolChanged == nil {
+		return
+	}
+	files, err := q.spool.count()
+	if err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to count spooled uploads", zap.Error(err))
+		return
+	}
+	q.spoolChanged(files)
+}
+
+// enqueue adds an upload to the queue without blocking.  If the
+// queue is full, the upload is spilled to the spool, if there is one.
+// If it can't be spilled either, the queue's overflow policy decides
+// which upload is dropped, and an error is returned if it's this one.
+// Once the queue is closed, uploads are only spilled to the spool
+// (for the next configuration to process), and rejected otherwise.
+func (q *uploadQueue) enqueue(up upload) error {
+	if q.tryQueue(up) {
+		return nil
+	}
+	if q.spool == nil {
+		if q.isClosed() {
+			return errClosed
+		}
+		return q.overflow(up, errQueueFull)
+	}
+	if err := q.spool.write(up); err != nil {
+		if q.isClosed() {
+			return fmt.Errorf("%v, and spilling to disk failed: %v", errClosed, err)
+		}
+		return q.overflow(up, fmt.Errorf("%v, and spilling to disk failed: %v", errQueueFull, err))
+	}
+	q.countSpooled()
+	return nil
+}
+
+// tryQueue adds an upload to the in-memory queue if it fits,
+// and reports whether it did.
+func (q *uploadQueue) tryQueue(up upload) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return false
+	}
+	size := int64(len(up.body))
+	if total := q.bytes.Add(size); q.maxBytes <= 0 || total <= q.maxBytes {
+		select {
+		case q.uploads <- up:
+			return true
+		default:
+		}
+	}
+	q.bytes.Add(-size)
+	return false
+}
+
+// isClosed reports whether the queue has been closed.
+func (q *uploadQueue) isClosed() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.closed
+}
+
+// close stops accepting uploads and waits for the worker to
+// finish processing the ones already queued.
+func (q *uploadQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	close(q.uploads)
+	q.mu.Unlock()
+	q.done.Wait()
+}
+
+// An uploadGroup runs the processing of fire-and-forget uploads,
+// each on its own goroutine, until it is closed, and close waits
+// for those still running, so that none of them outlives the
+// tracker's audit log, quarantine file, and other resources.
+type uploadGroup struct {
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// run calls process on a new goroutine, and reports whether it
+// did, which it doesn't once the group is closed.
+func (g *uploadGroup) run(process func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		process()
+	}()
+	return true
+}
+
+// close stops running uploads and waits for those still running.
+func (g *uploadGroup) close() {
+	g.mu.Lock()
+	g.closed = true
+	g.mu.Unlock()
+	g.wg.Wait()
+}
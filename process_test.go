@@ -0,0 +1,294 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestValidMode(t *testing.T) {
+	for _, mode := range []string{"", modeInline, modeBackground, modeFireAndForget} {
+		if err := validMode(mode); err != nil {
+			t.Errorf("Expected mode %q to be valid, got %s", mode, err)
+		}
+	}
+	if err := validMode("sometimes"); err == nil {
+		t.Errorf("Expected mode %q to be invalid", "sometimes")
+	}
+}
+
+func TestUploadQueueOrderAndDrain(t *testing.T) {
+	var processed []string
+	release := make(chan struct{})
+	q := newUploadQueue(10, 0, nil, func(up upload) {
+		<-release
+		processed = append(processed, up.remoteAddr)
+	})
+	for i := 0; i < 5; i++ {
+		if err := q.enqueue(upload{remoteAddr: fmt.Sprintf("client-%d", i)}); err != nil {
+			t.Fatalf("Failed to enqueue upload %d", i)
+		}
+	}
+	close(release)
+	q.close()
+	if len(processed) != 5 {
+		t.Fatalf("Expected 5 uploads processed after close, got %d", len(processed))
+	}
+	for i, addr := range processed {
+		if expected := fmt.Sprintf("client-%d", i); addr != expected {
+			t.Errorf("Upload %d: expected %q, got %q", i, expected, addr)
+		}
+	}
+}
+
+func TestUploadQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	q := newUploadQueue(1, 0, nil, func(up upload) { <-release })
+	accepted := 0
+	for i := 0; i < 5; i++ {
+		if err := q.enqueue(upload{}); err == nil {
+			accepted++
+		}
+	}
+	if accepted > 2 {
+		t.Errorf("Expected at most 2 uploads accepted by a length 1 queue, got %d", accepted)
+	}
+	close(release)
+	q.close()
+}
+
+func TestUploadQueueAfterClose(t *testing.T) {
+	q := newUploadQueue(10, 0, nil, func(up upload) {})
+	q.policy = overflowDropOldest
+	q.close()
+	if err := q.enqueue(upload{remoteAddr: "late"}); !errors.Is(err, errClosed) {
+		t.Errorf("Expected a late upload to be rejected, got %v", err)
+	}
+
+	// a closed queue with a spool spills late uploads for the next one
+	spool, err := openUploadSpool(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	q = newUploadQueue(10, 0, spool, func(up upload) {})
+	q.close()
+	if err := q.enqueue(upload{remoteAddr: "late"}); err != nil {
+		t.Errorf("Expected a late upload to be spooled, got %v", err)
+	}
+	if up, path, err := spool.next(); err != nil || up.remoteAddr != "late" {
+		t.Errorf("Expected the late upload in the spool, got %q (%v)", path, err)
+	}
+
+	// uploads that race with close are either processed or rejected
+	var processed atomic.Int32
+	q = newUploadQueue(1, 0, nil, func(up upload) { processed.Add(1) })
+	q.policy = overflowDropOldest
+	var accepted atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if q.enqueue(upload{}) == nil {
+					accepted.Add(1)
+				}
+			}
+		}()
+	}
+	q.close()
+	wg.Wait()
+	if processed.Load() > accepted.Load() {
+		t.Errorf("Expected at most %d uploads processed, got %d", accepted.Load(), processed.Load())
+	}
+}
+
+func TestUploadGroup(t *testing.T) {
+	var g uploadGroup
+	release := make(chan struct{})
+	var finished atomic.Bool
+	if !g.run(func() {
+		<-release
+		finished.Store(true)
+	}) {
+		t.Fatalf("Expected an open group to run uploads")
+	}
+	closed := make(chan struct{})
+	go func() {
+		g.close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatalf("Expected close to wait for the running upload")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	<-closed
+	if !finished.Load() {
+		t.Errorf("Expected the running upload to finish before close returned")
+	}
+	if g.run(func() { t.Errorf("Expected no upload to run after close") }) {
+		t.Errorf("Expected a closed group to refuse uploads")
+	}
+}
+
+func TestServeHTTPStreamsBody(t *testing.T) {
+	buffer, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	var captured upload
+	m := AdobeUsageTracker{Mode: modeBackground}
+	m.queue = newUploadQueue(1, 0, nil, func(up upload) { captured = up })
+	// the next handler reads only the first half of the body
+	var forwarded []byte
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		forwarded = make([]byte, len(buffer)/2)
+		_, err := io.ReadFull(r.Body, forwarded)
+		return err
+	})
+	r := httptest.NewRequest("POST", "/ulecs/v1", bytes.NewReader(buffer))
+	if err := m.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %s", err)
+	}
+	m.queue.close()
+	if !bytes.Equal(forwarded, buffer[:len(buffer)/2]) {
+		t.Errorf("Next handler did not receive the start of the body")
+	}
+	if !bytes.Equal(captured.body, buffer) {
+		t.Errorf("Tracker did not capture the entire body")
+	}
+	if expected := core.ParseLog(string(buffer), r.RemoteAddr); !reflect.DeepEqual(captured.sessions, expected) {
+		t.Errorf("Expected %d sessions, got %d", len(expected), len(captured.sessions))
+	}
+	// client addresses are normalized before parsing
+	r = httptest.NewRequest("POST", "/ulecs/v1", bytes.NewReader(buffer))
+	r.RemoteAddr = "[2001:DB8:0::1]:53450"
+	m.queue = newUploadQueue(1, 0, nil, func(up upload) { captured = up })
+	if err := m.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+		t.Fatalf("ServeHTTP failed: %s", err)
+	}
+	m.queue.close()
+	if captured.remoteAddr != "[2001:db8::1]:53450" || captured.sessions[0].ClientIp != captured.remoteAddr ||
+		captured.sessions[0].AddressFamily != core.FamilyIPv6 {
+		t.Errorf("Expected a normalized IPv6 client address, got %q, %v", captured.remoteAddr, captured.sessions[0])
+	}
+}
+
+func TestServeHTTPOnError(t *testing.T) {
+	buffer, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	for _, c := range []struct {
+		name      string
+		policy    string
+		body      []byte
+		cut       bool // whether the connection fails after the body
+		full      bool // whether the queue is already full
+		status    int  // 0 if the upload is passed on
+		proxied   bool
+		processed bool
+	}{
+		{"pass-bad", onErrorPass, []byte("not a log"), false, false, 0, true, true},
+		{"reject-good", onErrorReject, buffer, false, false, 0, true, true},
+		{"reject-empty", onErrorReject, nil, false, false, 0, true, true},
+		{"reject-bad", onErrorReject, []byte("not a log"), false, false, http.StatusBadRequest, false, false},
+		{"retry-bad", onErrorRetryLater, []byte("not a log"), false, false, http.StatusServiceUnavailable, false, false},
+		{"retry-cut", onErrorRetryLater, buffer, true, false, http.StatusServiceUnavailable, false, false},
+		{"retry-full", onErrorRetryLater, buffer, false, true, http.StatusServiceUnavailable, false, false},
+	} {
+		release, taken := make(chan struct{}), make(chan struct{}, 10)
+		var processed atomic.Bool
+		m := AdobeUsageTracker{Mode: modeBackground, OnError: c.policy}
+		m.queue = newUploadQueue(1, 0, nil, func(up upload) {
+			// the uploads that fill the queue have no receipt time
+			if !up.received.IsZero() {
+				processed.Store(true)
+			}
+			taken <- struct{}{}
+			<-release
+		})
+		if c.full {
+			// one upload being processed, and one waiting
+			_ = m.queue.enqueue(upload{})
+			<-taken
+			_ = m.queue.enqueue(upload{})
+		}
+		var forwarded []byte
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			forwarded, err = io.ReadAll(r.Body)
+			return err
+		})
+		var body io.Reader = bytes.NewReader(c.body)
+		if c.cut {
+			body = io.MultiReader(body, iotest.ErrReader(errors.New("connection reset")))
+		}
+		w := httptest.NewRecorder()
+		err := m.ServeHTTP(w, httptest.NewRequest("POST", "/ulecs/v1", body), next)
+		close(release)
+		m.queue.close()
+		if processed.Load() != c.processed {
+			t.Errorf("%s: expected processed %v, got %v", c.name, c.processed, processed.Load())
+		}
+		var handlerErr caddyhttp.HandlerError
+		if c.status == 0 && err != nil {
+			t.Errorf("%s: expected the upload passed on, got %v", c.name, err)
+		} else if c.status != 0 && (!errors.As(err, &handlerErr) || handlerErr.StatusCode != c.status) {
+			t.Errorf("%s: expected status %d, got %v", c.name, c.status, err)
+		}
+		if (forwarded != nil) != c.proxied || (c.proxied && !bytes.Equal(forwarded, c.body)) {
+			t.Errorf("%s: expected proxied %v, got %d bytes", c.name, c.proxied, len(forwarded))
+		}
+		if c.policy == onErrorRetryLater && w.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: expected a Retry-After header", c.name)
+		}
+	}
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\non_error sometimes\n}")); err == nil {
+		t.Errorf("Expected an error parsing an unknown failure policy")
+	}
+}
+
+func TestProcessUploadLogsSessions(t *testing.T) {
+	buffer, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	obsCore, logs := observer.New(zap.InfoLevel)
+	m := AdobeUsageTracker{sessionLog: zap.New(obsCore)}
+	sessions := core.ParseLog(string(buffer), "127.0.0.1:53450")
+	m.processUpload(upload{remoteAddr: "127.0.0.1:53450", body: buffer, sessions: sessions})
+	entries := logs.All()
+	if len(entries) != len(sessions) {
+		t.Fatalf("Expected %d session log entries, got %d", len(sessions), len(entries))
+	}
+	for i, entry := range entries {
+		fields := entry.ContextMap()
+		if fields["sessionId"] != sessions[i].SessionId || fields["appId"] != sessions[i].AppId {
+			t.Errorf("Entry %d: unexpected fields %v", i, fields)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A quarantineRecord holds a point that the database rejected,
+// along with the reason it gave.  Rejections are caused by the
+// content of the point (such as a field type conflict, or a
+// timestamp beyond the retention policy), so the point would be
+// rejected again if retried as is.  Instead, it is kept so that
+// it can be fixed up and written by hand.
+//
+// A quarantineRecord can instead hold an entire upload that made
+// the parser panic, so that it can be used to reproduce the bug.
+type quarantineRecord struct {
+	Timestamp     time.Time `json:"timestamp"`
+	ClientAddress string    `json:"client_address"`
+	SessionId     string    `json:"session_id,omitempty"`
+	Line          string    `json:"line,omitempty"`
+	Upload        []byte    `json:"upload,omitempty"` // base64-encoded in the file
+	Reason        string    `json:"reason"`
+}
+
+// A quarantineLog appends quarantineRecords, one JSON object
+// per line, to a file.
+type quarantineLog struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openQuarantineLog opens (or creates) the quarantine file at
+// path for appending.
+func openQuarantineLog(path string) (*quarantineLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open quarantine file %q: %v", path, err)
+	}
+	return &quarantineLog{file: f}, nil
+}
+
+// write appends the points rejected in a partial write of an
+// upload.  The sessions, if given, are the ones that were written,
+// in order.
+func (q *quarantineLog) write(up upload, sessions []core.Session, pw core.PartialWriteError) error {
+	indexes := make([]int, 0, len(pw.Rejected))
+	for i := range pw.Rejected {
+		if i < len(pw.Lines) {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	var content []byte
+	for _, i := range indexes {
+		rec := quarantineRecord{
+			Timestamp:     up.received,
+			ClientAddress: up.remoteAddr,
+			Line:          pw.Lines[i],
+			Reason:        pw.Rejected[i],
+		}
+		if i < len(sessions) {
+			rec.SessionId = sessions[i].SessionId
+		}
+		line, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		content = append(append(content, line...), '\n')
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, err := q.file.Write(content)
+	return err
+}
+
+// writeUpload appends an entire upload, with the reason it
+// was quarantined.
+func (q *quarantineLog) writeUpload(up upload, reason string) error {
+	line, err := json.Marshal(quarantineRecord{
+		Timestamp:     up.received,
+		ClientAddress: up.remoteAddr,
+		Upload:        up.body,
+		Reason:        reason,
+	})
+	if err != nil {
+		return err
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, err = q.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying quarantine file.
+func (q *quarantineLog) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.file.Close()
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPartialWriteQuarantine(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprint(w, `{"code":"invalid","message":"partial write has occurred, `+
+			`errors encountered on line(s): line 2: field type conflict"}`)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	quarantine, err := openQuarantineLog(filepath.Join(dir, "quarantine.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open quarantine: %v", err)
+	}
+	audit, err := openAuditLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	m := AdobeUsageTracker{ep: server.URL, db: "db", rp: "rp", quarantine: quarantine, audit: audit}
+	m.token = sharedToken("", m.ep, m.db)
+	sessions := []core.Session{
+		{SessionId: "good", LaunchTime: time.UnixMilli(1716994039000)},
+		{SessionId: "bad", LaunchTime: time.UnixMilli(1716994040000)},
+	}
+	m.processUpload(upload{received: time.Now(), remoteAddr: "127.0.0.1", body: []byte("log"), sessions: sessions})
+	_ = quarantine.Close()
+	_ = audit.Close()
+
+	var q quarantineRecord
+	readOneRecord(t, filepath.Join(dir, "quarantine.jsonl"), &q)
+	if q.SessionId != "bad" || q.Reason != "field type conflict" || q.Line != core.SessionLine(sessions[1], nil, zap.NewNop()) {
+		t.Errorf("Unexpected quarantine record: %v", q)
+	}
+	var a auditRecord
+	readOneRecord(t, filepath.Join(dir, "audit.jsonl"), &a)
+	if a.Outcome != auditPartial || a.SessionsFound != 2 || a.SessionsWritten != 1 {
+		t.Errorf("Unexpected audit record: %v", a)
+	}
+}
+
+func TestPartialWriteQuarantineV1(t *testing.T) {
+	// a v1 database only says how many points it dropped
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		body, _ := io.ReadAll(r.Body)
+		dropped := strings.Count(string(body), `sessionId=bad`)
+		if dropped == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = fmt.Fprintf(w, `{"error":"partial write: field type conflict: input field \"launchDuration\" on `+
+			`measurement \"log-session\" is type float, already exists as type integer dropped=%d"}`, dropped)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	quarantine, err := openQuarantineLog(filepath.Join(dir, "quarantine.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open quarantine: %v", err)
+	}
+	audit, err := openAuditLog(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatalf("Failed to open audit log: %v", err)
+	}
+	m := AdobeUsageTracker{ep: server.URL, db: "db", rp: "rp", quarantine: quarantine, audit: audit}
+	m.token = sharedToken("", m.ep, m.db)
+	var sessions []core.Session
+	for i, id := range []string{"good1", "good2", "good3", "bad", "good4"} {
+		sessions = append(sessions, core.Session{SessionId: id, LaunchTime: time.UnixMilli(1716994039000 + int64(i))})
+	}
+	m.processUpload(upload{received: time.Now(), remoteAddr: "127.0.0.1", body: []byte("log"), sessions: sessions})
+	_ = quarantine.Close()
+	_ = audit.Close()
+
+	var q quarantineRecord
+	readOneRecord(t, filepath.Join(dir, "quarantine.jsonl"), &q)
+	if q.SessionId != "bad" || !strings.HasPrefix(q.Reason, "partial write: field type conflict") ||
+		q.Line != core.SessionLine(sessions[3], nil, zap.NewNop()) {
+		t.Errorf("Unexpected quarantine record: %v", q)
+	}
+	if requests >= 1+len(sessions) {
+		t.Errorf("Expected fewer rewrites than sessions, got %d requests", requests)
+	}
+	var a auditRecord
+	readOneRecord(t, filepath.Join(dir, "audit.jsonl"), &a)
+	if a.Outcome != auditPartial || a.SessionsFound != 5 || a.SessionsWritten != 4 {
+		t.Errorf("Unexpected audit record: %v", a)
+	}
+}
+
+// readOneRecord reads a file that should hold a single JSON record.
+func readOneRecord(t *testing.T, path string, v any) {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Cannot open %s: %v", path, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	var count int
+	for scanner.Scan() {
+		count++
+		if err := json.Unmarshal(scanner.Bytes(), v); err != nil {
+			t.Fatalf("Invalid record in %s: %v", path, err)
+		}
+	}
+	if count != 1 {
+		t.Errorf("Expected one record in %s, got %d", path, count)
+	}
+}
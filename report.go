@@ -0,0 +1,221 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Kinds of failures that are reported to maintainers.
+const (
+	reportParseFailure  = "parse-failure"
+	reportUploadFailure = "upload-failure"
+	reportParserPanic   = "parser-panic"
+)
+
+var (
+	reportClient   = &http.Client{Timeout: 10 * time.Second}
+	reportKeyRegex = regexp.MustCompile(`([A-Za-z]+)=`)
+)
+
+// An errorReport describes a parse or upload failure that should
+// be brought to the attention of maintainers.  Reports with the
+// same fingerprint describe the same underlying problem, so error
+// reporting services can group recurrences together.
+type errorReport struct {
+	Kind        string         `json:"kind"`
+	Message     string         `json:"message"`
+	Fingerprint []string       `json:"fingerprint"`
+	PayloadHash string         `json:"payload_hash"`
+	Context     map[string]any `json:"context"`
+}
+
+// An errorReporter delivers errorReports to an external service.
+type errorReporter interface {
+	report(r errorReport) error
+}
+
+// parseFailureReport describes an upload whose content could not
+// be parsed into any sessions.  The fingerprint is derived from
+// the shape of the first line of the upload, so that uploads in
+// the same unrecognized format are grouped together.
+func parseFailureReport(payload []byte, userAgent string) errorReport {
+	log := string(payload)
+	firstLine, _, _ := strings.Cut(strings.TrimLeft(log, "\r\n"), "\n")
+	firstLine = strings.TrimRight(firstLine, "\r")
+	shape := "unstructured"
+	if keys := reportKeyRegex.FindAllStringSubmatch(firstLine, -1); keys != nil {
+		names := make([]string, 0, len(keys))
+		for _, key := range keys {
+			names = append(names, key[1])
+		}
+		shape = strings.Join(names, ",")
+	}
+	if len(firstLine) > 200 {
+		firstLine = firstLine[:200]
+	}
+	return errorReport{
+		Kind:        reportParseFailure,
+		Message:     "no sessions found in uploaded log",
+		Fingerprint: []string{reportParseFailure, shape},
+		PayloadHash: payloadHash(payload),
+		Context: map[string]any{
+			"bytes":        len(payload),
+			"lines":        strings.Count(log, "\n") + 1,
+			"matchedLines": core.CountLogLines(log),
+			"firstLine":    firstLine,
+			"lineShape":    shape,
+			"userAgent":    userAgent,
+		},
+	}
+}
+
+// uploadFailureReport describes a failure to upload the sessions
+// parsed from a payload.
+func uploadFailureReport(payload []byte, sessions []core.Session, err error) errorReport {
+	appIds := make([]string, 0, len(sessions))
+	for _, session := range sessions {
+		if session.AppId != "" {
+			appIds = append(appIds, session.AppId)
+		}
+	}
+	return errorReport{
+		Kind:        reportUploadFailure,
+		Message:     err.Error(),
+		Fingerprint: []string{reportUploadFailure, err.Error()},
+		PayloadHash: payloadHash(payload),
+		Context: map[string]any{
+			"bytes":        len(payload),
+			"sessionCount": len(sessions),
+			"appIds":       appIds,
+		},
+	}
+}
+
+// parserPanicReport describes an upload that made the parser
+// panic.  Since the panic is a bug in the parser, uploads that
+// cause the same panic are grouped together.
+func parserPanicReport(payload []byte, panic string, userAgent string) errorReport {
+	return errorReport{
+		Kind:        reportParserPanic,
+		Message:     panic,
+		Fingerprint: []string{reportParserPanic, panic},
+		PayloadHash: payloadHash(payload),
+		Context: map[string]any{
+			"bytes":     len(payload),
+			"userAgent": userAgent,
+		},
+	}
+}
+
+// payloadHash returns a hex-encoded SHA256 of the payload.
+func payloadHash(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// A webhookReporter posts each errorReport as a JSON object
+// to a configured URL.
+type webhookReporter struct {
+	url string
+}
+
+func (w webhookReporter) report(r errorReport) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return postReport(w.url, body, nil)
+}
+
+// A sentryReporter sends each errorReport as an event to
+// the Sentry project identified by a DSN.
+type sentryReporter struct {
+	store string
+	auth  string
+}
+
+// newSentryReporter parses a Sentry DSN of the form
+// https://<key>@<host>/<project> into a reporter.
+func newSentryReporter(dsn string) (*sentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not a valid sentry DSN: %v", dsn, err)
+	}
+	key := u.User.Username()
+	project := strings.Trim(u.Path, "/")
+	if u.Scheme == "" || u.Host == "" || key == "" || project == "" {
+		return nil, fmt.Errorf("sentry DSN %q must have the form https://<key>@<host>/<project>", dsn)
+	}
+	return &sentryReporter{
+		store: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth:  fmt.Sprintf("Sentry sentry_version=7, sentry_client=adobe-usage-tracker/1.0, sentry_key=%s", key),
+	}, nil
+}
+
+func (s sentryReporter) report(r errorReport) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	extra := map[string]any{"payloadHash": r.PayloadHash}
+	for k, v := range r.Context {
+		extra[k] = v
+	}
+	event := map[string]any{
+		"event_id":    hex.EncodeToString(id),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       "error",
+		"logger":      "adobe_usage_tracker",
+		"platform":    "go",
+		"message":     r.Message,
+		"fingerprint": r.Fingerprint,
+		"tags":        map[string]string{"kind": r.Kind},
+		"extra":       extra,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return postReport(s.store, body, map[string]string{"X-Sentry-Auth": s.auth})
+}
+
+// postReport posts a JSON body to the given URL, with any
+// additional headers, and checks for a successful response.
+func postReport(target string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest("POST", target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	res, err := reportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("error report status code: %d", res.StatusCode)
+	}
+	return nil
+}
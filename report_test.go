@@ -0,0 +1,90 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseFailureFingerprint(t *testing.T) {
+	log1 := "Level=Info Time=12:00:01 Message=\"a new log format\"\nLevel=Info Time=12:00:02 Message=\"more\"\n"
+	log2 := "Level=Warn Time=13:45:10 Message=\"same format, different content\"\n"
+	r1 := parseFailureReport([]byte(log1), "agent")
+	r2 := parseFailureReport([]byte(log2), "agent")
+	if strings.Join(r1.Fingerprint, "|") != strings.Join(r2.Fingerprint, "|") {
+		t.Errorf("Expected same fingerprint for same format, got %v and %v", r1.Fingerprint, r2.Fingerprint)
+	}
+	if r1.PayloadHash == r2.PayloadHash {
+		t.Errorf("Expected different payload hashes for different payloads")
+	}
+	if r1.Context["lineShape"] != "Level,Time,Message" {
+		t.Errorf("Expected line shape %q, got %q", "Level,Time,Message", r1.Context["lineShape"])
+	}
+	r3 := parseFailureReport([]byte("just some text\n"), "agent")
+	if r3.Fingerprint[1] != "unstructured" {
+		t.Errorf("Expected unstructured fingerprint, got %v", r3.Fingerprint)
+	}
+}
+
+func TestWebhookReporter(t *testing.T) {
+	var received errorReport
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &received); err != nil {
+			t.Errorf("Webhook body is not a valid report: %s", err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	report := uploadFailureReport([]byte("payload"), nil, fmt.Errorf("upload status code: 500"))
+	if err := (webhookReporter{url: server.URL}).report(report); err != nil {
+		t.Fatalf("Webhook report failed: %s", err)
+	}
+	if received.Kind != reportUploadFailure || received.PayloadHash != report.PayloadHash {
+		t.Errorf("Expected %+v, got %+v", report, received)
+	}
+}
+
+func TestSentryReporter(t *testing.T) {
+	var path, auth string
+	var event map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		auth = r.Header.Get("X-Sentry-Auth")
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("Sentry body is not valid JSON: %s", err)
+		}
+	}))
+	defer server.Close()
+	dsn := strings.Replace(server.URL, "://", "://publickey@", 1) + "/42"
+	reporter, err := newSentryReporter(dsn)
+	if err != nil {
+		t.Fatalf("Failed to create sentry reporter: %s", err)
+	}
+	if err := reporter.report(parseFailureReport([]byte("garbage"), "agent")); err != nil {
+		t.Fatalf("Sentry report failed: %s", err)
+	}
+	if path != "/api/42/store/" {
+		t.Errorf("Expected store path %q, got %q", "/api/42/store/", path)
+	}
+	if !strings.Contains(auth, "sentry_key=publickey") {
+		t.Errorf("Expected sentry key in auth header, got %q", auth)
+	}
+	if event["message"] != "no sessions found in uploaded log" {
+		t.Errorf("Unexpected event message: %v", event["message"])
+	}
+	if _, err := newSentryReporter("https://sentry.example.com/42"); err == nil {
+		t.Errorf("Expected error for DSN without key")
+	}
+}
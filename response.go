@@ -0,0 +1,78 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// The response headers that acknowledge what the tracker made of
+// an upload.
+const (
+	sessionsHeader = "X-Usage-Tracker-Sessions"
+	statusHeader   = "X-Usage-Tracker-Status"
+)
+
+// The values of the status header.
+const (
+	ackNone       = "none"       // nothing was parsed from the upload
+	ackQueued     = "queued"     // the parsed upload is to be queued
+	ackAccepted   = "accepted"   // the parsed upload is to be sent
+	ackIncomplete = "incomplete" // the response started before parsing finished
+)
+
+// acknowledge sets the response headers for an upload.  If the
+// upload hasn't been completely parsed, only the status is set.
+func (m AdobeUsageTracker) acknowledge(h http.Header, up *upload, parsed bool) {
+	if !parsed {
+		h.Set(statusHeader, ackIncomplete)
+		return
+	}
+	count := len(up.sessions) + len(up.events)
+	h.Set(sessionsHeader, strconv.Itoa(count))
+	switch {
+	case count == 0:
+		h.Set(statusHeader, ackNone)
+	case m.Mode == modeBackground:
+		h.Set(statusHeader, ackQueued)
+	default:
+		h.Set(statusHeader, ackAccepted)
+	}
+}
+
+// An ackWriter calls ack with the response headers just before
+// the final response status is written.
+type ackWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	once sync.Once
+	ack  func(h http.Header)
+}
+
+// newAckWriter wraps w so that ack is called before the response starts.
+func newAckWriter(w http.ResponseWriter, ack func(h http.Header)) *ackWriter {
+	return &ackWriter{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}, ack: ack}
+}
+
+// WriteHeader implements http.ResponseWriter.  Informational
+// responses don't carry the headers, since the upload may not
+// have been read yet.
+func (w *ackWriter) WriteHeader(status int) {
+	if status >= 200 {
+		w.once.Do(func() { w.ack(w.Header()) })
+	}
+	w.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (w *ackWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { w.ack(w.Header()) })
+	return w.ResponseWriterWrapper.Write(p)
+}
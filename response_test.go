@@ -0,0 +1,74 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/clickonetwo/tracker/core"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	buffer, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	// a static response, which never reads the body
+	respond := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	})
+	// a proxy, which reads all of the body before responding
+	proxy := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, err := io.Copy(io.Discard, r.Body)
+		_, _ = w.Write([]byte("ok"))
+		return err
+	})
+	// a handler that responds part way through the body
+	early := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		_, _ = r.Body.Read(make([]byte, 16))
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	})
+	for _, c := range []struct {
+		name     string
+		next     caddyhttp.Handler
+		body     []byte
+		sessions string
+		status   string
+	}{
+		{"respond", respond, buffer, "2", ackQueued},
+		{"proxy", proxy, buffer, "2", ackQueued},
+		{"empty", proxy, []byte("not a log"), "0", ackNone},
+		{"early", early, buffer, "", ackIncomplete},
+	} {
+		m := AdobeUsageTracker{Mode: modeBackground, ResponseHeaders: true}
+		m.queue = newUploadQueue(1, 0, nil, func(up upload) {})
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/ulecs/v1", bytes.NewReader(c.body))
+		if err := m.ServeHTTP(w, r, c.next); err != nil {
+			t.Fatalf("%s: ServeHTTP failed: %s", c.name, err)
+		}
+		m.queue.close()
+		if got := w.Header().Get(sessionsHeader); got != c.sessions {
+			t.Errorf("%s: expected %s %q, got %q", c.name, sessionsHeader, c.sessions, got)
+		}
+		if got := w.Header().Get(statusHeader); got != c.status {
+			t.Errorf("%s: expected %s %q, got %q", c.name, statusHeader, c.status, got)
+		}
+	}
+	h := make(http.Header)
+	AdobeUsageTracker{}.acknowledge(h, &upload{sessions: make([]core.Session, 3)}, true)
+	if h.Get(sessionsHeader) != "3" || h.Get(statusHeader) != ackAccepted {
+		t.Errorf("Expected 3 accepted sessions in inline mode, got %v", h)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRollupWindow      = 24 * time.Hour
+	defaultRollupMeasurement = "user-machines"
+	rollupCheckInterval      = time.Minute
+)
+
+// RollupConfig configures the periodic rollup of the number of
+// distinct machines each user has launched apps on.  Windows are
+// aligned to multiples of Window since the Unix epoch (so daily
+// windows start at midnight UTC).  If MaxMachines is positive, users
+// seen on more machines than that in a window are tagged as over the
+// limit.
+type RollupConfig struct {
+	Window      caddy.Duration `json:"window,omitempty"`
+	Measurement string         `json:"measurement,omitempty"`
+	MaxMachines int            `json:"max_machines,omitempty"`
+}
+
+// The rollup registry holds the rollup in progress for each
+// endpoint, database, and measurement.  Like the token registry,
+// it outlives any single configuration, so that a config reload
+// part way through a window doesn't lose the machines seen so far.
+// A rollup is stopped (and its final window written) when the last
+// tracker using it is cleaned up.
+var rollupRegistry = struct {
+	sync.Mutex
+	rollups map[string]*machineRollup
+}{rollups: make(map[string]*machineRollup)}
+
+// A machineRollup counts the distinct machines seen for each user
+// in the current window, and writes the counts as line protocol
+// points when the window ends.  Machines are identified by the IP
+// address that uploaded their logs, since NGL logs carry no device
+// identifier.
+type machineRollup struct {
+	key         string
+	measurement string
+	refs        int
+	stop        chan struct{}
+	done        sync.WaitGroup
+
+	mu          sync.Mutex
+	window      time.Duration
+	maxMachines int
+	send        func(lines []string) error
+	start       time.Time
+	machines    map[string]map[string]bool
+}
+
+// acquireRollup returns the named tracker's rollup for the given
+// endpoint and database and the configured measurement, starting it
+// if necessary.  The window, limit, and send function of an existing
+// rollup are replaced by the given ones, so the newest configuration
+// wins.
+func acquireRollup(cfg RollupConfig, name string, ep string, db string, send func(lines []string) error) (*machineRollup, error) {
+	window := time.Duration(cfg.Window)
+	if window == 0 {
+		window = defaultRollupWindow
+	}
+	if window < rollupCheckInterval {
+		return nil, fmt.Errorf("machine rollup window must be at least %s", rollupCheckInterval)
+	}
+	if cfg.MaxMachines < 0 {
+		return nil, fmt.Errorf("machine rollup max_machines must not be negative")
+	}
+	measurement := cfg.Measurement
+	if measurement == "" {
+		measurement = defaultRollupMeasurement
+	}
+	rollupRegistry.Lock()
+	defer rollupRegistry.Unlock()
+	key := name + "|" + ep + "|" + db + "|" + measurement
+	r, ok := rollupRegistry.rollups[key]
+	if !ok {
+		r = &machineRollup{key: key, measurement: measurement, stop: make(chan struct{})}
+		r.start = time.Now().Truncate(window)
+		r.machines = make(map[string]map[string]bool)
+		rollupRegistry.rollups[key] = r
+		r.run()
+	}
+	r.refs++
+	r.mu.Lock()
+	r.window, r.maxMachines, r.send = window, cfg.MaxMachines, send
+	r.mu.Unlock()
+	return r, nil
+}
+
+// release gives up one tracker's use of the rollup.  When the last
+// use is given up, the rollup is stopped and its counts written.
+func (r *machineRollup) release() {
+	rollupRegistry.Lock()
+	r.refs--
+	last := r.refs == 0
+	if last {
+		delete(rollupRegistry.rollups, r.key)
+	}
+	rollupRegistry.Unlock()
+	if last {
+		close(r.stop)
+		r.done.Wait()
+	}
+}
+
+// add records the machines that the given sessions were launched on.
+func (r *machineRollup) add(sessions []core.Session) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range sessions {
+		if s.UserId == "" {
+			continue
+		}
+		machines := r.machines[s.UserId]
+		if machines == nil {
+			machines = make(map[string]bool)
+			r.machines[s.UserId] = machines
+		}
+		machines[sessionMachine(s)] = true
+	}
+}
+
+// sessionMachine identifies the machine a session was launched on
+// by the host part of its client address.
+func sessionMachine(s core.Session) string {
+	return core.AddressHost(s.ClientIp)
+}
+
+// tick ends the current window if now is past it, returning the
+// lines for the window that ended, and the function to send them.
+func (r *machineRollup) tick(now time.Time, final bool) ([]string, func(lines []string) error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !final && now.Before(r.start.Add(r.window)) {
+		return nil, nil
+	}
+	lines := r.lines()
+	r.start = now.Truncate(r.window)
+	r.machines = make(map[string]map[string]bool)
+	return lines, r.send
+}
+
+// lines returns one line protocol point for each user seen in
+// the current window, timestamped with the start of the window.
+func (r *machineRollup) lines() []string {
+	users := make([]string, 0, len(r.machines))
+	for user := range r.machines {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	lines := make([]string, 0, len(users))
+	for _, user := range users {
+		count := len(r.machines[user])
+		var tags string
+		if r.maxMachines > 0 && count > r.maxMachines {
+			tags = ",overLimit=true"
+		}
+		lines = append(lines, fmt.Sprintf("%s%s,userId=%s machines=%di %d",
+			r.measurement, tags, core.TagEscaper.Replace(user), count, r.start.UnixMilli()))
+	}
+	return lines
+}
+
+// flush writes the counts for the window that ended, if any.
+func (r *machineRollup) flush(now time.Time, final bool) {
+	lines, send := r.tick(now, final)
+	if len(lines) == 0 {
+		return
+	}
+	if err := send(lines); err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to write machine rollup",
+			zap.String("measurement", r.measurement), zap.Error(err))
+	}
+}
+
+// run starts the rollup's background checks for the end of a window.
+func (r *machineRollup) run() {
+	r.done.Add(1)
+	go func() {
+		defer r.done.Done()
+		ticker := time.NewTicker(rollupCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.stop:
+				r.flush(time.Now(), true)
+				return
+			case now := <-ticker.C:
+				r.flush(now, false)
+			}
+		}
+	}()
+}
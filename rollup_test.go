@@ -0,0 +1,87 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMachineRollupWindows(t *testing.T) {
+	var sent [][]string
+	var mu sync.Mutex
+	send := func(lines []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, lines)
+		return nil
+	}
+	r, err := acquireRollup(RollupConfig{Window: caddy.Duration(time.Hour), MaxMachines: 1}, "", "test-windows", "db", send)
+	if err != nil {
+		t.Fatalf("Failed to acquire rollup: %v", err)
+	}
+	start := time.UnixMilli(1716994039000).Truncate(time.Hour)
+	r.mu.Lock()
+	r.start = start
+	r.mu.Unlock()
+	r.add([]core.Session{
+		{UserId: "u1", ClientIp: "10.0.0.1:53450"},
+		{UserId: "u1", ClientIp: "10.0.0.1:53451"},
+		{UserId: "u2", ClientIp: "10.0.0.2:53450"},
+		{UserId: "u2", ClientIp: "10.0.0.3:53450"},
+		{UserId: "", ClientIp: "10.0.0.4:53450"},
+	})
+	r.flush(start.Add(59*time.Minute), false)
+	if len(sent) != 0 {
+		t.Fatalf("Expected no points before the window ends, got %v", sent)
+	}
+	r.flush(start.Add(61*time.Minute), false)
+	expected := []string{
+		"user-machines,userId=u1 machines=1i 1716991200000",
+		"user-machines,overLimit=true,userId=u2 machines=2i 1716991200000",
+	}
+	if len(sent) != 1 || !reflect.DeepEqual(sent[0], expected) {
+		t.Fatalf("Expected points %v, got %v", expected, sent)
+	}
+	r.add([]core.Session{{UserId: "u3", ClientIp: "10.0.0.5:53450"}})
+	r.release()
+	mu.Lock()
+	defer mu.Unlock()
+	expected = []string{"user-machines,userId=u3 machines=1i 1716994800000"}
+	if len(sent) != 2 || !reflect.DeepEqual(sent[1], expected) {
+		t.Errorf("Expected final points %v, got %v", expected, sent)
+	}
+}
+
+func TestMachineRollupShared(t *testing.T) {
+	noSend := func(lines []string) error { return nil }
+	r1, err := acquireRollup(RollupConfig{}, "", "test-shared", "db", noSend)
+	if err != nil {
+		t.Fatalf("Failed to acquire rollup: %v", err)
+	}
+	r2, err := acquireRollup(RollupConfig{}, "", "test-shared", "db", noSend)
+	if err != nil {
+		t.Fatalf("Failed to acquire rollup: %v", err)
+	}
+	if r1 != r2 {
+		t.Errorf("Expected trackers to share a rollup")
+	}
+	r1.release()
+	r3, _ := acquireRollup(RollupConfig{Measurement: "other"}, "", "test-shared", "db", noSend)
+	if r3 == r2 {
+		t.Errorf("Expected a different measurement to have its own rollup")
+	}
+	r3.release()
+	r2.release()
+	if _, err := acquireRollup(RollupConfig{Window: caddy.Duration(time.Second)}, "", "test-shared", "db", noSend); err == nil {
+		t.Errorf("Expected a window shorter than a minute to be rejected")
+	}
+}
@@ -0,0 +1,337 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSketchWindow      = time.Hour
+	defaultSketchMeasurement = "unique-users"
+	defaultSketchPrecision   = 14
+	minSketchPrecision       = 4
+	maxSketchPrecision       = 16
+	sketchFormatVersion      = 1
+)
+
+// SketchConfig configures the periodic estimates of the number of
+// unique users of each app.  Windows are aligned to multiples of
+// Window since the Unix epoch, as they are for the machine rollup.
+type SketchConfig struct {
+	Window      caddy.Duration `json:"window,omitempty"`
+	Measurement string         `json:"measurement,omitempty"`
+	// Precision is the number of bits of each user's hash that pick
+	// its register, so each sketch has 2^Precision registers and a
+	// standard error of about 1.04/sqrt(2^Precision).  Defaults to 14
+	// (16384 registers, for an error of about 0.8%).
+	Precision int `json:"precision,omitempty"`
+	// Serialize, if true, adds each sketch to its point, so that
+	// sketches can be merged downstream to count the unique users
+	// of longer periods or of several apps.
+	Serialize bool `json:"serialize,omitempty"`
+	// Epsilon, if positive, adds Laplace noise with scale 1/Epsilon
+	// to each estimate, so the points are differentially private for
+	// each user.  Noisy sketches can't be serialized, since a sketch
+	// gives away the exact estimate.
+	Epsilon float64 `json:"epsilon,omitempty"`
+}
+
+// A hyperLogLog estimates the number of distinct values added to it
+// in a fixed amount of memory, no matter how many there are.  Each
+// value is hashed, the first p bits of the hash pick a register, and
+// the register keeps the longest run of leading zeros seen in the
+// rest of the hashes that pick it.
+type hyperLogLog struct {
+	p         uint8
+	registers []uint8
+}
+
+// newHyperLogLog returns an empty sketch with 2^p registers.
+func newHyperLogLog(p int) *hyperLogLog {
+	return &hyperLogLog{p: uint8(p), registers: make([]uint8, 1<<p)}
+}
+
+// hashValue returns a 64-bit hash of a value.  FNV-1a is stable
+// across processes, so sketches written by different trackers can
+// be merged, and its result is mixed (as in MurmurHash3's finalizer)
+// so that its high bits are well distributed.
+func hashValue(value string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(value))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// add adds a value to the sketch.
+func (h *hyperLogLog) add(value string) {
+	x := hashValue(value)
+	i := x >> (64 - h.p)
+	rank := uint8(bits.LeadingZeros64(x<<h.p|1<<(h.p-1))) + 1
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+	}
+}
+
+// estimate returns the estimated number of distinct values added.
+// Small counts, for which the raw estimate is biased, are estimated
+// by linear counting of the empty registers instead.
+func (h *hyperLogLog) estimate() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	var zeros int
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	e := alpha * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return uint64(math.Round(e))
+}
+
+// marshal returns the sketch in its serialized form: a format
+// version byte, the precision, and the registers, base64-encoded.
+func (h *hyperLogLog) marshal() string {
+	content := make([]byte, 0, 2+len(h.registers))
+	content = append(content, sketchFormatVersion, h.p)
+	content = append(content, h.registers...)
+	return base64.StdEncoding.EncodeToString(content)
+}
+
+// The sketch registry holds the sketches in progress for each
+// endpoint, database, and measurement.  Like the rollup registry, it
+// outlives any single configuration, so that a config reload part way
+// through a window doesn't lose the users seen so far.  The sketches
+// are stopped (and their final window written) when the last tracker
+// using them is cleaned up.
+var sketchRegistry = struct {
+	sync.Mutex
+	sketches map[string]*userSketches
+}{sketches: make(map[string]*userSketches)}
+
+// A userSketches keeps a HyperLogLog sketch of the users of each app
+// in the current window, and writes their estimates as line protocol
+// points when the window ends.
+type userSketches struct {
+	key         string
+	measurement string
+	refs        int
+	stop        chan struct{}
+	done        sync.WaitGroup
+
+	mu        sync.Mutex
+	window    time.Duration
+	precision int
+	serialize bool
+	epsilon   float64
+	send      func(lines []string) error
+	start     time.Time
+	apps      map[string]*hyperLogLog
+}
+
+// acquireSketches returns the named tracker's sketches for the
+// given endpoint and database and the configured measurement,
+// starting them if necessary.  The settings of existing sketches
+// are replaced by the given ones, so the newest configuration wins,
+// but sketches already started in the current window keep their
+// precision.
+func acquireSketches(cfg SketchConfig, name string, ep string, db string, send func(lines []string) error) (*userSketches, error) {
+	window := time.Duration(cfg.Window)
+	if window == 0 {
+		window = defaultSketchWindow
+	}
+	if window < rollupCheckInterval {
+		return nil, fmt.Errorf("user sketch window must be at least %s", rollupCheckInterval)
+	}
+	precision := cfg.Precision
+	if precision == 0 {
+		precision = defaultSketchPrecision
+	}
+	if err := validSketchPrecision(precision); err != nil {
+		return nil, err
+	}
+	if err := validSketchNoise(cfg); err != nil {
+		return nil, err
+	}
+	measurement := cfg.Measurement
+	if measurement == "" {
+		measurement = defaultSketchMeasurement
+	}
+	sketchRegistry.Lock()
+	defer sketchRegistry.Unlock()
+	key := name + "|" + ep + "|" + db + "|" + measurement
+	u, ok := sketchRegistry.sketches[key]
+	if !ok {
+		u = &userSketches{key: key, measurement: measurement, stop: make(chan struct{})}
+		u.start = time.Now().Truncate(window)
+		u.apps = make(map[string]*hyperLogLog)
+		sketchRegistry.sketches[key] = u
+		u.run()
+	}
+	u.refs++
+	u.mu.Lock()
+	u.window, u.precision, u.serialize, u.epsilon, u.send = window, precision, cfg.Serialize, cfg.Epsilon, send
+	u.mu.Unlock()
+	return u, nil
+}
+
+// validSketchPrecision checks that a sketch precision is one we support.
+func validSketchPrecision(precision int) error {
+	if precision < minSketchPrecision || precision > maxSketchPrecision {
+		return fmt.Errorf("user sketch precision must be from %d to %d, not %d",
+			minSketchPrecision, maxSketchPrecision, precision)
+	}
+	return nil
+}
+
+// validSketchNoise checks that the sketches' noise, if any, is
+// valid and that they aren't also serialized.
+func validSketchNoise(cfg SketchConfig) error {
+	if err := validEpsilon(cfg.Epsilon); err != nil {
+		return fmt.Errorf("user sketch %v", err)
+	}
+	if cfg.Epsilon > 0 && cfg.Serialize {
+		return fmt.Errorf("user sketches with noise cannot be serialized")
+	}
+	return nil
+}
+
+// release gives up one tracker's use of the sketches.  When the last
+// use is given up, they are stopped and their estimates written.
+func (u *userSketches) release() {
+	sketchRegistry.Lock()
+	u.refs--
+	last := u.refs == 0
+	if last {
+		delete(sketchRegistry.sketches, u.key)
+	}
+	sketchRegistry.Unlock()
+	if last {
+		close(u.stop)
+		u.done.Wait()
+	}
+}
+
+// add adds the users of the given sessions to their apps' sketches.
+// Sessions without a user or app aren't counted.
+func (u *userSketches) add(sessions []core.Session) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, s := range sessions {
+		if s.UserId == "" || s.AppId == "" {
+			continue
+		}
+		sketch := u.apps[s.AppId]
+		if sketch == nil {
+			sketch = newHyperLogLog(u.precision)
+			u.apps[s.AppId] = sketch
+		}
+		sketch.add(s.UserId)
+	}
+}
+
+// tick ends the current window if now is past it, returning the
+// lines for the window that ended, and the function to send them.
+func (u *userSketches) tick(now time.Time, final bool) ([]string, func(lines []string) error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !final && now.Before(u.start.Add(u.window)) {
+		return nil, nil
+	}
+	lines := u.lines()
+	u.start = now.Truncate(u.window)
+	u.apps = make(map[string]*hyperLogLog)
+	return lines, u.send
+}
+
+// lines returns one line protocol point for each app seen in
+// the current window, timestamped with the start of the window.
+// If the sketches have an epsilon, each estimate is noisy.
+func (u *userSketches) lines() []string {
+	apps := make([]string, 0, len(u.apps))
+	for app := range u.apps {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	lines := make([]string, 0, len(apps))
+	for _, app := range apps {
+		sketch := u.apps[app]
+		var extra string
+		if u.serialize {
+			extra = fmt.Sprintf(",sketch=%q", sketch.marshal())
+		}
+		users := noisyCount(int(sketch.estimate()), u.epsilon)
+		lines = append(lines, fmt.Sprintf("%s,appId=%s users=%di%s %d",
+			u.measurement, core.TagEscaper.Replace(app), users, extra, u.start.UnixMilli()))
+	}
+	return lines
+}
+
+// flush writes the estimates for the window that ended, if any.
+func (u *userSketches) flush(now time.Time, final bool) {
+	lines, send := u.tick(now, final)
+	if len(lines) == 0 {
+		return
+	}
+	if err := send(lines); err != nil {
+		caddy.Log().Error("AdobeUsageTracker: failed to write user sketches",
+			zap.String("measurement", u.measurement), zap.Error(err))
+	}
+}
+
+// run starts the sketches' background checks for the end of a window.
+func (u *userSketches) run() {
+	u.done.Add(1)
+	go func() {
+		defer u.done.Done()
+		ticker := time.NewTicker(rollupCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-u.stop:
+				u.flush(time.Now(), true)
+				return
+			case now := <-ticker.C:
+				u.flush(now, false)
+			}
+		}
+	}()
+}
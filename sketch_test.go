@@ -0,0 +1,139 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/base64"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"math"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHyperLogLogEstimates(t *testing.T) {
+	for _, c := range []struct {
+		precision int
+		count     int
+	}{
+		{14, 0},
+		{14, 10},
+		{14, 1000},
+		{14, 100000},
+		{10, 50000},
+	} {
+		h := newHyperLogLog(c.precision)
+		for i := 0; i < c.count; i++ {
+			h.add(fmt.Sprintf("user-%d", i))
+			h.add(fmt.Sprintf("user-%d", i)) // repeats don't count
+		}
+		// allow four standard errors
+		tolerance := 4 * 1.04 / math.Sqrt(float64(int(1)<<c.precision)) * float64(c.count)
+		if got := float64(h.estimate()); math.Abs(got-float64(c.count)) > math.Max(tolerance, 1) {
+			t.Errorf("Precision %d: expected about %d users, got %v", c.precision, c.count, got)
+		}
+	}
+	h := newHyperLogLog(4)
+	h.add("user")
+	content, err := base64.StdEncoding.DecodeString(h.marshal())
+	if err != nil {
+		t.Fatalf("Serialized sketch is not base64: %v", err)
+	}
+	if len(content) != 18 || content[0] != sketchFormatVersion || content[1] != 4 {
+		t.Errorf("Unexpected serialized sketch: %v", content)
+	}
+}
+
+func TestUserSketchesWindows(t *testing.T) {
+	var sent [][]string
+	var mu sync.Mutex
+	send := func(lines []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		sent = append(sent, lines)
+		return nil
+	}
+	u, err := acquireSketches(SketchConfig{Precision: 10, Serialize: true}, "", "test-sketches", "db", send)
+	if err != nil {
+		t.Fatalf("Failed to acquire sketches: %v", err)
+	}
+	start := time.UnixMilli(1716994039000).Truncate(time.Hour)
+	u.mu.Lock()
+	u.start = start
+	u.mu.Unlock()
+	u.add([]core.Session{
+		{UserId: "u1", AppId: "Photoshop1"},
+		{UserId: "u1", AppId: "Photoshop1"},
+		{UserId: "u2", AppId: "Photoshop1"},
+		{UserId: "u1", AppId: "InDesign1"},
+		{UserId: "", AppId: "InDesign1"},
+		{UserId: "u3", AppId: ""},
+	})
+	u.flush(start.Add(59*time.Minute), false)
+	if len(sent) != 0 {
+		t.Fatalf("Expected no points before the window ends, got %v", sent)
+	}
+	u.flush(start.Add(61*time.Minute), false)
+	if len(sent) != 1 || len(sent[0]) != 2 {
+		t.Fatalf("Expected two points, got %v", sent)
+	}
+	pattern := regexp.MustCompile(`^unique-users,appId=(\w+) users=(\d+)i,sketch="([A-Za-z0-9+/=]+)" 1716991200000$`)
+	for i, expected := range []struct{ app, users string }{{"InDesign1", "1"}, {"Photoshop1", "2"}} {
+		match := pattern.FindStringSubmatch(sent[0][i])
+		if match == nil || match[1] != expected.app || match[2] != expected.users {
+			t.Errorf("Expected %s with %s users, got %q", expected.app, expected.users, sent[0][i])
+		}
+	}
+	u.add([]core.Session{{UserId: "u3", AppId: "Illustrator1"}})
+	u.release()
+	mu.Lock()
+	defer mu.Unlock()
+	expected := "unique-users,appId=Illustrator1 users=1i,sketch="
+	if len(sent) != 2 || len(sent[1]) != 1 || !strings.HasPrefix(sent[1][0], expected) {
+		t.Errorf("Expected a final point for Illustrator1, got %v", sent)
+	}
+	if _, err := acquireSketches(SketchConfig{Precision: 20}, "", "test-sketches", "db", send); err == nil {
+		t.Errorf("Expected an error for precision 20")
+	}
+	if _, err := acquireSketches(SketchConfig{Window: caddy.Duration(time.Second)}, "", "test-sketches", "db", send); err == nil {
+		t.Errorf("Expected an error for a one second window")
+	}
+}
+
+func TestUnmarshalUserSketches(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		user_sketches 1d {
+			measurement daily-users
+			precision 12
+			serialize
+		}
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	expected := SketchConfig{Window: caddy.Duration(24 * time.Hour), Measurement: "daily-users", Precision: 12, Serialize: true}
+	if m.Sketches == nil || *m.Sketches != expected {
+		t.Errorf("Expected %+v, got %+v", expected, m.Sketches)
+	}
+	for _, config := range []string{
+		"user_sketches {\nprecision 3\n}",
+		"user_sketches {\nprecision many\n}",
+		"user_sketches {\nserialize yes\n}",
+		"user_sketches never",
+	} {
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\n" + config + "\n}")); err == nil {
+			t.Errorf("Expected an error parsing %q", config)
+		}
+	}
+}
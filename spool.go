@@ -0,0 +1,311 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// spoolSuffix is the suffix of spooled upload files, and
+// badSpoolSuffix is the suffix given to those that can't be read.
+// claimedSpoolSuffix is added to a file while a worker processes
+// it, and a claim older than staleSpoolClaim is taken to be left
+// over from a worker that died, so the file is made available again.
+const (
+	spoolSuffix        = ".upload"
+	badSpoolSuffix     = ".bad"
+	claimedSpoolSuffix = ".processing"
+	staleSpoolClaim    = 10 * time.Minute
+)
+
+// sealedSpoolMagic starts every encrypted spool file.
+var sealedSpoolMagic = []byte("ATSPOOL1")
+
+// An uploadSpool holds uploads on disk, one file per upload, until
+// they can be processed.  Files are named by the time the upload
+// was received, so they are read back in the order received.  Since
+// the files outlive the tracker, uploads spooled by one configuration
+// (or one run of Caddy) are processed by the next.
+//
+// If the spool has a key, each file is encrypted and authenticated
+// with AES-GCM, using the file's name as additional data, so a file
+// that has been altered, or renamed to change its place in the
+// order, fails to open.  A keyed spool rejects unencrypted files,
+// and an unkeyed spool rejects encrypted ones.
+type uploadSpool struct {
+	dir  string
+	aead cipher.AEAD
+	mu   sync.Mutex
+	seq  uint64
+}
+
+// A spooledUpload is the content of a spool file.  Only the raw
+// upload is kept, and it is parsed again when read back.
+type spooledUpload struct {
+	Received   time.Time `json:"received"`
+	RemoteAddr string    `json:"remote_addr"`
+	UserAgent  string    `json:"user_agent"`
+	TargetHost string    `json:"target_host,omitempty"`
+	TargetPath string    `json:"target_path,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	Body       []byte    `json:"body"`
+}
+
+// openUploadSpool opens (or creates) the spool directory.  If key
+// is non-empty, it must be an AES key (16, 24, or 32 bytes) with
+// which spool files are encrypted.
+func openUploadSpool(dir string, key []byte) (*uploadSpool, error) {
+	s := &uploadSpool{dir: dir}
+	if len(key) > 0 {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid spool key: %v", err)
+		}
+		if s.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("invalid spool key: %v", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("cannot create spool directory %q: %v", dir, err)
+	}
+	return s, nil
+}
+
+// loadSpoolKey decodes a base64-encoded spool key, given either
+// directly or as the contents of a file.
+func loadSpoolKey(key string, keyFile string) ([]byte, error) {
+	if key != "" && keyFile != "" {
+		return nil, fmt.Errorf("a spool key and a spool key file cannot both be specified")
+	}
+	if keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read spool key file: %v", err)
+		}
+		key = strings.TrimSpace(string(content))
+	}
+	if key == "" {
+		return nil, nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("spool key must be base64-encoded: %v", err)
+	}
+	return decoded, nil
+}
+
+// seal encrypts the content of the named spool file, if the
+// spool has a key.
+func (s *uploadSpool) seal(name string, content []byte) ([]byte, error) {
+	if s.aead == nil {
+		return content, nil
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(bytes.Clone(sealedSpoolMagic), nonce...)
+	return s.aead.Seal(sealed, nonce, content, []byte(name)), nil
+}
+
+// open decrypts and authenticates the content of the named spool
+// file, if the spool has a key.
+func (s *uploadSpool) open(name string, content []byte) ([]byte, error) {
+	sealed := bytes.HasPrefix(content, sealedSpoolMagic)
+	if s.aead == nil {
+		if sealed {
+			return nil, errors.New("file is encrypted, but no spool key is configured")
+		}
+		return content, nil
+	}
+	if !sealed {
+		return nil, errors.New("file is not encrypted with the spool key")
+	}
+	content = content[len(sealedSpoolMagic):]
+	if len(content) < s.aead.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	nonce, ciphertext := content[:s.aead.NonceSize()], content[s.aead.NonceSize():]
+	plain, err := s.aead.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, errors.New("file failed authentication with the spool key")
+	}
+	return plain, nil
+}
+
+// write adds an upload to the spool.  The file is written under
+// a temporary name and then renamed, so that a partially written
+// file is never read back.
+func (s *uploadSpool) write(up upload) error {
+	content, err := json.Marshal(spooledUpload{
+		Received:   up.received,
+		RemoteAddr: up.remoteAddr,
+		UserAgent:  up.userAgent,
+		TargetHost: up.targetHost,
+		TargetPath: up.targetPath,
+		Identity:   up.identity,
+		Body:       up.body,
+	})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.seq++
+	name := fmt.Sprintf("%020d-%06d%s", up.received.UnixNano(), s.seq%1_000_000, spoolSuffix)
+	s.mu.Unlock()
+	if content, err = s.seal(name, content); err != nil {
+		return fmt.Errorf("cannot encrypt spool file: %v", err)
+	}
+	path := filepath.Join(s.dir, name)
+	if err := os.WriteFile(path+".tmp", content, 0o640); err != nil {
+		return fmt.Errorf("cannot write spool file: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// next claims the oldest upload in the spool, and returns it and
+// the path of its claimed file, which should be removed once the
+// upload is processed.  If the spool is empty, the path is empty.
+// A file is claimed by renaming it, which only one worker can do,
+// so workers sharing a spool directory (such as the queues of the
+// old and new configurations during a reload) never process the
+// same upload.  A file that can't be read is renamed out of the
+// way, and the error is returned.
+func (s *uploadSpool) next() (upload, string, error) {
+	if err := s.reclaim(); err != nil {
+		return upload{}, "", err
+	}
+	names, err := s.list()
+	if err != nil {
+		return upload{}, "", err
+	}
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+		claimed := path + claimedSpoolSuffix
+		if err := os.Rename(path, claimed); errors.Is(err, fs.ErrNotExist) {
+			continue // another worker claimed it first
+		} else if err != nil {
+			return upload{}, "", fmt.Errorf("cannot claim spool file %q: %v", path, err)
+		}
+		// the claim's age is measured from its modification time
+		now := time.Now()
+		_ = os.Chtimes(claimed, now, now)
+		up, err := s.readFile(claimed, name)
+		if err != nil {
+			if renameErr := os.Rename(claimed, path+badSpoolSuffix); renameErr != nil {
+				_ = os.Remove(claimed)
+			}
+			return upload{}, "", err
+		}
+		return up, claimed, nil
+	}
+	return upload{}, "", nil
+}
+
+// reclaim makes the files of stale claims available again.
+func (s *uploadSpool) reclaim() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), spoolSuffix+claimedSpoolSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleSpoolClaim {
+			continue
+		}
+		path := filepath.Join(s.dir, entry.Name())
+		_ = os.Rename(path, strings.TrimSuffix(path, claimedSpoolSuffix))
+	}
+	return nil
+}
+
+// list returns the names of the spool files, oldest first.
+func (s *uploadSpool) list() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), spoolSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// count returns the number of uploads in the spool, including
+// those claimed by workers but not yet processed.
+func (s *uploadSpool) count() (int, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, spoolSuffix) || strings.HasSuffix(name, spoolSuffix+claimedSpoolSuffix) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// read returns the upload in the named spool file.
+func (s *uploadSpool) read(name string) (upload, error) {
+	return s.readFile(filepath.Join(s.dir, name), name)
+}
+
+// readFile returns the upload in the file at path, which was
+// written under the given name.
+func (s *uploadSpool) readFile(path string, name string) (upload, error) {
+	var spooled spooledUpload
+	content, err := os.ReadFile(path)
+	if err == nil {
+		content, err = s.open(name, content)
+	}
+	if err == nil {
+		err = json.Unmarshal(content, &spooled)
+	}
+	if err != nil {
+		return upload{}, fmt.Errorf("cannot read spool file %q: %v", path, err)
+	}
+	return upload{
+		received:   spooled.Received,
+		remoteAddr: spooled.RemoteAddr,
+		userAgent:  spooled.UserAgent,
+		targetHost: spooled.TargetHost,
+		targetPath: spooled.TargetPath,
+		identity:   spooled.Identity,
+		body:       spooled.Body,
+		spooled:    true,
+	}, nil
+}
+
+// remove deletes a processed spool file.
+func (s *uploadSpool) remove(path string) error {
+	return os.Remove(path)
+}
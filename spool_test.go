@@ -0,0 +1,273 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpoolOrder(t *testing.T) {
+	spool, err := openUploadSpool(filepath.Join(t.TempDir(), "spool"), nil)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	start := time.Now()
+	for _, i := range []int{2, 0, 1} {
+		up := upload{received: start.Add(time.Duration(i) * time.Second), remoteAddr: fmt.Sprintf("client-%d", i)}
+		if err := spool.write(up); err != nil {
+			t.Fatalf("Failed to write upload %d: %v", i, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(spool.dir, "00000000000000000000-000000.upload"), []byte("{"), 0o640); err != nil {
+		t.Fatalf("Failed to write corrupt spool file: %v", err)
+	}
+	if _, path, err := spool.next(); err == nil || path != "" {
+		t.Errorf("Expected an error reading a corrupt spool file")
+	}
+	for i := 0; i < 3; i++ {
+		up, path, err := spool.next()
+		if err != nil || path == "" {
+			t.Fatalf("Failed to read upload %d: %v", i, err)
+		}
+		if expected := fmt.Sprintf("client-%d", i); up.remoteAddr != expected || !up.spooled {
+			t.Errorf("Expected %s, got %v", expected, up)
+		}
+		if err := spool.remove(path); err != nil {
+			t.Errorf("Failed to remove %s: %v", path, err)
+		}
+	}
+	if _, path, err := spool.next(); err != nil || path != "" {
+		t.Errorf("Expected an empty spool, got %q (%v)", path, err)
+	}
+}
+
+func TestQueueSpillsToSpool(t *testing.T) {
+	spool, err := openUploadSpool(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	release := make(chan struct{})
+	processed := make(chan upload, 10)
+	q := newUploadQueue(10, 10, spool, func(up upload) {
+		<-release
+		processed <- up
+	})
+	var counts []int
+	var countsMu sync.Mutex
+	q.spoolChanged = func(files int) {
+		countsMu.Lock()
+		defer countsMu.Unlock()
+		counts = append(counts, files)
+	}
+	for i := 0; i < 4; i++ {
+		up := upload{received: time.Now(), remoteAddr: fmt.Sprintf("client-%d", i), body: []byte("12345678")}
+		if err := q.enqueue(up); err != nil {
+			t.Fatalf("Failed to enqueue upload %d: %v", i, err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(spool.dir, "*"+spoolSuffix)); len(files) < 2 {
+		t.Errorf("Expected at least 2 spooled uploads, got %d", len(files))
+	}
+	close(release)
+	seen := make(map[string]bool)
+	for i := 0; i < 4; i++ {
+		select {
+		case up := <-processed:
+			seen[up.remoteAddr] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for upload %d", i)
+		}
+	}
+	q.close()
+	if len(seen) != 4 {
+		t.Errorf("Expected 4 distinct uploads processed, got %v", seen)
+	}
+	if len(counts) < 4 || counts[0] != 1 || counts[len(counts)-1] != 0 {
+		t.Errorf("Expected the spool count to be reported as it filled and drained, got %v", counts)
+	}
+	if files, _ := filepath.Glob(filepath.Join(spool.dir, "*"+spoolSuffix)); len(files) != 0 {
+		t.Errorf("Expected the spool to be empty, got %d files", len(files))
+	}
+}
+
+func TestSharedSpool(t *testing.T) {
+	dir := t.TempDir()
+	spool, err := openUploadSpool(dir, nil)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	const count = 50
+	for i := 0; i < count; i++ {
+		if err := spool.write(upload{received: time.Now(), remoteAddr: fmt.Sprintf("client-%d", i)}); err != nil {
+			t.Fatalf("Failed to write upload %d: %v", i, err)
+		}
+	}
+	// two queues on the same directory, as during a config reload
+	var mu sync.Mutex
+	seen := make(map[string]int)
+	done := make(chan struct{}, count*2)
+	process := func(up upload) {
+		// slow enough that the workers overlap
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		seen[up.remoteAddr]++
+		mu.Unlock()
+		done <- struct{}{}
+	}
+	var queues []*uploadQueue
+	for i := 0; i < 2; i++ {
+		other, err := openUploadSpool(dir, nil)
+		if err != nil {
+			t.Fatalf("Failed to open spool: %v", err)
+		}
+		queues = append(queues, newUploadQueue(10, 0, other, process))
+	}
+	for i := 0; i < count; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for upload %d", i)
+		}
+	}
+	for _, q := range queues {
+		q.close()
+	}
+	if len(seen) != count {
+		t.Errorf("Expected %d distinct uploads processed, got %d", count, len(seen))
+	}
+	for addr, n := range seen {
+		if n != 1 {
+			t.Errorf("Expected the upload from %s to be processed once, got %d", addr, n)
+		}
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Expected the spool to be empty, got %d files", len(entries))
+	}
+}
+
+func TestStaleSpoolClaim(t *testing.T) {
+	spool, err := openUploadSpool(t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	if err := spool.write(upload{received: time.Now(), remoteAddr: "client"}); err != nil {
+		t.Fatalf("Failed to write upload: %v", err)
+	}
+	_, claimed, err := spool.next()
+	if err != nil || claimed == "" {
+		t.Fatalf("Failed to claim upload: %v", err)
+	}
+	if _, path, err := spool.next(); err != nil || path != "" {
+		t.Errorf("Expected a claimed upload not to be claimed again, got %q (%v)", path, err)
+	}
+	// a worker that died leaves its claim behind
+	old := time.Now().Add(-2 * staleSpoolClaim)
+	if err := os.Chtimes(claimed, old, old); err != nil {
+		t.Fatalf("Failed to age claim: %v", err)
+	}
+	up, path, err := spool.next()
+	if err != nil || path == "" || up.remoteAddr != "client" {
+		t.Errorf("Expected a stale claim to be processed again, got %q (%v)", path, err)
+	}
+}
+
+func TestQueueFullWithoutSpool(t *testing.T) {
+	release := make(chan struct{})
+	q := newUploadQueue(10, 10, nil, func(up upload) { <-release })
+	var rejected int
+	for i := 0; i < 4; i++ {
+		if err := q.enqueue(upload{body: []byte("12345678")}); err != nil {
+			rejected++
+		}
+	}
+	if rejected < 2 {
+		t.Errorf("Expected at least 2 uploads rejected by the byte limit, got %d", rejected)
+	}
+	close(release)
+	q.close()
+}
+
+func TestEncryptedSpool(t *testing.T) {
+	dir := t.TempDir()
+	key, err := loadSpoolKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", "")
+	if err != nil {
+		t.Fatalf("Failed to load spool key: %v", err)
+	}
+	spool, err := openUploadSpool(dir, key)
+	if err != nil {
+		t.Fatalf("Failed to open spool: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		up := upload{received: start.Add(time.Duration(i) * time.Second), remoteAddr: "192.0.2.1", body: []byte("secret log")}
+		if err := spool.write(up); err != nil {
+			t.Fatalf("Failed to write upload %d: %v", i, err)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		content, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if bytes.Contains(content, []byte("192.0.2.1")) || bytes.Contains(content, []byte("secret")) {
+			t.Errorf("Spool file %s is not encrypted", entry.Name())
+		}
+	}
+	// a tampered file fails authentication
+	first := filepath.Join(dir, entries[0].Name())
+	content, _ := os.ReadFile(first)
+	content[len(content)-1] ^= 1
+	if err := os.WriteFile(first, content, 0o640); err != nil {
+		t.Fatalf("Failed to tamper with spool file: %v", err)
+	}
+	if _, path, err := spool.next(); err == nil || path != "" {
+		t.Errorf("Expected an error reading a tampered spool file")
+	}
+	// a file renamed to change its order fails authentication
+	second, third := filepath.Join(dir, entries[1].Name()), filepath.Join(dir, entries[2].Name())
+	if err := os.Rename(third, first); err != nil {
+		t.Fatalf("Failed to rename spool file: %v", err)
+	}
+	if _, path, err := spool.next(); err == nil || path != "" {
+		t.Errorf("Expected an error reading a renamed spool file")
+	}
+	// an unkeyed spool can't read encrypted files
+	unkeyed, _ := openUploadSpool(dir, nil)
+	if _, path, err := unkeyed.next(); err == nil || path != "" {
+		t.Errorf("Expected an error reading an encrypted file without a key")
+	}
+	if err := spool.write(upload{received: start.Add(time.Hour), body: []byte("later")}); err != nil {
+		t.Fatalf("Failed to write upload: %v", err)
+	}
+	up, path, err := spool.next()
+	if err != nil || string(up.body) != "later" {
+		t.Errorf("Expected to read back the later upload, got %q (%v)", up.body, err)
+	}
+	if _, err := os.Stat(second); err == nil || path == "" {
+		t.Errorf("Expected the unreadable file to be set aside")
+	}
+}
+
+func TestLoadSpoolKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "spool.key")
+	if err := os.WriteFile(keyFile, []byte("MDEyMzQ1Njc4OWFiY2RlZg==\n"), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	if key, err := loadSpoolKey("", keyFile); err != nil || string(key) != "0123456789abcdef" {
+		t.Errorf("Expected key from file, got %q (%v)", key, err)
+	}
+	if _, err := loadSpoolKey("not base64!", ""); err == nil {
+		t.Errorf("Expected an error for a key that isn't base64")
+	}
+	if _, err := openUploadSpool(t.TempDir(), []byte("short")); err == nil {
+		t.Errorf("Expected an error for a key of the wrong length")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"strings"
+	"sync"
+)
+
+// The sources of the extra tags added to sessions.
+const (
+	tagSourceTarget    = "target"
+	tagSourceDirectory = "directory"
+	tagSourceEnrichers = "enrichers"
+	tagSourceTransform = "transform"
+	tagSourceAbuse     = "abuse"
+)
+
+// defaultTagPrecedence ranks the tag sources, highest first, when
+// none is configured.  It is the order in which the sources were
+// applied before precedence could be configured, with later sources
+// overriding earlier ones.
+var defaultTagPrecedence = []string{
+	tagSourceAbuse, tagSourceTransform, tagSourceEnrichers, tagSourceDirectory, tagSourceTarget,
+}
+
+// A tagPolicy decides which value a session's tag gets when more
+// than one source gives it a value.  The static sources (the upload
+// target, the directory, the enrichers, and abuse detection) register the names of the tags they
+// add, so that when a source gives a tag a value that differs from
+// the one it already has, the policy knows which source the existing
+// value came from.  The value from the higher-ranked source is kept.
+// Each kind of conflict is logged the first time it happens.
+type tagPolicy struct {
+	rank   map[string]int
+	owners map[string][]string
+	warned sync.Map
+}
+
+// newTagPolicy ranks the tag sources in the given order, highest
+// first.  Sources not named are ranked below the named ones, in
+// their default order.
+func newTagPolicy(precedence []string) (*tagPolicy, error) {
+	p := &tagPolicy{rank: make(map[string]int), owners: make(map[string][]string)}
+	for _, source := range precedence {
+		if !validTagSource(source) {
+			return nil, fmt.Errorf("tag source must be one of %s, not %q",
+				strings.Join(defaultTagPrecedence, ", "), source)
+		}
+		if _, ok := p.rank[source]; ok {
+			return nil, fmt.Errorf("tag source %q is ranked more than once", source)
+		}
+		p.rank[source] = len(p.rank)
+	}
+	for _, source := range defaultTagPrecedence {
+		if _, ok := p.rank[source]; !ok {
+			p.rank[source] = len(p.rank)
+		}
+	}
+	return p, nil
+}
+
+// validTagSource checks that a tag source is one we know.
+func validTagSource(source string) bool {
+	for _, known := range defaultTagPrecedence {
+		if source == known {
+			return true
+		}
+	}
+	return false
+}
+
+// own registers the names of the tags added by a static source.
+// It returns the names that another static source also adds, which
+// will conflict whenever both sources give them values.
+func (p *tagPolicy) own(source string, names ...string) []string {
+	var shared []string
+	for _, name := range names {
+		if len(p.owners[name]) > 0 {
+			shared = append(shared, name)
+		}
+		p.owners[name] = append(p.owners[name], source)
+	}
+	return shared
+}
+
+// holder returns the highest-ranked static source, other than the
+// given one, that adds the named tag, or the empty string if none.
+func (p *tagPolicy) holder(name string, source string) string {
+	holder := ""
+	for _, owner := range p.owners[name] {
+		if owner != source && (holder == "" || p.rank[owner] < p.rank[holder]) {
+			holder = owner
+		}
+	}
+	return holder
+}
+
+// merge returns a session with the tags from the given source added,
+// leaving the original session's tags unchanged.  A nil policy lets
+// each source override the ones before it.  Tags whose names are
+// written as part of every session are dropped.
+func (p *tagPolicy) merge(s core.Session, extra map[string]string, source string, logger *zap.Logger) core.Session {
+	if p == nil {
+		return withTags(s, extra)
+	}
+	kept := make(map[string]string, len(extra))
+	for name, value := range extra {
+		if core.IsReservedKey(name) {
+			p.warn(logger, "AdobeUsageTracker: dropped tag whose name is reserved",
+				name+"|"+source, zap.String("tag", name), zap.String("source", source))
+			continue
+		}
+		if old, ok := s.Tags[name]; ok && old != value {
+			holder := p.holder(name, source)
+			if holder != "" && p.rank[holder] < p.rank[source] {
+				p.warn(logger, "AdobeUsageTracker: conflicting tag values, keeping the higher-ranked one",
+					name+"|"+holder+"|"+source, zap.String("tag", name),
+					zap.String("kept-source", holder), zap.String("kept-value", old),
+					zap.String("dropped-source", source), zap.String("dropped-value", value))
+				continue
+			}
+			p.warn(logger, "AdobeUsageTracker: conflicting tag values, keeping the higher-ranked one",
+				name+"|"+source+"|"+holder, zap.String("tag", name),
+				zap.String("kept-source", source), zap.String("kept-value", value),
+				zap.String("dropped-source", holder), zap.String("dropped-value", old))
+		}
+		kept[name] = value
+	}
+	return withTags(s, kept)
+}
+
+// warn logs a warning the first time it is given each key.
+func (p *tagPolicy) warn(logger *zap.Logger, msg string, key string, fields ...zap.Field) {
+	if _, seen := p.warned.LoadOrStore(key, true); !seen {
+		logger.Warn(msg, fields...)
+	}
+}
+
+// withTags returns a session with the given tags added, leaving
+// the original session's tags unchanged.
+func withTags(s core.Session, extra map[string]string) core.Session {
+	if len(extra) == 0 {
+		return s
+	}
+	tags := make(map[string]string, len(s.Tags)+len(extra))
+	for name, value := range s.Tags {
+		tags[name] = value
+	}
+	for name, value := range extra {
+		tags[name] = value
+	}
+	s.Tags = tags
+	return s
+}
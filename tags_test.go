@@ -0,0 +1,60 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func TestTagPolicyPrecedence(t *testing.T) {
+	obsCore, logs := observer.New(zap.WarnLevel)
+	logger := zap.New(obsCore)
+	p, err := newTagPolicy([]string{tagSourceTarget})
+	if err != nil {
+		t.Fatalf("Failed to create tag policy: %v", err)
+	}
+	p.own(tagSourceTarget, targetHostTag, targetPathTag)
+	if shared := p.own(tagSourceDirectory, "department", targetHostTag); len(shared) != 1 || shared[0] != targetHostTag {
+		t.Errorf("Expected %s to be shared, got %v", targetHostTag, shared)
+	}
+	s := core.Session{SessionId: "a"}
+	s = p.merge(s, map[string]string{targetHostTag: "lcs-cops.adobe.io"}, tagSourceTarget, logger)
+	for i := 0; i < 2; i++ {
+		s = p.merge(s, map[string]string{targetHostTag: "other", "department": "sales"}, tagSourceDirectory, logger)
+	}
+	if s.Tags[targetHostTag] != "lcs-cops.adobe.io" || s.Tags["department"] != "sales" {
+		t.Errorf("Expected the target tag to outrank the directory, got %v", s.Tags)
+	}
+	// the transform is ranked above the directory by default
+	s = p.merge(s, map[string]string{"department": "marketing"}, tagSourceTransform, logger)
+	if s.Tags["department"] != "marketing" {
+		t.Errorf("Expected the transform to outrank the directory, got %v", s.Tags)
+	}
+	s = p.merge(s, map[string]string{"appId": "Photoshop1"}, tagSourceTransform, logger)
+	if _, ok := s.Tags["appId"]; ok {
+		t.Errorf("Expected a reserved tag name to be dropped, got %v", s.Tags)
+	}
+	if n := logs.Len(); n != 3 {
+		t.Errorf("Expected each kind of conflict to be logged once, got %d warnings: %v", n, logs.All())
+	}
+}
+
+func TestTagPolicyErrors(t *testing.T) {
+	for _, precedence := range [][]string{{"geoip"}, {tagSourceTarget, tagSourceTarget}} {
+		if _, err := newTagPolicy(precedence); err == nil {
+			t.Errorf("Expected an error for precedence %v", precedence)
+		}
+	}
+	var p *tagPolicy
+	s := p.merge(core.Session{Tags: map[string]string{"a": "1"}}, map[string]string{"a": "2"}, tagSourceDirectory, zap.NewNop())
+	if s.Tags["a"] != "2" {
+		t.Errorf("Expected a nil policy to let later sources win, got %v", s.Tags)
+	}
+}
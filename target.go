@@ -0,0 +1,55 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Tags that record the Adobe endpoint an upload was sent to.
+const (
+	targetHostTag = "targetHost"
+	targetPathTag = "targetPath"
+)
+
+// uploadTarget returns the normalized host and path that the
+// client sent a request to.  Since earlier handlers may have
+// rewritten the request, these are taken from the original
+// request if it's available.  The host is lowercased and has
+// any port removed, and the path is cleaned of any dot segments,
+// duplicate slashes, and trailing slash.
+func uploadTarget(r *http.Request) (string, string) {
+	original, ok := r.Context().Value(caddyhttp.OriginalRequestCtxKey).(http.Request)
+	if !ok {
+		original = *r
+	}
+	host := original.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	p := "/"
+	if original.URL != nil {
+		p = path.Clean("/" + original.URL.Path)
+	}
+	return host, p
+}
+
+// tagTarget adds the upload target tags to each of the given sessions.
+func tagTarget(sessions []core.Session, host string, path string, tags *tagPolicy, logger *zap.Logger) {
+	for i := range sessions {
+		extra := map[string]string{targetHostTag: host, targetPathTag: path}
+		sessions[i] = tags.merge(sessions[i], extra, tagSourceTarget, logger)
+	}
+}
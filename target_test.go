@@ -0,0 +1,45 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadTarget(t *testing.T) {
+	r := httptest.NewRequest("POST", "https://LCS-Cops.Adobe.io:443/ulecs//v1/?a=b", nil)
+	if host, path := uploadTarget(r); host != "lcs-cops.adobe.io" || path != "/ulecs/v1" {
+		t.Errorf("Unexpected target %q %q", host, path)
+	}
+	rewritten := httptest.NewRequest("POST", "http://localhost/internal", nil)
+	ctx := context.WithValue(rewritten.Context(), caddyhttp.OriginalRequestCtxKey, *r)
+	if host, path := uploadTarget(rewritten.WithContext(ctx)); host != "lcs-cops.adobe.io" || path != "/ulecs/v1" {
+		t.Errorf("Expected the original target, got %q %q", host, path)
+	}
+}
+
+func TestTagTarget(t *testing.T) {
+	original := map[string]string{"slow": "yes"}
+	sessions := []core.Session{{SessionId: "a", Tags: original}, {SessionId: "b"}}
+	tagTarget(sessions, "lcs-cops.adobe.io", "/ulecs/v1", nil, zap.NewNop())
+	if len(original) != 1 {
+		t.Errorf("Expected the original tags to be untouched, got %v", original)
+	}
+	line := core.SessionLine(sessions[0], &core.LineFormat{}, zap.NewNop())
+	if !strings.HasPrefix(line, "log-session,slow=yes,targetHost=lcs-cops.adobe.io,targetPath=/ulecs/v1,sessionId=a ") {
+		t.Errorf("Unexpected line: %q", line)
+	}
+	if sessions[1].Tags[targetHostTag] != "lcs-cops.adobe.io" {
+		t.Errorf("Expected the second session to be tagged, got %v", sessions[1].Tags)
+	}
+}
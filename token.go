@@ -0,0 +1,180 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+func init() {
+	caddy.RegisterModule(trackerAdmin{})
+}
+
+// The token registry holds the current write token for each
+// tracker name, endpoint, and database.  It outlives any single configuration,
+// so a tracker that is still finishing uploads after a reload
+// can pick up the token given in the new configuration, and
+// tokens can be swapped at runtime via the admin API.  Each holder
+// is shared by all the trackers that use it, and is removed when
+// the last of them is cleaned up, so that once a reload changes a
+// tracker's endpoint or database, only the new one can be swapped.
+var tokenRegistry = struct {
+	sync.Mutex
+	holders map[string]*tokenHolder
+}{holders: make(map[string]*tokenHolder)}
+
+// A tokenHolder holds the current write token for an endpoint
+// and database.
+type tokenHolder struct {
+	key  string
+	refs int
+
+	mu    sync.RWMutex
+	token string
+}
+
+// sharedToken returns the named tracker's token holder for the
+// given endpoint and database, creating it if necessary.  The
+// caller must release the holder when it's done with it.
+func sharedToken(name string, ep string, db string) *tokenHolder {
+	tokenRegistry.Lock()
+	defer tokenRegistry.Unlock()
+	key := name + "|" + ep + "|" + db
+	holder, ok := tokenRegistry.holders[key]
+	if !ok {
+		holder = &tokenHolder{key: key}
+		tokenRegistry.holders[key] = holder
+	}
+	holder.refs++
+	return holder
+}
+
+// release gives up one tracker's use of the holder.  When the
+// last use is given up, the holder is removed from the registry.
+func (h *tokenHolder) release() {
+	if h == nil {
+		return
+	}
+	tokenRegistry.Lock()
+	defer tokenRegistry.Unlock()
+	h.refs--
+	if h.refs == 0 && tokenRegistry.holders[h.key] == h {
+		delete(tokenRegistry.holders, h.key)
+	}
+}
+
+// current returns the current token.
+func (h *tokenHolder) current() string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.token
+}
+
+// set replaces the current token.
+func (h *tokenHolder) set(token string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.token = token
+}
+
+// trackerAdmin is a Caddy admin API module that allows the write
+// token for a tracker name, endpoint, and database to be swapped
+// at runtime, serves snapshots of each tracker name's usage for
+// the current day, and re-parses archived uploads on demand.  A
+// swapped token lasts until the next config load, which resets
+// the token to the one in the configuration.
+type trackerAdmin struct{}
+
+// CaddyModule returns the Caddy module information.
+func (trackerAdmin) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.adobe_usage_tracker",
+		New: func() caddy.Module { return new(trackerAdmin) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a trackerAdmin) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: "/adobe_usage_tracker/token", Handler: caddy.AdminHandlerFunc(a.handleToken)},
+		{Pattern: "/adobe_usage_tracker/usage", Handler: caddy.AdminHandlerFunc(a.handleUsage)},
+		{Pattern: "/adobe_usage_tracker/reparse", Handler: caddy.AdminHandlerFunc(a.handleReparse)},
+	}
+}
+
+// A tokenSwap is the body of a token swap request.
+type tokenSwap struct {
+	Name     string `json:"name,omitempty"`
+	Endpoint string `json:"endpoint"`
+	Database string `json:"database"`
+	Token    string `json:"token"`
+}
+
+// handleToken swaps the token for the tracker name, endpoint, and
+// database in the request body.  The name is omitted for unnamed
+// trackers, and the endpoint and database can be omitted if the
+// named trackers use only one.
+func (a trackerAdmin) handleToken(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	var swap tokenSwap
+	if err := json.NewDecoder(r.Body).Decode(&swap); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid token swap: %v", err)}
+	}
+	if swap.Token == "" {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("a token must be specified")}
+	}
+	holder, err := findToken(swap.Name, swap.Endpoint, swap.Database)
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: err}
+	}
+	holder.set(swap.Token)
+	caddy.Log().Info("AdobeUsageTracker: write token swapped via admin API")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// findToken returns the named tracker's existing token holder for
+// the given endpoint and database.  If both are empty, and the
+// named trackers have only one holder, that holder is returned.
+func findToken(name string, ep string, db string) (*tokenHolder, error) {
+	tokenRegistry.Lock()
+	defer tokenRegistry.Unlock()
+	if ep == "" && db == "" {
+		var found []*tokenHolder
+		for key, holder := range tokenRegistry.holders {
+			if strings.HasPrefix(key, name+"|") {
+				found = append(found, holder)
+			}
+		}
+		if len(found) != 1 {
+			return nil, fmt.Errorf("endpoint and database must be specified when %d are in use",
+				len(found))
+		}
+		return found[0], nil
+	}
+	holder, ok := tokenRegistry.holders[name+"|"+ep+"|"+db]
+	if !ok {
+		if name != "" {
+			return nil, fmt.Errorf("no tracker named %q writes to database %q at %q", name, db, ep)
+		}
+		return nil, fmt.Errorf("no tracker writes to database %q at %q", db, ep)
+	}
+	return holder, nil
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*trackerAdmin)(nil)
+)
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/clickonetwo/tracker/core"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSharedTokenAcrossReloads(t *testing.T) {
+	old := sharedToken("", "http://token-test.example.com", "db1")
+	old.set("token1")
+	reloaded := sharedToken("", "http://token-test.example.com", "db1")
+	if reloaded != old {
+		t.Fatalf("Expected the same token holder after reload")
+	}
+	reloaded.set("token2")
+	if tok := old.current(); tok != "token2" {
+		t.Errorf("Expected old config to see token2, got %q", tok)
+	}
+	if other := sharedToken("", "http://token-test.example.com", "db2"); other == old {
+		t.Errorf("Expected a different token holder for a different database")
+	}
+}
+
+func TestTokenHolderRelease(t *testing.T) {
+	old := sharedToken("release-test", "http://old.example.com", "db")
+	reloaded := sharedToken("release-test", "http://old.example.com", "db")
+	// the reload moves the tracker to a new endpoint
+	moved := sharedToken("release-test", "http://new.example.com", "db")
+	if _, err := findToken("release-test", "", ""); err == nil {
+		t.Errorf("Expected an ambiguous swap while both endpoints are in use")
+	}
+	// cleaning up the old config releases one use of the old endpoint
+	old.release()
+	if _, err := findToken("release-test", "http://old.example.com", "db"); err != nil {
+		t.Errorf("Expected the old endpoint to still be in use: %v", err)
+	}
+	reloaded.release()
+	if _, err := findToken("release-test", "http://old.example.com", "db"); err == nil {
+		t.Errorf("Expected the old endpoint to be released")
+	}
+	if found, err := findToken("release-test", "", ""); err != nil || found != moved {
+		t.Errorf("Expected to find only the new endpoint, got %v", err)
+	}
+	moved.release()
+	if _, err := findToken("release-test", "", ""); err == nil {
+		t.Errorf("Expected no endpoints after the last release")
+	}
+}
+
+func TestTokenAdminSwap(t *testing.T) {
+	holder := sharedToken("", "http://admin-test.example.com", "db")
+	holder.set("before")
+	body := `{"endpoint": "http://admin-test.example.com", "database": "db", "token": "after"}`
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/adobe_usage_tracker/token", strings.NewReader(body))
+	if err := (trackerAdmin{}).handleToken(w, r); err != nil {
+		t.Fatalf("Token swap failed: %v", err)
+	}
+	if tok := holder.current(); tok != "after" {
+		t.Errorf("Expected swapped token, got %q", tok)
+	}
+	body = `{"endpoint": "http://unknown.example.com", "database": "db", "token": "after"}`
+	r = httptest.NewRequest(http.MethodPost, "/adobe_usage_tracker/token", strings.NewReader(body))
+	if err := (trackerAdmin{}).handleToken(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error swapping the token of an unknown endpoint")
+	}
+	r = httptest.NewRequest(http.MethodGet, "/adobe_usage_tracker/token", nil)
+	if err := (trackerAdmin{}).handleToken(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error on GET")
+	}
+}
+
+func TestUploadRetriesWithRotatedToken(t *testing.T) {
+	buffer, err := os.ReadFile("testdata/indesign-single-session-1.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	var auths []string
+	var m AdobeUsageTracker
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths = append(auths, r.Header.Get("Authorization"))
+		if r.Header.Get("Authorization") != "Token new" {
+			// simulate a reload that happens while the upload is in flight
+			m.token.set("new")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	m.ep, m.db = server.URL, "db"
+	m.token = sharedToken("", m.ep, m.db)
+	m.token.set("old")
+	sessions := core.ParseLog(string(buffer), "127.0.0.1:53450")
+	m.processUpload(upload{remoteAddr: "127.0.0.1:53450", body: buffer, sessions: sessions})
+	if len(auths) != 2 || auths[0] != "Token old" || auths[1] != "Token new" {
+		t.Errorf("Expected a retry with the new token, got %v", auths)
+	}
+}
@@ -9,20 +9,29 @@ package tracker
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/dustin/go-humanize"
 	"go.uber.org/zap"
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func init() {
 	caddy.RegisterModule(AdobeUsageTracker{})
 	httpcaddyfile.RegisterHandlerDirective("adobe_usage_tracker", parseCaddyfile)
+	httpcaddyfile.RegisterGlobalOption("adobe_usage_tracker", parseGlobalOption)
 }
 
 // AdobeUsageTracker implements HTTP middleware that parses
@@ -44,16 +53,228 @@ func init() {
 // uploads to go to. See the influx docs for details:
 //
 // https://docs.influxdata.com/influxdb/cloud-serverless/write-data/api/v1-http/
+//
+// Optionally, the tracker can also be given the path of an audit
+// log file, to which it appends one JSON record per upload, and
+// a Sentry DSN and/or webhook URL to which it reports uploads
+// that fail to parse or fail to be sent.  It can also be given a
+// Slack-compatible webhook URL to which it sends an alert when
+// writes to the database have been failing for too long, and a
+// watchdog configuration that raises an alert when no sessions have
+// been parsed for too long during business hours.
+//
+// The tracker can also log each parsed session as a structured
+// entry to a named logger, so that sites relying on log shipping
+// can consume sessions without influx.  When a session logger is
+// given, the influx parameters can be omitted.
+//
+// A tracker placed on the path that Adobe Genuine Service logs
+// are uploaded to can be given the AGS parser, in which case it
+// records genuine-software validation events instead of launches.
+// Alternatively, a tracker can be told to also accept the JSON
+// analytics payloads that Creative Cloud apps send via LogTransport2.
+//
+// Finally, the tracker can be given a processing mode (inline,
+// background, or fire-and-forget) that determines whether parsed
+// uploads are sent before the handler returns or afterwards, and
+// a name that keeps its state apart from that of trackers with
+// other names.
 type AdobeUsageTracker struct {
+	// Name scopes the state this tracker shares with others (tokens,
+	// rollups, gauges, sketches, usage, and spooled uploads), its
+	// metrics, and its admin API requests.  Trackers with the same
+	// name share state; those with different names don't.
+	Name     string `json:"name,omitempty"`
 	Endpoint string `json:"endpoint,omitempty"`
 	Database string `json:"database,omitempty"`
 	Policy   string `json:"policy,omitempty"`
 	Token    string `json:"token,omitempty"`
+	// Policies maps classes of measurement (sessions, rollup, or
+	// ags) to the retention policies they are written with, in
+	// place of Policy, so that, for example, raw sessions can
+	// expire sooner than rollups.
+	Policies map[string]string `json:"policies,omitempty"`
+	// OAuth2, if given, is used to acquire bearer tokens for the
+	// endpoint instead of using a static token.
+	OAuth2   *OAuth2Config `json:"oauth2,omitempty"`
+	AuditLog string        `json:"audit_log,omitempty"`
+	// QuarantineFile is a file to which points rejected by
+	// the database in a partial write are appended.
+	QuarantineFile string `json:"quarantine_file,omitempty"`
+	// SentryDSN identifies a Sentry project to report failures to.
+	SentryDSN string `json:"sentry_dsn,omitempty"`
+	// ErrorWebhook is a URL that failure reports are POSTed to.
+	ErrorWebhook string `json:"error_webhook,omitempty"`
+	// AlertWebhook is a Slack-compatible URL that alerts are POSTed to.
+	AlertWebhook string `json:"alert_webhook,omitempty"`
+	// AlertAfter is how long writes must fail before alerting.
+	// Defaults to 5 minutes.
+	AlertAfter caddy.Duration `json:"alert_after,omitempty"`
+	// AlertSpoolFiles, if positive, is the most uploads the spool
+	// can hold before an alert is sent.
+	AlertSpoolFiles int `json:"alert_spool_files,omitempty"`
+	// Watchdog configures the zero-traffic watchdog.
+	Watchdog *WatchdogConfig `json:"watchdog,omitempty"`
+	// Measurement is a template for the name of the measurement
+	// that sessions are written to, such as `launches_{appId}`.
+	// Defaults to "log-session".
+	Measurement string `json:"measurement,omitempty"`
+	// Fingerprint, if true, adds a fingerprint tag to each session
+	// that is a stable hash of the session's content.
+	Fingerprint bool `json:"fingerprint,omitempty"`
+	// ExpiryRisk, if positive, adds an expiryRisk tag to each
+	// session whose license profile expires sooner than this.
+	ExpiryRisk caddy.Duration `json:"expiry_risk,omitempty"`
+	// LaunchKind, if true, adds a launchKind tag to each session
+	// that classifies the launch as cold, warm, or a resume.
+	LaunchKind bool `json:"launch_kind,omitempty"`
+	// AddressFamily, if true, adds an addressFamily tag (ipv4 or
+	// ipv6) to each session, from its client address.
+	AddressFamily bool `json:"address_family,omitempty"`
+	// SessionLogger is the name of a logger to which each parsed
+	// session is logged as a structured entry.  If it is given,
+	// the influx parameters may be omitted, in which case sessions
+	// are only logged and not sent to influx.
+	SessionLogger string `json:"session_logger,omitempty"`
+	// Mode is the processing mode: inline (the default),
+	// background, or fire-and-forget.
+	Mode string `json:"mode,omitempty"`
+	// QueueMemory is the most upload content, in bytes, held
+	// in memory by the background queue.  Defaults to 64MiB.
+	QueueMemory int64 `json:"queue_memory,omitempty"`
+	// QueueOverflow is which upload is dropped when the background
+	// queue is full and can't spill to disk: drop-newest (the
+	// default), drop-oldest, or sample.  QueueSampleRate is the
+	// fraction of arriving uploads that the sample policy keeps
+	// (by dropping the oldest); it defaults to 0.5.
+	QueueOverflow   string  `json:"queue_overflow,omitempty"`
+	QueueSampleRate float64 `json:"queue_sample_rate,omitempty"`
+	// OnError is what to do with uploads that can't be parsed
+	// or processed: pass (the default) passes them on anyway,
+	// reject answers them with a 400, and retry-later with a 503.
+	OnError string `json:"on_error,omitempty"`
+	// SpoolDir is a directory that uploads that don't fit in
+	// the background queue are spilled to.
+	SpoolDir string `json:"spool_dir,omitempty"`
+	// SpoolKey is a base64-encoded AES key with which spooled
+	// (and archived) uploads are encrypted, or SpoolKeyFile is a
+	// file holding it.
+	SpoolKey     string `json:"spool_key,omitempty"`
+	SpoolKeyFile string `json:"spool_key_file,omitempty"`
+	// UploadArchive is a directory in which a copy of every upload
+	// is kept, so that archived uploads can be re-parsed on demand
+	// via the admin API.
+	UploadArchive string `json:"upload_archive,omitempty"`
+	// ArchiveDays is how many days of archived uploads are kept,
+	// counting the current one.  By default, they are all kept.
+	ArchiveDays int `json:"archive_days,omitempty"`
+	// Parser is the parser for uploads: ngl (the default) for app
+	// licensing logs, or ags for Adobe Genuine Service logs.
+	Parser string `json:"parser,omitempty"`
+	// TargetTags, if true, tags each session with the host and
+	// path of the Adobe endpoint that the upload was sent to.
+	TargetTags bool `json:"target_tags,omitempty"`
+	// TagPrecedence ranks the sources of extra tags (target,
+	// directory, and transform), highest first, to decide which
+	// value a tag gets when more than one source gives it one.
+	// Defaults to transform, directory, target.
+	TagPrecedence []string `json:"tag_precedence,omitempty"`
+	// Directory configures the enrichment of sessions with
+	// attributes of their users from a SCIM directory.
+	Directory *DirectoryConfig `json:"directory,omitempty"`
+	// Rollup configures the periodic rollup of distinct
+	// machines per user.
+	Rollup *RollupConfig `json:"rollup,omitempty"`
+	// Concurrency configures the periodic gauge of simultaneous
+	// sessions per app.
+	Concurrency *ConcurrencyConfig `json:"concurrency,omitempty"`
+	// Sketches configures the periodic estimates of unique
+	// users per app.
+	Sketches *SketchConfig `json:"user_sketches,omitempty"`
+	// Dedup configures the persistent store used to drop sessions
+	// that have already been written.
+	Dedup *DedupConfig `json:"dedup,omitempty"`
+	// Export configures the export of sessions as Parquet files.
+	// If it is given, the influx parameters may be omitted, as
+	// they may be with a session logger.
+	Export *ExportConfig `json:"parquet_export,omitempty"`
+	// EnrichersRaw is the enrichment pipeline: the enrichers, in
+	// order, that add to or change each session before it is
+	// filtered.
+	EnrichersRaw []json.RawMessage `json:"enrichers,omitempty" caddy:"namespace=tracker.enrichers inline_key=enricher"`
+	// Abuse configures the detection of uploads whose logs
+	// look fabricated.
+	Abuse *AbuseConfig `json:"abuse,omitempty"`
+	// Anonymize configures the hashing of the user ID and client
+	// IP of each session before it is logged or sent.
+	Anonymize *AnonymizeConfig `json:"anonymize,omitempty"`
+	// NglUpgrades, if true, writes a point each time an app on a
+	// machine is launched with a different NGL version than before.
+	NglUpgrades bool `json:"ngl_upgrades,omitempty"`
+	// FirstSeen configures the events written the first time each
+	// version of each app is seen.
+	FirstSeen *FirstSeenConfig `json:"first_seen,omitempty"`
+	// ResponseHeaders, if true, adds headers to the response
+	// giving the number of sessions parsed from the upload and
+	// what is being done with them.
+	ResponseHeaders bool `json:"response_headers,omitempty"`
+	// UsageSnapshot, if true, counts the sessions uploaded each day
+	// in memory, so that a snapshot of the day's usage can be served
+	// by the admin API.
+	UsageSnapshot bool `json:"usage_snapshot,omitempty"`
+	// LogTransport, if true, parses uploads that are JSON as
+	// LogTransport2 analytics payloads, and the rest as NGL logs.
+	LogTransport bool `json:"log_transport,omitempty"`
+	// MaxLineLength, MaxLines, and MaxSessions limit the parsing
+	// of each upload.  Each defaults to a value far beyond what
+	// any real log contains.
+	MaxLineLength int `json:"max_line_length,omitempty"`
+	MaxLines      int `json:"max_lines,omitempty"`
+	MaxSessions   int `json:"max_sessions,omitempty"`
+	// Filters are rules that decide which sessions are kept.
+	Filters []FilterRule `json:"filters,omitempty"`
+	// Extractions are patterns matched against the lines of each
+	// session's log, whose matches become extra tags or fields.
+	Extractions []ExtractionConfig `json:"extractions,omitempty"`
+	// Transform is a CEL expression evaluated against each
+	// session before it is sent, which can keep, drop, or
+	// modify the session.
+	Transform string `json:"transform,omitempty"`
 
-	ep  string
-	db  string
-	rp  string
-	tok string
+	ep              string
+	db              string
+	rp              string
+	rps             map[string]string
+	tok             string
+	token           *tokenHolder
+	oauth           *oauthSource
+	audit           *auditLog
+	quarantine      *quarantineLog
+	reporters       []errorReporter
+	alerts          *alerter
+	watchdog        *watchdog
+	queue           *uploadQueue
+	inflight        *uploadGroup
+	archive         *uploadArchive
+	format          *core.LineFormat
+	tags            *tagPolicy
+	directory       *directory
+	enrichers       []Enricher
+	rollup          *machineRollup
+	concurrency     *concurrencyGauge
+	sketches        *userSketches
+	usage           *usageAggregate
+	upgrades        *nglVersions
+	versions        *versionStore
+	firstSeenTenant string
+	dedup           *dedupStore
+	export          *sessionExport
+	anonymizer      *anonymizer
+	abuse           *abuseDetector
+	filter          *sessionFilter
+	extractions     []core.Extraction
+	transform       *sessionTransform
+	sessionLog      *zap.Logger
 }
 
 // CaddyModule returns the Caddy module information.
@@ -65,7 +286,299 @@ func (AdobeUsageTracker) CaddyModule() caddy.ModuleInfo {
 }
 
 // Provision implements caddy.Provisioner.
-func (m *AdobeUsageTracker) Provision(caddy.Context) error {
+func (m *AdobeUsageTracker) Provision(ctx caddy.Context) error {
+	if err := validName(m.Name); err != nil {
+		return err
+	}
+	if m.usesInflux() {
+		if err := m.provisionInflux(); err != nil {
+			return err
+		}
+	}
+	m.sessionLog = nil
+	if m.SessionLogger != "" {
+		m.sessionLog = caddy.Log().Named(m.SessionLogger)
+	}
+	if m.AuditLog != "" {
+		audit, err := openAuditLog(m.AuditLog)
+		if err != nil {
+			return err
+		}
+		m.audit = audit
+	}
+	if m.QuarantineFile != "" {
+		quarantine, err := openQuarantineLog(m.QuarantineFile)
+		if err != nil {
+			return err
+		}
+		m.quarantine = quarantine
+	}
+	m.reporters = nil
+	if m.SentryDSN != "" {
+		reporter, err := newSentryReporter(m.SentryDSN)
+		if err != nil {
+			return err
+		}
+		m.reporters = append(m.reporters, reporter)
+	}
+	if m.ErrorWebhook != "" {
+		u, err := url.Parse(m.ErrorWebhook)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%q is not a valid error webhook URL", m.ErrorWebhook)
+		}
+		m.reporters = append(m.reporters, webhookReporter{url: m.ErrorWebhook})
+	}
+	m.alerts = nil
+	if m.AlertWebhook != "" {
+		u, err := url.Parse(m.AlertWebhook)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("%q is not a valid alert webhook URL", m.AlertWebhook)
+		}
+		m.alerts = newAlerter(m.AlertWebhook, time.Duration(m.AlertAfter))
+		m.alerts.spoolLimit = m.AlertSpoolFiles
+	}
+	if m.AlertSpoolFiles < 0 {
+		return fmt.Errorf("alert_spool_files must be positive, not %d", m.AlertSpoolFiles)
+	}
+	if m.AlertSpoolFiles > 0 && (m.AlertWebhook == "" || m.SpoolDir == "") {
+		return fmt.Errorf("alert_spool_files can only be used with an alert webhook and a spool directory")
+	}
+	if m.Watchdog != nil {
+		logger := caddy.Log()
+		alerts := m.alerts
+		w, err := newWatchdog(*m.Watchdog, func(text string) {
+			logger.Warn("AdobeUsageTracker: watchdog alert", zap.String("alert", text))
+			if alerts != nil {
+				alerts.notify(text, logger)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		m.watchdog = w
+		m.watchdog.run()
+	}
+	m.format = &core.LineFormat{
+		Fingerprint:   m.Fingerprint,
+		ExpiryRisk:    time.Duration(m.ExpiryRisk),
+		LaunchKind:    m.LaunchKind,
+		AddressFamily: m.AddressFamily,
+	}
+	if m.Measurement != "" {
+		measure, err := core.ParseMeasurementTemplate(m.Measurement)
+		if err != nil {
+			return err
+		}
+		m.format.Measure = measure
+	}
+	tags, err := newTagPolicy(m.TagPrecedence)
+	if err != nil {
+		return err
+	}
+	m.tags = tags
+	if m.TargetTags {
+		m.tags.own(tagSourceTarget, targetHostTag, targetPathTag)
+	}
+	m.directory = nil
+	if m.Directory != nil {
+		directory, err := newDirectory(*m.Directory)
+		if err != nil {
+			return err
+		}
+		directory.tags = m.tags
+		m.directory = directory
+		names := make([]string, 0, len(m.Directory.Tags))
+		for name := range m.Directory.Tags {
+			if core.IsReservedKey(name) {
+				return fmt.Errorf("directory tag name %q is reserved", name)
+			}
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range m.tags.own(tagSourceDirectory, names...) {
+			caddy.Log().Warn("AdobeUsageTracker: tag is added by more than one source",
+				zap.String("tag", name), zap.String("winner", m.tags.holder(name, "")))
+		}
+	}
+	extractions, err := compileExtractions(m.Extractions)
+	if err != nil {
+		return err
+	}
+	m.extractions = extractions
+	m.filter = nil
+	if len(m.Filters) > 0 {
+		filter, err := newSessionFilter(m.Filters)
+		if err != nil {
+			return err
+		}
+		m.filter = filter
+	}
+	m.transform = nil
+	if m.Transform != "" {
+		transform, err := newSessionTransform(m.Transform)
+		if err != nil {
+			return err
+		}
+		transform.tags = m.tags
+		m.transform = transform
+	}
+	if err := validMode(m.Mode); err != nil {
+		return err
+	}
+	if err := validParser(m.Parser); err != nil {
+		return err
+	}
+	if err := validOnError(m.OnError); err != nil {
+		return err
+	}
+	if err := validQueueOverflow(m.QueueOverflow); err != nil {
+		return err
+	}
+	if m.QueueSampleRate < 0 || m.QueueSampleRate > 1 {
+		return fmt.Errorf("queue_sample_rate must be between 0 and 1, not %v", m.QueueSampleRate)
+	}
+	var spool *uploadSpool
+	if m.SpoolDir == "" && m.UploadArchive == "" && (m.SpoolKey != "" || m.SpoolKeyFile != "") {
+		return fmt.Errorf("a spool key can only be used with a spool directory or an upload archive")
+	}
+	key, err := loadSpoolKey(m.SpoolKey, m.SpoolKeyFile)
+	if err != nil {
+		return err
+	}
+	if m.SpoolDir != "" {
+		if m.Mode != modeBackground {
+			return fmt.Errorf("a spool directory can only be used in %s mode", modeBackground)
+		}
+		if spool, err = openUploadSpool(spoolDirFor(m.SpoolDir, m.Name), key); err != nil {
+			return err
+		}
+	}
+	if m.ArchiveDays < 0 {
+		return fmt.Errorf("archive_days must be positive, not %d", m.ArchiveDays)
+	}
+	if m.ArchiveDays > 0 && m.UploadArchive == "" {
+		return fmt.Errorf("archive_days can only be used with an upload archive")
+	}
+	m.archive = nil
+	if m.UploadArchive != "" {
+		if m.Parser == parserAGS {
+			return fmt.Errorf("an upload archive can only be used with the %s parser", parserNGL)
+		}
+		if m.archive, err = openUploadArchive(spoolDirFor(m.UploadArchive, m.Name), key, m.ArchiveDays); err != nil {
+			return err
+		}
+	}
+	if m.Rollup != nil {
+		rollup, err := acquireRollup(*m.Rollup, m.Name, m.ep, m.db, m.sendRollup)
+		if err != nil {
+			return err
+		}
+		m.rollup = rollup
+	}
+	if m.Concurrency != nil {
+		concurrency, err := acquireConcurrency(*m.Concurrency, m.Name, m.ep, m.db, m.sendConcurrency)
+		if err != nil {
+			return err
+		}
+		m.concurrency = concurrency
+	}
+	if m.Sketches != nil {
+		sketches, err := acquireSketches(*m.Sketches, m.Name, m.ep, m.db, m.sendSketches)
+		if err != nil {
+			return err
+		}
+		m.sketches = sketches
+	}
+	if m.UsageSnapshot {
+		m.usage = acquireUsage(m.Name)
+	}
+	if m.NglUpgrades {
+		m.upgrades = acquireUpgrades(m.Name)
+	}
+	if m.FirstSeen != nil {
+		versions, err := acquireVersions(m.FirstSeen.Path)
+		if err != nil {
+			return err
+		}
+		m.versions = versions
+		m.firstSeenTenant = m.FirstSeen.Tenant
+		if m.firstSeenTenant == "" {
+			m.firstSeenTenant = defaultTenant
+		}
+	}
+	if err := m.loadEnrichers(ctx); err != nil {
+		return err
+	}
+	if m.Abuse != nil {
+		abuse, err := newAbuseDetector(*m.Abuse, m.Name)
+		if err != nil {
+			return err
+		}
+		m.abuse = abuse
+		if !abuse.drop {
+			for _, name := range m.tags.own(tagSourceAbuse, suspectTag) {
+				caddy.Log().Warn("AdobeUsageTracker: tag is added by more than one source",
+					zap.String("tag", name), zap.String("winner", m.tags.holder(name, "")))
+			}
+		}
+	}
+	m.anonymizer = nil
+	if m.Anonymize != nil {
+		anonymizer, err := newAnonymizer(*m.Anonymize)
+		if err != nil {
+			return err
+		}
+		m.anonymizer = anonymizer
+	}
+	if m.Dedup != nil {
+		dedup, err := acquireDedup(*m.Dedup)
+		if err != nil {
+			return err
+		}
+		m.dedup = dedup
+	}
+	if m.Export != nil {
+		export, err := acquireExport(*m.Export)
+		if err != nil {
+			return err
+		}
+		m.export = export
+	}
+	if m.Mode == modeFireAndForget {
+		m.inflight = new(uploadGroup)
+	}
+	if m.Mode == modeBackground {
+		queueMemory := m.QueueMemory
+		if queueMemory <= 0 {
+			queueMemory = defaultQueueMemory
+		}
+		m.queue = newUploadQueue(defaultQueueLength, queueMemory, spool, func(up upload) { m.processQueued(up) })
+		m.queue.name, m.queue.policy, m.queue.rate = m.Name, m.QueueOverflow, m.QueueSampleRate
+		if m.queue.rate == 0 {
+			m.queue.rate = defaultSampleRate
+		}
+		m.queue.evicted = func(up upload, err error) { m.dropUpload(up, err) }
+		if spool != nil && m.alerts != nil && m.AlertSpoolFiles > 0 {
+			alerts := m.alerts
+			m.queue.spoolChanged = func(files int) { alerts.spoolChanged(files, caddy.Log()) }
+		}
+	}
+	if m.archive != nil {
+		registerArchive(m)
+	}
+	return nil
+}
+
+// usesInflux reports whether sessions are to be sent to influx.
+// That's always the case unless sessions are being logged or
+// exported and no influx parameters have been given.
+func (m *AdobeUsageTracker) usesInflux() bool {
+	return (m.SessionLogger == "" && m.Export == nil) || m.Endpoint != "" || m.Database != "" || m.Policy != "" ||
+		len(m.Policies) > 0 || m.Token != "" || m.OAuth2 != nil
+}
+
+// provisionInflux checks and provisions the influx parameters.
+func (m *AdobeUsageTracker) provisionInflux() error {
 	if m.Endpoint == "" {
 		return fmt.Errorf("an endpoint URL must be specified")
 	}
@@ -91,15 +604,96 @@ func (m *AdobeUsageTracker) Provision(caddy.Context) error {
 		return fmt.Errorf("A retention policy must be specified")
 	}
 	m.rp = m.Policy
+	m.rps = make(map[string]string, len(m.Policies))
+	for class, rp := range m.Policies {
+		if err := validPolicyClass(class); err != nil {
+			return err
+		}
+		if rp == "" {
+			return fmt.Errorf("the retention policy for %s cannot be empty", class)
+		}
+		m.rps[class] = rp
+	}
+	if m.OAuth2 != nil {
+		if m.Token != "" {
+			return fmt.Errorf("a token and OAuth2 credentials cannot both be specified")
+		}
+		oauth, err := newOAuthSource(*m.OAuth2)
+		if err != nil {
+			return err
+		}
+		m.oauth = oauth
+		return nil
+	}
 	if m.Token == "" {
 		return fmt.Errorf("A token must be specified")
 	}
 	m.tok = m.Token
+	m.token = sharedToken(m.Name, m.ep, m.db)
+	m.token.set(m.tok)
+	return nil
+}
+
+// Cleanup implements caddy.CleanerUpper.
+func (m *AdobeUsageTracker) Cleanup() error {
+	if m.archive != nil {
+		unregisterArchive(m)
+	}
+	if m.queue != nil {
+		m.queue.close()
+	}
+	if m.inflight != nil {
+		m.inflight.close()
+	}
+	// the token is released once the queue has drained, so a
+	// reload can't swap it out from under the last uploads.
+	m.token.release()
+	if m.watchdog != nil {
+		m.watchdog.close()
+	}
+	if m.rollup != nil {
+		m.rollup.release()
+	}
+	if m.concurrency != nil {
+		m.concurrency.release()
+	}
+	if m.sketches != nil {
+		m.sketches.release()
+	}
+	if m.usage != nil {
+		m.usage.release()
+	}
+	if m.upgrades != nil {
+		m.upgrades.release()
+	}
+	if m.versions != nil {
+		m.versions.release()
+	}
+	if m.dedup != nil {
+		m.dedup.release()
+	}
+	if m.export != nil {
+		m.export.release()
+	}
+	if m.abuse != nil {
+		m.abuse.release()
+	}
+	if m.quarantine != nil {
+		if err := m.quarantine.Close(); err != nil {
+			return err
+		}
+	}
+	if m.audit != nil {
+		return m.audit.Close()
+	}
 	return nil
 }
 
 // Validate implements caddy.Validator.
 func (m *AdobeUsageTracker) Validate() error {
+	if !m.usesInflux() {
+		return nil
+	}
 	if m.ep == "" {
 		return fmt.Errorf("endpoint URL must be specified")
 	}
@@ -122,46 +716,173 @@ func (m *AdobeUsageTracker) Validate() error {
 	if m.rp == "" {
 		return fmt.Errorf("retention policy must be specified")
 	}
-	if m.tok == "" {
+	if m.tok == "" && m.oauth == nil {
 		return fmt.Errorf("token must be specified")
 	}
 	return nil
 }
 
-// ServeHTTP implements caddyhttp.MiddlewareHandler. It extracts
-// measurements from any logs uploaded in the request, sends them
-// to the influxDB endpoint, and then passes the request intact
-// onto the next handler.
+// ServeHTTP implements caddyhttp.MiddlewareHandler. It passes
+// the request onto the next handler, extracting measurements from
+// any logs uploaded in the request as the request body streams
+// through to that handler.  Once the request has been handled, the
+// measurements are sent to the influxDB endpoint, either before
+// returning or in the background, depending on the processing mode.
+//
+// If the failure policy calls for it, the upload is instead parsed
+// and handed off for processing before it is passed on, and it is
+// answered with an error, rather than passed on, if either fails.
 func (m AdobeUsageTracker) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
-	logger := caddy.Log()
-	buf, err := io.ReadAll(r.Body)
-	if err != nil {
-		return err
-	}
-	sessions := parseLog(string(buf), r.RemoteAddr)
 	userAgent, err := url.QueryUnescape(r.UserAgent())
 	if err != nil {
 		userAgent = r.UserAgent()
 	}
-	logger.Info("AdobeUsageTracker: incoming request summary",
-		zap.String("remote-address", r.RemoteAddr),
-		zap.String("user-agent", userAgent),
-		zap.Int("content-length", len(buf)),
-		zap.Int("session-count", len(sessions)),
-	)
-	logger.Debug("AdobeUsageTracker: uploading sessions", zap.Objects("sessions", sessions))
-	if len(sessions) == 0 {
-		logger.Info("AdobeUsageTracker: no sessions to upload")
-	} else {
-		err = sendSessions(m.ep, m.db, m.rp, m.tok, sessions, logger)
-		if err != nil {
-			logger.Error("AdobeUsageTracker: failed to send sessions", zap.Error(err))
+	up := upload{received: time.Now(), remoteAddr: core.NormalizeAddress(r.RemoteAddr), userAgent: userAgent}
+	up.targetHost, up.targetPath = uploadTarget(r)
+	if m.Directory != nil && m.Directory.Identity != "" {
+		if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+			up.identity = repl.ReplaceAll(m.Directory.Identity, "")
+		}
+	}
+	limits := core.NewLimits(m.MaxLineLength, m.MaxLines, m.MaxSessions)
+	pr, pw := io.Pipe()
+	parsed := make(chan error, 1)
+	go func() {
+		parsed <- m.parseUpload(pr, &up, limits)
+	}()
+	// parsing finishes as soon as the next handler reads the entire
+	// body, so that (for example) response headers can make use of
+	// the placeholders, or else once the next handler returns.
+	var finished sync.Once
+	var done, read atomic.Bool
+	finish := func(readErr error) {
+		finished.Do(func() {
+			_ = pw.CloseWithError(readErr)
+			if err := <-parsed; err != nil {
+				caddy.Log().Debug("AdobeUsageTracker: upload not completely read", zap.Error(err))
+			}
+			setPlaceholders(r, up)
+			done.Store(true)
+		})
+	}
+	body := r.Body
+	tee := io.TeeReader(body, pw)
+	r.Body = teeBody{Reader: tee, Closer: body, onEOF: func() { finish(nil) }, read: &read}
+	if m.ResponseHeaders {
+		w = newAckWriter(w, func(h http.Header) {
+			// a handler that responds without having read any of
+			// the body (such as a static response) won't read it
+			// later, so it can be parsed now.
+			if !read.Load() {
+				_, err := io.Copy(io.Discard, tee)
+				finish(err)
+			}
+			m.acknowledge(h, &up, done.Load())
+		})
+	}
+	if m.checksUploads() {
+		content, readErr := io.ReadAll(tee)
+		finish(readErr)
+		reportLimits(limits, m.Name, up.remoteAddr, caddy.Log())
+		failure := parseFailure(up, readErr)
+		if failure != nil {
+			// the upload won't be passed on, so it isn't processed
+			// either: a relay that retries it would otherwise have
+			// its sessions written twice.
+			m.processFailed(up, failure)
 		} else {
-			logger.Info("AdobeUsageTracker: sent sessions successfully")
+			failure = m.dispatch(up)
+		}
+		if failure != nil {
+			caddy.Log().Info("AdobeUsageTracker: answering failed upload with an error",
+				zap.String("remote-address", up.remoteAddr), zap.String("on-error", m.OnError),
+				zap.Error(failure))
+			return m.failureResponse(w, failure)
+		}
+		r.Body = teeBody{Reader: bytes.NewReader(content), Closer: body}
+		return next.ServeHTTP(w, r)
+	}
+	handlerErr := next.ServeHTTP(w, r)
+	// read whatever part of the body the next handler didn't,
+	// so that the entire upload is parsed.
+	_, drainErr := io.Copy(io.Discard, tee)
+	finish(drainErr)
+	reportLimits(limits, m.Name, up.remoteAddr, caddy.Log())
+	_ = m.dispatch(up)
+	return handlerErr
+}
+
+// dispatch processes a parsed upload according to the processing
+// mode.  It returns an error if the upload was dropped because the
+// background queue was full or, in inline mode, if its sessions
+// couldn't be sent.
+func (m AdobeUsageTracker) dispatch(up upload) error {
+	m.archiveUpload(up)
+	switch m.Mode {
+	case modeBackground:
+		if err := m.queue.enqueue(up); err != nil {
+			m.dropUpload(up, err)
+			return err
 		}
+	case modeFireAndForget:
+		if !m.inflight.run(func() { _ = m.processUpload(up) }) {
+			m.dropUpload(up, errClosed)
+			return errClosed
+		}
+	default:
+		return m.processUpload(up)
+	}
+	return nil
+}
+
+// dropUpload logs and audits an upload dropped from the background queue.
+func (m AdobeUsageTracker) dropUpload(up upload, err error) {
+	logger := caddy.Log()
+	logger.Error("AdobeUsageTracker: dropping upload", zap.Error(err),
+		zap.String("remote-address", up.remoteAddr), zap.Int("content-length", len(up.body)))
+	m.writeAudit(auditRecord{
+		Timestamp:     up.received,
+		ClientAddress: up.remoteAddr,
+		Bytes:         len(up.body),
+		SessionsFound: len(up.sessions) + len(up.events),
+		Outcome:       auditDropped,
+		Error:         err.Error(),
+	}, logger)
+}
+
+// A teeBody is a request body whose content is copied to
+// the parser as the next handler reads it.  It calls onEOF
+// when the next handler reads to the end of the body.
+type teeBody struct {
+	io.Reader
+	io.Closer
+	onEOF func()
+	read  *atomic.Bool // set once the body is first read
+}
+
+func (b teeBody) Read(p []byte) (int, error) {
+	if b.read != nil {
+		b.read.Store(true)
+	}
+	n, err := b.Reader.Read(p)
+	if err == io.EOF && b.onEOF != nil {
+		b.onEOF()
+	}
+	return n, err
+}
+
+// reportError sends the given report to all the configured error
+// reporters.  Reports are sent in the background, so that reporting
+// never delays the handling of the request.
+func (m AdobeUsageTracker) reportError(report errorReport, logger *zap.Logger) {
+	for _, reporter := range m.reporters {
+		go func(reporter errorReporter) {
+			if err := reporter.report(report); err != nil {
+				logger.Error("AdobeUsageTracker: failed to report error",
+					zap.String("kind", report.Kind), zap.Error(err))
+			}
+		}(reporter)
 	}
-	r.Body = io.NopCloser(bytes.NewReader(buf))
-	return next.ServeHTTP(w, r)
 }
 
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler.
@@ -170,10 +891,146 @@ func (m *AdobeUsageTracker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 	for nesting := d.Nesting(); d.NextBlock(nesting); {
 		key := d.Val()
+		switch key {
+		case "watchdog":
+			if err := m.unmarshalWatchdog(d); err != nil {
+				return err
+			}
+			continue
+		case "filter":
+			if err := m.unmarshalFilter(d); err != nil {
+				return err
+			}
+			continue
+		case "extract":
+			if err := m.unmarshalExtract(d); err != nil {
+				return err
+			}
+			continue
+		case "fingerprint":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Fingerprint = true
+			continue
+		case "launch_kind":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.LaunchKind = true
+			continue
+		case "address_family":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.AddressFamily = true
+			continue
+		case "tag_precedence":
+			m.TagPrecedence = d.RemainingArgs()
+			if len(m.TagPrecedence) == 0 {
+				return d.ArgErr()
+			}
+			continue
+		case "target_tags":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.TargetTags = true
+			continue
+		case "enrichers":
+			if err := m.unmarshalEnrichers(d); err != nil {
+				return err
+			}
+			continue
+		case "abuse_detection":
+			if err := m.unmarshalAbuse(d); err != nil {
+				return err
+			}
+			continue
+		case "anonymize":
+			if err := m.unmarshalAnonymize(d); err != nil {
+				return err
+			}
+			continue
+		case "dedup_store":
+			if err := m.unmarshalDedup(d); err != nil {
+				return err
+			}
+			continue
+		case "parquet_export":
+			if err := m.unmarshalExport(d); err != nil {
+				return err
+			}
+			continue
+		case "ngl_upgrades":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.NglUpgrades = true
+			continue
+		case "version_first_seen":
+			if err := m.unmarshalFirstSeen(d); err != nil {
+				return err
+			}
+			continue
+		case "response_headers":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.ResponseHeaders = true
+			continue
+		case "usage_snapshot":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.UsageSnapshot = true
+			continue
+		case "machine_rollup":
+			if err := m.unmarshalRollup(d); err != nil {
+				return err
+			}
+			continue
+		case "concurrency":
+			if err := m.unmarshalConcurrency(d); err != nil {
+				return err
+			}
+			continue
+		case "user_sketches":
+			if err := m.unmarshalSketches(d); err != nil {
+				return err
+			}
+			continue
+		case "directory":
+			if err := m.unmarshalDirectory(d); err != nil {
+				return err
+			}
+			continue
+		case "oauth2":
+			if err := m.unmarshalOAuth2(d); err != nil {
+				return err
+			}
+			continue
+		case "policies":
+			if err := m.unmarshalPolicies(d); err != nil {
+				return err
+			}
+			continue
+		case "log_transport":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.LogTransport = true
+			continue
+		}
 		if !d.NextArg() {
 			return d.ArgErr()
 		}
 		switch key {
+		case "name":
+			if err := validName(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			m.Name = d.Val()
 		case "endpoint":
 			m.Endpoint = d.Val()
 		case "database":
@@ -182,24 +1039,730 @@ func (m *AdobeUsageTracker) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			m.Policy = d.Val()
 		case "token":
 			m.Token = d.Val()
+		case "audit_log":
+			m.AuditLog = d.Val()
+		case "quarantine_file":
+			m.QuarantineFile = d.Val()
+		case "sentry_dsn":
+			m.SentryDSN = d.Val()
+		case "error_webhook":
+			m.ErrorWebhook = d.Val()
+		case "measurement":
+			if _, err := core.ParseMeasurementTemplate(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			m.Measurement = d.Val()
+		case "session_logger":
+			m.SessionLogger = d.Val()
+		case "mode":
+			if err := validMode(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			m.Mode = d.Val()
+		case "on_error":
+			if err := validOnError(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			m.OnError = d.Val()
+		case "parser":
+			if err := validParser(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			m.Parser = d.Val()
+		case "transform":
+			if _, err := newSessionTransform(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			m.Transform = d.Val()
+		case "queue_memory":
+			size, err := humanize.ParseBytes(d.Val())
+			if err != nil || size == 0 {
+				return d.Errf("invalid queue_memory size %q", d.Val())
+			}
+			m.QueueMemory = int64(size)
+		case "queue_overflow":
+			if err := validQueueOverflow(d.Val()); err != nil {
+				return d.Err(err.Error())
+			}
+			m.QueueOverflow = d.Val()
+			if d.NextArg() {
+				if m.QueueOverflow != overflowSample {
+					return d.Errf("only the %s policy takes a rate", overflowSample)
+				}
+				rate, err := validSampleRate(d.Val())
+				if err != nil {
+					return d.Err(err.Error())
+				}
+				m.QueueSampleRate = rate
+			}
+		case "spool_dir":
+			m.SpoolDir = d.Val()
+		case "spool_key":
+			m.SpoolKey = d.Val()
+		case "spool_key_file":
+			m.SpoolKeyFile = d.Val()
+		case "upload_archive":
+			m.UploadArchive = d.Val()
+		case "archive_days":
+			days, err := strconv.Atoi(d.Val())
+			if err != nil || days <= 0 {
+				return d.Errf("archive_days must be a positive integer, not %q", d.Val())
+			}
+			m.ArchiveDays = days
+		case "alert_webhook":
+			m.AlertWebhook = d.Val()
+		case "max_line_length", "max_lines", "max_sessions":
+			limit, err := strconv.Atoi(d.Val())
+			if err != nil || limit <= 0 {
+				return d.Errf("%s must be a positive integer, not %q", key, d.Val())
+			}
+			switch key {
+			case "max_line_length":
+				m.MaxLineLength = limit
+			case "max_lines":
+				m.MaxLines = limit
+			default:
+				m.MaxSessions = limit
+			}
+		case "alert_spool_files":
+			files, err := strconv.Atoi(d.Val())
+			if err != nil || files <= 0 {
+				return d.Errf("alert_spool_files must be a positive integer, not %q", d.Val())
+			}
+			m.AlertSpoolFiles = files
+		case "alert_after":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid alert_after duration %q: %v", d.Val(), err)
+			}
+			m.AlertAfter = caddy.Duration(dur)
+		case "expiry_risk":
+			dur, err := caddy.ParseDuration(d.Val())
+			if err != nil || dur <= 0 {
+				return d.Errf("invalid expiry_risk duration %q", d.Val())
+			}
+			m.ExpiryRisk = caddy.Duration(dur)
+		default:
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// unmarshalWatchdog parses a watchdog block of the form:
+//
+//	watchdog <period> {
+//	    hours <start> <end>
+//	    days <day>...
+//	    timezone <tz>
+//	}
+func (m *AdobeUsageTracker) unmarshalWatchdog(d *caddyfile.Dispenser) error {
+	var cfg WatchdogConfig
+	if !d.NextArg() {
+		return d.ArgErr()
+	}
+	period, err := caddy.ParseDuration(d.Val())
+	if err != nil {
+		return d.Errf("invalid watchdog period %q: %v", d.Val(), err)
+	}
+	cfg.Period = caddy.Duration(period)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "hours":
+			if !d.Args(&cfg.Start, &cfg.End) {
+				return d.ArgErr()
+			}
+		case "days":
+			cfg.Days = d.RemainingArgs()
+			if len(cfg.Days) == 0 {
+				return d.ArgErr()
+			}
+		case "timezone":
+			if !d.Args(&cfg.Timezone) {
+				return d.ArgErr()
+			}
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.Watchdog = &cfg
+	return nil
+}
+
+// unmarshalOAuth2 parses an oauth2 block of the form:
+//
+//	oauth2 {
+//	    token_url <url>
+//	    client_id <id>
+//	    client_secret <secret>
+//	    scopes <scope>...
+//	}
+func (m *AdobeUsageTracker) unmarshalOAuth2(d *caddyfile.Dispenser) error {
+	var cfg OAuth2Config
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "token_url":
+			if !d.Args(&cfg.TokenURL) {
+				return d.ArgErr()
+			}
+		case "client_id":
+			if !d.Args(&cfg.ClientID) {
+				return d.ArgErr()
+			}
+		case "client_secret":
+			if !d.Args(&cfg.ClientSecret) {
+				return d.ArgErr()
+			}
+		case "scopes":
+			cfg.Scopes = d.RemainingArgs()
+			if len(cfg.Scopes) == 0 {
+				return d.ArgErr()
+			}
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.OAuth2 = &cfg
+	return nil
+}
+
+// unmarshalRollup parses a machine_rollup block of the form:
+//
+//	machine_rollup [<window>] {
+//	    measurement <name>
+//	    max_machines <count>
+//	}
+func (m *AdobeUsageTracker) unmarshalRollup(d *caddyfile.Dispenser) error {
+	var cfg RollupConfig
+	if d.NextArg() {
+		window, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid machine_rollup window %q: %v", d.Val(), err)
+		}
+		cfg.Window = caddy.Duration(window)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "measurement":
+			if !d.Args(&cfg.Measurement) {
+				return d.ArgErr()
+			}
+		case "max_machines":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			limit, err := strconv.Atoi(d.Val())
+			if err != nil || limit <= 0 {
+				return d.Errf("max_machines must be a positive integer, not %q", d.Val())
+			}
+			cfg.MaxMachines = limit
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.Rollup = &cfg
+	return nil
+}
+
+// unmarshalSketches parses a user_sketches block of the form:
+//
+//	user_sketches [<window>] {
+//	    measurement <name>
+//	    precision <bits>
+//	    serialize
+//	    epsilon <epsilon>
+//	}
+func (m *AdobeUsageTracker) unmarshalSketches(d *caddyfile.Dispenser) error {
+	var cfg SketchConfig
+	if d.NextArg() {
+		window, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid user_sketches window %q: %v", d.Val(), err)
+		}
+		cfg.Window = caddy.Duration(window)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "measurement":
+			if !d.Args(&cfg.Measurement) {
+				return d.ArgErr()
+			}
+		case "precision":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			precision, err := strconv.Atoi(d.Val())
+			if err != nil {
+				return d.Errf("precision must be an integer, not %q", d.Val())
+			}
+			if err := validSketchPrecision(precision); err != nil {
+				return d.Err(err.Error())
+			}
+			cfg.Precision = precision
+		case "serialize":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			cfg.Serialize = true
+		case "epsilon":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			epsilon, err := parseEpsilon(d.Val())
+			if err != nil {
+				return d.Err(err.Error())
+			}
+			cfg.Epsilon = epsilon
+		default:
+			return d.ArgErr()
+		}
+	}
+	if err := validSketchNoise(cfg); err != nil {
+		return d.Err(err.Error())
+	}
+	m.Sketches = &cfg
+	return nil
+}
+
+// unmarshalConcurrency parses a concurrency block of the form:
+//
+//	concurrency [<window>] {
+//	    measurement <name>
+//	    epsilon <epsilon>
+//	}
+func (m *AdobeUsageTracker) unmarshalConcurrency(d *caddyfile.Dispenser) error {
+	var cfg ConcurrencyConfig
+	if d.NextArg() {
+		window, err := caddy.ParseDuration(d.Val())
+		if err != nil {
+			return d.Errf("invalid concurrency window %q: %v", d.Val(), err)
+		}
+		cfg.Window = caddy.Duration(window)
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "measurement":
+			if !d.Args(&cfg.Measurement) {
+				return d.ArgErr()
+			}
+		case "epsilon":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			epsilon, err := parseEpsilon(d.Val())
+			if err != nil {
+				return d.Err(err.Error())
+			}
+			cfg.Epsilon = epsilon
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.Concurrency = &cfg
+	return nil
+}
+
+// unmarshalPolicies parses a policies block of the form:
+//
+//	policies {
+//	    <class> <policy>
+//	}
+//
+// The policies are added to any given in the global option.
+func (m *AdobeUsageTracker) unmarshalPolicies(d *caddyfile.Dispenser) error {
+	policies := make(map[string]string, len(m.Policies))
+	for class, rp := range m.Policies {
+		policies[class] = rp
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		class := d.Val()
+		if err := validPolicyClass(class); err != nil {
+			return d.Err(err.Error())
+		}
+		var rp string
+		if !d.Args(&rp) {
+			return d.ArgErr()
+		}
+		policies[class] = rp
+	}
+	m.Policies = policies
+	return nil
+}
+
+// unmarshalFirstSeen parses a version_first_seen option of the form:
+//
+//	version_first_seen <path> {
+//	    tenant <name>
+//	}
+func (m *AdobeUsageTracker) unmarshalFirstSeen(d *caddyfile.Dispenser) error {
+	var cfg FirstSeenConfig
+	if !d.Args(&cfg.Path) || d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "tenant":
+			if !d.Args(&cfg.Tenant) {
+				return d.ArgErr()
+			}
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.FirstSeen = &cfg
+	return nil
+}
+
+// unmarshalAbuse parses an abuse_detection block of the form:
+//
+//	abuse_detection [tag|drop] {
+//	    max_upload_sessions <count>
+//	    max_session_ips <count>
+//	    window <duration>
+//	    max_clock_skew <duration>
+//	}
+func (m *AdobeUsageTracker) unmarshalAbuse(d *caddyfile.Dispenser) error {
+	var cfg AbuseConfig
+	if d.NextArg() {
+		cfg.Action = d.Val()
+		if cfg.Action != abuseTag && cfg.Action != abuseDrop {
+			return d.Errf("abuse_detection action must be %s or %s, not %q", abuseTag, abuseDrop, cfg.Action)
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch option := d.Val(); option {
+		case "max_upload_sessions", "max_session_ips":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			count, err := strconv.Atoi(d.Val())
+			if err != nil || count <= 0 {
+				return d.Errf("%s must be a positive integer, not %q", option, d.Val())
+			}
+			if option == "max_upload_sessions" {
+				cfg.MaxUploadSessions = count
+			} else {
+				cfg.MaxSessionIPs = count
+			}
+		case "window", "max_clock_skew":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			duration, err := caddy.ParseDuration(d.Val())
+			if err != nil || duration <= 0 {
+				return d.Errf("invalid abuse_detection %s %q", option, d.Val())
+			}
+			if option == "window" {
+				cfg.Window = caddy.Duration(duration)
+			} else {
+				cfg.MaxClockSkew = caddy.Duration(duration)
+			}
 		default:
 			return d.ArgErr()
 		}
 	}
+	m.Abuse = &cfg
+	return nil
+}
+
+// unmarshalAnonymize parses an anonymize block of the form:
+//
+//	anonymize {
+//	    algorithm <algorithm>
+//	    salt_dir <dir>
+//	    tenant <name>
+//	}
+//
+// Settings not given are taken from the global option, so the
+// global option can give the algorithm and salt directory, and
+// each site its tenant.
+func (m *AdobeUsageTracker) unmarshalAnonymize(d *caddyfile.Dispenser) error {
+	var cfg AnonymizeConfig
+	if m.Anonymize != nil {
+		cfg = *m.Anonymize
+	}
+	if err := unmarshalAnonymizeBlock(d, &cfg); err != nil {
+		return err
+	}
+	m.Anonymize = &cfg
+	return nil
+}
+
+// unmarshalAnonymizeBlock parses the settings in an anonymize block
+// into cfg.
+func unmarshalAnonymizeBlock(d *caddyfile.Dispenser, cfg *AnonymizeConfig) error {
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var target *string
+		switch d.Val() {
+		case "algorithm":
+			target = &cfg.Algorithm
+		case "salt_dir":
+			target = &cfg.SaltDir
+		case "tenant":
+			target = &cfg.Tenant
+		default:
+			return d.ArgErr()
+		}
+		if !d.Args(target) {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+// unmarshalDedup parses a dedup_store block of the form:
+//
+//	dedup_store <path> {
+//	    horizon <duration>
+//	    capacity <count>
+//	    false_positive_rate <rate>
+//	}
+func (m *AdobeUsageTracker) unmarshalDedup(d *caddyfile.Dispenser) error {
+	var cfg DedupConfig
+	if !d.Args(&cfg.Path) {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "horizon":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			horizon, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid dedup_store horizon %q: %v", d.Val(), err)
+			}
+			cfg.Horizon = caddy.Duration(horizon)
+		case "capacity":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			capacity, err := strconv.Atoi(d.Val())
+			if err != nil || capacity <= 0 {
+				return d.Errf("capacity must be a positive integer, not %q", d.Val())
+			}
+			cfg.Capacity = capacity
+		case "false_positive_rate":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rate, err := strconv.ParseFloat(d.Val(), 64)
+			if err != nil || rate <= 0 || rate >= 1 {
+				return d.Errf("false_positive_rate must be between 0 and 1, not %q", d.Val())
+			}
+			cfg.FalsePositiveRate = rate
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.Dedup = &cfg
+	return nil
+}
+
+// unmarshalExport parses a parquet_export block of the form:
+//
+//	parquet_export <dir> {
+//	    flush_interval <duration>
+//	    max_rows <count>
+//	    compression snappy|gzip|zstd|none
+//	}
+func (m *AdobeUsageTracker) unmarshalExport(d *caddyfile.Dispenser) error {
+	var cfg ExportConfig
+	if !d.Args(&cfg.Dir) {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "flush_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid parquet_export flush_interval %q: %v", d.Val(), err)
+			}
+			cfg.FlushInterval = caddy.Duration(interval)
+		case "max_rows":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			rows, err := strconv.Atoi(d.Val())
+			if err != nil || rows <= 0 {
+				return d.Errf("max_rows must be a positive integer, not %q", d.Val())
+			}
+			cfg.MaxRows = rows
+		case "compression":
+			if !d.Args(&cfg.Compression) {
+				return d.ArgErr()
+			}
+			if err := validExportCompression(cfg.Compression); err != nil {
+				return d.Err(err.Error())
+			}
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.Export = &cfg
+	return nil
+}
+
+// unmarshalDirectory parses a directory block of the form:
+//
+//	directory <url> {
+//	    token <token>
+//	    match <attribute>
+//	    identity <placeholder>
+//	    tag <name> <attribute>
+//	    cache_ttl <duration>
+//	}
+func (m *AdobeUsageTracker) unmarshalDirectory(d *caddyfile.Dispenser) error {
+	cfg := DirectoryConfig{Tags: make(map[string]string)}
+	if !d.Args(&cfg.URL) {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		switch d.Val() {
+		case "token":
+			if !d.Args(&cfg.Token) {
+				return d.ArgErr()
+			}
+		case "match":
+			if !d.Args(&cfg.Match) {
+				return d.ArgErr()
+			}
+		case "identity":
+			if !d.Args(&cfg.Identity) {
+				return d.ArgErr()
+			}
+		case "tag":
+			var name, attr string
+			if !d.Args(&name, &attr) {
+				return d.ArgErr()
+			}
+			cfg.Tags[name] = attr
+		case "cache_ttl":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			ttl, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid directory cache_ttl %q: %v", d.Val(), err)
+			}
+			cfg.CacheTTL = caddy.Duration(ttl)
+		default:
+			return d.ArgErr()
+		}
+	}
+	m.Directory = &cfg
+	return nil
+}
+
+// unmarshalFilter parses a filter block of the form:
+//
+//	filter keep|drop [all|any] {
+//	    <attribute> <op> <value>
+//	    ...
+//	}
+func (m *AdobeUsageTracker) unmarshalFilter(d *caddyfile.Dispenser) error {
+	var rule FilterRule
+	if !d.Args(&rule.Action) {
+		return d.ArgErr()
+	}
+	d.Args(&rule.Match)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var cond FilterCondition
+		cond.Attribute = d.Val()
+		if !d.Args(&cond.Op, &cond.Value) {
+			return d.ArgErr()
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		rule.Conditions = append(rule.Conditions, cond)
+	}
+	if _, err := compileFilterRule(rule); err != nil {
+		return d.Err(err.Error())
+	}
+	m.Filters = append(m.Filters, rule)
+	return nil
+}
+
+// unmarshalExtract parses an extract block of the form:
+//
+//	extract {
+//	    tag|field <name> <pattern>
+//	    ...
+//	}
+func (m *AdobeUsageTracker) unmarshalExtract(d *caddyfile.Dispenser) error {
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	configs := append([]ExtractionConfig(nil), m.Extractions...)
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		var cfg ExtractionConfig
+		switch d.Val() {
+		case "tag":
+		case "field":
+			cfg.Field = true
+		default:
+			return d.Errf("extractions must start with tag or field, not %q", d.Val())
+		}
+		if !d.Args(&cfg.Name, &cfg.Pattern) || d.NextArg() {
+			return d.ArgErr()
+		}
+		configs = append(configs, cfg)
+	}
+	if _, err := compileExtractions(configs); err != nil {
+		return d.Err(err.Error())
+	}
+	m.Extractions = configs
 	return nil
 }
 
 // parseCaddyfile unmarshals tokens from h into a new AdobeUsageTracker.
+// If there is a global adobe_usage_tracker option, its values are
+// the defaults, which the directive's values override.  Filter rules,
+// extractions, and enrichers in the directive are added after those
+// in the global option.
 func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
 	var m AdobeUsageTracker
+	if defaults, ok := h.Option("adobe_usage_tracker").(*AdobeUsageTracker); ok {
+		m = *defaults
+		m.Filters = append([]FilterRule(nil), defaults.Filters...)
+		m.Extractions = append([]ExtractionConfig(nil), defaults.Extractions...)
+		m.EnrichersRaw = append([]json.RawMessage(nil), defaults.EnrichersRaw...)
+	}
 	err := m.UnmarshalCaddyfile(h.Dispenser)
 	return m, err
 }
 
+// parseGlobalOption unmarshals the global adobe_usage_tracker
+// option, which takes the same block as the directive.
+func parseGlobalOption(d *caddyfile.Dispenser, existingVal any) (any, error) {
+	if existingVal != nil {
+		return nil, d.Err("the adobe_usage_tracker global option can only be given once")
+	}
+	defaults := new(AdobeUsageTracker)
+	if err := defaults.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
 // Interface guards
 var (
 	_ caddy.Provisioner           = (*AdobeUsageTracker)(nil)
 	_ caddy.Validator             = (*AdobeUsageTracker)(nil)
+	_ caddy.CleanerUpper          = (*AdobeUsageTracker)(nil)
 	_ caddyhttp.MiddlewareHandler = (*AdobeUsageTracker)(nil)
 	_ caddyfile.Unmarshaler       = (*AdobeUsageTracker)(nil)
 )
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"reflect"
+	"testing"
+)
+
+func TestGlobalOptionDefaults(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		endpoint https://influx.example.com
+		database shared
+		policy autogen
+		token secret
+		filter drop {
+			osName == WIN
+		}
+		policies {
+			rollup forever
+		}
+	}`)
+	defaults, err := parseGlobalOption(d, nil)
+	if err != nil {
+		t.Fatalf("Failed to parse global option: %v", err)
+	}
+	if _, err := parseGlobalOption(caddyfile.NewTestDispenser(`adobe_usage_tracker`), defaults); err == nil {
+		t.Errorf("Expected an error giving the global option twice")
+	}
+	m := *defaults.(*AdobeUsageTracker)
+	m.Filters = append([]FilterRule(nil), m.Filters...)
+	d = caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		database override
+		filter keep {
+			appId ^= InDesign
+		}
+		policies {
+			sessions week
+		}
+	}`)
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	if m.Endpoint != "https://influx.example.com" || m.Database != "override" || m.Token != "secret" {
+		t.Errorf("Unexpected settings: %q %q %q", m.Endpoint, m.Database, m.Token)
+	}
+	if len(m.Filters) != 2 || m.Filters[0].Action != "drop" || m.Filters[1].Action != "keep" {
+		t.Errorf("Unexpected filters: %v", m.Filters)
+	}
+	if len(m.Policies) != 2 || m.Policies[classRollup] != "forever" || m.Policies[classSessions] != "week" {
+		t.Errorf("Unexpected policies: %v", m.Policies)
+	}
+	if len(defaults.(*AdobeUsageTracker).Filters) != 1 || len(defaults.(*AdobeUsageTracker).Policies) != 1 {
+		t.Errorf("Expected the defaults to be unchanged")
+	}
+}
+
+func TestPolicyFor(t *testing.T) {
+	m := AdobeUsageTracker{
+		Endpoint: "https://influx.example.com",
+		Database: "tracker",
+		Policy:   "autogen",
+		Token:    "secret",
+		Policies: map[string]string{classSessions: "week", classRollup: "forever"},
+	}
+	if err := m.provisionInflux(); err != nil {
+		t.Fatalf("Failed to provision: %v", err)
+	}
+	if rp := m.policyFor(classSessions); rp != "week" {
+		t.Errorf("Expected sessions to be written with policy week, got %q", rp)
+	}
+	if rp := m.policyFor(classAGS); rp != "autogen" {
+		t.Errorf("Expected AGS events to be written with the default policy, got %q", rp)
+	}
+	if policies := m.allPolicies(); !reflect.DeepEqual(policies, []string{"autogen", "forever", "week"}) {
+		t.Errorf("Unexpected policies: %v", policies)
+	}
+	m.Policies = map[string]string{"errors": "day"}
+	if err := m.provisionInflux(); err == nil {
+		t.Errorf("Expected an error for an unknown measurement class")
+	}
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		policies {
+			errors day
+		}
+	}`)
+	if err := new(AdobeUsageTracker).UnmarshalCaddyfile(d); err == nil {
+		t.Errorf("Expected an error parsing an unknown measurement class")
+	}
+}
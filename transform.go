@@ -0,0 +1,134 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/google/cel-go/cel"
+	"go.uber.org/zap"
+	"reflect"
+)
+
+// sessionSetters gives the session attributes that can be
+// replaced by a transform.
+var sessionSetters = map[string]func(s *core.Session, v string){
+	"sessionId":     func(s *core.Session, v string) { s.SessionId = v },
+	"clientIp":      func(s *core.Session, v string) { s.ClientIp = v },
+	"appId":         func(s *core.Session, v string) { s.AppId = v },
+	"appVersion":    func(s *core.Session, v string) { s.AppVersion = v },
+	"appLocale":     func(s *core.Session, v string) { s.AppLocale = v },
+	"nglVersion":    func(s *core.Session, v string) { s.NglVersion = v },
+	"osName":        func(s *core.Session, v string) { s.OsName = v },
+	"osVersion":     func(s *core.Session, v string) { s.OsVersion = v },
+	"userId":        func(s *core.Session, v string) { s.UserId = v },
+	"launchKind":    func(s *core.Session, v string) { s.LaunchKind = v },
+	"addressFamily": func(s *core.Session, v string) { s.AddressFamily = v },
+	"profileId":     func(s *core.Session, v string) { s.ProfileId = v },
+}
+
+// A sessionTransform is a CEL expression that is evaluated
+// against each parsed session before it is sent.  The expression
+// sees the session as the map `session`, which has all the session
+// attributes as strings, plus `launchDuration` (in milliseconds)
+// and `launchTime` (a timestamp).  The expression's result decides
+// what happens to the session:
+//
+//   - a bool keeps (true) or drops (false) the session; the variables
+//     `keep` and `drop` can be used for readability.
+//   - a map of strings keeps the session, replacing any session
+//     attributes named in the map and adding the other entries as
+//     tags.
+//
+// If the expression fails on a session, the error is logged and the
+// session is kept unchanged.
+type sessionTransform struct {
+	expr    string
+	program cel.Program
+	tags    *tagPolicy // decides conflicts with tags from other sources
+}
+
+var mapOfAnyType = reflect.TypeOf(map[string]any{})
+
+// newSessionTransform compiles a transform expression.
+func newSessionTransform(expr string) (*sessionTransform, error) {
+	env, err := cel.NewEnv(
+		cel.Variable("session", cel.MapType(cel.StringType, cel.DynType)),
+		cel.Variable("keep", cel.BoolType),
+		cel.Variable("drop", cel.BoolType),
+	)
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expr)
+	if issues.Err() != nil {
+		return nil, fmt.Errorf("invalid transform %q: %v", expr, issues.Err())
+	}
+	program, err := env.Program(ast)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transform %q: %v", expr, err)
+	}
+	return &sessionTransform{expr: expr, program: program}, nil
+}
+
+// apply runs the transform over the given sessions, returning
+// the sessions that are kept, as transformed.
+func (t *sessionTransform) apply(sessions []core.Session, logger *zap.Logger) []core.Session {
+	if t == nil {
+		return sessions
+	}
+	kept := make([]core.Session, 0, len(sessions))
+	for _, session := range sessions {
+		result, keep, err := t.eval(session, logger)
+		if err != nil {
+			logger.Error("AdobeUsageTracker: transform failed, keeping session",
+				zap.String("sessionId", session.SessionId), zap.Error(err))
+			kept = append(kept, session)
+		} else if keep {
+			kept = append(kept, result)
+		}
+	}
+	return kept
+}
+
+// eval evaluates the transform on a single session.
+func (t *sessionTransform) eval(s core.Session, logger *zap.Logger) (core.Session, bool, error) {
+	vars := make(map[string]any, len(core.SessionAttributes)+2)
+	for name, attr := range core.SessionAttributes {
+		vars[name] = attr(s)
+	}
+	vars["launchDuration"] = s.LaunchDuration.Milliseconds()
+	vars["launchTime"] = s.LaunchTime
+	for name, value := range s.Tags {
+		vars[name] = value
+	}
+	out, _, err := t.program.Eval(map[string]any{"session": vars, "keep": true, "drop": false})
+	if err != nil {
+		return s, true, err
+	}
+	if keep, ok := out.Value().(bool); ok {
+		return s, keep, nil
+	}
+	native, err := out.ConvertToNative(mapOfAnyType)
+	if err != nil {
+		return s, true, fmt.Errorf("transform result must be a bool or a map, not %s", out.Type().TypeName())
+	}
+	tags := make(map[string]string)
+	for name, value := range native.(map[string]any) {
+		str, ok := value.(string)
+		if !ok {
+			return s, true, fmt.Errorf("transform result %q must be a string, not %T", name, value)
+		}
+		if set, ok := sessionSetters[name]; ok {
+			set(&s, str)
+		} else {
+			tags[name] = str
+		}
+	}
+	return t.tags.merge(s, tags, tagSourceTransform, logger), true, nil
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransformKeepOrDrop(t *testing.T) {
+	transform, err := newSessionTransform(`session.appVersion.startsWith("19.") ? keep : drop`)
+	if err != nil {
+		t.Fatalf("Failed to compile transform: %v", err)
+	}
+	sessions := []core.Session{
+		{SessionId: "a", AppVersion: "19.4"},
+		{SessionId: "b", AppVersion: "20.1"},
+		{SessionId: "c", AppVersion: "19.0.1"},
+	}
+	kept := transform.apply(sessions, zap.NewNop())
+	if len(kept) != 2 || kept[0].SessionId != "a" || kept[1].SessionId != "c" {
+		t.Errorf("Expected sessions a and c to be kept, got %v", kept)
+	}
+}
+
+func TestTransformModifyAndTag(t *testing.T) {
+	transform, err := newSessionTransform(
+		`{"appId": session.appId + "-beta", "slow": session.launchDuration > 5000 ? "yes" : "no"}`)
+	if err != nil {
+		t.Fatalf("Failed to compile transform: %v", err)
+	}
+	original := core.Session{SessionId: "a", AppId: "InDesign1", LaunchDuration: 6 * time.Second}
+	kept := transform.apply([]core.Session{original}, zap.NewNop())
+	if len(kept) != 1 {
+		t.Fatalf("Expected the session to be kept, got %d sessions", len(kept))
+	}
+	if kept[0].AppId != "InDesign1-beta" {
+		t.Errorf("Expected appId to be modified, got %q", kept[0].AppId)
+	}
+	if kept[0].Tags["slow"] != "yes" {
+		t.Errorf("Expected a slow tag of yes, got %v", kept[0].Tags)
+	}
+	if original.Tags != nil {
+		t.Errorf("Expected the original session to be untouched, got %v", original.Tags)
+	}
+	line := core.SessionLine(kept[0], &core.LineFormat{}, zap.NewNop())
+	if !strings.HasPrefix(line, "log-session,slow=yes,sessionId=a ") {
+		t.Errorf("Expected the tag in the line, got %q", line)
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+	if _, err := newSessionTransform(`session.appId.startsWith(`); err == nil {
+		t.Errorf("Expected an error on an unparseable transform")
+	}
+	transform, err := newSessionTransform(`session.appId.size()`)
+	if err != nil {
+		t.Fatalf("Failed to compile transform: %v", err)
+	}
+	sessions := []core.Session{{SessionId: "a", AppId: "InDesign1"}}
+	if kept := transform.apply(sessions, zap.NewNop()); len(kept) != 1 || kept[0].Tags != nil {
+		t.Errorf("Expected a failing transform to keep the session unchanged, got %v", kept)
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"go.uber.org/zap"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	upgradeMeasurement   = "ngl_upgrade"
+	upgradeHorizon       = 90 * 24 * time.Hour
+	upgradePruneInterval = 24 * time.Hour
+)
+
+// The upgrade registry holds the NGL versions shared by all the
+// trackers with the same name that report upgrades.  Like the usage
+// registry, it outlives any single configuration, so a config reload
+// doesn't forget the version each app was last seen with.  The
+// versions are discarded when the last tracker using them is
+// cleaned up.
+var upgradeRegistry = struct {
+	sync.Mutex
+	versions map[string]*nglVersions
+}{versions: make(map[string]*nglVersions)}
+
+// An nglVersions remembers the NGL version that each app on each
+// machine was last launched with.  Since each app bundles its own
+// copy of NGL, apps on the same machine are tracked separately.
+// Machines are identified by the address that uploaded their logs,
+// as in the machine rollup.  Apps that haven't been launched for
+// the upgrade horizon are forgotten.
+type nglVersions struct {
+	name string
+	refs int
+
+	mu     sync.Mutex
+	last   map[string]nglVersion
+	pruned time.Time
+}
+
+// An nglVersion is the NGL version of the latest launch of an app.
+type nglVersion struct {
+	version string
+	launch  time.Time
+}
+
+// acquireUpgrades returns the named tracker's NGL versions,
+// creating them if necessary.
+func acquireUpgrades(name string) *nglVersions {
+	upgradeRegistry.Lock()
+	defer upgradeRegistry.Unlock()
+	v, ok := upgradeRegistry.versions[name]
+	if !ok {
+		v = &nglVersions{name: name, last: make(map[string]nglVersion)}
+		upgradeRegistry.versions[name] = v
+	}
+	v.refs++
+	return v
+}
+
+// release gives up one tracker's use of the versions.
+func (v *nglVersions) release() {
+	upgradeRegistry.Lock()
+	defer upgradeRegistry.Unlock()
+	v.refs--
+	if v.refs == 0 && upgradeRegistry.versions[v.name] == v {
+		delete(upgradeRegistry.versions, v.name)
+	}
+}
+
+// observe records the NGL versions of the given sessions, which
+// were uploaded at now, and returns a line protocol point for each
+// session launched with a different version than the previous launch
+// of its app on its machine.  Sessions launched before the latest
+// launch already seen (such as those in logs uploaded late) don't
+// change the version, so they can't be taken for downgrades.
+func (v *nglVersions) observe(sessions []core.Session, now time.Time) []string {
+	if v == nil || len(sessions) == 0 {
+		return nil
+	}
+	ordered := make([]core.Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.AppId != "" && s.NglVersion != "" {
+			ordered = append(ordered, s)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].LaunchTime.Before(ordered[j].LaunchTime) })
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.prune(now)
+	var lines []string
+	for _, s := range ordered {
+		key := sessionMachine(s) + "|" + s.AppId
+		prev, ok := v.last[key]
+		if ok && !s.LaunchTime.After(prev.launch) {
+			continue
+		}
+		if ok && prev.version != s.NglVersion {
+			lines = append(lines, upgradeLine(s, prev.version))
+		}
+		v.last[key] = nglVersion{version: s.NglVersion, launch: s.LaunchTime}
+	}
+	return lines
+}
+
+// prune forgets the apps that haven't been launched for the
+// upgrade horizon.  It runs at most once a day.
+func (v *nglVersions) prune(now time.Time) {
+	if now.Sub(v.pruned) < upgradePruneInterval {
+		return
+	}
+	v.pruned = now
+	for key, last := range v.last {
+		if now.Sub(last.launch) > upgradeHorizon {
+			delete(v.last, key)
+		}
+	}
+}
+
+// upgradeLine returns the line protocol point for a session that
+// was launched with a different NGL version than the one before.
+func upgradeLine(s core.Session, oldVersion string) string {
+	line := fmt.Sprintf("%s,appId=%s,oldVersion=%s,newVersion=%s sessionId=%q,clientIp=%q",
+		upgradeMeasurement, core.TagEscaper.Replace(s.AppId),
+		core.TagEscaper.Replace(oldVersion), core.TagEscaper.Replace(s.NglVersion),
+		s.SessionId, s.ClientIp)
+	if s.UserId != "" {
+		line = line + fmt.Sprintf(",userId=%q", s.UserId)
+	}
+	return line + fmt.Sprintf(" %d", s.LaunchTime.UnixMilli())
+}
+
+// sendEvents writes event points derived from sessions (such as
+// NGL upgrades) to the database, or logs them if sessions are only
+// being logged.  They are written with the retention policy for
+// sessions.
+func (m AdobeUsageTracker) sendEvents(what string, lines []string, logger *zap.Logger) {
+	if len(lines) == 0 {
+		return
+	}
+	if m.ep == "" {
+		logger.Info("AdobeUsageTracker: "+what, zap.Strings("points", lines))
+		return
+	}
+	err := m.sendWithToken(func(tok string) error {
+		return core.UploadLines(m.ep, m.db, m.policyFor(classSessions), tok, lines, logger)
+	}, logger)
+	m.alertOnWrite(err, logger)
+	if err != nil {
+		logger.Error("AdobeUsageTracker: failed to write "+what, zap.Error(err))
+	}
+}
@@ -0,0 +1,52 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/clickonetwo/tracker/core"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNglUpgrades(t *testing.T) {
+	v := acquireUpgrades("")
+	defer v.release()
+	start := time.UnixMilli(1716994039000)
+	launch := func(id string, ip string, app string, ngl string, hours int) core.Session {
+		return core.Session{SessionId: id, ClientIp: ip, AppId: app, NglVersion: ngl,
+			LaunchTime: start.Add(time.Duration(hours) * time.Hour)}
+	}
+	lines := v.observe([]core.Session{
+		launch("a", "10.0.0.1:53450", "Photoshop1", "1.34.0.4", 0),
+		launch("b", "10.0.0.1:53451", "InDesign1", "1.33.0.9", 1),
+		launch("c", "10.0.0.2:53450", "Photoshop1", "1.34.0.4", 1),
+	}, start.Add(2*time.Hour))
+	if len(lines) != 0 {
+		t.Errorf("Expected no upgrades for first launches, got %v", lines)
+	}
+	// the sessions of an upload are ordered by launch time, and
+	// late logs of launches older than the latest are ignored
+	lines = v.observe([]core.Session{
+		launch("e", "10.0.0.1:53452", "Photoshop1", "1.35.0.1", 5),
+		{SessionId: "f", ClientIp: "10.0.0.1:53452", AppId: "Photoshop1", NglVersion: "1.34.0.4",
+			LaunchTime: start.Add(-time.Hour), UserId: "u1"},
+		launch("d", "10.0.0.1:53452", "Photoshop1", "1.34.0.4", 3),
+		launch("g", "10.0.0.1:53452", "InDesign1", "1.33.0.9", 5),
+	}, start.Add(6*time.Hour))
+	expected := []string{
+		`ngl_upgrade,appId=Photoshop1,oldVersion=1.34.0.4,newVersion=1.35.0.1 sessionId="e",clientIp="10.0.0.1:53452" ` +
+			"1717012039000",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+	var none *nglVersions
+	if lines := none.observe([]core.Session{launch("h", "10.0.0.1:1", "Photoshop1", "1.0", 9)}, start); lines != nil {
+		t.Errorf("Expected no upgrades without tracking, got %v", lines)
+	}
+}
@@ -0,0 +1,231 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/clickonetwo/tracker/core"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultUsageTop is the number of OS versions in a snapshot,
+// if the request doesn't say how many it wants.
+const defaultUsageTop = 10
+
+// The usage registry holds the usage aggregate shared by all the
+// trackers with the same name that keep one.  Like the rollup
+// registry, it outlives any single configuration, so a config reload
+// doesn't lose the day's usage so far.  An aggregate is discarded
+// when the last tracker using it is cleaned up.
+var usageRegistry = struct {
+	sync.Mutex
+	usage map[string]*usageAggregate
+}{usage: make(map[string]*usageAggregate)}
+
+// A usageAggregate counts the launches, users, and OS versions seen
+// in the sessions uploaded since midnight UTC.  Sessions are counted
+// once each, no matter how many uploads their logs are split across.
+type usageAggregate struct {
+	name string
+	refs int
+
+	mu         sync.Mutex
+	day        time.Time
+	updated    time.Time
+	sessions   map[string]bool
+	users      map[string]bool
+	apps       map[string]*appUsage
+	osVersions map[osVersion]int
+}
+
+// An appUsage counts the launches and users of a single app.
+type appUsage struct {
+	launches int
+	users    map[string]bool
+}
+
+// An osVersion identifies the OS a session was launched on.
+type osVersion struct {
+	name    string
+	version string
+}
+
+// acquireUsage returns the named tracker's usage aggregate,
+// creating it if necessary.
+func acquireUsage(name string) *usageAggregate {
+	usageRegistry.Lock()
+	defer usageRegistry.Unlock()
+	u, ok := usageRegistry.usage[name]
+	if !ok {
+		u = &usageAggregate{name: name}
+		u.reset(time.Now())
+		usageRegistry.usage[name] = u
+	}
+	u.refs++
+	return u
+}
+
+// release gives up one tracker's use of the aggregate.
+func (u *usageAggregate) release() {
+	usageRegistry.Lock()
+	defer usageRegistry.Unlock()
+	u.refs--
+	if u.refs == 0 && usageRegistry.usage[u.name] == u {
+		delete(usageRegistry.usage, u.name)
+	}
+}
+
+// reset empties the aggregate and starts the day containing now.
+func (u *usageAggregate) reset(now time.Time) {
+	u.day = now.UTC().Truncate(24 * time.Hour)
+	u.updated = time.Time{}
+	u.sessions = make(map[string]bool)
+	u.users = make(map[string]bool)
+	u.apps = make(map[string]*appUsage)
+	u.osVersions = make(map[osVersion]int)
+}
+
+// rollover starts a new day if now is past the current one.
+func (u *usageAggregate) rollover(now time.Time) {
+	if !now.Before(u.day.Add(24 * time.Hour)) {
+		u.reset(now)
+	}
+}
+
+// add counts the given sessions, which were uploaded at now.
+func (u *usageAggregate) add(sessions []core.Session, now time.Time) {
+	if u == nil || len(sessions) == 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover(now)
+	u.updated = now
+	for _, s := range sessions {
+		if u.sessions[s.SessionId] {
+			continue
+		}
+		u.sessions[s.SessionId] = true
+		if s.UserId != "" {
+			u.users[s.UserId] = true
+		}
+		app := u.apps[s.AppId]
+		if app == nil {
+			app = &appUsage{users: make(map[string]bool)}
+			u.apps[s.AppId] = app
+		}
+		app.launches++
+		if s.UserId != "" {
+			app.users[s.UserId] = true
+		}
+		u.osVersions[osVersion{s.OsName, s.OsVersion}]++
+	}
+}
+
+// A usageSnapshot is the JSON form of the usage aggregate.
+type usageSnapshot struct {
+	Day         string           `json:"day"`
+	Updated     *time.Time       `json:"updated,omitempty"`
+	Launches    int              `json:"launches"`
+	UniqueUsers int              `json:"unique_users"`
+	Apps        []appSnapshot    `json:"apps"`
+	TopOS       []osVersionCount `json:"top_os_versions"`
+}
+
+// An appSnapshot gives the usage of a single app.
+type appSnapshot struct {
+	AppId       string `json:"app_id"`
+	Launches    int    `json:"launches"`
+	UniqueUsers int    `json:"unique_users"`
+}
+
+// An osVersionCount gives the launches on a single OS version.
+type osVersionCount struct {
+	OsName    string `json:"os_name"`
+	OsVersion string `json:"os_version"`
+	Launches  int    `json:"launches"`
+}
+
+// snapshot returns the usage for the current day, with at most
+// top OS versions.  Apps and OS versions are listed most launched
+// first.
+func (u *usageAggregate) snapshot(now time.Time, top int) usageSnapshot {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.rollover(now)
+	snap := usageSnapshot{
+		Day:         u.day.Format(time.DateOnly),
+		Launches:    len(u.sessions),
+		UniqueUsers: len(u.users),
+		Apps:        make([]appSnapshot, 0, len(u.apps)),
+		TopOS:       make([]osVersionCount, 0, len(u.osVersions)),
+	}
+	if !u.updated.IsZero() {
+		updated := u.updated.UTC()
+		snap.Updated = &updated
+	}
+	for id, app := range u.apps {
+		snap.Apps = append(snap.Apps, appSnapshot{AppId: id, Launches: app.launches, UniqueUsers: len(app.users)})
+	}
+	sort.Slice(snap.Apps, func(i, j int) bool {
+		a, b := snap.Apps[i], snap.Apps[j]
+		return a.Launches > b.Launches || (a.Launches == b.Launches && a.AppId < b.AppId)
+	})
+	for os, count := range u.osVersions {
+		snap.TopOS = append(snap.TopOS, osVersionCount{OsName: os.name, OsVersion: os.version, Launches: count})
+	}
+	sort.Slice(snap.TopOS, func(i, j int) bool {
+		a, b := snap.TopOS[i], snap.TopOS[j]
+		if a.Launches != b.Launches {
+			return a.Launches > b.Launches
+		}
+		if a.OsName != b.OsName {
+			return a.OsName < b.OsName
+		}
+		return a.OsVersion < b.OsVersion
+	})
+	if len(snap.TopOS) > top {
+		snap.TopOS = snap.TopOS[:top]
+	}
+	return snap
+}
+
+// handleUsage serves a snapshot of the current day's usage.  The
+// number of OS versions can be given with the top query parameter,
+// and the tracker whose usage is wanted with the name parameter.
+func (a trackerAdmin) handleUsage(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: fmt.Errorf("method not allowed")}
+	}
+	top := defaultUsageTop
+	if param := r.URL.Query().Get("top"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n < 0 {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: fmt.Errorf("invalid top %q", param)}
+		}
+		top = n
+	}
+	name := r.URL.Query().Get("name")
+	usageRegistry.Lock()
+	usage := usageRegistry.usage[name]
+	usageRegistry.Unlock()
+	if usage == nil {
+		if name != "" {
+			return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no tracker named %q keeps a usage snapshot", name)}
+		}
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: fmt.Errorf("no tracker keeps a usage snapshot")}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(usage.snapshot(time.Now(), top))
+}
@@ -0,0 +1,79 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"github.com/clickonetwo/tracker/core"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestUsageAggregate(t *testing.T) {
+	u := &usageAggregate{}
+	now := time.Date(2024, 5, 30, 15, 0, 0, 0, time.UTC)
+	u.reset(now)
+	u.add([]core.Session{
+		{SessionId: "a", AppId: "Photoshop1", UserId: "u1", OsName: "MAC", OsVersion: "14.5.0"},
+		{SessionId: "b", AppId: "Photoshop1", UserId: "u2", OsName: "MAC", OsVersion: "14.5.0"},
+		{SessionId: "c", AppId: "InDesign1", UserId: "u1", OsName: "WINDOWS", OsVersion: "10.0"},
+	}, now)
+	// a session split across uploads is only counted once
+	u.add([]core.Session{{SessionId: "a", AppId: "Photoshop1", UserId: "u1", OsName: "MAC", OsVersion: "14.5.0"}}, now)
+	snap := u.snapshot(now, 1)
+	if snap.Day != "2024-05-30" || snap.Launches != 3 || snap.UniqueUsers != 2 {
+		t.Errorf("Unexpected totals: %+v", snap)
+	}
+	apps := []appSnapshot{{"Photoshop1", 2, 2}, {"InDesign1", 1, 1}}
+	if !reflect.DeepEqual(snap.Apps, apps) {
+		t.Errorf("Expected apps %v, got %v", apps, snap.Apps)
+	}
+	top := []osVersionCount{{"MAC", "14.5.0", 2}}
+	if !reflect.DeepEqual(snap.TopOS, top) {
+		t.Errorf("Expected top OS versions %v, got %v", top, snap.TopOS)
+	}
+	snap = u.snapshot(now.Add(9*time.Hour), defaultUsageTop)
+	if snap.Day != "2024-05-31" || snap.Launches != 0 || len(snap.Apps) != 0 || snap.Updated != nil {
+		t.Errorf("Expected an empty snapshot for the next day, got %+v", snap)
+	}
+}
+
+func TestUsageAdmin(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/adobe_usage_tracker/usage", nil)
+	if err := (trackerAdmin{}).handleUsage(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error when no tracker keeps a usage snapshot")
+	}
+	u := acquireUsage("")
+	defer u.release()
+	if acquireUsage("") != u {
+		t.Errorf("Expected trackers to share the usage aggregate")
+	}
+	u.release()
+	u.add([]core.Session{{SessionId: "a", AppId: "Photoshop1", UserId: "u1"}}, time.Now())
+	w := httptest.NewRecorder()
+	if err := (trackerAdmin{}).handleUsage(w, r); err != nil {
+		t.Fatalf("Usage snapshot failed: %v", err)
+	}
+	var snap usageSnapshot
+	if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil {
+		t.Fatalf("Cannot decode snapshot %q: %v", w.Body.String(), err)
+	}
+	if snap.Launches != 1 || len(snap.Apps) != 1 || snap.Apps[0].AppId != "Photoshop1" {
+		t.Errorf("Unexpected snapshot: %s", w.Body.String())
+	}
+	r = httptest.NewRequest(http.MethodGet, "/adobe_usage_tracker/usage?top=-1", nil)
+	if err := (trackerAdmin{}).handleUsage(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error for a negative top")
+	}
+	r = httptest.NewRequest(http.MethodPost, "/adobe_usage_tracker/usage", nil)
+	if err := (trackerAdmin{}).handleUsage(httptest.NewRecorder(), r); err == nil {
+		t.Errorf("Expected an error on POST")
+	}
+}
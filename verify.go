@@ -0,0 +1,238 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/clickonetwo/tracker/core"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "adobe-usage-tracker",
+		Short: "Commands for the adobe_usage_tracker handler",
+		CobraFunc: func(cmd *cobra.Command) {
+			verify := &cobra.Command{
+				Use:   "verify [--config <path>] [--adapter <name>] [--sample <log>]",
+				Short: "Checks each adobe_usage_tracker handler in a config",
+				Long: `
+Checks each adobe_usage_tracker handler in a config, and prints a
+pass/fail report.  Each handler is provisioned and validated, its
+Influx endpoint is sent an empty write with its token (which
+checks the endpoint, database, retention policy, and token without
+writing any data), and, if --sample is given, the sample log is
+parsed as the handler would parse an upload, without sending the
+sessions found.
+
+--config and --adapter load the config as the run command does.
+
+The exit status is non-zero if any check fails.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdVerify),
+			}
+			verify.Flags().StringP("config", "c", "", "Configuration file")
+			verify.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			verify.Flags().StringP("sample", "s", "", "A sample log to parse")
+			cmd.AddCommand(verify)
+			cmd.AddCommand(benchCommand())
+		},
+	})
+}
+
+// A verifyResult is the outcome of a single check.
+type verifyResult struct {
+	check  string
+	err    error
+	detail string
+}
+
+func (r verifyResult) String() string {
+	if r.err != nil {
+		return fmt.Sprintf("FAIL  %s: %v", r.check, r.err)
+	}
+	if r.detail != "" {
+		return fmt.Sprintf("PASS  %s: %s", r.check, r.detail)
+	}
+	return fmt.Sprintf("PASS  %s", r.check)
+}
+
+// cmdVerify implements the verify command.
+func cmdVerify(fs caddycmd.Flags) (int, error) {
+	config, _, err := caddycmd.LoadConfig(fs.String("config"), fs.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	var sample []byte
+	if path := fs.String("sample"); path != "" {
+		if sample, err = os.ReadFile(path); err != nil {
+			return caddy.ExitCodeFailedStartup, fmt.Errorf("cannot read sample log: %v", err)
+		}
+	}
+	var tree any
+	if err := json.Unmarshal(config, &tree); err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("cannot decode config: %v", err)
+	}
+	handlers := findTrackerHandlers(tree, nil)
+	if len(handlers) == 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no adobe_usage_tracker handlers found in config")
+	}
+	failed := false
+	for i, handler := range handlers {
+		fmt.Printf("adobe_usage_tracker handler %d of %d:\n", i+1, len(handlers))
+		for _, result := range verifyTracker(handler, sample, http.DefaultClient) {
+			fmt.Println("  " + result.String())
+			failed = failed || result.err != nil
+		}
+	}
+	if failed {
+		return 1, fmt.Errorf("some checks failed")
+	}
+	return 0, nil
+}
+
+// findTrackerHandlers returns the JSON of every adobe_usage_tracker
+// handler found anywhere in a decoded config.
+func findTrackerHandlers(node any, found []json.RawMessage) []json.RawMessage {
+	switch node := node.(type) {
+	case map[string]any:
+		if node["handler"] == "adobe_usage_tracker" {
+			if raw, err := json.Marshal(node); err == nil {
+				found = append(found, raw)
+			}
+			return found
+		}
+		for _, value := range node {
+			found = findTrackerHandlers(value, found)
+		}
+	case []any:
+		for _, value := range node {
+			found = findTrackerHandlers(value, found)
+		}
+	}
+	return found
+}
+
+// loadTracker provisions and validates a handler from its JSON
+// config.  The returned function cleans up the handler.
+func loadTracker(config json.RawMessage) (*AdobeUsageTracker, func(), error) {
+	m := new(AdobeUsageTracker)
+	if err := json.Unmarshal(config, m); err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	cleanup := func() {
+		_ = m.Cleanup()
+		cancel()
+	}
+	err := m.Provision(ctx)
+	if err == nil {
+		err = m.Validate()
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	return m, cleanup, nil
+}
+
+// verifyTracker runs the checks on a single handler's JSON config.
+// The handler is provisioned for the checks, and cleaned up after.
+func verifyTracker(config json.RawMessage, sample []byte, client *http.Client) []verifyResult {
+	m, cleanup, err := loadTracker(config)
+	if err != nil {
+		return []verifyResult{{check: "configuration", err: err}}
+	}
+	defer cleanup()
+	results := []verifyResult{{check: "configuration", detail: "valid"}}
+	if m.ep == "" {
+		results = append(results, verifyResult{check: "endpoint", detail: "none (sessions are only logged or exported)"})
+	} else {
+		for _, rp := range m.allPolicies() {
+			err := m.sendWithToken(func(tok string) error {
+				return checkWrite(client, m.ep, m.db, rp, tok)
+			}, zap.NewNop())
+			results = append(results, verifyResult{
+				check:  "endpoint",
+				err:    err,
+				detail: fmt.Sprintf("%s accepts writes to database %q, policy %q", m.ep, m.db, rp),
+			})
+		}
+	}
+	if sample != nil {
+		results = append(results, m.verifySample(sample))
+	}
+	return results
+}
+
+// checkWrite sends an empty write to an influx endpoint, which
+// checks the database, policy, and token without writing any data.
+func checkWrite(client *http.Client, ep string, db string, pol string, tok string) error {
+	target := fmt.Sprintf("%s/write?db=%s&rp=%s&precision=ms", ep, url.QueryEscape(db), url.QueryEscape(pol))
+	req, err := http.NewRequest("POST", target, http.NoBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Authorization", core.Authorization(tok))
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if core.IsAuthError(core.UploadError{Status: res.StatusCode}) {
+		return fmt.Errorf("token was rejected (status %d): %s", res.StatusCode, bytes.TrimSpace(body))
+	}
+	return fmt.Errorf("write failed (status %d): %s", res.StatusCode, bytes.TrimSpace(body))
+}
+
+// verifySample parses a sample log as the handler would parse an
+// upload, and reports what it found.
+func (m AdobeUsageTracker) verifySample(sample []byte) verifyResult {
+	result := verifyResult{check: "sample log"}
+	up := upload{received: time.Now(), remoteAddr: "192.0.2.1:0"}
+	limits := core.NewLimits(m.MaxLineLength, m.MaxLines, m.MaxSessions)
+	if err := m.parseUpload(bytes.NewReader(sample), &up, limits); err != nil {
+		result.err = err
+		return result
+	}
+	if m.Parser == parserAGS {
+		if len(up.events) == 0 {
+			result.err = fmt.Errorf("no validation events found in %d bytes", len(sample))
+		} else {
+			result.detail = fmt.Sprintf("%d validation events found", len(up.events))
+		}
+		return result
+	}
+	if len(up.sessions) == 0 {
+		result.err = fmt.Errorf("no sessions found in %d bytes", len(sample))
+		return result
+	}
+	logger := zap.NewNop()
+	sessions := m.transform.apply(m.filter.apply(up.sessions, logger), logger)
+	result.detail = fmt.Sprintf("%d sessions found, %d kept by filters and transform", len(up.sessions), len(sessions))
+	if len(sessions) > 0 {
+		result.detail += fmt.Sprintf("; the first would be written as:\n        %s", core.SessionLine(sessions[0], m.format, logger))
+	}
+	return result
+}
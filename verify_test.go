@@ -0,0 +1,84 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFindTrackerHandlers(t *testing.T) {
+	config := `{"apps": {"http": {"servers": {"srv0": {"routes": [{"handle": [
+		{"handler": "subroute", "routes": [{"handle": [
+			{"handler": "adobe_usage_tracker", "database": "one"},
+			{"handler": "reverse_proxy"}
+		]}]},
+		{"handler": "adobe_usage_tracker", "database": "two"}
+	]}]}}}}}`
+	var tree any
+	if err := json.Unmarshal([]byte(config), &tree); err != nil {
+		t.Fatalf("Failed to decode config: %v", err)
+	}
+	handlers := findTrackerHandlers(tree, nil)
+	if len(handlers) != 2 {
+		t.Fatalf("Expected 2 handlers, got %d", len(handlers))
+	}
+}
+
+func TestVerifyTracker(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"authorization failed"}`))
+			return
+		}
+		if r.URL.Query().Get("db") != "tracker" {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error":"database not found"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+	sample, err := os.ReadFile("testdata/indesign-multi-session-1-2.txt")
+	if err != nil {
+		t.Fatalf("Cannot read test log: %s", err)
+	}
+	config := func(db, tok string) json.RawMessage {
+		return json.RawMessage(fmt.Sprintf(`{"handler": "adobe_usage_tracker", "endpoint": %q, `+
+			`"database": %q, "policy": "autogen", "token": %q}`, server.URL, db, tok))
+	}
+	results := verifyTracker(config("tracker", "good"), sample, server.Client())
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %v", results)
+	}
+	for _, result := range results {
+		if result.err != nil {
+			t.Errorf("Expected all checks to pass, got %s", result)
+		}
+	}
+	if !strings.Contains(results[2].detail, "log-session,sessionId=") {
+		t.Errorf("Expected a sample line in the report, got %s", results[2])
+	}
+	results = verifyTracker(config("tracker", "bad"), nil, server.Client())
+	if len(results) != 2 || results[1].err == nil || !strings.Contains(results[1].err.Error(), "token was rejected") {
+		t.Errorf("Expected the token to be rejected, got %v", results)
+	}
+	results = verifyTracker(config("other", "good"), []byte("not a log"), server.Client())
+	if len(results) != 3 || !strings.Contains(results[1].err.Error(), "database not found") || results[2].err == nil {
+		t.Errorf("Expected the database and sample checks to fail, got %v", results)
+	}
+	results = verifyTracker(json.RawMessage(`{"handler": "adobe_usage_tracker", "endpoint": "http://influx"}`), nil, server.Client())
+	if len(results) != 1 || results[0].err == nil {
+		t.Errorf("Expected the configuration check to fail, got %v", results)
+	}
+}
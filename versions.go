@@ -0,0 +1,139 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/clickonetwo/tracker/core"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const firstSeenMeasurement = "version_first_seen"
+
+// FirstSeenConfig configures the events written the first time
+// each version of each app is seen.
+type FirstSeenConfig struct {
+	// Path is the file in which the versions already seen are kept,
+	// so they aren't reported again after a restart.
+	Path string `json:"path"`
+	// Tenant is the tenant whose versions are tracked.  Each tenant
+	// sees each version for the first time separately.  Defaults
+	// to "default".
+	Tenant string `json:"tenant,omitempty"`
+}
+
+// The first-seen registry holds the open version store for each
+// path.  Like the dedup registry, it outlives any single
+// configuration, and a store is closed when the last tracker using
+// it is cleaned up.
+var firstSeenRegistry = struct {
+	sync.Mutex
+	stores map[string]*versionStore
+}{stores: make(map[string]*versionStore)}
+
+// A versionStore remembers when each version of each app was first
+// seen by each tenant.  Since new versions are rare, the store is
+// saved whenever one is seen.
+type versionStore struct {
+	path string
+	refs int
+
+	mu    sync.Mutex
+	first map[string]time.Time // keyed by tenant, app, and version
+}
+
+// acquireVersions returns the version store kept at the given
+// path, opening it if necessary.
+func acquireVersions(path string) (*versionStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("version_first_seen needs a path")
+	}
+	firstSeenRegistry.Lock()
+	defer firstSeenRegistry.Unlock()
+	v, ok := firstSeenRegistry.stores[path]
+	if !ok {
+		v = &versionStore{path: path, first: make(map[string]time.Time)}
+		content, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("cannot read version store %q: %v", path, err)
+		}
+		if err == nil {
+			if err := json.Unmarshal(content, &v.first); err != nil {
+				return nil, fmt.Errorf("cannot parse version store %q: %v", path, err)
+			}
+		}
+		firstSeenRegistry.stores[path] = v
+	}
+	v.refs++
+	return v, nil
+}
+
+// release gives up one tracker's use of the store.
+func (v *versionStore) release() {
+	firstSeenRegistry.Lock()
+	defer firstSeenRegistry.Unlock()
+	v.refs--
+	if v.refs == 0 {
+		delete(firstSeenRegistry.stores, v.path)
+	}
+}
+
+// observe records the app versions of the given sessions for the
+// tenant, and returns a line protocol point for each version that
+// the tenant hadn't seen before, timestamped with the launch time of
+// the first of its sessions.  If the store can't be saved, the points
+// are still returned, and the error with them.
+func (v *versionStore) observe(tenant string, sessions []core.Session) ([]string, error) {
+	if v == nil || len(sessions) == 0 {
+		return nil, nil
+	}
+	ordered := make([]core.Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.AppId != "" && s.AppVersion != "" {
+			ordered = append(ordered, s)
+		}
+	}
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].LaunchTime.Before(ordered[j].LaunchTime) })
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var lines []string
+	for _, s := range ordered {
+		key := strings.Join([]string{tenant, s.AppId, s.AppVersion}, "|")
+		if _, ok := v.first[key]; ok {
+			continue
+		}
+		v.first[key] = s.LaunchTime
+		lines = append(lines, fmt.Sprintf("%s,tenant=%s,appId=%s,appVersion=%s sessionId=%q,clientIp=%q %d",
+			firstSeenMeasurement, core.TagEscaper.Replace(tenant), core.TagEscaper.Replace(s.AppId),
+			core.TagEscaper.Replace(s.AppVersion), s.SessionId, s.ClientIp, s.LaunchTime.UnixMilli()))
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	return lines, v.save()
+}
+
+// save writes the store to a temporary file that replaces the old
+// one, so a crash never leaves a partial store.
+func (v *versionStore) save() error {
+	content, err := json.MarshalIndent(v.first, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := v.path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.path)
+}
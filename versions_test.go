@@ -0,0 +1,87 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/clickonetwo/tracker/core"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestVersionFirstSeen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "versions.json")
+	v, err := acquireVersions(path)
+	if err != nil {
+		t.Fatalf("Failed to open version store: %v", err)
+	}
+	start := time.UnixMilli(1716994039000)
+	launch := func(id string, app string, version string, hours int) core.Session {
+		return core.Session{SessionId: id, ClientIp: "10.0.0.1:53450", AppId: app, AppVersion: version,
+			LaunchTime: start.Add(time.Duration(hours) * time.Hour)}
+	}
+	lines, err := v.observe("acme", []core.Session{
+		launch("b", "Photoshop1", "25.7", 2),
+		launch("a", "Photoshop1", "25.7", 1),
+		launch("c", "InDesign1", "19.4", 3),
+		{SessionId: "d", AppId: "InDesign1"},
+	})
+	if err != nil {
+		t.Fatalf("Failed to save version store: %v", err)
+	}
+	expected := []string{
+		`version_first_seen,tenant=acme,appId=Photoshop1,appVersion=25.7 sessionId="a",clientIp="10.0.0.1:53450" 1716997639000`,
+		`version_first_seen,tenant=acme,appId=InDesign1,appVersion=19.4 sessionId="c",clientIp="10.0.0.1:53450" 1717004839000`,
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Expected %v, got %v", expected, lines)
+	}
+	v.release()
+	// the seen versions survive reopening the store, and each
+	// tenant sees versions separately
+	v, err = acquireVersions(path)
+	if err != nil {
+		t.Fatalf("Failed to reopen version store: %v", err)
+	}
+	defer v.release()
+	lines, _ = v.observe("acme", []core.Session{launch("e", "Photoshop1", "25.7", 5), launch("f", "Photoshop1", "25.9", 6)})
+	if len(lines) != 1 || lines[0] != `version_first_seen,tenant=acme,appId=Photoshop1,appVersion=25.9 sessionId="f",clientIp="10.0.0.1:53450" 1717015639000` {
+		t.Errorf("Expected only the new version to be first seen, got %v", lines)
+	}
+	lines, _ = v.observe("other", []core.Session{launch("g", "Photoshop1", "25.7", 7)})
+	if len(lines) != 1 {
+		t.Errorf("Expected another tenant to see the version first, got %v", lines)
+	}
+	var none *versionStore
+	if lines, err := none.observe("acme", []core.Session{launch("h", "Photoshop1", "26.0", 8)}); lines != nil || err != nil {
+		t.Errorf("Expected no points without tracking, got %v, %v", lines, err)
+	}
+}
+
+func TestUnmarshalFirstSeen(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`adobe_usage_tracker {
+		version_first_seen /var/lib/tracker/versions.json {
+			tenant acme
+		}
+	}`)
+	var m AdobeUsageTracker
+	if err := m.UnmarshalCaddyfile(d); err != nil {
+		t.Fatalf("Failed to unmarshal directive: %v", err)
+	}
+	expected := &FirstSeenConfig{Path: "/var/lib/tracker/versions.json", Tenant: "acme"}
+	if !reflect.DeepEqual(m.FirstSeen, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, m.FirstSeen)
+	}
+	for _, config := range []string{"version_first_seen", "version_first_seen a b", "version_first_seen a {\ncolor red\n}"} {
+		var m AdobeUsageTracker
+		if err := m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("adobe_usage_tracker {\n" + config + "\n}")); err == nil {
+			t.Errorf("Expected an error parsing %q", config)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+// Package tracker provides the caddy adobe_usage_tracker plugin.
+package tracker
+
+import (
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchdogInterval is how often the watchdog checks for silence.
+const watchdogInterval = time.Minute
+
+// WatchdogConfig configures the zero-traffic watchdog.  The watchdog
+// raises an alert when no sessions have been parsed for Period,
+// counting only time that falls within business hours.
+//
+// Business hours are from Start to End (both "HH:MM", in the given
+// Timezone) on the given Days ("mon", "tue", ...).  If Start and End
+// are omitted, all hours count; if Days is omitted, all days count.
+// An End earlier than Start means business hours span midnight.
+type WatchdogConfig struct {
+	Period   caddy.Duration `json:"period,omitempty"`
+	Start    string         `json:"start,omitempty"`
+	End      string         `json:"end,omitempty"`
+	Days     []string       `json:"days,omitempty"`
+	Timezone string         `json:"timezone,omitempty"`
+}
+
+// A watchdog tracks how much business time has passed since the
+// tracker last parsed any sessions, and sends a notification when
+// that exceeds the configured period, since silence usually means
+// a broken client configuration rather than genuinely zero usage.
+type watchdog struct {
+	period time.Duration
+	start  time.Duration // offset of business hours start from midnight
+	end    time.Duration // offset of business hours end from midnight
+	days   map[time.Weekday]bool
+	loc    *time.Location
+	notify func(text string)
+
+	mu      sync.Mutex
+	last    time.Time
+	quiet   time.Duration
+	alerted bool
+	stop    chan struct{}
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// newWatchdog validates a watchdog configuration and returns a
+// watchdog (not yet running) that calls notify with its alerts.
+func newWatchdog(cfg WatchdogConfig, notify func(text string)) (*watchdog, error) {
+	w := &watchdog{period: time.Duration(cfg.Period), loc: time.Local, notify: notify}
+	if w.period <= 0 {
+		return nil, fmt.Errorf("watchdog period must be positive")
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid watchdog timezone %q: %v", cfg.Timezone, err)
+		}
+		w.loc = loc
+	}
+	if cfg.Start != "" || cfg.End != "" {
+		var err error
+		if w.start, err = parseTimeOfDay(cfg.Start); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseTimeOfDay(cfg.End); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Days) > 0 {
+		w.days = make(map[time.Weekday]bool, len(cfg.Days))
+		for _, day := range cfg.Days {
+			weekday, ok := weekdayNames[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("invalid watchdog day %q", day)
+			}
+			w.days[weekday] = true
+		}
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses an "HH:MM" string into an offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid watchdog time of day %q: must be HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inBusinessHours reports whether t falls within business hours.
+func (w *watchdog) inBusinessHours(t time.Time) bool {
+	t = t.In(w.loc)
+	if w.days != nil && !w.days[t.Weekday()] {
+		return false
+	}
+	if w.start == w.end {
+		return true
+	}
+	tod := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start < w.end {
+		return tod >= w.start && tod < w.end
+	}
+	return tod >= w.start || tod < w.end
+}
+
+// tick accounts for the time since the last tick, and returns the
+// text of an alert if the quiet period has now been exceeded.
+func (w *watchdog) tick(now time.Time) string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.last.IsZero() && w.inBusinessHours(w.last) {
+		w.quiet += now.Sub(w.last)
+	}
+	w.last = now
+	if w.alerted || w.quiet < w.period {
+		return ""
+	}
+	w.alerted = true
+	return fmt.Sprintf("Adobe usage tracker: no sessions have been parsed for %s of business hours; "+
+		"check the configuration of client machines.", w.quiet.Round(time.Minute))
+}
+
+// sessionsParsed resets the quiet period, and returns the text
+// of a notice if an alert had previously been sent.
+func (w *watchdog) sessionsParsed() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.quiet = 0
+	if !w.alerted {
+		return ""
+	}
+	w.alerted = false
+	return "Adobe usage tracker: sessions are being parsed again."
+}
+
+// run starts the watchdog's background checks.
+func (w *watchdog) run() {
+	w.stop = make(chan struct{})
+	w.tick(time.Now())
+	go func() {
+		ticker := time.NewTicker(watchdogInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case now := <-ticker.C:
+				if text := w.tick(now); text != "" {
+					w.notify(text)
+				}
+			}
+		}
+	}()
+}
+
+// close stops the watchdog's background checks.
+func (w *watchdog) close() {
+	if w.stop != nil {
+		close(w.stop)
+	}
+}
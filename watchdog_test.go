@@ -0,0 +1,89 @@
+/*
+ * Copyright 2024 Daniel C. Brotsky. All rights reserved.
+ * All the copyrighted work in this repository is licensed under the
+ * open source MIT License, reproduced in the LICENSE file.
+ */
+
+package tracker
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"testing"
+	"time"
+)
+
+func TestWatchdogBusinessHours(t *testing.T) {
+	cfg := WatchdogConfig{
+		Period:   caddy.Duration(time.Hour),
+		Start:    "08:00",
+		End:      "18:00",
+		Days:     []string{"mon", "tue", "wed", "thu", "fri"},
+		Timezone: "America/Los_Angeles",
+	}
+	w, err := newWatchdog(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create watchdog: %s", err)
+	}
+	loc, _ := time.LoadLocation("America/Los_Angeles")
+	cases := []struct {
+		t        time.Time
+		expected bool
+	}{
+		{time.Date(2024, 5, 29, 9, 30, 0, 0, loc), true},      // Wednesday morning
+		{time.Date(2024, 5, 29, 7, 59, 0, 0, loc), false},     // before hours
+		{time.Date(2024, 5, 29, 18, 0, 0, 0, loc), false},     // at end of hours
+		{time.Date(2024, 6, 1, 10, 0, 0, 0, loc), false},      // Saturday
+		{time.Date(2024, 5, 29, 17, 0, 0, 0, time.UTC), true}, // 5pm UTC is 10am in LA
+	}
+	for i, c := range cases {
+		if got := w.inBusinessHours(c.t); got != c.expected {
+			t.Errorf("%d: inBusinessHours(%v): expected %v, got %v", i, c.t, c.expected, got)
+		}
+	}
+}
+
+func TestWatchdogCountsOnlyBusinessTime(t *testing.T) {
+	cfg := WatchdogConfig{Period: caddy.Duration(time.Hour), Start: "08:00", End: "18:00", Timezone: "UTC"}
+	w, err := newWatchdog(cfg, nil)
+	if err != nil {
+		t.Fatalf("Failed to create watchdog: %s", err)
+	}
+	now := time.Date(2024, 5, 29, 0, 0, 0, 0, time.UTC)
+	for ; now.Hour() < 8; now = now.Add(time.Minute) {
+		if text := w.tick(now); text != "" {
+			t.Fatalf("Expected no alert outside business hours, got %q at %v", text, now)
+		}
+	}
+	var alertAt time.Time
+	for ; now.Hour() < 10; now = now.Add(time.Minute) {
+		if text := w.tick(now); text != "" {
+			if !alertAt.IsZero() {
+				t.Fatalf("Expected only one alert, got another at %v", now)
+			}
+			alertAt = now
+		}
+	}
+	if expected := time.Date(2024, 5, 29, 9, 0, 0, 0, time.UTC); !alertAt.Equal(expected) {
+		t.Errorf("Expected alert at %v, got %v", expected, alertAt)
+	}
+	if text := w.sessionsParsed(); text == "" {
+		t.Errorf("Expected a notice when sessions resume")
+	}
+	if text := w.tick(now); text != "" {
+		t.Errorf("Expected no alert right after sessions resume, got %q", text)
+	}
+}
+
+func TestWatchdogConfigErrors(t *testing.T) {
+	bad := []WatchdogConfig{
+		{},
+		{Period: caddy.Duration(time.Hour), Start: "8am", End: "18:00"},
+		{Period: caddy.Duration(time.Hour), Days: []string{"someday"}},
+		{Period: caddy.Duration(time.Hour), Timezone: "Nowhere/Special"},
+	}
+	for i, cfg := range bad {
+		if _, err := newWatchdog(cfg, nil); err == nil {
+			t.Errorf("%d: expected error for config %+v", i, cfg)
+		}
+	}
+}